@@ -38,6 +38,7 @@ type Client interface {
 	DeleteVolume(volumeID int) (err error)
 	UpdateVolume(volumeID int, volume Volume) (*Volume, error)
 	GetVolumeSnapshotByParentID(volumeID int) (*[]Volume, error)
+	RestoreVolumeFromSnapShot(parentID, srcSnapShotID int) (bool, error)
 
 	GetHostByName(hostName string) (host Host, err error)
 	CreateHost(hostName string) (host Host, err error)
@@ -50,6 +51,13 @@ type Client interface {
 	UnMapVolumeFromHost(hostID, volumeID int) (err error)
 	GetFCPorts() (fcNodes []FCNode, err error)
 	GetHostPort(hostID int, portAddress string) (hostPort HostPort, err error)
+	GetHostClusterByName(clusterName string) (cluster HostCluster, err error)
+	CreateHostCluster(clusterName string) (cluster HostCluster, err error)
+	AddHostToHostCluster(clusterID, hostID int) (err error)
+	MapVolumeToHostCluster(clusterID, volumeID, lun int) (luninfo LunInfo, err error)
+	GetLunByHostClusterVolume(clusterID, volumeID int) (luninfo LunInfo, err error)
+	UnMapVolumeFromHostCluster(clusterID, volumeID int) (err error)
+	RemoveHostFromHostCluster(clusterID, hostID int) (err error)
 
 	// for nfs
 	OneTimeValidation(poolname string, networkspace string) (list string, err error)
@@ -75,6 +83,10 @@ type Client interface {
 	UpdateFilesystem(fileSystemID int64, fileSystem FileSystem) (*FileSystem, error)
 	GetSnapshotByName(snapshotName string) (*[]FileSystemSnapshotResponce, error)
 	RestoreFileSystemFromSnapShot(parentID, srcSnapShotID int64) (bool, error)
+	GetFileSystemSnapshotsByParentID(parentID int64) (*[]FileSystemSnapshotResponce, error)
+	GetMetadata(objectID int64) (*[]Metadata, error)
+	DeleteMetadataKey(objectID int64, key string) (err error)
+	GetMetadataByKey(key string, page int) (*MetadataPage, error)
 
 	GetFileSystemsByPoolID(poolID int64, page int) (*FSMetadata, error)
 	GetFilesytemTreeqCount(fileSystemID int64) (treeqCnt int, err error)
@@ -85,6 +97,7 @@ type Client interface {
 	GetTreeqSizeByFileSystemID(filesystemID int64) (int64, error)
 	GetFileSystemCountByPoolID(poolID int64) (int, error)
 	GetTreeqByName(fileSystemID int64, treeqName string) (*Treeq, error)
+	GetTreeqsByFileSystemID(fileSystemID int64) ([]Treeq, error)
 }
 
 //ClientService : struct having reference of rest client and will host methods which need rest operations
@@ -661,6 +674,176 @@ func (c *ClientService) GetAllLunByHost(hostID int) (luninfo []LunInfo, err erro
 	return luninfo, nil
 }
 
+//GetHostClusterByName - get host cluster details for given name
+func (c *ClientService) GetHostClusterByName(clusterName string) (cluster HostCluster, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetHostClusterByName Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("get host cluster by name ", clusterName)
+	uri := "api/rest/clusters"
+	clusters := []HostCluster{}
+	queryParam := map[string]interface{}{"name": clusterName}
+	resp, err := c.getResponseWithQueryString(uri, queryParam, &clusters)
+	if err != nil {
+		log.Errorf("host cluster %s not found ", clusterName)
+		return cluster, err
+	}
+	if len(clusters) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		clusters, _ = apiresp.Result.([]HostCluster)
+	}
+
+	if len(clusters) > 0 {
+		cluster = clusters[0]
+	}
+	if cluster.ID == 0 && cluster.Name == "" {
+		return cluster, errors.New("HOST_CLUSTER_NOT_FOUND")
+	}
+	log.Info("fetched host cluster with name ", cluster.Name)
+	return cluster, nil
+}
+
+//CreateHostCluster - create host cluster with given name
+func (c *ClientService) CreateHostCluster(clusterName string) (cluster HostCluster, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("CreateHostCluster Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("create host cluster with name  ", clusterName)
+	uri := "api/rest/clusters"
+	body := map[string]interface{}{"name": clusterName}
+	resp, err := c.getJSONResponse(http.MethodPost, uri, body, &cluster)
+	if err != nil {
+		log.Errorf("error creating host cluster : %s error : %v", clusterName, err)
+		return cluster, err
+	}
+	if reflect.DeepEqual(cluster, (HostCluster{})) {
+		apiresp := resp.(client.ApiResponse)
+		cluster, _ = apiresp.Result.(HostCluster)
+	}
+	log.Info("created host cluster with name ", cluster.Name)
+	return cluster, nil
+}
+
+//AddHostToHostCluster - add host to the host cluster, the host gets the cluster luns
+func (c *ClientService) AddHostToHostCluster(clusterID, hostID int) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("AddHostToHostCluster Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("add host %d to host cluster %d", hostID, clusterID)
+	uri := "api/rest/clusters/" + strconv.Itoa(clusterID) + "/hosts?approved=true"
+	body := map[string]interface{}{"id": hostID}
+	_, err = c.getJSONResponse(http.MethodPost, uri, body, nil)
+	if err != nil {
+		log.Errorf("failed to add host %d to host cluster %d with error %v", hostID, clusterID, err)
+		return err
+	}
+	log.Infof("successfully added host %d to host cluster %d", hostID, clusterID)
+	return nil
+}
+
+// MapVolumeToHostCluster - Map volume with given volumeID to all hosts of the host cluster
+func (c *ClientService) MapVolumeToHostCluster(clusterID, volumeID, lun int) (luninfo LunInfo, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("MapVolumeToHostCluster Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("map volume %d to host cluster %d", volumeID, clusterID)
+	uri := "api/rest/clusters/" + strconv.Itoa(clusterID) + "/luns?approved=true"
+	data := make(map[string]interface{})
+	data["volume_id"] = volumeID
+	if lun != -1 {
+		data["lun"] = lun
+	}
+	resp, err := c.getJSONResponse(http.MethodPost, uri, data, &luninfo)
+	if err != nil {
+		// ignore logging for following error code
+		if !strings.Contains(err.Error(), "MAPPING_ALREADY_EXISTS") {
+			log.Errorf("error occured while mapping volume to host cluster %v", err)
+		}
+		return luninfo, err
+	}
+	if luninfo == (LunInfo{}) {
+		apiresp := resp.(client.ApiResponse)
+		luninfo, _ = apiresp.Result.(LunInfo)
+	}
+	log.Infof("Successfully mapped volume %d to host cluster %d", volumeID, clusterID)
+	return luninfo, nil
+}
+
+// GetLunByHostClusterVolume - Get Lun details for volume and host cluster provided
+func (c *ClientService) GetLunByHostClusterVolume(clusterID, volumeID int) (luninfo LunInfo, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetLunByHostClusterVolume Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	luns := []LunInfo{}
+	log.Infof("get lun for volume %d and host cluster %d", volumeID, clusterID)
+	uri := "api/rest/clusters/" + strconv.Itoa(clusterID) + "/luns"
+	data := map[string]interface{}{"volume_id": volumeID}
+	resp, err := c.getResponseWithQueryString(uri, data, &luns)
+	if err != nil {
+		log.Errorf("error occured while get luns for volumeID %d and host cluster %d err %v", volumeID, clusterID, err)
+		return luninfo, err
+	}
+	if len(luns) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		luns, _ = apiresp.Result.([]LunInfo)
+	}
+	if len(luns) > 0 {
+		luninfo = luns[0]
+	}
+	log.Infof("got %d lun for volume %d and host cluster %d", luninfo.Lun, volumeID, clusterID)
+	return luninfo, nil
+}
+
+// UnMapVolumeFromHostCluster - Remove mapping of volume with host cluster
+func (c *ClientService) UnMapVolumeFromHostCluster(clusterID, volumeID int) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("UnMapVolumeFromHostCluster Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("Remove mapping of volume %d from host cluster %d", volumeID, clusterID)
+	uri := "api/rest/clusters/" + strconv.Itoa(clusterID) + "/luns/volume_id/" + strconv.Itoa(volumeID) + "?approved=true"
+	_, err = c.getJSONResponse(http.MethodDelete, uri, nil, nil)
+	if err != nil {
+		if !strings.Contains(err.Error(), "NOT_FOUND") {
+			log.Errorf("failed to unmap volume %d from host cluster %d with error %v", volumeID, clusterID, err)
+		}
+		return err
+	}
+	log.Infof("successfully unmapped volume %d from host cluster %d", volumeID, clusterID)
+	return nil
+}
+
+//RemoveHostFromHostCluster - remove host from the host cluster, the host loses the cluster luns
+func (c *ClientService) RemoveHostFromHostCluster(clusterID, hostID int) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("RemoveHostFromHostCluster Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("remove host %d from host cluster %d", hostID, clusterID)
+	uri := "api/rest/clusters/" + strconv.Itoa(clusterID) + "/hosts/" + strconv.Itoa(hostID) + "?approved=true"
+	_, err = c.getJSONResponse(http.MethodDelete, uri, nil, nil)
+	if err != nil {
+		if !strings.Contains(err.Error(), "NOT_FOUND") {
+			log.Errorf("failed to remove host %d from host cluster %d with error %v", hostID, clusterID, err)
+		}
+		return err
+	}
+	log.Infof("successfully removed host %d from host cluster %d", hostID, clusterID)
+	return nil
+}
+
 //GetVolumeSnapshotByParentID method return true is the filesystemID has child else false
 func (c *ClientService) GetVolumeSnapshotByParentID(volumeID int) (*[]Volume, error) {
 	var err error
@@ -711,6 +894,32 @@ func (c *ClientService) UpdateVolume(volumeID int, volume Volume) (*Volume, erro
 	return &volumeResp, nil
 }
 
+// RestoreVolumeFromSnapShot :
+func (c *ClientService) RestoreVolumeFromSnapShot(parentID, srcSnapShotID int) (bool, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("RestoreVolumeFromSnapShot Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Restore volume from snapshot : ", srcSnapShotID)
+	uri := "api/rest/volumes/" + strconv.Itoa(parentID) + "/restore?approved=true"
+	var result bool
+	body := map[string]interface{}{"source_id": srcSnapShotID}
+	resp, err := c.getJSONResponse(http.MethodPost, uri, body, &result)
+	if err != nil {
+		log.Errorf("Error occured while restoring volume : %s", err)
+		return false, err
+	}
+
+	if result == false {
+		apiresp := resp.(client.ApiResponse)
+		result, _ = apiresp.Result.(bool)
+	}
+	log.Info("Restored volume from snapshot : ", srcSnapShotID)
+	return result, nil
+}
+
 // **************************************************Util Methods*********************************************
 //                                   generic methods to do reset called
 //                                   consume by other method intent to do rese calls
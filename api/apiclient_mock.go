@@ -247,6 +247,14 @@ func (m *MockApiService) GetParentID(fileSystemID int64) int64 {
 	return resp
 }
 
+//DeleteFileSystem mock
+func (m *MockApiService) DeleteFileSystem(fileSystemID int64) (*FileSystem, error) {
+	args := m.Called(fileSystemID)
+	fileSystem, _ := args.Get(0).(FileSystem)
+	err, _ := args.Get(1).(error)
+	return &fileSystem, err
+}
+
 //DeleteFileSystemComplete
 func (m *MockApiService) DeleteFileSystemComplete(fileSystemID int64) (err error) {
 	args := m.Called(fileSystemID)
@@ -324,6 +332,14 @@ func (m *MockApiService) GetFileSystemCountByPoolID(poolID int64) (int, error) {
 	return cnt, err
 }
 
+//GetTreeqsByFileSystemID mock
+func (m *MockApiService) GetTreeqsByFileSystemID(fileSystemID int64) ([]Treeq, error) {
+	args := m.Called(fileSystemID)
+	resp, _ := args.Get(0).([]Treeq)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
+
 func (m *MockApiService) GetTreeqByName(fileSystemID int64, treeqName string) (*Treeq, error) {
 	args := m.Called(fileSystemID, treeqName)
 	trq, _ := args.Get(0).(Treeq)
@@ -407,6 +423,66 @@ func (m *MockApiService) UnMapVolumeFromHost(hostID, volumeID int) (error){
 	err, _ := args.Get(0).(error)
 	return err
 }
+//GetHostClusterByName mock
+func (m *MockApiService) AddHostPort(portType, portAddress string, hostID int) (HostPort, error) {
+	args := m.Called(portType, portAddress, hostID)
+	hostPort, _ := args.Get(0).(HostPort)
+	err, _ := args.Get(1).(error)
+	return hostPort, err
+}
+
+func (m *MockApiService) GetHostClusterByName(clusterName string) (HostCluster, error) {
+	args := m.Called(clusterName)
+	cluster, _ := args.Get(0).(HostCluster)
+	err, _ := args.Get(1).(error)
+	return cluster, err
+}
+
+//CreateHostCluster mock
+func (m *MockApiService) CreateHostCluster(clusterName string) (HostCluster, error) {
+	args := m.Called(clusterName)
+	cluster, _ := args.Get(0).(HostCluster)
+	err, _ := args.Get(1).(error)
+	return cluster, err
+}
+
+//AddHostToHostCluster mock
+func (m *MockApiService) AddHostToHostCluster(clusterID, hostID int) error {
+	args := m.Called(clusterID, hostID)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+//MapVolumeToHostCluster mock
+func (m *MockApiService) MapVolumeToHostCluster(clusterID, volumeID, lun int) (LunInfo, error) {
+	args := m.Called(clusterID, volumeID)
+	lunInfo, _ := args.Get(0).(LunInfo)
+	err, _ := args.Get(1).(error)
+	return lunInfo, err
+}
+
+//GetLunByHostClusterVolume mock
+func (m *MockApiService) GetLunByHostClusterVolume(clusterID, volumeID int) (LunInfo, error) {
+	args := m.Called(clusterID, volumeID)
+	lunInfo, _ := args.Get(0).(LunInfo)
+	err, _ := args.Get(1).(error)
+	return lunInfo, err
+}
+
+//UnMapVolumeFromHostCluster mock
+func (m *MockApiService) UnMapVolumeFromHostCluster(clusterID, volumeID int) error {
+	args := m.Called(clusterID, volumeID)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+//RemoveHostFromHostCluster mock
+func (m *MockApiService) RemoveHostFromHostCluster(clusterID, hostID int) error {
+	args := m.Called(clusterID, hostID)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
 func (m *MockApiService)DeleteHost(hostID int) (error) {
 	args := m.Called(hostID)
 	err, _ := args.Get(0).(error)
@@ -417,4 +493,51 @@ func (m *MockApiService)UpdateVolume(volumeID int, volume Volume) (*Volume, erro
 	vol, _ := args.Get(0).(Volume)
 	err, _ := args.Get(1).(error)
 	return &vol, err
-}
\ No newline at end of file
+}
+
+//RestoreVolumeFromSnapShot mock
+func (m *MockApiService) RestoreVolumeFromSnapShot(parentID, srcSnapShotID int) (bool, error) {
+	args := m.Called(parentID, srcSnapShotID)
+	resp, _ := args.Get(0).(bool)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
+
+//RestoreFileSystemFromSnapShot mock
+func (m *MockApiService) RestoreFileSystemFromSnapShot(parentID, srcSnapShotID int64) (bool, error) {
+	args := m.Called(parentID, srcSnapShotID)
+	resp, _ := args.Get(0).(bool)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
+
+//GetFileSystemSnapshotsByParentID mock
+func (m *MockApiService) GetFileSystemSnapshotsByParentID(parentID int64) (*[]FileSystemSnapshotResponce, error) {
+	args := m.Called(parentID)
+	resp, _ := args.Get(0).([]FileSystemSnapshotResponce)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//GetMetadata mock
+func (m *MockApiService) GetMetadata(objectID int64) (*[]Metadata, error) {
+	args := m.Called(objectID)
+	resp, _ := args.Get(0).([]Metadata)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//GetMetadataByKey mock
+func (m *MockApiService) GetMetadataByKey(key string, page int) (*MetadataPage, error) {
+	args := m.Called(key, page)
+	resp, _ := args.Get(0).(MetadataPage)
+	err, _ := args.Get(1).(error)
+	return &resp, err
+}
+
+//DeleteMetadataKey mock
+func (m *MockApiService) DeleteMetadataKey(objectID int64, key string) error {
+	args := m.Called(objectID, key)
+	err, _ := args.Get(0).(error)
+	return err
+}
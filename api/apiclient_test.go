@@ -313,6 +313,58 @@ func (suite *ApiTestSuite) Test_MapVolumeToHost_Success() {
 	assert.Equal(suite.T(), expectedResponse.Result, response, "Response not returned as expected")
 }
 
+func (suite *ApiTestSuite) Test_GetHostClusterByName_Fail() {
+	expectedError := errors.New("Unable to get host cluster by given name")
+	suite.clientMock.On("GetWithQueryString").Return(nil, expectedError)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	_, err := service.GetHostClusterByName("test_cluster")
+
+	// Assert
+	assert.NotNil(suite.T(), err, "Error should not be nil")
+	assert.Equal(suite.T(), expectedError, err, "Error not returned as expected")
+}
+
+func (suite *ApiTestSuite) Test_GetHostClusterByName_NotFound() {
+	expectedResponse := client.ApiResponse{Result: []HostCluster{}}
+	suite.clientMock.On("GetWithQueryString").Return(expectedResponse, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	_, err := service.GetHostClusterByName("test_cluster")
+
+	// Assert
+	assert.NotNil(suite.T(), err, "Error should not be nil")
+	assert.Equal(suite.T(), "HOST_CLUSTER_NOT_FOUND", err.Error(), "Error not returned as expected")
+}
+
+func (suite *ApiTestSuite) Test_MapVolumeToHostCluster_Fail() {
+	expectedError := errors.New("Volume ID is missing")
+	suite.clientMock.On("Post").Return(nil, expectedError)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	_, err := service.MapVolumeToHostCluster(1, 2, -1)
+
+	// Assert
+	assert.NotNil(suite.T(), err, "Error should not be nil")
+	assert.Equal(suite.T(), expectedError, err, "Error not returned as expected")
+}
+
+func (suite *ApiTestSuite) Test_MapVolumeToHostCluster_Success() {
+	expectedResponse := client.ApiResponse{Result: LunInfo{HostClusterID: 1, VolumeID: 2, CLustered: true, Lun: 11}}
+
+	suite.clientMock.On("Post").Return(expectedResponse, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	response, _ := service.MapVolumeToHostCluster(1, 2, -1)
+
+	// Assert
+	assert.Equal(suite.T(), expectedResponse.Result, response, "Response not returned as expected")
+}
+
 func (suite *ApiTestSuite) Test_UpdateFilesystem_Fail() {
 	// Test volume snapshot will not be created
 	expectedError := errors.New("Missing parameters")
@@ -631,6 +683,31 @@ func (suite *ApiTestSuite) Test_RestoreFileSystemFromSnapShot_Success() {
 	assert.Equal(suite.T(), expectedResponse, response, "Response not returned as expected")
 }
 
+func (suite *ApiTestSuite) Test_RestoreVolumeFromSnapShot_Fail() {
+	expectedError := errors.New("Missing parameters")
+	suite.clientMock.On("Post").Return(nil, expectedError)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	_, err := service.RestoreVolumeFromSnapShot(1001, 1002)
+
+	// Assert
+	assert.NotNil(suite.T(), err, "Error should not be nil")
+	assert.Equal(suite.T(), expectedError, err, "Error not returned as expected")
+}
+
+func (suite *ApiTestSuite) Test_RestoreVolumeFromSnapShot_Success() {
+	suite.clientMock.On("Post").Return(client.ApiResponse{Result: true}, nil)
+	service := ClientService{api: suite.clientMock, SecretsMap: setSecret()}
+
+	// Act
+	response, err := service.RestoreVolumeFromSnapShot(1001, 1002)
+
+	// Assert
+	assert.Nil(suite.T(), err, "Error should be nil")
+	assert.True(suite.T(), response, "Response not returned as expected")
+}
+
 func (suite *ApiTestSuite) Test_UpdateVolume_Fail() {
 	// Test volume snapshot will not be created
 	expectedError := errors.New("Missing parameters")
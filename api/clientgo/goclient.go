@@ -14,6 +14,7 @@ import (
 	log "infinibox-csi-driver/helper/logger"
 
 	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -22,6 +23,9 @@ import (
 type KubeClient interface {
 	GetSecret(secretName, nameSpace string) (map[string]string, error)
 	GetClusterVerion() (string, error)
+	ListPersistentVolumes(driverName string) ([]v1.PersistentVolume, error)
+	ListVolumeAttachments(driverName string) ([]storagev1.VolumeAttachment, error)
+	GetCSINodeIDs(driverName string) (map[string]string, error)
 }
 
 type kubeclient struct {
@@ -126,3 +130,53 @@ func (kc *kubeclient) GetClusterVerion() (string, error) {
 	}
 	return info.GitVersion, nil
 }
+
+//ListPersistentVolumes return the CSI PVs of the driver
+func (kc *kubeclient) ListPersistentVolumes(driverName string) ([]v1.PersistentVolume, error) {
+	pvList, err := kc.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("Error listing persistent volumes Error: %v", err)
+		return nil, err
+	}
+	pvs := []v1.PersistentVolume{}
+	for _, pv := range pvList.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName {
+			pvs = append(pvs, pv)
+		}
+	}
+	return pvs, nil
+}
+
+//ListVolumeAttachments return the volume attachments of the driver
+func (kc *kubeclient) ListVolumeAttachments(driverName string) ([]storagev1.VolumeAttachment, error) {
+	vaList, err := kc.client.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("Error listing volume attachments Error: %v", err)
+		return nil, err
+	}
+	vas := []storagev1.VolumeAttachment{}
+	for _, va := range vaList.Items {
+		if va.Spec.Attacher == driverName {
+			vas = append(vas, va)
+		}
+	}
+	return vas, nil
+}
+
+//GetCSINodeIDs return the node ID of the driver by node name
+func (kc *kubeclient) GetCSINodeIDs(driverName string) (map[string]string, error) {
+	csiNodeList, err := kc.client.StorageV1beta1().CSINodes().List(metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("Error listing CSI nodes Error: %v", err)
+		return nil, err
+	}
+	nodeIDs := make(map[string]string)
+	for _, csiNode := range csiNodeList.Items {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == driverName {
+				nodeIDs[csiNode.Name] = driver.NodeID
+			}
+		}
+	}
+	return nodeIDs, nil
+}
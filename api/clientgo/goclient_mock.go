@@ -0,0 +1,47 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package clientgo
+
+import (
+	"github.com/stretchr/testify/mock"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+//MockKubeClient mock of KubeClient
+type MockKubeClient struct {
+	mock.Mock
+	KubeClient
+}
+
+//ListPersistentVolumes mock
+func (m *MockKubeClient) ListPersistentVolumes(driverName string) ([]v1.PersistentVolume, error) {
+	args := m.Called(driverName)
+	resp, _ := args.Get(0).([]v1.PersistentVolume)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
+
+//ListVolumeAttachments mock
+func (m *MockKubeClient) ListVolumeAttachments(driverName string) ([]storagev1.VolumeAttachment, error) {
+	args := m.Called(driverName)
+	resp, _ := args.Get(0).([]storagev1.VolumeAttachment)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
+
+//GetCSINodeIDs mock
+func (m *MockKubeClient) GetCSINodeIDs(driverName string) (map[string]string, error) {
+	args := m.Called(driverName)
+	resp, _ := args.Get(0).(map[string]string)
+	err, _ := args.Get(1).(error)
+	return resp, err
+}
@@ -0,0 +1,250 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package clientgo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"infinibox-csi-driver/helper"
+	log "infinibox-csi-driver/helper/logger"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	leasev1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	//LeaseDuration : duration of a lock lease, renewed by its holder every third of it
+	LeaseDuration = 30 * time.Second
+
+	//LeaseLockTimeout : time Lock waits for a lease held by another replica
+	LeaseLockTimeout = 5 * time.Minute
+
+	leaseRetryInterval = time.Second
+	leaseNamePrefix    = "infinibox-csi-"
+)
+
+//leaseLocker Locker holding a Lease per locked name, the goroutines of the process first lock the name in process
+type leaseLocker struct {
+	leases   leasev1.LeaseInterface
+	identity string
+	process  helper.Locker
+
+	duration time.Duration
+	retry    time.Duration
+	timeout  time.Duration
+}
+
+//NewLeaseLocker return a Locker shared by the controller replicas, holding Leases of the namespace.
+//identity, e.g. the pod name, is the holder of the leases of the replica
+func NewLeaseLocker(namespace, identity string) (helper.Locker, error) {
+	kc, err := BuildClient()
+	if err != nil {
+		return nil, err
+	}
+	return newLeaseLocker(kc.client.CoordinationV1().Leases(namespace), identity), nil
+}
+
+func newLeaseLocker(leases leasev1.LeaseInterface, identity string) *leaseLocker {
+	return &leaseLocker{
+		leases:   leases,
+		identity: identity,
+		process:  helper.NewProcessLocker(),
+		duration: LeaseDuration,
+		retry:    leaseRetryInterval,
+		timeout:  LeaseLockTimeout,
+	}
+}
+
+//leaseName return the name of the lease of a lock, the lock name is hashed as it may not be a valid object name
+func leaseName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	if len(sanitized) > 40 {
+		sanitized = sanitized[:40]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return fmt.Sprintf("%s%s-%08x", leaseNamePrefix, strings.Trim(sanitized, "-"), hash.Sum32())
+}
+
+//Lock lock name for the controller replicas, the lease is renewed until unlocked
+func (l *leaseLocker) Lock(name string) (func(), error) {
+	unlockProcess, err := l.process.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	lease := leaseName(name)
+	deadline := time.Now().Add(l.timeout)
+	for {
+		acquired, err := l.tryAcquire(lease)
+		if err != nil {
+			unlockProcess()
+			return nil, fmt.Errorf("fail to acquire lease %s: %v", lease, err)
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			unlockProcess()
+			return nil, fmt.Errorf("timeout waiting for lease %s", lease)
+		}
+		time.Sleep(l.retry)
+	}
+	return l.hold(lease, unlockProcess), nil
+}
+
+//TryLock lock name for the controller replicas when neither the process nor another replica holds it
+func (l *leaseLocker) TryLock(name string) (func(), bool, error) {
+	unlockProcess, ok, err := l.process.TryLock(name)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	lease := leaseName(name)
+	acquired, err := l.tryAcquire(lease)
+	if err != nil || !acquired {
+		unlockProcess()
+		if err != nil {
+			return nil, false, fmt.Errorf("fail to acquire lease %s: %v", lease, err)
+		}
+		return nil, false, nil
+	}
+	return l.hold(lease, unlockProcess), true, nil
+}
+
+//hold renew the acquired lease until the returned function releases it
+func (l *leaseLocker) hold(lease string, unlockProcess func()) func() {
+	log.Debugf("lease %s acquired by %s", lease, l.identity)
+	stop := make(chan struct{})
+	go l.renew(lease, stop)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			l.release(lease)
+			unlockProcess()
+		})
+	}
+}
+
+//isLeaseHeld check the lease has a holder that renewed it within its duration
+func isLeaseHeld(lease *coordinationv1.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return now.Before(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+//tryAcquire take the lease when it does not exist, is released or expired, false when another holder keeps it
+func (l *leaseLocker) tryAcquire(name string) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(l.duration / time.Second)
+	identity := l.identity
+	lease, err := l.leases.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = l.leases.Create(lease)
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if isLeaseHeld(lease, now.Time) {
+		return false, nil
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" {
+		log.Warnf("lease %s of %s expired, taking it over", name, *lease.Spec.HolderIdentity)
+	}
+	transitions := int32(1)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions = *lease.Spec.LeaseTransitions + 1
+	}
+	lease.Spec = coordinationv1.LeaseSpec{
+		HolderIdentity:       &identity,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+		LeaseTransitions:     &transitions,
+	}
+	_, err = l.leases.Update(lease)
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//renew update the renew time of the lease until stopped
+func (l *leaseLocker) renew(name string, stop chan struct{}) {
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			lease, err := l.leases.Get(name, metav1.GetOptions{})
+			if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+				log.Errorf("fail to renew lease %s, it is no more held by %s error %v", name, l.identity, err)
+				continue
+			}
+			now := metav1.NewMicroTime(time.Now())
+			lease.Spec.RenewTime = &now
+			if _, err = l.leases.Update(lease); err != nil {
+				log.Errorf("fail to renew lease %s error %v", name, err)
+			}
+		}
+	}
+}
+
+//release delete the lease, lock names as a PV name would otherwise leave a lease each.
+//The deletion is conditioned on the version read, a lease taken over meanwhile is kept
+func (l *leaseLocker) release(name string) {
+	lease, err := l.leases.Get(name, metav1.GetOptions{})
+	if err != nil {
+		log.Errorf("fail to release lease %s error %v", name, err)
+		return
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.identity {
+		log.Warnf("lease %s is no more held by %s", name, l.identity)
+		return
+	}
+	uid, version := lease.UID, lease.ResourceVersion
+	err = l.leases.Delete(name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &version}})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Errorf("fail to release lease %s error %v", name, err)
+		return
+	}
+	log.Debugf("lease %s released by %s", name, l.identity)
+}
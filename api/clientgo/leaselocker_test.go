@@ -0,0 +1,222 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package clientgo
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	leasev1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+//fakeLeases in memory leases, updates of a stale resource version conflict as with the API server
+type fakeLeases struct {
+	sync.Mutex
+	leasev1.LeaseInterface
+	leases  map[string]coordinationv1.Lease
+	version int
+}
+
+var leaseResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+func (f *fakeLeases) Get(name string, options metav1.GetOptions) (*coordinationv1.Lease, error) {
+	f.Lock()
+	defer f.Unlock()
+	lease, ok := f.leases[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (f *fakeLeases) Create(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.leases[lease.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(leaseResource, lease.Name)
+	}
+	f.version++
+	lease.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = *lease.DeepCopy()
+	return lease, nil
+}
+
+func (f *fakeLeases) Update(lease *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	f.Lock()
+	defer f.Unlock()
+	current, ok := f.leases[lease.Name]
+	if !ok {
+		return nil, apierrors.NewNotFound(leaseResource, lease.Name)
+	}
+	if current.ResourceVersion != lease.ResourceVersion {
+		return nil, apierrors.NewConflict(leaseResource, lease.Name, nil)
+	}
+	f.version++
+	lease.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Name] = *lease.DeepCopy()
+	return lease, nil
+}
+
+func (f *fakeLeases) Delete(name string, options *metav1.DeleteOptions) error {
+	f.Lock()
+	defer f.Unlock()
+	current, ok := f.leases[name]
+	if !ok {
+		return apierrors.NewNotFound(leaseResource, name)
+	}
+	if options != nil && options.Preconditions != nil {
+		if version := options.Preconditions.ResourceVersion; version != nil && *version != current.ResourceVersion {
+			return apierrors.NewConflict(leaseResource, name, nil)
+		}
+	}
+	delete(f.leases, name)
+	return nil
+}
+
+type LeaseLockerSuite struct {
+	suite.Suite
+	leases *fakeLeases
+}
+
+func (suite *LeaseLockerSuite) SetupTest() {
+	suite.leases = &fakeLeases{leases: make(map[string]coordinationv1.Lease)}
+}
+
+func TestLeaseLockerSuite(t *testing.T) {
+	suite.Run(t, new(LeaseLockerSuite))
+}
+
+func (suite *LeaseLockerSuite) getLocker(identity string) *leaseLocker {
+	locker := newLeaseLocker(suite.leases, identity)
+	locker.retry = time.Millisecond
+	locker.timeout = 50 * time.Millisecond
+	return locker
+}
+
+func (suite *LeaseLockerSuite) Test_Lock_Replicas() {
+	replica1 := suite.getLocker("replica-1")
+	replica2 := suite.getLocker("replica-2")
+
+	unlock, err := replica1.Lock("treeq-pool-10")
+	assert.Nil(suite.T(), err, "error not expected")
+	_, err = replica2.Lock("treeq-pool-10")
+	assert.NotNil(suite.T(), err, "lease is held by replica-1")
+	unlock2, err := replica2.Lock("treeq-pool-20")
+	assert.Nil(suite.T(), err, "leases of other names are free")
+	unlock2()
+
+	unlock()
+	unlock, err = replica2.Lock("treeq-pool-10")
+	assert.Nil(suite.T(), err, "released lease should be acquired")
+	unlock()
+}
+
+func (suite *LeaseLockerSuite) Test_TryLock_Replicas() {
+	replica1 := suite.getLocker("replica-1")
+	replica2 := suite.getLocker("replica-2")
+
+	unlock, ok, err := replica1.TryLock("treeq-populate-pvc-1")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.True(suite.T(), ok, "free lease should be acquired")
+	_, ok, err = replica2.TryLock("treeq-populate-pvc-1")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.False(suite.T(), ok, "lease is held by replica-1")
+	_, ok, _ = replica1.TryLock("treeq-populate-pvc-1")
+	assert.False(suite.T(), ok, "lock is held in process")
+
+	unlock()
+	unlock, ok, _ = replica2.TryLock("treeq-populate-pvc-1")
+	assert.True(suite.T(), ok, "released lease should be acquired")
+	unlock()
+}
+
+func (suite *LeaseLockerSuite) Test_Lock_Expired() {
+	name := leaseName("treeq-pool-10")
+	holder := "replica-1"
+	duration := int32(30)
+	renewTime := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	suite.leases.Create(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration, RenewTime: &renewTime},
+	})
+
+	unlock, err := suite.getLocker("replica-2").Lock("treeq-pool-10")
+	assert.Nil(suite.T(), err, "expired lease should be taken over")
+	lease, _ := suite.leases.Get(name, metav1.GetOptions{})
+	assert.Equal(suite.T(), "replica-2", *lease.Spec.HolderIdentity)
+	assert.Equal(suite.T(), int32(1), *lease.Spec.LeaseTransitions)
+	unlock()
+	_, err = suite.leases.Get(name, metav1.GetOptions{})
+	assert.True(suite.T(), apierrors.IsNotFound(err), "lease should be deleted on release")
+}
+
+func (suite *LeaseLockerSuite) Test_Unlock_DeletesLeases() {
+	locker := suite.getLocker("replica-1")
+	for _, name := range []string{"treeq-populate-pvc-1", "treeq-populate-pvc-2", "treeq-snapshot-refs-10"} {
+		unlock, ok, err := locker.TryLock(name)
+		assert.Nil(suite.T(), err, "error not expected")
+		assert.True(suite.T(), ok, "free lease should be acquired")
+		unlock()
+	}
+	assert.Empty(suite.T(), suite.leases.leases, "released leases should not pile up")
+}
+
+func (suite *LeaseLockerSuite) Test_Unlock_TakenOver() {
+	name := leaseName("treeq-pool-10")
+	unlock, err := suite.getLocker("replica-1").Lock("treeq-pool-10")
+	assert.Nil(suite.T(), err, "error not expected")
+	lease, _ := suite.leases.Get(name, metav1.GetOptions{})
+	holder := "replica-2"
+	lease.Spec.HolderIdentity = &holder
+	suite.leases.Update(lease)
+
+	unlock()
+	lease, err = suite.leases.Get(name, metav1.GetOptions{})
+	assert.Nil(suite.T(), err, "lease of another holder should be kept")
+	assert.Equal(suite.T(), "replica-2", *lease.Spec.HolderIdentity)
+}
+
+func (suite *LeaseLockerSuite) Test_Lock_Serialize() {
+	replicas := []*leaseLocker{suite.getLocker("replica-1"), suite.getLocker("replica-2")}
+	for _, locker := range replicas {
+		locker.timeout = 10 * time.Second
+	}
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(locker *leaseLocker) {
+			defer wg.Done()
+			unlock, err := locker.Lock("treeq-pool-10")
+			assert.Nil(suite.T(), err, "error not expected")
+			defer unlock()
+			value := counter
+			time.Sleep(time.Millisecond)
+			counter = value + 1
+		}(replicas[i%2])
+	}
+	wg.Wait()
+	assert.Equal(suite.T(), 10, counter, "lease holders should be serialized")
+}
+
+func (suite *LeaseLockerSuite) Test_leaseName() {
+	assert.Equal(suite.T(), leaseName("treeq-pool-10"), leaseName("treeq-pool-10"))
+	assert.NotEqual(suite.T(), leaseName("pool_A"), leaseName("pool-a"), "sanitized names should stay unique")
+	assert.Regexp(suite.T(), "^infinibox-csi-pool-a-[0-9a-f]{8}$", leaseName("pool_A"))
+}
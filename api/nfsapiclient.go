@@ -771,3 +771,99 @@ func (c *ClientService) GetFileSystemCountByPoolID(poolID int64) (fileSysCnt int
 	fileSysCnt = metadata.NoOfObject
 	return
 }
+
+//GetFileSystemSnapshotsByParentID : list the snapshots of given filesystem
+func (c *ClientService) GetFileSystemSnapshotsByParentID(parentID int64) (*[]FileSystemSnapshotResponce, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetFileSystemSnapshotsByParentID Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Get snapshots of filesystem : ", parentID)
+	uri := "api/rest/filesystems"
+	snapshots := []FileSystemSnapshotResponce{}
+	queryParam := make(map[string]interface{})
+	queryParam["parent_id"] = parentID
+	resp, err := c.getResponseWithQueryString(uri, queryParam, &snapshots)
+	if err != nil {
+		log.Errorf("Error occured while getting snapshots of filesystem : %s ", err)
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		snapshots, _ = apiresp.Result.([]FileSystemSnapshotResponce)
+	}
+	log.Info("Got snapshots of filesystem : ", parentID)
+	return &snapshots, nil
+}
+
+//GetMetadata : get all metadata attached to object
+func (c *ClientService) GetMetadata(objectID int64) (*[]Metadata, error) {
+	var err error
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetMetadata Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("Get metadata of object : ", objectID)
+	uri := "api/rest/metadata/" + strconv.FormatInt(objectID, 10)
+	metadata := []Metadata{}
+	resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &metadata)
+	if err != nil {
+		log.Errorf("Error occured while getting metadata of object : %s ", err)
+		return nil, err
+	}
+	if len(metadata) == 0 {
+		apiresp := resp.(client.ApiResponse)
+		metadata, _ = apiresp.Result.([]Metadata)
+	}
+	log.Info("Got metadata of object : ", objectID)
+	return &metadata, nil
+}
+
+//DeleteMetadataKey : delete a single metadata key from object
+func (c *ClientService) DeleteMetadataKey(objectID int64, key string) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("DeleteMetadataKey Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("Delete metadata key %s from object : %d", key, objectID)
+	uri := "api/rest/metadata/" + strconv.FormatInt(objectID, 10) + "/" + key + "?approved=true"
+	_, err = c.getJSONResponse(http.MethodDelete, uri, nil, nil)
+	if err != nil {
+		log.Errorf("Error occured while deleting metadata key %s : %s ", key, err)
+		return
+	}
+	log.Infof("Deleted metadata key %s from object : %d", key, objectID)
+	return
+}
+
+//GetMetadataByKey : get one page of the metadata entries of the given key, whatever the object
+func (c *ClientService) GetMetadataByKey(key string, page int) (metadataPage *MetadataPage, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetMetadataByKey Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("Get metadata with key %s page %d", key, page)
+	uri := "api/rest/metadata?key=" + key + "&page=" + strconv.Itoa(page) + "&page_size=1000"
+	metadata := []Metadata{}
+	resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &metadata)
+	if err != nil {
+		log.Errorf("Error occured while getting metadata with key %s : %s ", key, err)
+		return
+	}
+	apiresp := resp.(client.ApiResponse)
+	mdata := apiresp.MetaData
+	if len(metadata) == 0 {
+		metadata, _ = apiresp.Result.([]Metadata)
+	}
+	metadataPage = &MetadataPage{MetadataArry: metadata}
+	metadataPage.Pagemetadata.NumberOfObjects = mdata.NoOfObject
+	metadataPage.Pagemetadata.Page = mdata.Page
+	metadataPage.Pagemetadata.PageSize = mdata.PageSize
+	metadataPage.Pagemetadata.PagesTotal = mdata.TotalPages
+	return
+}
@@ -39,6 +39,14 @@ type Treeq struct {
 	Path         string `json:"path,omitempty"`
 	HardCapacity int64  `json:"hard_capacity,omitempty"`
 	UsedCapacity int64  `json:"used_capacity,omitempty"`
+	SoftCapacity int64  `json:"soft_capacity,omitempty"`
+	HardInodes   int64  `json:"hard_inodes,omitempty"`
+	SoftInodes   int64  `json:"soft_inodes,omitempty"`
+	UsedInodes   int64  `json:"used_inodes,omitempty"`
+
+	//CapacityGracePeriod and InodesGracePeriod : seconds the soft capacity and inodes may be exceeded
+	CapacityGracePeriod int64 `json:"capacity_grace_period,omitempty"`
+	InodesGracePeriod   int64 `json:"inodes_grace_period,omitempty"`
 }
 
 //GetFileSystemsByPoolID get filesystem by poolID
@@ -242,3 +250,30 @@ func (c *ClientService) GetTreeqByName(fileSystemID int64, treeqName string) (*T
 	}
 	return nil, errors.New("treeq with given name not found")
 }
+
+//GetTreeqsByFileSystemID return all treeqs of the filesystem
+func (c *ClientService) GetTreeqsByFileSystemID(fileSystemID int64) (treeqs []Treeq, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("GetTreeqsByFileSystemID Panic occured -  " + fmt.Sprint(res))
+		}
+	}()
+	treeqs = []Treeq{}
+	for page := 1; ; page++ {
+		uri := "api/rest/filesystems/" + strconv.FormatInt(fileSystemID, 10) + "/treeqs?page=" + strconv.Itoa(page) + "&page_size=1000"
+		treeqPage := []Treeq{}
+		resp, err := c.getJSONResponse(http.MethodGet, uri, nil, &treeqPage)
+		if err != nil {
+			log.Errorf("error occured while fetching treeqs of filesystem %d : %s ", fileSystemID, err)
+			return nil, err
+		}
+		apiresp := resp.(client.ApiResponse)
+		if len(treeqPage) == 0 {
+			treeqPage, _ = apiresp.Result.([]Treeq)
+		}
+		treeqs = append(treeqs, treeqPage...)
+		if page >= apiresp.MetaData.TotalPages {
+			return treeqs, nil
+		}
+	}
+}
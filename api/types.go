@@ -103,6 +103,7 @@ type SnapshotVolumesResp struct {
 	ParentID   int    `json:"parent_id,omitempty"`
 	PoolID     int    `json:"pool_id,omitempty"`
 	Name       string `json:"name,omitempty"`
+	CreatedAt  int64  `json:"created_at,omitempty"`
 }
 
 type NetworkSpace struct {
@@ -115,7 +116,7 @@ type NetworkSpace struct {
 	ID                  int                  `json:"id,omitempty"`
 	Portals             []Portal             `json:"ips,omitempty"`
 	Mtu                 int                  `json:"mtu,omitempty"`
-	NetworkConfig       NetworkConfigDetails `json:""network_config,omitempty"`
+	NetworkConfig       NetworkConfigDetails `json:"network_config,omitempty"`
 	Name                string               `json:"name,omitempty"`
 	Vmac_Addresses      []VmacAddress        `json:"vmac_addresses,omitempty"`
 	Routes              []Route              `json:"routes,omitempty"`
@@ -152,6 +153,7 @@ type NetworkSpaceProperty struct {
 	IscsiIqn            string      `json:"iscsi_iqn,omitempty"`
 	IscsiTcpPort        int         `json:"iscsi_tcp_port,omitempty"`
 	IscsiSecurityMethod string      `json:"iscsi_default_security_method,omitempty"`
+	NfsVersions         []string    `json:"nfs_versions,omitempty"`
 }
 
 type HostCluster struct {
@@ -189,6 +191,9 @@ type ExportFileSys struct {
 	Privileged_port     bool                     `json:"privileged_port,omitempty"`
 	Export_path         string                   `json:"export_path,omitempty"`
 	Permissionsput      []map[string]interface{} `json:"permissions,omitempty"`
+	Nfs_versions        []string                 `json:"nfs_versions,omitempty"`
+	Anonymous_uid       int                      `json:"anonymous_uid,omitempty"`
+	Anonymous_gid       int                      `json:"anonymous_gid,omitempty"`
 }
 
 type ExportResponse struct {
@@ -206,6 +211,7 @@ type ExportResponse struct {
 	MakeAllUsersAnonymous bool          `json:"make_all_users_anonymous,omitempty"`
 	SnapdirVisible        bool          `json:"snapdir_visible,omitempty"`
 	TransportProtocols    string        `json:"transport_protocols,omitempty"`
+	NfsVersions           []string      `json:"nfs_versions,omitempty"`
 	AnonymousGid          int           `json:"anonymous_gid,omitempty"`
 	AnonymousUid          int           `json:"anonymous_uid,omitempty"`
 	FilesystemId          int           `json:"filesystem_id,omitempty"`
@@ -272,6 +278,12 @@ type Metadata struct {
 	ObjectType string `json:"object_type,omitempty"`
 }
 
+//MetadataPage one page of metadata entries
+type MetadataPage struct {
+	MetadataArry []Metadata
+	Pagemetadata FileSystemMetaData
+}
+
 //FileSystemSnapshot file system snapshot request parameter
 type FileSystemSnapshot struct {
 	ParentID       int64  `json:"parent_id"`
@@ -289,12 +301,6 @@ type FileSystemSnapshotResponce struct {
 	CreatedAt   int64  `json:"created_at,omitempty"`
 }
 
-type VolumeProtocolConfig struct {
-	VolumeID      string
-	StorageType   string
-	ChildVolumeID string
-}
-
 //VolumeSnapshot volume snapshot request parameter
 type VolumeSnapshot struct {
 	ParentID       int    `json:"parent_id"`
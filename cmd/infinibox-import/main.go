@@ -0,0 +1,176 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//infinibox-import print the static PersistentVolume of an existing InfiniBox volume or filesystem
+//
+//	infinibox-import -hostname ibox.example.com -username admin -protocol nfs -name fs1 \
+//	    -param network_space=nas -storageclass ibox-nfs-storageclass-demo | kubectl apply -f -
+//
+//the password is read from the INFINIBOX_PASSWORD environment variable when -password is not given,
+//with -param array=<name> the credentials are those of the array registry file of ARRAY_REGISTRY
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"infinibox-csi-driver/storage"
+)
+
+//paramFlags repeated -param key=value flags
+type paramFlags map[string]string
+
+func (p paramFlags) String() string {
+	return fmt.Sprint(map[string]string(p))
+}
+
+func (p paramFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("parameter %s is not key=value", value)
+	}
+	p[kv[0]] = kv[1]
+	return nil
+}
+
+type persistentVolume struct {
+	Name             string
+	Driver           string
+	AccessMode       string
+	VolumeMode       string
+	Capacity         int64
+	StorageClass     string
+	SecretName       string
+	SecretNamespace  string
+	FsType           string
+	VolumeHandle     string
+	VolumeAttributes []attribute
+}
+
+type attribute struct {
+	Key   string
+	Value string
+}
+
+const pvTemplate = `apiVersion: v1
+kind: PersistentVolume
+metadata:
+  annotations:
+    pv.kubernetes.io/provisioned-by: {{ .Driver }}
+  name: {{ .Name }}
+spec:
+  accessModes:
+  - {{ .AccessMode }}
+  capacity:
+    storage: "{{ .Capacity }}"
+  csi:
+    controllerExpandSecretRef:
+      name: {{ .SecretName }}
+      namespace: {{ .SecretNamespace }}
+    controllerPublishSecretRef:
+      name: {{ .SecretName }}
+      namespace: {{ .SecretNamespace }}
+    driver: {{ .Driver }}
+{{- if .FsType }}
+    fsType: {{ .FsType }}
+{{- end }}
+    nodePublishSecretRef:
+      name: {{ .SecretName }}
+      namespace: {{ .SecretNamespace }}
+    nodeStageSecretRef:
+      name: {{ .SecretName }}
+      namespace: {{ .SecretNamespace }}
+    volumeAttributes:
+{{- range .VolumeAttributes }}
+      {{ .Key }}: {{ printf "%q" .Value }}
+{{- end }}
+    volumeHandle: {{ printf "%q" .VolumeHandle }}
+  persistentVolumeReclaimPolicy: Retain
+{{- if .StorageClass }}
+  storageClassName: {{ .StorageClass }}
+{{- end }}
+  volumeMode: {{ .VolumeMode }}
+`
+
+func main() {
+	params := paramFlags{}
+	hostname := flag.String("hostname", os.Getenv("INFINIBOX_HOSTNAME"), "InfiniBox management address")
+	username := flag.String("username", os.Getenv("INFINIBOX_USERNAME"), "InfiniBox user")
+	password := flag.String("password", os.Getenv("INFINIBOX_PASSWORD"), "InfiniBox password")
+	protocol := flag.String("protocol", "", "storage protocol of the volume: fc, iscsi, nvme or nfs")
+	name := flag.String("name", "", "name of the InfiniBox volume or filesystem")
+	pvName := flag.String("pv-name", "", "name of the PersistentVolume, default the InfiniBox object name")
+	driver := flag.String("driver", storage.Name, "CSI driver name")
+	accessMode := flag.String("access-mode", "", "PV access mode, default ReadWriteMany for nfs and ReadWriteOnce otherwise")
+	volumeMode := flag.String("volume-mode", "Filesystem", "PV volume mode, Filesystem or Block")
+	storageClass := flag.String("storageclass", "", "storage class name of the PV")
+	secretName := flag.String("secret-name", "infinibox-creds", "name of the InfiniBox credentials secret")
+	secretNamespace := flag.String("secret-namespace", "infi", "namespace of the InfiniBox credentials secret")
+	force := flag.Bool("force", false, "import an object already tagged with another PV name")
+	flag.Var(params, "param", "storage class parameter key=value, may be repeated, network_space is required for iscsi, nvme and nfs")
+	flag.Parse()
+
+	secrets := map[string]string{"hostname": *hostname, "username": *username, "password": *password}
+	if params[storage.KeyArray] != "" && *hostname == "" {
+		arraySecrets, err := storage.ArraySecrets(params[storage.KeyArray], secrets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to get array %s: %v\n", params[storage.KeyArray], err)
+			os.Exit(1)
+		}
+		secrets = arraySecrets
+	}
+	if *protocol == "" || *name == "" || secrets["hostname"] == "" || secrets["username"] == "" || secrets["password"] == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	volume, err := storage.ImportVolume(*protocol, *name, *pvName, params, secrets, *force)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to import %s: %v\n", *name, err)
+		os.Exit(1)
+	}
+
+	pv := persistentVolume{
+		Name:            *pvName,
+		Driver:          *driver,
+		AccessMode:      *accessMode,
+		VolumeMode:      *volumeMode,
+		Capacity:        volume.CapacityBytes,
+		StorageClass:    *storageClass,
+		SecretName:      *secretName,
+		SecretNamespace: *secretNamespace,
+		VolumeHandle:    volume.VolumeId,
+	}
+	if pv.Name == "" {
+		pv.Name = *name
+	}
+	if pv.AccessMode == "" {
+		pv.AccessMode = "ReadWriteOnce"
+		if *protocol == "nfs" {
+			pv.AccessMode = "ReadWriteMany"
+		}
+	}
+	if *protocol != "nfs" && *volumeMode != "Block" {
+		pv.FsType = volume.VolumeContext["fstype"]
+	}
+	for key, value := range volume.VolumeContext {
+		pv.VolumeAttributes = append(pv.VolumeAttributes, attribute{Key: key, Value: value})
+	}
+	sort.Slice(pv.VolumeAttributes, func(i, j int) bool { return pv.VolumeAttributes[i].Key < pv.VolumeAttributes[j].Key })
+
+	if err := template.Must(template.New("pv").Parse(pvTemplate)).Execute(os.Stdout, pv); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to print PersistentVolume: %v\n", err)
+		os.Exit(1)
+	}
+}
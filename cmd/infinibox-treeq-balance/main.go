@@ -0,0 +1,63 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//infinibox-treeq-balance print a JSON report of the treeq imbalance across the treeq filesystems of a pool,
+//with the treeq moves that would even the treeq counts. It only reads the array, no treeq is moved
+//
+//	infinibox-treeq-balance -hostname ibox.example.com -username admin -pool pool1
+//
+//the password is read from the INFINIBOX_PASSWORD environment variable when -password is not given,
+//with -array <name> the credentials are those of the array registry file of ARRAY_REGISTRY
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"infinibox-csi-driver/storage"
+)
+
+func main() {
+	hostname := flag.String("hostname", os.Getenv("INFINIBOX_HOSTNAME"), "InfiniBox management address")
+	username := flag.String("username", os.Getenv("INFINIBOX_USERNAME"), "InfiniBox user")
+	password := flag.String("password", os.Getenv("INFINIBOX_PASSWORD"), "InfiniBox password")
+	array := flag.String("array", "", "name of the array of the array registry, instead of the credentials")
+	pool := flag.String("pool", "", "name of the pool of the treeq filesystems")
+	fsPrefix := flag.String("fs-prefix", "csit_", "name prefix of the treeq filesystems, the fs_prefix of the storage class, empty for all filesystems")
+	flag.Parse()
+
+	secrets := map[string]string{"hostname": *hostname, "username": *username, "password": *password}
+	if *array != "" && *hostname == "" {
+		arraySecrets, err := storage.ArraySecrets(*array, secrets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to get array %s: %v\n", *array, err)
+			os.Exit(1)
+		}
+		secrets = arraySecrets
+	}
+	if *pool == "" || secrets["hostname"] == "" || secrets["username"] == "" || secrets["password"] == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	report, err := storage.BuildTreeqBalanceReport(*pool, *fsPrefix, secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to report treeq balance of pool %s: %v\n", *pool, err)
+		os.Exit(1)
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to print report: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+}
@@ -0,0 +1,15 @@
+{{/* name of the secret of the array registry, empty without array registry */}}
+{{- define "arrayRegistrySecret" -}}
+{{- if .Values.arrayRegistry.secretName -}}
+{{ .Values.arrayRegistry.secretName }}
+{{- else if .Values.arrayRegistry.arrays -}}
+{{ .Release.Name }}-arrays
+{{- end -}}
+{{- end -}}
+
+{{/* path of the array registry in the driver containers, empty without array registry */}}
+{{- define "arrayRegistryPath" -}}
+{{- if include "arrayRegistrySecret" . -}}
+/etc/infinibox-arrays/arrays.json
+{{- end -}}
+{{- end -}}
@@ -0,0 +1,109 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package helper
+
+import (
+	"sync"
+	"time"
+)
+
+//Locker lock named resources, e.g. the treeq placement of a storage pool.
+//Lock blocks until the named lock is held and returns the function releasing it,
+//TryLock does not wait and returns false when the lock is held elsewhere
+type Locker interface {
+	Lock(name string) (unlock func(), err error)
+	TryLock(name string) (unlock func(), ok bool, err error)
+}
+
+//processLocker Locker serializing the goroutines of the process, a lock is freed once no goroutine holds or waits for it
+type processLocker struct {
+	sync.Mutex
+	locks map[string]*processLock
+}
+
+//processLock lock of a name, held while its channel holds a value
+type processLock struct {
+	held  chan struct{}
+	users int
+}
+
+//NewProcessLocker return a Locker for a single process, e.g. a single controller replica
+func NewProcessLocker() Locker {
+	return newProcessLocker()
+}
+
+func newProcessLocker() *processLocker {
+	return &processLocker{locks: make(map[string]*processLock)}
+}
+
+//Lock lock name for the process
+func (l *processLocker) Lock(name string) (func(), error) {
+	unlock, _ := l.lock(name, nil)
+	return unlock, nil
+}
+
+//TryLock lock name for the process when no goroutine holds it
+func (l *processLocker) TryLock(name string) (func(), bool, error) {
+	lock := l.use(name)
+	select {
+	case lock.held <- struct{}{}:
+	default:
+		l.release(name, lock)
+		return nil, false, nil
+	}
+	return l.unlocker(name, lock), true, nil
+}
+
+//lock lock name unless timeout fires first, in which case it returns false
+func (l *processLocker) lock(name string, timeout <-chan time.Time) (func(), bool) {
+	lock := l.use(name)
+	select {
+	case lock.held <- struct{}{}:
+	case <-timeout:
+		l.release(name, lock)
+		return nil, false
+	}
+	return l.unlocker(name, lock), true
+}
+
+//use add a user to the lock of name, created with its first user
+func (l *processLocker) use(name string) *processLock {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &processLock{held: make(chan struct{}, 1)}
+		l.locks[name] = lock
+	}
+	lock.users++
+	return lock
+}
+
+//unlocker return the function releasing the held lock, it can be called more than once
+func (l *processLocker) unlocker(name string, lock *processLock) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-lock.held
+			l.release(name, lock)
+		})
+	}
+}
+
+//release forget a user of the lock, freed with its last user
+func (l *processLocker) release(name string, lock *processLock) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(l.locks, name)
+	}
+}
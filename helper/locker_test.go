@@ -0,0 +1,73 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package helper
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockerSuite struct {
+	suite.Suite
+}
+
+func TestLockerSuite(t *testing.T) {
+	suite.Run(t, new(LockerSuite))
+}
+
+func (suite *LockerSuite) Test_ProcessLocker_Serialize() {
+	locker := NewProcessLocker()
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locker.Lock("pool-1")
+			assert.Nil(suite.T(), err, "error not expected")
+			defer unlock()
+			value := counter
+			counter = value + 1
+		}()
+	}
+	wg.Wait()
+	assert.Equal(suite.T(), 20, counter, "lock holders should be serialized")
+	assert.Empty(suite.T(), locker.(*processLocker).locks, "released locks should be freed")
+}
+
+func (suite *LockerSuite) Test_ProcessLocker_Names() {
+	locker := NewProcessLocker()
+	unlock1, _ := locker.Lock("pool-1")
+	unlock2, err := locker.Lock("pool-2")
+	assert.Nil(suite.T(), err, "other names should not be locked")
+	unlock2()
+	unlock1()
+	unlock1()
+	unlock1, _ = locker.Lock("pool-1")
+	unlock1()
+}
+
+func (suite *LockerSuite) Test_ProcessLocker_TryLock() {
+	locker := NewProcessLocker()
+	unlock, ok, err := locker.TryLock("treeq-1")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.True(suite.T(), ok, "free lock should be held")
+	_, ok, _ = locker.TryLock("treeq-1")
+	assert.False(suite.T(), ok, "held lock should not be waited for")
+	unlock()
+	unlock, ok, _ = locker.TryLock("treeq-1")
+	assert.True(suite.T(), ok, "released lock should be held")
+	unlock()
+	assert.Empty(suite.T(), locker.(*processLocker).locks, "released locks should be freed")
+}
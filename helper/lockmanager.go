@@ -0,0 +1,167 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package helper
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+//LockTimeoutError returned when a key stays locked by another operation beyond the lock timeout
+type LockTimeoutError struct {
+	Manager string
+	Key     string
+	Timeout time.Duration
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timeout waiting %v for %s lock %s", e.Timeout, e.Manager, e.Key)
+}
+
+//slowLockWait waits longer than this are logged as warnings
+const slowLockWait = 10 * time.Second
+
+//LockManager in process locks of keys, e.g. the volumes, hosts and filesystems of publish and unpublish.
+//Operations lock every key they modify, so only operations sharing a key are serialized
+type LockManager struct {
+	name    string
+	timeout time.Duration
+	locks   *processLocker
+
+	mutex   sync.Mutex
+	metrics LockMetrics
+}
+
+//LockMetrics counters of the locks of a LockManager
+type LockMetrics struct {
+	Acquired    int64         //locks acquired
+	Contended   int64         //locks acquired after waiting more than a millisecond for another holder
+	Timeouts    int64         //locks not acquired within the timeout
+	Held        int64         //locks currently held
+	Waiting     int64         //operations currently waiting for a lock
+	WaitTime    time.Duration //total wait time of the acquired locks
+	MaxWaitTime time.Duration //longest wait time of an acquired lock
+}
+
+//NewLockManager return a LockManager, name identifies it in logs, timeout bounds the wait for a key
+func NewLockManager(name string, timeout time.Duration) *LockManager {
+	return &LockManager{name: name, timeout: timeout, locks: newProcessLocker()}
+}
+
+//VolumeKey lock key of a volume, published or unpublished
+func VolumeKey(volumeID int64) string {
+	return fmt.Sprintf("volume-%d", volumeID)
+}
+
+//HostKey lock key of a host, locked while volumes are mapped to or unmapped from it and while it is created or deleted
+func HostKey(hostName string) string {
+	return "host-" + hostName
+}
+
+//FileSystemKey lock key of a filesystem, locked while its export rules are updated
+func FileSystemKey(fileSystemID int64) string {
+	return fmt.Sprintf("filesystem-%d", fileSystemID)
+}
+
+//Lock lock key, waiting at most the timeout of the manager, so LockManager is a Locker
+func (m *LockManager) Lock(key string) (func(), error) {
+	return m.LockKeys(key)
+}
+
+//LockKeys lock every key, waiting at most the timeout of the manager for all of them.
+//Keys are locked in sorted order so operations locking several keys can not deadlock
+func (m *LockManager) LockKeys(keys ...string) (func(), error) {
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+	unlocks := make([]func(), 0, len(sorted))
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, key := range sorted {
+		unlock, err := m.lock(key, timer.C)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	var once sync.Once
+	return func() { once.Do(unlockAll) }, nil
+}
+
+//lock lock a single key unless timeout fires first
+func (m *LockManager) lock(key string, timeout <-chan time.Time) (func(), error) {
+	start := time.Now()
+	m.update(func(metrics *LockMetrics) { metrics.Waiting++ })
+	unlock, ok := m.locks.lock(key, timeout)
+	wait := time.Since(start)
+	if !ok {
+		m.update(func(metrics *LockMetrics) {
+			metrics.Waiting--
+			metrics.Timeouts++
+		})
+		log.Errorf("%s lock %s not acquired within %v, metrics %+v", m.name, key, m.timeout, m.Metrics())
+		return nil, &LockTimeoutError{Manager: m.name, Key: key, Timeout: m.timeout}
+	}
+	m.update(func(metrics *LockMetrics) {
+		metrics.Waiting--
+		metrics.Acquired++
+		metrics.Held++
+		metrics.WaitTime += wait
+		if wait > metrics.MaxWaitTime {
+			metrics.MaxWaitTime = wait
+		}
+		if wait > time.Millisecond {
+			metrics.Contended++
+		}
+	})
+	if wait > slowLockWait {
+		log.Warnf("%s lock %s acquired after %v", m.name, key, wait)
+	} else {
+		log.Debugf("%s lock %s acquired after %v", m.name, key, wait)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unlock()
+			m.update(func(metrics *LockMetrics) { metrics.Held-- })
+		})
+	}, nil
+}
+
+func (m *LockManager) update(change func(metrics *LockMetrics)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	change(&m.metrics)
+}
+
+//Metrics return a snapshot of the lock metrics
+func (m *LockManager) Metrics() LockMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.metrics
+}
@@ -0,0 +1,87 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package helper
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockManagerSuite struct {
+	suite.Suite
+}
+
+func TestLockManagerSuite(t *testing.T) {
+	suite.Run(t, new(LockManagerSuite))
+}
+
+func (suite *LockManagerSuite) Test_LockKeys_Serialize() {
+	manager := NewLockManager("test", 10*time.Second)
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			//operations share the host key, the volume keys differ and are locked in any order
+			keys := []string{VolumeKey(int64(i)), HostKey("node-1")}
+			if i%2 == 0 {
+				keys = []string{HostKey("node-1"), VolumeKey(int64(i))}
+			}
+			unlock, err := manager.LockKeys(keys...)
+			assert.Nil(suite.T(), err, "error not expected")
+			defer unlock()
+			value := counter
+			time.Sleep(time.Millisecond)
+			counter = value + 1
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(suite.T(), 20, counter, "operations sharing a key should be serialized")
+	metrics := manager.Metrics()
+	assert.Equal(suite.T(), int64(40), metrics.Acquired)
+	assert.Equal(suite.T(), int64(0), metrics.Held)
+	assert.Equal(suite.T(), int64(0), metrics.Waiting)
+	assert.True(suite.T(), metrics.Contended > 0, "operations should have waited for the host key")
+	assert.Empty(suite.T(), manager.locks.locks, "released locks should be freed")
+}
+
+func (suite *LockManagerSuite) Test_LockKeys_Timeout() {
+	manager := NewLockManager("test", 10*time.Millisecond)
+	unlock, err := manager.LockKeys(HostKey("node-1"))
+	assert.Nil(suite.T(), err, "error not expected")
+
+	_, err = manager.LockKeys(VolumeKey(1), HostKey("node-1"))
+	assert.IsType(suite.T(), &LockTimeoutError{}, err)
+	assert.Contains(suite.T(), err.Error(), "host-node-1")
+	unlock2, err := manager.LockKeys(VolumeKey(1), FileSystemKey(2))
+	assert.Nil(suite.T(), err, "keys released on timeout should be free")
+	unlock2()
+
+	metrics := manager.Metrics()
+	assert.Equal(suite.T(), int64(1), metrics.Timeouts)
+	assert.Equal(suite.T(), int64(1), metrics.Held)
+	unlock()
+	unlock()
+	assert.Equal(suite.T(), int64(0), manager.Metrics().Held, "unlock should release once")
+	assert.Empty(suite.T(), manager.locks.locks, "released locks should be freed")
+}
+
+func (suite *LockManagerSuite) Test_LockKeys_Duplicate() {
+	manager := NewLockManager("test", 10*time.Millisecond)
+	unlock, err := manager.LockKeys(HostKey("node-1"), HostKey("node-1"))
+	assert.Nil(suite.T(), err, "duplicate keys should be locked once")
+	unlock()
+}
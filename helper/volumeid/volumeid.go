@@ -0,0 +1,209 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+
+//Package volumeid encode and decode the volume and snapshot IDs of the driver.
+//
+//IDs are encoded in the versioned format
+//
+//	v1$$<protocol>$$id=<object id>;array=<array>;export=<export id>;treeq=<treeq id>;max=<size>;path=<path>;name=<name>;ref=<pv name>
+//
+//where only id is required, values are escaped with %XX for '%', ';', '=' and '$'. The earlier formats still parse:
+//
+//	<object id>$$<protocol>[$$<array>]
+//	<filesystem id>#<treeq id>#<max filesystem size>$$nfs_treeq[$$<array>]                    treeq volume
+//	<filesystem snapshot id>#<treeq path>#<snapshot name>$$nfs_treeq[$$<array>]              treeq snapshot
+package volumeid
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	//Version : version of the IDs encoded by String
+	Version = 1
+
+	//NFSTreeq : protocol of the treeq volumes, whose legacy IDs have several object identifiers
+	NFSTreeq = "nfs_treeq"
+
+	separator     = "$$"
+	versionPrefix = "v1"
+)
+
+//ID : decoded volume or snapshot ID, Version is 0 for an ID of a legacy format
+type ID struct {
+	Version  int
+	Protocol string
+
+	//Array : name of the array of the array registry, empty for the array of the secrets
+	Array string
+
+	//ObjectID : volume, filesystem or snapshot ID, the filesystem ID of a treeq and filesystem snapshot ID of a treeq snapshot
+	ObjectID int64
+
+	//ExportID : export of an nfs filesystem, used by the nodes when the volume context misses the export path
+	ExportID int64
+
+	TreeqID           int64
+	MaxFileSystemSize string
+
+	//TreeqPath and SnapshotName : treeq path and name of a treeq snapshot
+	TreeqPath    string
+	SnapshotName string
+
+	//RestoreRef : PV name of a volume restored in place, which references the object of another PV instead of owning it
+	RestoreRef string
+}
+
+//fieldEscaper escape the characters of a value that are part of the format
+var fieldEscaper = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D", "$", "%24")
+
+//String encode the ID in the current format
+func (id ID) String() string {
+	fields := []string{"id=" + strconv.FormatInt(id.ObjectID, 10)}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+fieldEscaper.Replace(value))
+		}
+	}
+	add("array", id.Array)
+	if id.ExportID != 0 {
+		add("export", strconv.FormatInt(id.ExportID, 10))
+	}
+	if id.TreeqID != 0 {
+		add("treeq", strconv.FormatInt(id.TreeqID, 10))
+	}
+	add("max", id.MaxFileSystemSize)
+	add("path", id.TreeqPath)
+	add("name", id.SnapshotName)
+	add("ref", id.RestoreRef)
+	return versionPrefix + separator + id.Protocol + separator + strings.Join(fields, ";")
+}
+
+//IsTreeq check the ID is the ID of a treeq volume or treeq snapshot
+func (id ID) IsTreeq() bool {
+	return id.Protocol == NFSTreeq
+}
+
+//IsReference check the ID references the object of another volume, so deleting it must not delete the object
+func (id ID) IsReference() bool {
+	return id.RestoreRef != ""
+}
+
+//Parse decode a volume ID of any format
+func Parse(volumeID string) (ID, error) {
+	return parse(volumeID, false)
+}
+
+//ParseSnapshot decode a snapshot ID of any format
+func ParseSnapshot(snapshotID string) (ID, error) {
+	return parse(snapshotID, true)
+}
+
+func parse(str string, snapshot bool) (id ID, err error) {
+	parts := strings.Split(str, separator)
+	if len(parts) == 3 && parts[0] == versionPrefix {
+		id, err = parseFields(parts[2])
+		id.Version = Version
+		id.Protocol = parts[1]
+	} else if len(parts) == 2 || len(parts) == 3 {
+		id.Protocol = parts[1]
+		if len(parts) == 3 {
+			id.Array = parts[2]
+		}
+		err = parseLegacyObject(&id, parts[0], snapshot)
+	} else {
+		return ID{}, fmt.Errorf("volume Id and other details not found in %s", str)
+	}
+	if err == nil && id.Protocol == "" {
+		err = errors.New("storage protocol not found")
+	}
+	if err == nil && id.IsTreeq() {
+		if snapshot && (id.TreeqPath == "" || id.SnapshotName == "") {
+			err = errors.New("treeq path and snapshot name not found")
+		} else if !snapshot && id.TreeqID == 0 {
+			err = errors.New("treeq ID not found")
+		}
+	}
+	if err != nil {
+		return ID{}, fmt.Errorf("invalid ID %s: %v", str, err)
+	}
+	return id, nil
+}
+
+//parseFields decode the key=value fields of the current format
+func parseFields(str string) (id ID, err error) {
+	found := false
+	for _, field := range strings.Split(str, ";") {
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) != 2 {
+			return id, fmt.Errorf("field %s is not key=value", field)
+		}
+		value, err := url.PathUnescape(keyValue[1])
+		if err != nil {
+			return id, err
+		}
+		switch keyValue[0] {
+		case "id":
+			id.ObjectID, err = strconv.ParseInt(value, 10, 64)
+			found = true
+		case "array":
+			id.Array = value
+		case "export":
+			id.ExportID, err = strconv.ParseInt(value, 10, 64)
+		case "treeq":
+			id.TreeqID, err = strconv.ParseInt(value, 10, 64)
+		case "max":
+			id.MaxFileSystemSize = value
+		case "path":
+			id.TreeqPath = value
+		case "name":
+			id.SnapshotName = value
+		case "ref":
+			id.RestoreRef = value
+		default:
+			// fields of later versions are ignored
+		}
+		if err != nil {
+			return id, fmt.Errorf("invalid %s value %s", keyValue[0], value)
+		}
+	}
+	if !found {
+		return id, errors.New("object id not found")
+	}
+	return id, nil
+}
+
+//parseLegacyObject decode the object part of a legacy ID
+func parseLegacyObject(id *ID, str string, snapshot bool) (err error) {
+	if !id.IsTreeq() {
+		id.ObjectID, err = strconv.ParseInt(str, 10, 64)
+		return err
+	}
+	fields := strings.Split(str, "#")
+	if len(fields) != 3 {
+		return errors.New("volume Id and other details not found")
+	}
+	if id.ObjectID, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return err
+	}
+	if snapshot {
+		id.TreeqPath = fields[1]
+		id.SnapshotName = fields[2]
+		return nil
+	}
+	id.MaxFileSystemSize = fields[2]
+	id.TreeqID, err = strconv.ParseInt(fields[1], 10, 64)
+	return err
+}
@@ -0,0 +1,105 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package volumeid
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type VolumeIDSuite struct {
+	suite.Suite
+}
+
+func TestVolumeIDSuite(t *testing.T) {
+	suite.Run(t, new(VolumeIDSuite))
+}
+
+func (suite *VolumeIDSuite) Test_String_Parse() {
+	id := ID{Protocol: "nfs", Array: "ibox;1=a$b%", ObjectID: 100, ExportID: 3000}
+	str := id.String()
+	assert.Equal(suite.T(), "v1$$nfs$$id=100;array=ibox%3B1%3Da%24b%25;export=3000", str)
+	parsed, err := Parse(str)
+	assert.Nil(suite.T(), err, "error not expected")
+	id.Version = Version
+	assert.Equal(suite.T(), id, parsed)
+
+	id = ID{Protocol: NFSTreeq, ObjectID: 100, TreeqID: 200, MaxFileSystemSize: "4TiB"}
+	parsed, err = Parse(id.String())
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(200), parsed.TreeqID)
+	assert.Equal(suite.T(), "4TiB", parsed.MaxFileSystemSize)
+	assert.True(suite.T(), parsed.IsTreeq())
+
+	id = ID{Protocol: NFSTreeq, ObjectID: 300, TreeqPath: "/pvc-1", SnapshotName: "snapshot-1"}
+	parsed, err = ParseSnapshot(id.String())
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "/pvc-1", parsed.TreeqPath)
+	assert.Equal(suite.T(), "snapshot-1", parsed.SnapshotName)
+
+	id = ID{Protocol: "iscsi", ObjectID: 400, RestoreRef: "pvc-2"}
+	parsed, err = Parse(id.String())
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "pvc-2", parsed.RestoreRef)
+	assert.True(suite.T(), parsed.IsReference())
+}
+
+func (suite *VolumeIDSuite) Test_Parse_Legacy() {
+	id, err := Parse("100$$iscsi")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), ID{Protocol: "iscsi", ObjectID: 100}, id)
+
+	id, err = Parse("100$$fc$$ibox2")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), ID{Protocol: "fc", Array: "ibox2", ObjectID: 100}, id)
+
+	id, err = Parse("100#200#4TiB$$nfs_treeq")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), ID{Protocol: NFSTreeq, ObjectID: 100, TreeqID: 200, MaxFileSystemSize: "4TiB"}, id)
+
+	id, err = ParseSnapshot("300#/pvc-1#snapshot-1$$nfs_treeq$$ibox1")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), ID{Protocol: NFSTreeq, Array: "ibox1", ObjectID: 300, TreeqPath: "/pvc-1", SnapshotName: "snapshot-1"}, id)
+}
+
+func (suite *VolumeIDSuite) Test_Parse_Invalid() {
+	invalidIDs := []string{
+		"",
+		"100",
+		"abc$$nfs",
+		"100$$",
+		"100#200$$nfs_treeq",
+		"100$$nfs_treeq",
+		"v1$$nfs$$pool=pool1",
+		"v1$$nfs$$id=abc",
+		"v1$$nfs$$id",
+		"v1$$nfs_treeq$$id=100",
+		"1$$nfs$$ibox1$$extra",
+	}
+	for _, invalidID := range invalidIDs {
+		_, err := Parse(invalidID)
+		assert.NotNil(suite.T(), err, "invalid ID "+invalidID)
+	}
+	_, err := ParseSnapshot("v1$$nfs_treeq$$id=300;path=/pvc-1")
+	assert.NotNil(suite.T(), err, "treeq snapshot name missing")
+}
+
+func (suite *VolumeIDSuite) Test_Parse_UnknownField() {
+	id, err := Parse("v1$$nfs$$id=100;future=value")
+	assert.Nil(suite.T(), err, "fields of later versions are ignored")
+	assert.Equal(suite.T(), int64(100), id.ObjectID)
+
+	id, err = Parse("v1$$nfs$$id=100;pool=pool1;export=3000")
+	assert.Nil(suite.T(), err, "pool of the first v1 IDs is ignored")
+	assert.Equal(suite.T(), ID{Version: Version, Protocol: "nfs", ObjectID: 100, ExportID: 3000}, id)
+}
@@ -12,6 +12,8 @@ package main
 
 import (
 	"context"
+	"os"
+
 	"infinibox-csi-driver/provider"
 	"infinibox-csi-driver/service"
 
@@ -21,6 +23,9 @@ import (
 
 //starting method of CSI-Driver
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcile(os.Args[2:]))
+	}
 	configParams := getConfigParams()
 	gocsi.Run(
 		context.Background(),
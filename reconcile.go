@@ -0,0 +1,66 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"infinibox-csi-driver/api/clientgo"
+	"infinibox-csi-driver/storage"
+)
+
+//reconcile run the orphan reconciliation once and print the JSON report, it returns the exit code
+//
+//	infinibox-csi-driver reconcile -secret-name infinibox-creds -secret-namespace infi [-cleanup]
+//	infinibox-csi-driver reconcile -array ibox1 [-cleanup]
+func reconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	secretName := flags.String("secret-name", "infinibox-creds", "name of the InfiniBox credentials secret")
+	secretNamespace := flags.String("secret-namespace", "infi", "namespace of the InfiniBox credentials secret")
+	array := flags.String("array", "", "name of the array of the array registry, instead of the credentials secret")
+	driver := flags.String("driver", storage.Name, "CSI driver name")
+	cleanup := flags.Bool("cleanup", false, "remove orphan export rules and LUN mappings")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	kc, err := clientgo.BuildClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to build kubernetes client: %v\n", err)
+		return 1
+	}
+	var secrets map[string]string
+	if *array == "" {
+		secrets, err = kc.GetSecret(*secretName, *secretNamespace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to get secret %s/%s: %v\n", *secretNamespace, *secretName, err)
+			return 1
+		}
+	} else if secrets, err = storage.ArraySecrets(*array, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to get array %s: %v\n", *array, err)
+		return 1
+	}
+	report, err := storage.ReconcileOrphans(*driver, *cleanup, secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to reconcile orphans: %v\n", err)
+		return 1
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to print report: %v\n", err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
@@ -17,6 +17,7 @@ import (
 	"infinibox-csi-driver/storage"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
@@ -43,7 +44,17 @@ func (s *service) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest
 	if storageprotocol == "" {
 		return &csi.CreateVolumeResponse{}, status.Error(codes.Internal, "storage protocol is not found, 'storage_protocol' is required field")
 	}
-	storageController, err := storage.NewStorageController(storageprotocol, configparams, req.GetSecrets())
+	arrayName := req.GetParameters()[storage.KeyArray]
+	secrets, err := storage.ArraySecrets(arrayName, req.GetSecrets())
+	if err != nil {
+		log.Errorf("In CreateVolume method : %v", err)
+		return &csi.CreateVolumeResponse{}, err
+	}
+	if err = validateContentSourceArray(req, arrayName); err != nil {
+		log.Errorf("In CreateVolume method : %v", err)
+		return &csi.CreateVolumeResponse{}, err
+	}
+	storageController, err := storage.NewStorageController(storageprotocol, configparams, secrets)
 	if err != nil || storageController == nil {
 		log.Errorf("In CreateVolume method : %v", err)
 		err = errors.New("fail to initialise storage controller while create volume " + storageprotocol)
@@ -51,12 +62,15 @@ func (s *service) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest
 	}
 	csiResp, err = storageController.CreateVolume(ctx, req)
 	if err != nil {
-		err = errors.New("fail to create volume of storage protocol " + storageprotocol)
+		log.Errorf("fail to create volume %v", err)
+		// keep the code of status errors, e.g. AlreadyExists for a volume that does not match the request
+		if _, ok := status.FromError(err); !ok {
+			err = errors.New("fail to create volume of storage protocol " + storageprotocol)
+		}
 		return
 	}
 	if csiResp != nil && csiResp.Volume != nil && csiResp.Volume.VolumeId != "" {
-		csiResp.Volume.VolumeId = csiResp.Volume.VolumeId + "$$" + storageprotocol
-		log.Infof("CreateVolume updated volumeId %s", csiResp.Volume.VolumeId)
+		log.Infof("CreateVolume created volumeId %s", csiResp.Volume.VolumeId)
 		return
 	}
 	err = errors.New("CreateVolume error: failed to create volume")
@@ -78,28 +92,29 @@ func (s *service) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest
 		}
 	}()
 
-	voltype := req.GetVolumeId()
-	log.Infof("DeleteVolume method called with volume name %s", voltype)
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	log.Infof("DeleteVolume method called with volume name %s", req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate storage type %v", err)
 		return
 	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		log.Errorf("fail to get secrets of array %s %v", volproto.Array, err)
+		return
+	}
 	config := make(map[string]string)
 	config["nodeid"] = s.nodeID
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	storageController, err := storage.NewStorageController(volproto.Protocol, config, secrets)
 	if err != nil || storageController == nil {
-		err = errors.New("fail to initialise storage controller while delete volume " + volproto.StorageType)
+		err = errors.New("fail to initialise storage controller while delete volume " + volproto.Protocol)
 		return
 	}
-	req.VolumeId = volproto.VolumeID
 	deleteResponce, err = storageController.DeleteVolume(ctx, req)
 	if err != nil {
 		log.Errorf("fail to delete volume %v", err)
-		err = errors.New("fail to delete volume of type " + volproto.StorageType)
-		return
+		err = errors.New("fail to delete volume of type " + volproto.Protocol)
 	}
-	req.VolumeId = voltype
 	return
 }
 
@@ -112,17 +127,22 @@ func (s *service) ControllerPublishVolume(ctx context.Context, req *csi.Controll
 		}
 	}()
 
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate StorageType Publish Volume %v", err)
 		err = errors.New("fail to validate StorageType")
 		return
 	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		log.Errorf("fail to get secrets of array %s %v", volproto.Array, err)
+		return
+	}
 	config := make(map[string]string)
 
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	storageController, err := storage.NewStorageController(volproto.Protocol, config, secrets)
 	if err != nil || storageController == nil {
-		err = errors.New("fail to initialise storage controller while ControllerPublishVolume " + volproto.StorageType)
+		err = errors.New("fail to initialise storage controller while ControllerPublishVolume " + volproto.Protocol)
 		return
 	}
 	controlePublishResponce, err = storageController.ControllerPublishVolume(ctx, req)
@@ -141,16 +161,21 @@ func (s *service) ControllerUnpublishVolume(ctx context.Context, req *csi.Contro
 		}
 	}()
 
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate StorageType while Unpublish Volume %v", err)
 		err = errors.New("fail to validate StorageType while Unpublish Volume")
 		return
 	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		log.Errorf("fail to get secrets of array %s %v", volproto.Array, err)
+		return
+	}
 	config := make(map[string]string)
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	storageController, err := storage.NewStorageController(volproto.Protocol, config, secrets)
 	if err != nil || storageController == nil {
-		err = errors.New("fail to initialise storage controller while ControllerUnpublishVolume " + volproto.StorageType)
+		err = errors.New("fail to initialise storage controller while ControllerUnpublishVolume " + volproto.Protocol)
 		return
 	}
 	controleUnPublishResponce, err = storageController.ControllerUnpublishVolume(ctx, req)
@@ -247,15 +272,20 @@ func (s *service) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotReq
 	}()
 
 	log.Infof("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := s.validateStorageType(req.GetSourceVolumeId())
+	volproto, err := volumeid.Parse(req.GetSourceVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate storage type %v", err)
 		return
 	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		log.Errorf("fail to get secrets of array %s %v", volproto.Array, err)
+		return
+	}
 	config := make(map[string]string)
 	config["nodeid"] = s.nodeID
 	config["nodeIPAddress"] = s.nodeIPAddress
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	storageController, err := storage.NewStorageController(volproto.Protocol, config, secrets)
 	if err != nil {
 		log.Error("Error Occured: ", err)
 		return
@@ -275,22 +305,26 @@ func (s *service) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotReq
 	}()
 
 	log.Infof("Delete Snapshot called with snapshot Id %s", req.GetSnapshotId())
-	volproto, err := s.validateStorageType(req.GetSnapshotId())
+	volproto, err := volumeid.ParseSnapshot(req.GetSnapshotId())
 	if err != nil {
 		log.Errorf("fail to validate storage type %v", err)
 		return
 	}
 
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		log.Errorf("fail to get secrets of array %s %v", volproto.Array, err)
+		return
+	}
 	config := make(map[string]string)
 	config["nodeid"] = s.nodeID
 	config["nodeIPAddress"] = s.nodeIPAddress
-	storageController, err := storage.NewStorageController(volproto.StorageType, config, req.GetSecrets())
+	storageController, err := storage.NewStorageController(volproto.Protocol, config, secrets)
 	if err != nil {
 		log.Error("Error Occured: ", err)
 		return
 	}
 	if storageController != nil {
-		req.SnapshotId = volproto.VolumeID
 		deleteSnapshot, err := storageController.DeleteSnapshot(ctx, req)
 		return deleteSnapshot, err
 	}
@@ -311,18 +345,22 @@ func (s *service) ControllerExpandVolume(ctx context.Context, req *csi.Controlle
 
 	configparams := make(map[string]string)
 	configparams["nodeid"] = s.nodeID
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil {
+		return
+	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
 	if err != nil {
+		log.Errorf("fail to get secrets of array %s %v", volproto.Array, err)
 		return
 	}
 
-	storageController, err := storage.NewStorageController(volproto.StorageType, configparams, req.GetSecrets())
+	storageController, err := storage.NewStorageController(volproto.Protocol, configparams, secrets)
 	if err != nil {
 		log.Error("Error Occured: ", err)
 		return
 	}
 	if storageController != nil {
-		req.VolumeId = volproto.VolumeID
 		expandVolume, err = storageController.ControllerExpandVolume(ctx, req)
 		return expandVolume, err
 	}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"infinibox-csi-driver/helper/volumeid"
 	"infinibox-csi-driver/storage"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -14,7 +15,8 @@ type ControllerMock struct {
 }
 
 func (m *ControllerMock) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "100"}}, nil
+	volumeID := volumeid.ID{Protocol: req.GetParameters()["storage_protocol"], Array: req.GetParameters()[storage.KeyArray], ObjectID: 100}
+	return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: volumeID.String()}}, nil
 }
 func (m *ControllerMock) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (deleteResponce *csi.DeleteVolumeResponse, err error) {
 	return &csi.DeleteVolumeResponse{}, nil
@@ -13,6 +13,8 @@ package service
 import (
 	"context"
 	"infinibox-csi-driver/storage"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"bou.ke/monkey"
@@ -293,6 +295,71 @@ func (suite *ControllerTestSuite) Test_GetCapacity(){
 
 //=============================
 
+func (suite *ControllerTestSuite) Test_CreateVolume_ArrayRegistry() {
+	registry := writeArrayRegistry(suite.T())
+	defer os.Remove(registry)
+	os.Setenv(storage.ArrayRegistryEnv, registry)
+	defer os.Unsetenv(storage.ArrayRegistryEnv)
+	var secrets map[string]string
+	patch := monkey.Patch(storage.NewStorageController, func(_ string, configparams ...map[string]string) (storage.Storageoperations, error) {
+		secrets = configparams[1]
+		return &ControllerMock{}, nil
+	})
+	defer patch.Unpatch()
+
+	parameterMap := getContrCreateVolumeParamter()
+	parameterMap[storage.KeyArray] = "ibox2"
+	createVolumeReq := getControllerCreateVolumeRequest("pvcName", parameterMap)
+	s := getService()
+	resp, err := s.CreateVolume(context.Background(), createVolumeReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "v1$$nfs$$id=100;array=ibox2", resp.Volume.VolumeId)
+	assert.Equal(suite.T(), "ibox2.example.com", secrets["hostname"])
+
+	deleteVolumeReq := getCtrDeleteVolumeRequest()
+	deleteVolumeReq.VolumeId = "100$$nfs$$ibox2"
+	_, err = s.DeleteVolume(context.Background(), deleteVolumeReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "ibox2.example.com", secrets["hostname"])
+
+	createVolumeReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "100$$nfs$$ibox1"},
+		},
+	}
+	_, err = s.CreateVolume(context.Background(), createVolumeReq)
+	assert.NotNil(suite.T(), err, "clone across arrays")
+
+	parameterMap[storage.KeyArray] = "unknown"
+	_, err = s.CreateVolume(context.Background(), getControllerCreateVolumeRequest("pvcName", parameterMap))
+	assert.NotNil(suite.T(), err, "array not in the registry")
+}
+
+func (suite *ControllerTestSuite) Test_validateContentSourceArray() {
+	createVolumeReq := getControllerCreateVolumeRequest("pvcName", getContrCreateVolumeParamter())
+	assert.Nil(suite.T(), validateContentSourceArray(createVolumeReq, ""), "no content source")
+	createVolumeReq.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "v1$$nfs$$id=200;array=ibox1"},
+		},
+	}
+	assert.Nil(suite.T(), validateContentSourceArray(createVolumeReq, "ibox1"), "snapshot on the array")
+	assert.NotNil(suite.T(), validateContentSourceArray(createVolumeReq, ""), "snapshot on another array")
+	createVolumeReq.VolumeContentSource.GetSnapshot().SnapshotId = "200"
+	assert.NotNil(suite.T(), validateContentSourceArray(createVolumeReq, ""), "invalid snapshot ID")
+}
+
+func writeArrayRegistry(t *testing.T) string {
+	file, err := ioutil.TempFile("", "arrays")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString(`[{"name":"ibox1","hostname":"ibox1.example.com","username":"admin","password":"pass1"},
+		{"name":"ibox2","hostname":"ibox2.example.com","username":"admin","password":"pass2"}]`)
+	return file.Name()
+}
+
 func getCtrControllerGetCapabilitiesRequest()*csi.ControllerGetCapabilitiesRequest {
 	return &csi.ControllerGetCapabilitiesRequest{}
 }
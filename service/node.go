@@ -15,15 +15,53 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/storage"
-	"time"
+	"sync"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+//treeqSecrets node publish secrets of the treeq volumes published on the node, by volume ID and target path.
+//NodeGetVolumeStats gets no secrets and reads the treeq quota usage with them
+var treeqSecrets = struct {
+	sync.Mutex
+	volumes map[string]map[string]map[string]string
+}{volumes: make(map[string]map[string]map[string]string)}
+
+//setTreeqSecrets remember the secrets of a published treeq volume
+func setTreeqSecrets(volumeID, targetPath string, secrets map[string]string) {
+	treeqSecrets.Lock()
+	defer treeqSecrets.Unlock()
+	if treeqSecrets.volumes[volumeID] == nil {
+		treeqSecrets.volumes[volumeID] = make(map[string]map[string]string)
+	}
+	treeqSecrets.volumes[volumeID][targetPath] = secrets
+}
+
+//forgetTreeqSecrets forget the secrets of the target path, those of the volume are forgotten with its last target path
+func forgetTreeqSecrets(volumeID, targetPath string) {
+	treeqSecrets.Lock()
+	defer treeqSecrets.Unlock()
+	delete(treeqSecrets.volumes[volumeID], targetPath)
+	if len(treeqSecrets.volumes[volumeID]) == 0 {
+		delete(treeqSecrets.volumes, volumeID)
+	}
+}
+
+//getTreeqSecrets return the secrets of the published treeq volume, nil when it is not published since the node started
+func getTreeqSecrets(volumeID string) map[string]string {
+	treeqSecrets.Lock()
+	defer treeqSecrets.Unlock()
+	for _, secrets := range treeqSecrets.volumes[volumeID] {
+		return secrets
+	}
+	return nil
+}
+
 func (s *service) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	var err error
 	defer func() {
@@ -37,11 +75,26 @@ func (s *service) NodePublishVolume(ctx context.Context, req *csi.NodePublishVol
 	config := make(map[string]string)
 	config["nodeIPAddress"] = s.nodeIPAddress
 	log.Debug("NodePublishVolume nodeIPAddress ", s.nodeIPAddress)
+	volproto, err := volumeid.Parse(voltype)
+	if err != nil {
+		return &csi.NodePublishVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if storagePorotcol == "" {
+		storagePorotcol = volproto.Protocol
+	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		return &csi.NodePublishVolumeResponse{}, err
+	}
 
 	// get operator
-	storageNode, err := storage.NewStorageNode(storagePorotcol, config, req.GetSecrets())
+	storageNode, err := storage.NewStorageNode(storagePorotcol, config, secrets)
 	if storageNode != nil {
-		return storageNode.NodePublishVolume(ctx, req)
+		resp, err := storageNode.NodePublishVolume(ctx, req)
+		if err == nil && volproto.Protocol == volumeid.NFSTreeq {
+			setTreeqSecrets(req.GetVolumeId(), req.GetTargetPath(), req.GetSecrets())
+		}
+		return resp, err
 	}
 	log.Error("Error Occured: ", err)
 	return &csi.NodePublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
@@ -55,15 +108,18 @@ func (s *service) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublis
 		}
 	}()
 	log.Infof("NodeUnpublishVolume called with volume name %s", req.GetVolumeId())
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.NodeUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
-	protocolOperation, err := storage.NewStorageNode(volproto.StorageType, nil, nil)
+	protocolOperation, err := storage.NewStorageNode(volproto.Protocol, nil, nil)
 	if err != nil {
 		return &csi.NodeUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
 	resp, err := protocolOperation.NodeUnpublishVolume(ctx, req)
+	if err == nil && volproto.Protocol == volumeid.NFSTreeq {
+		forgetTreeqSecrets(req.GetVolumeId(), req.GetTargetPath())
+	}
 	return resp, err
 }
 
@@ -94,6 +150,13 @@ func (s *service) NodeGetCapabilities(
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -118,8 +181,16 @@ func (s service) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	storagePorotcol := req.GetVolumeContext()["storage_protocol"]
 	config := make(map[string]string)
 	config["nodeIPAddress"] = s.nodeIPAddress
+	volproto, err := volumeid.Parse(voltype)
+	if err != nil {
+		return &csi.NodeStageVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	secrets, err := storage.ArraySecrets(volproto.Array, req.GetSecrets())
+	if err != nil {
+		return &csi.NodeStageVolumeResponse{}, err
+	}
 	// get operator
-	storageNode, err := storage.NewStorageNode(storagePorotcol, config, req.GetSecrets())
+	storageNode, err := storage.NewStorageNode(storagePorotcol, config, secrets)
 	if storageNode != nil {
 		return storageNode.NodeStageVolume(ctx, req)
 	}
@@ -135,11 +206,11 @@ func (s *service) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVol
 		}
 	}()
 	log.Infof("NodeUnstageVolume called with volume name %s", req.GetVolumeId())
-	volproto, err := s.validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.NodeUnstageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
-	protocolOperation, err := storage.NewStorageNode(volproto.StorageType, nil, nil)
+	protocolOperation, err := storage.NewStorageNode(volproto.Protocol, nil, nil)
 	if err != nil {
 		return &csi.NodeUnstageVolumeResponse{}, status.Error(codes.Internal, err.Error())
 	}
@@ -147,9 +218,37 @@ func (s *service) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVol
 	return resp, err
 }
 func (s *service) NodeGetVolumeStats(
-	ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return &csi.NodeGetVolumeStatsResponse{}, status.Error(codes.Unimplemented, time.Now().String())
-
+	ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (resp *csi.NodeGetVolumeStatsResponse, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from NodeGetVolumeStats " + fmt.Sprint(res))
+		}
+	}()
+	log.Debugf("NodeGetVolumeStats called with volume name %s", req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	//the treeq quota usage is read from the array, with the credentials of the array registry for the volumes
+	//of a named array, otherwise with the secrets of the volume publish
+	var config, secrets map[string]string
+	if volproto.Protocol == volumeid.NFSTreeq {
+		secrets, err = storage.ArraySecrets(volproto.Array, getTreeqSecrets(req.GetVolumeId()))
+		if err != nil {
+			return nil, err
+		}
+		if secrets == nil {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume %s has no array name and is not published since the node plugin started, its quota usage is reported once it is published again",
+				req.GetVolumeId())
+		}
+		config = map[string]string{"nodeIPAddress": s.nodeIPAddress}
+	}
+	storageNode, err := storage.NewStorageNode(volproto.Protocol, config, secrets)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return storageNode.NodeGetVolumeStats(ctx, req)
 }
 
 func (s *service) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
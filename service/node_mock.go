@@ -22,3 +22,6 @@ func (m *NodeMock) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpubli
 func (m *NodeMock) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	return &csi.NodeStageVolumeResponse{},nil
 }
+func (m *NodeMock) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return &csi.NodeGetVolumeStatsResponse{}, nil
+}
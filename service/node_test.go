@@ -3,12 +3,15 @@ package service
 import (
 	"context"
 	"infinibox-csi-driver/storage"
+	"os"
 	"testing"
 
 	"bou.ke/monkey"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type NodeTestSuite struct {
@@ -104,6 +107,44 @@ func (suite *NodeTestSuite) Test_NodeGetVolumeStats() {
 	assert.NotNil(suite.T(), err)	
 }
 
+func (suite *NodeTestSuite) Test_NodeGetVolumeStats_Treeq_NotPublished() {
+	s := getService()
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "v1$$nfs_treeq$$id=100;treeq=200", VolumePath: "/var/lib/kubelet/pods/1/volumes/pv"}
+	_, err := s.NodeGetVolumeStats(context.Background(), req)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "secrets of the publish are needed without array name")
+}
+
+func (suite *NodeTestSuite) Test_NodeGetVolumeStats_Treeq_ArrayRegistry() {
+	registry := writeArrayRegistry(suite.T())
+	defer os.Remove(registry)
+	os.Setenv(storage.ArrayRegistryEnv, registry)
+	defer os.Unsetenv(storage.ArrayRegistryEnv)
+	var secrets map[string]string
+	patch := monkey.Patch(storage.NewStorageNode, func(_ string, configparams ...map[string]string) (storage.Storageoperations, error) {
+		secrets = configparams[1]
+		return &NodeMock{}, nil
+	})
+	defer patch.Unpatch()
+
+	s := getService()
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "v1$$nfs_treeq$$id=100;array=ibox2;treeq=200", VolumePath: "/var/lib/kubelet/pods/1/volumes/pv"}
+	_, err := s.NodeGetVolumeStats(context.Background(), req)
+	assert.Nil(suite.T(), err, "credentials of the array registry expected")
+	assert.Equal(suite.T(), "ibox2.example.com", secrets["hostname"])
+	assert.Equal(suite.T(), "pass2", secrets["password"])
+}
+
+func (suite *NodeTestSuite) Test_treeqSecrets() {
+	volumeID := "v1$$nfs_treeq$$id=100;treeq=200"
+	secrets := map[string]string{"hostname": "ibox", "username": "user", "password": "pass"}
+	setTreeqSecrets(volumeID, "/pod1", secrets)
+	setTreeqSecrets(volumeID, "/pod2", secrets)
+	forgetTreeqSecrets(volumeID, "/pod1")
+	assert.Equal(suite.T(), secrets, getTreeqSecrets(volumeID), "secrets kept while a target path is published")
+	forgetTreeqSecrets(volumeID, "/pod2")
+	assert.Nil(suite.T(), getTreeqSecrets(volumeID), "secrets forgotten with the last target path")
+}
+
 
 
 func (suite *NodeTestSuite) Test_NodeExpandVolume_invalid_ID() {
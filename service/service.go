@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/rexray/gocsi"
@@ -110,15 +111,27 @@ func (s *service) getNodeFQDN() string {
 	return nodeFQDN
 }
 
-func (s *service) validateStorageType(str string) (volprotoconf api.VolumeProtocolConfig, err error) {
-	volproto := strings.Split(str, "$$")
-	if len(volproto) != 2 {
-		return volprotoconf, errors.New("volume Id and other details not found")
+//validateContentSourceArray check the source of a new volume is on the array of the volume
+func validateContentSourceArray(req *csi.CreateVolumeRequest, arrayName string) error {
+	var source volumeid.ID
+	var err error
+	sourceID := ""
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		sourceID = snapshot.GetSnapshotId()
+		source, err = volumeid.ParseSnapshot(sourceID)
+	} else if volume := req.GetVolumeContentSource().GetVolume(); volume != nil {
+		sourceID = volume.GetVolumeId()
+		source, err = volumeid.Parse(sourceID)
+	} else {
+		return nil
+	}
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
-	log.Info("volproto ", volproto)
-	volprotoconf.VolumeID = volproto[0]
-	volprotoconf.StorageType = volproto[1]
-	return volprotoconf, nil
+	if source.Array != arrayName {
+		return status.Errorf(codes.InvalidArgument, "source %s is not on the array '%s' of the volume", sourceID, arrayName)
+	}
+	return nil
 }
 
 // Controller expand volume request validation
@@ -0,0 +1,148 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
+
+	csictx "github.com/rexray/gocsi/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	//KeyArray : storage class parameter, name of the array of the array registry the volumes are created on
+	KeyArray = "array"
+
+	//ArrayRegistryEnv : path of the array registry, a JSON list of named arrays with their credentials
+	ArrayRegistryEnv = "ARRAY_REGISTRY"
+)
+
+//Array : array of the array registry
+type Array struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+//arrayRegistry arrays by name, reloaded when the registry file changes, e.g. when its secret is updated
+var arrayRegistry = struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	arrays  map[string]Array
+}{}
+
+//loadArrayRegistry return the arrays of the registry by name, none when no registry is configured
+func loadArrayRegistry() (map[string]Array, error) {
+	path, ok := csictx.LookupEnv(context.Background(), ArrayRegistryEnv)
+	if !ok || path == "" {
+		return map[string]Array{}, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "fail to read array registry %s: %v", path, err)
+	}
+	arrayRegistry.Lock()
+	defer arrayRegistry.Unlock()
+	if arrayRegistry.arrays != nil && arrayRegistry.path == path && arrayRegistry.modTime.Equal(info.ModTime()) {
+		return arrayRegistry.arrays, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "fail to read array registry %s: %v", path, err)
+	}
+	list := []Array{}
+	if err = json.Unmarshal(content, &list); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "fail to parse array registry %s: %v", path, err)
+	}
+	arrays := make(map[string]Array, len(list))
+	for _, array := range list {
+		if array.Name == "" || array.Hostname == "" || array.Username == "" || array.Password == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "array %s of array registry %s needs name, hostname, username and password", array.Name, path)
+		}
+		if strings.Contains(array.Name, "$$") {
+			return nil, status.Errorf(codes.FailedPrecondition, "array name %s of array registry %s must not contain '$$'", array.Name, path)
+		}
+		arrays[array.Name] = array
+	}
+	log.Infof("array registry %s loaded with %d arrays", path, len(arrays))
+	arrayRegistry.path = path
+	arrayRegistry.modTime = info.ModTime()
+	arrayRegistry.arrays = arrays
+	return arrays, nil
+}
+
+//GetArray return the named array of the registry
+func GetArray(name string) (Array, error) {
+	arrays, err := loadArrayRegistry()
+	if err != nil {
+		return Array{}, err
+	}
+	array, ok := arrays[name]
+	if !ok {
+		return Array{}, status.Errorf(codes.InvalidArgument, "array %s not found in the array registry", name)
+	}
+	return array, nil
+}
+
+//ArraySecrets return the secrets to reach the named array, the given secrets when name is empty.
+//Other keys of the given secrets, e.g. the iSCSI CHAP ones, are kept
+func ArraySecrets(name string, secrets map[string]string) (map[string]string, error) {
+	if name == "" {
+		return secrets, nil
+	}
+	array, err := GetArray(name)
+	if err != nil {
+		return nil, err
+	}
+	arraySecrets := make(map[string]string, len(secrets)+3)
+	for key, value := range secrets {
+		arraySecrets[key] = value
+	}
+	arraySecrets["hostname"] = array.Hostname
+	arraySecrets["username"] = array.Username
+	arraySecrets["password"] = array.Password
+	return arraySecrets, nil
+}
+
+//arrayPersistentVolumes return the PVs of the array with the hostname, PVs without array name belong to every array
+func arrayPersistentVolumes(pvs []v1.PersistentVolume, hostname string) []v1.PersistentVolume {
+	if hostname == "" {
+		return pvs
+	}
+	arrayPVs := []v1.PersistentVolume{}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil {
+			continue
+		}
+		volproto, err := volumeid.Parse(pv.Spec.CSI.VolumeHandle)
+		if err == nil && volproto.Array != "" {
+			array, err := GetArray(volproto.Array)
+			if err != nil || array.Hostname != hostname {
+				continue
+			}
+		}
+		arrayPVs = append(arrayPVs, pv)
+	}
+	return arrayPVs
+}
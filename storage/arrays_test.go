@@ -0,0 +1,89 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+func (suite *ArrayRegistrySuite) SetupTest() {
+	file, err := ioutil.TempFile("", "arrays")
+	if err != nil {
+		suite.T().Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString(`[{"name":"ibox1","hostname":"ibox1.example.com","username":"admin","password":"pass1"},
+		{"name":"ibox2","hostname":"ibox2.example.com","username":"admin","password":"pass2"}]`)
+	suite.registry = file.Name()
+	os.Setenv(ArrayRegistryEnv, suite.registry)
+}
+
+func (suite *ArrayRegistrySuite) TearDownTest() {
+	os.Unsetenv(ArrayRegistryEnv)
+	os.Remove(suite.registry)
+}
+
+type ArrayRegistrySuite struct {
+	suite.Suite
+	registry string
+}
+
+func TestArrayRegistrySuite(t *testing.T) {
+	suite.Run(t, new(ArrayRegistrySuite))
+}
+
+func (suite *ArrayRegistrySuite) Test_ArraySecrets() {
+	secrets := map[string]string{"hostname": "default", "username": "user", "password": "pass", "node.session.auth.username": "chap"}
+	arraySecrets, err := ArraySecrets("ibox2", secrets)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "ibox2.example.com", arraySecrets["hostname"])
+	assert.Equal(suite.T(), "pass2", arraySecrets["password"])
+	assert.Equal(suite.T(), "chap", arraySecrets["node.session.auth.username"])
+	assert.Equal(suite.T(), "default", secrets["hostname"], "secrets of the request unchanged")
+
+	arraySecrets, err = ArraySecrets("", secrets)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "default", arraySecrets["hostname"])
+
+	_, err = ArraySecrets("ibox3", secrets)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+}
+
+func (suite *ArrayRegistrySuite) Test_ArraySecrets_InvalidRegistry() {
+	ioutil.WriteFile(suite.registry, []byte(`[{"name":"ibox1","hostname":"ibox1.example.com"}]`), 0600)
+	arrayRegistry.Lock()
+	arrayRegistry.arrays = nil
+	arrayRegistry.Unlock()
+	_, err := ArraySecrets("ibox1", nil)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err))
+}
+
+func (suite *ArrayRegistrySuite) Test_arrayPersistentVolumes() {
+	pvs := []v1.PersistentVolume{
+		getOrphanPV("pv-1", "100$$iscsi"),
+		getOrphanPV("pv-2", "101$$iscsi$$ibox1"),
+		getOrphanPV("pv-3", "102$$iscsi$$ibox2"),
+	}
+	arrayPVs := arrayPersistentVolumes(pvs, "ibox1.example.com")
+	names := []string{}
+	for _, pv := range arrayPVs {
+		names = append(names, pv.Name)
+	}
+	assert.Equal(suite.T(), []string{"pv-1", "pv-2"}, names)
+}
@@ -15,13 +15,14 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper"
+	"infinibox-csi-driver/helper/volumeid"
 	"strconv"
 	"strings"
 
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/protobuf/ptypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -56,11 +57,9 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	if volCaps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
 	}
-	for _, volCap := range volCaps {
-		if volCap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			log.Errorf("volume cpability %s for FC is not supported", volCap.GetAccessMode().GetMode().String())
-			return &csi.CreateVolumeResponse{}, fmt.Errorf("volume cpability %s for FC is not supported", volCap.GetAccessMode().GetMode().String())
-		}
+	if err = validateBlockAccessModes(volCaps); err != nil {
+		log.Errorf("%v for FC", err)
+		return &csi.CreateVolumeResponse{}, fmt.Errorf("%v for FC", err)
 	}
 
 	// Volume name to be created
@@ -69,6 +68,11 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	if name == "" {
 		return &csi.CreateVolumeResponse{}, errors.New("Name cannot be empty")
 	}
+	name, err = getObjectName(name, req.GetParameters())
+	if err != nil {
+		log.Errorf("%v for FC", err)
+		return &csi.CreateVolumeResponse{}, err
+	}
 
 	targetVol, err := fc.cs.api.GetVolumeByName(name)
 	if err != nil {
@@ -77,7 +81,7 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		}
 	}
 	if targetVol != nil {
-		return &csi.CreateVolumeResponse{}, nil
+		return fc.cs.getExistingVolumeResponse(targetVol, req, sizeBytes)
 	}
 
 	// We require the storagePool name for creation
@@ -89,9 +93,14 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	// Volume content source support volume and snapshots
 	contentSource := req.GetVolumeContentSource()
 	if contentSource != nil {
-		return fc.createVolumeFromVolumeContent(req, name, sizeBytes, poolName)
+		return fc.createVolumeFromVolumeContent(req, name, sizeBytes)
 
 	}
+	if err = fc.cs.selectStoragePool(req.GetParameters(), sizeBytes); err != nil {
+		log.Errorf("fail to select storage pool of volume %s error %v", name, err)
+		return &csi.CreateVolumeResponse{}, err
+	}
+	poolName = req.GetParameters()[StoragePoolKey]
 	ssd := req.GetParameters()["ssd_enabled"]
 	if ssd == "" {
 		ssd = fmt.Sprint(false)
@@ -117,8 +126,10 @@ func (fc *fcstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	}
 
 	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = volumeResp.Name
+	metadata["host.k8s.pvname"] = req.GetName()
 	metadata["host.filesystem_type"] = fstype
+	metadata["host.created_by"] = fc.cs.GetCreatedBy()
+	addCreateMetadata(req.GetParameters(), metadata)
 	_, err = fc.cs.api.AttachMetadataToObject(int64(volumeResp.ID), metadata)
 	if err != nil {
 		log.Errorf("fail to attach metadata for volume : %s", volumeResp.Name)
@@ -139,12 +150,21 @@ func (fc *fcstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error parsing volume id : %s", errors.New("Volume id not found"))
 	}
-	id, err := strconv.Atoi(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error parsing volume id : %s", err.Error())
 	}
-	err = fc.ValidateDeleteVolume(id)
+	deleteVolume, err := fc.cs.releaseObject(volproto.ObjectID, helper.VolumeKey(volproto.ObjectID), volproto)
+	if err != nil {
+		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
+			"error releasing volume : %s", err.Error())
+	}
+	if !deleteVolume {
+		log.Infof("volume %d is still referenced, not deleted", volproto.ObjectID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	err = fc.ValidateDeleteVolume(int(volproto.ObjectID))
 	if err != nil {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error deleting volume : %s", err.Error())
@@ -152,7 +172,7 @@ func (fc *fcstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest, name string, sizeInKbytes int64, storagePool string) (*csi.CreateVolumeResponse, error) {
+func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest, name string, sizeInKbytes int64) (*csi.CreateVolumeResponse, error) {
 	var err error
 	defer func() {
 		if res := recover(); res != nil && err == nil {
@@ -172,37 +192,44 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 	}
 
 	// Lookup the snapshot source volume.
-	volproto, err := validateStorageType(volumeContentID)
-	if err != nil {
-		log.Errorf("Failed to validate storage type %v", err)
-		return nil, errors.New("error getting volume id")
+	parse := volumeid.Parse
+	if restoreType == "Snapshot" {
+		parse = volumeid.ParseSnapshot
 	}
-
-	ID, err := strconv.Atoi(volproto.VolumeID)
+	volproto, err := parse(volumeContentID)
 	if err != nil {
+		log.Errorf("Failed to validate storage type %v", err)
 		return nil, errors.New("error getting volume id")
 	}
+	ID := int(volproto.ObjectID)
 	srcVol, err := fc.cs.api.GetVolume(ID)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, restoreType+" not found: %s", volumeContentID)
 	}
 
-	// Validate the size is the same.
-	if int64(srcVol.Size) != sizeInKbytes {
+	// Validate the size is not smaller, larger clones are resized once the snapshot is taken.
+	if sizeInKbytes < srcVol.Size {
 		return nil, status.Errorf(codes.InvalidArgument,
-			restoreType+" %s has incompatible size %d kbytes with requested %d kbytes",
+			restoreType+" %s has size %d bytes larger than requested %d bytes",
 			volumeContentID, srcVol.Size, sizeInKbytes)
 	}
 
-	// Validate the storagePool is the same.
-	storagePoolID, err := fc.cs.api.GetStoragePoolIDByName(storagePool)
+	// The clone stays in the storagePool of the source, block data is only copied into another pool by the hosts.
+	poolID, err := fc.cs.selectCloneStoragePool(req.GetParameters(), srcVol.PoolId, sizeInKbytes)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"error while getting storagepoolid with name %s ", storagePool)
+		return nil, err
 	}
-	if storagePoolID != srcVol.PoolId {
+	if poolID != srcVol.PoolId {
 		return nil, status.Errorf(codes.InvalidArgument,
-			"volume storage pool is different than the requested storage pool %s", storagePool)
+			restoreType+" %s is in storage pool %d, clones of block volumes can not be created in storage pool %s",
+			volumeContentID, srcVol.PoolId, req.GetParameters()[StoragePoolKey])
+	}
+	if restoreType == "Snapshot" && isRestoreInPlace(req.GetParameters()) {
+		if sizeInKbytes != srcVol.Size {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"restore in place from snapshot %s needs the size of the snapshot", volumeContentID)
+		}
+		return fc.cs.restoreVolumeInPlace(srcVol, req)
 	}
 	ssd := req.GetParameters()["ssd_enabled"]
 	if ssd == "" {
@@ -221,8 +248,13 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 		return nil, status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
 	}
 
-	// Retrieve created destination volume
+	// Resize the created destination volume when needed
 	volID := snapResponse.SnapShotID
+	if err = fc.cs.resizeClone(volID, srcVol, sizeInKbytes); err != nil {
+		return nil, err
+	}
+
+	// Retrieve created destination volume
 	dstVol, err := fc.cs.api.GetVolume(volID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not retrieve created volume: %d", volID)
@@ -233,8 +265,10 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 	copyRequestParameters(req.GetParameters(), csiVolume.VolumeContext)
 
 	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = dstVol.Name
+	metadata["host.k8s.pvname"] = req.GetName()
 	metadata["host.filesystem_type"] = req.GetParameters()["fstype"]
+	metadata["host.created_by"] = fc.cs.GetCreatedBy()
+	addCreateMetadata(req.GetParameters(), metadata)
 	_, err = fc.cs.api.AttachMetadataToObject(int64(dstVol.ID), metadata)
 	if err != nil {
 		log.Errorf("fail to attach metadata for volume : %s", dstVol.Name)
@@ -248,12 +282,12 @@ func (fc *fcstorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest,
 
 func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (resp *csi.ControllerPublishVolumeResponse, err error) {
 	log.Infof("ControllerPublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
-	volproto, err := validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("Failed to validate storage type %v", err)
 		return &csi.ControllerPublishVolumeResponse{}, errors.New("error getting volume id")
 	}
-	volID, _ := strconv.Atoi(volproto.VolumeID)
+	volID := int(volproto.ObjectID)
 
 	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
 	if len(nodeNameIP) != 2 {
@@ -261,6 +295,11 @@ func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	}
 	hostName := nodeNameIP[0]
 
+	unlock, err := lockPublish(helper.VolumeKey(volproto.ObjectID), helper.HostKey(hostName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	host, err := fc.cs.validateHost(hostName)
 	if err != nil {
 		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
@@ -281,6 +320,28 @@ func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	if ports != "" {
 		ports = ports[1:]
 	}
+	maxAllowedVol, err := strconv.Atoi(req.GetVolumeContext()["max_vols_per_host"])
+	if err != nil {
+		log.Errorf("Invalid parameter max_vols_per_host error:  %v", err)
+		return &csi.ControllerPublishVolumeResponse{}, err
+	}
+	log.Debugf("host can have maximum %d volume mapped", maxAllowedVol)
+	if clusterName := getHostCluster(req.GetVolumeCapability(), req.GetVolumeContext()); clusterName != "" {
+		log.Debugf("mapping volume %d to host cluster %s", volID, clusterName)
+		luninfo, err := fc.cs.mapVolumeToHostCluster(volID, host, clusterName, maxAllowedVol)
+		if err != nil {
+			log.Errorf("Failed to map volume to host cluster with error %v", err)
+			return &csi.ControllerPublishVolumeResponse{}, status.Error(status.Code(err), err.Error())
+		}
+		volCtx := make(map[string]string)
+		volCtx["lun"] = strconv.Itoa(luninfo.Lun)
+		volCtx["hostID"] = strconv.Itoa(host.ID)
+		volCtx["hostClusterID"] = strconv.Itoa(luninfo.HostClusterID)
+		volCtx["hostPorts"] = ports
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: volCtx,
+		}, nil
+	}
 	for _, lun := range lunList {
 		if lun.VolumeID == volID {
 			volCtx := make(map[string]string)
@@ -294,12 +355,6 @@ func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		}
 	}
 
-	maxAllowedVol, err := strconv.Atoi(req.GetVolumeContext()["max_vols_per_host"])
-	if err != nil {
-		log.Errorf("Invalid parameter max_vols_per_host error:  %v", err)
-		return &csi.ControllerPublishVolumeResponse{}, err
-	}
-	log.Debugf("host can have maximum %d volume mapped", maxAllowedVol)
 	log.Debugf("host %s has %d volume mapped", host.Name, len(lunList))
 	if len(lunList) >= maxAllowedVol {
 		log.Errorf("unable to publish volume on host %s, as maximum allowed volume per host is (%d), limit reached", host.Name, maxAllowedVol)
@@ -324,7 +379,7 @@ func (fc *fcstorage) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 
 func (fc *fcstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (resp *csi.ControllerUnpublishVolumeResponse, err error) {
 	log.Infof("ControllerUnpublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
-	volproto, err := validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("failed to validate storage type %v", err)
 		return nil, errors.New("error getting volume id")
@@ -334,6 +389,12 @@ func (fc *fcstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		return &csi.ControllerUnpublishVolumeResponse{}, errors.New("Node ID not found")
 	}
 	hostName := nodeNameIP[0]
+
+	unlock, err := lockPublish(helper.VolumeKey(volproto.ObjectID), helper.HostKey(hostName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	host, err := fc.cs.api.GetHostByName(hostName)
 	if err != nil {
 		if strings.Contains(err.Error(), "HOST_NOT_FOUND") {
@@ -342,8 +403,25 @@ func (fc *fcstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		log.Errorf("failed to get host details with error %v", err)
 		return nil, err
 	}
-	if len(host.Luns) > 0 {
-		volID, _ := strconv.Atoi(volproto.VolumeID)
+	clustered := false
+	for _, lun := range host.Luns {
+		if lun.CLustered && int64(lun.VolumeID) == volproto.ObjectID {
+			log.Debugf("release volume %d of host cluster %d for host %s", lun.VolumeID, lun.HostClusterID, host.Name)
+			left, err := fc.cs.unmapVolumeFromHostCluster(lun.HostClusterID, lun.VolumeID, &host)
+			if err != nil {
+				log.Errorf("failed to unmap volume %d from host cluster %d with error %v", lun.VolumeID, lun.HostClusterID, err)
+				return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+			}
+			if !left {
+				return &csi.ControllerUnpublishVolumeResponse{}, nil
+			}
+			host.HostClusterID = 0
+			clustered = true
+			break
+		}
+	}
+	if !clustered && len(host.Luns) > 0 {
+		volID := int(volproto.ObjectID)
 		log.Debugf("unmap volume %d from host %d", volID, host.ID)
 		err = fc.cs.unmapVolumeFromHost(host.ID, volID)
 		if err != nil {
@@ -351,10 +429,12 @@ func (fc *fcstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 			return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 		}
 	}
-	if len(host.Luns) < 2 {
+	// the host is deleted with its last mapping, other volumes may still be mapped to it by now
+	if host.HostClusterID == 0 {
 		luns, err := fc.cs.api.GetAllLunByHost(host.ID)
 		if err != nil {
 			log.Errorf("failed to retrive luns for host %d with error %v", host.ID, err)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
 		if len(luns) == 0 {
 			err = fc.cs.api.DeleteHost(host.ID)
@@ -394,26 +474,24 @@ func (fc *fcstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 	snapshotName := req.GetName()
 	log.Debugf("Create Snapshot of name %s", snapshotName)
 	log.Debugf("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := validateStorageType(req.GetSourceVolumeId())
+	volproto, err := volumeid.Parse(req.GetSourceVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate storage type %v", err)
 		return
 	}
 
-	sourceVolumeID, _ := strconv.Atoi(volproto.VolumeID)
+	sourceVolumeID := int(volproto.ObjectID)
 	volumeSnapshot, err := fc.cs.api.GetVolumeByName(snapshotName)
 	if err != nil {
 		log.Debug("Snapshot with given name not found : ", snapshotName)
-	} else if volumeSnapshot.ParentId == sourceVolumeID {
-		snapshotID = strconv.Itoa(volumeSnapshot.ID) + "$$" + volproto.StorageType
+	} else if volumeSnapshot != nil {
+		if volumeSnapshot.ParentId != sourceVolumeID {
+			log.Errorf("snapshot %s already exists with parent %d", snapshotName, volumeSnapshot.ParentId)
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for another source than volume %d", snapshotName, sourceVolumeID)
+		}
+		snapshotID = getSnapshotID(volproto, int64(volumeSnapshot.ID))
 		return &csi.CreateSnapshotResponse{
-			Snapshot: &csi.Snapshot{
-				SizeBytes:      volumeSnapshot.Size,
-				SnapshotId:     snapshotID,
-				SourceVolumeId: req.GetSourceVolumeId(),
-				CreationTime:   ptypes.TimestampNow(),
-				ReadyToUse:     true,
-			},
+			Snapshot: getCSISnapshot(snapshotID, req.GetSourceVolumeId(), volumeSnapshot.Size, volumeSnapshot.CreatedAt),
 		}, nil
 	}
 
@@ -429,14 +507,10 @@ func (fc *fcstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 		return
 	}
 
-	snapshotID = strconv.Itoa(snapshot.SnapShotID) + "$$" + volproto.StorageType
-	csiSnapshot := &csi.Snapshot{
-		SnapshotId:     snapshotID,
-		SourceVolumeId: req.GetSourceVolumeId(),
-		ReadyToUse:     true,
-		CreationTime:   ptypes.TimestampNow(),
-		SizeBytes:      snapshot.Size,
-	}
+	fc.cs.attachSnapshotMetadata(int64(snapshot.SnapShotID), req.GetParameters())
+
+	snapshotID = getSnapshotID(volproto, int64(snapshot.SnapShotID))
+	csiSnapshot := getCSISnapshot(snapshotID, req.GetSourceVolumeId(), snapshot.Size, snapshot.CreatedAt)
 	log.Debug("CreateFileSystemSnapshot resp() ", csiSnapshot)
 	snapshotResp := &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}
 	return snapshotResp, nil
@@ -449,8 +523,12 @@ func (fc *fcstorage) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshot
 		}
 	}()
 
-	snapshotID, _ := strconv.Atoi(req.GetSnapshotId())
-	err = fc.ValidateDeleteVolume(snapshotID)
+	snapproto, err := volumeid.ParseSnapshot(req.GetSnapshotId())
+	if err != nil {
+		log.Errorf("Invalid snapshot ID %v", err)
+		return &csi.DeleteSnapshotResponse{}, status.Error(codes.InvalidArgument, "Invalid snapshot ID")
+	}
+	err = fc.ValidateDeleteVolume(int(snapproto.ObjectID))
 	if err != nil {
 		log.Errorf("fail to delete snapshot %v", err)
 		return &csi.DeleteSnapshotResponse{}, err
@@ -511,11 +589,12 @@ func (fc *fcstorage) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 		}
 	}()
 
-	volumeID, err := strconv.Atoi(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("Invalid Volume ID %v", err)
 		return
 	}
+	volumeID := int(volproto.ObjectID)
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
@@ -10,6 +10,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (suite *FCControllerSuite) SetupTest() {
@@ -95,6 +97,28 @@ func (suite *FCControllerSuite) Test_CreateVolume_GetName_fail() {
 }
 
 
+func (suite *FCControllerSuite) Test_CreateVolume_VolumeExists() {
+	service := fcstorage{cs: *suite.cs}
+	parameterMap := getFCCreateVolumeParamter()
+	parameterMap["provision_type"] = "THIN"
+	crtValReq := getISCSICreateValumeRequest("PVName", parameterMap)
+	vol := getVolume()
+	vol.ParentId = 0
+	vol.PoolName = "pool_name1"
+	suite.api.On("GetVolumeByName", mock.Anything).Return(vol, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "existing volume should be returned")
+	assert.Equal(suite.T(), "v1$$storage_protocol1$$id=100", resp.GetVolume().GetVolumeId())
+	assert.Equal(suite.T(), "fstype1", resp.GetVolume().GetVolumeContext()["fstype"])
+
+	vol.ParentId = 1001
+	suite.api.ExpectedCalls = nil
+	suite.api.On("GetVolumeByName", mock.Anything).Return(vol, nil)
+	_, err = service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err), "existing volume is a clone")
+}
+
 func (suite *FCControllerSuite) Test_CreateVolume_CreateVolume_fail() {
 	service := fcstorage{cs: *suite.cs}
 	parameterMap := getFCCreateVolumeParamter()
@@ -130,6 +154,45 @@ func (suite *FCControllerSuite) Test_CreateVolume_CreateVolume_success() {
 	assert.Nil(suite.T(), err,"should not be nil" )
 }
 
+func (suite *FCControllerSuite) Test_CreateVolume_ExtraCreateMetadata() {
+	service := fcstorage{cs: *suite.cs}
+	parameterMap := getFCCreateVolumeParamter()
+	parameterMap[PVCNameParameter] = "data"
+	parameterMap[PVCNamespaceParameter] = "apps"
+	parameterMap[PVNameParameter] = "pvc-1234"
+	crtValReq := getISCSICreateValumeRequest("PVName", parameterMap)
+
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("CreateVolume", mock.Anything, mock.Anything).Return(getVolume(), nil)
+	suite.api.On("AttachMetadataToObject", int64(100), map[string]interface{}{
+		"host.k8s.pvname":        "pvc-1234",
+		"host.filesystem_type":   "fstype1",
+		"host.k8s.pvc_name":      "data",
+		"host.k8s.pvc_namespace": "apps",
+	}).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+}
+
+func (suite *FCControllerSuite) Test_CreateVolume_NameTemplate() {
+	service := fcstorage{cs: *suite.cs}
+	parameterMap := getFCCreateVolumeParamter()
+	parameterMap[KeyNameTemplate] = "{pvc_name}-{uuid}"
+	parameterMap[PVCNameParameter] = "data"
+	crtValReq := getISCSICreateValumeRequest("pvc-1234", parameterMap)
+
+	suite.api.On("GetVolumeByName", "data-1234").Return(nil, nil)
+	suite.api.On("CreateVolume", mock.Anything, mock.Anything).Return(getVolume(), nil)
+	suite.api.On("AttachMetadataToObject", int64(100), mock.MatchedBy(func(metadata map[string]interface{}) bool {
+		return metadata["host.k8s.pvname"] == "pvc-1234"
+	})).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "GetVolumeByName", "data-1234")
+}
+
 
 func (suite *FCControllerSuite) Test_CreateVolume_CreateVolume_metadataError() {
 	service := fcstorage{cs: *suite.cs}
@@ -208,6 +271,7 @@ func (suite *FCControllerSuite) Test_DeleteVolume_DeleteVolume_Error() {
 func (suite *FCControllerSuite) Test_DeleteVolume_DeleteVolume_success() {
 	service := fcstorage{cs: *suite.cs}
 	crtValReq := getISCSIDeleteRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	//expectedErr := errors.New("some Error")
 	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
 	suite.api.On("GetVolumeSnapshotByParentID", mock.Anything).Return([]api.Volume{}, nil)	
@@ -221,6 +285,7 @@ func (suite *FCControllerSuite) Test_DeleteVolume_DeleteVolume_success() {
 func (suite *FCControllerSuite) Test_DeleteVolume_DeleteVolume_AlreadyDelete() {
 	service := fcstorage{cs: *suite.cs}
 	crtValReq := getISCSIDeleteRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return(nil, errors.New("VOLUME_NOT_FOUND"))
 	expectedErr := errors.New("VOLUME_NOT_FOUND")
 	suite.api.On("GetVolume", mock.Anything).Return(nil, expectedErr)
 	
@@ -323,6 +388,28 @@ func (suite *FCControllerSuite) Test_UnControllerPublishVolume() {
 
 
 
+func (suite *FCControllerSuite) Test_UnControllerPublishVolume_OtherMappingRemains() {
+	service := fcstorage{cs: *suite.cs}
+	ctrUnPublishValReq := getISCSIControllerUnpublishVolume()
+	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
+	suite.api.On("UnMapVolumeFromHost", mock.Anything, mock.Anything).Return(nil)
+	suite.api.On("GetAllLunByHost", mock.Anything).Return([]api.LunInfo{{HostID: 10, VolumeID: 2, Lun: 2}}, nil)
+	_, err := service.ControllerUnpublishVolume(context.Background(), ctrUnPublishValReq)
+	assert.Nil(suite.T(), err, "controller unpublish for fc protocol")
+	suite.api.AssertNotCalled(suite.T(), "DeleteHost", mock.Anything)
+}
+
+func (suite *FCControllerSuite) Test_UnControllerPublishVolume_GetLunErr_KeepHost() {
+	service := fcstorage{cs: *suite.cs}
+	ctrUnPublishValReq := getISCSIControllerUnpublishVolume()
+	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
+	suite.api.On("UnMapVolumeFromHost", mock.Anything, mock.Anything).Return(nil)
+	suite.api.On("GetAllLunByHost", mock.Anything).Return(nil, errors.New("some Error"))
+	_, err := service.ControllerUnpublishVolume(context.Background(), ctrUnPublishValReq)
+	assert.Nil(suite.T(), err, "volume is unmapped")
+	suite.api.AssertNotCalled(suite.T(), "DeleteHost", mock.Anything)
+}
+
 func (suite *FCControllerSuite) Test_UnControllerPublishVolume_hostNameErr() {
 	service := fcstorage{cs: *suite.cs}
 	expectedErr := errors.New("some Error")
@@ -369,8 +456,9 @@ func (suite *FCControllerSuite) Test_CreateSnapshot() {
 	service := fcstorage{cs: *suite.cs}
 //	var parameterMap map[string]string
 	ctrUnPublishValReq := getISCSICreateSnapshotRequest()	
-	suite.api.On("GetVolumeByName", mock.Anything).Return(getVolume(), nil)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, errors.New("volume with given name not found"))
 	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("AttachMetadataToObject", int64(1000), map[string]interface{}{"host.created_by": suite.cs.GetCreatedBy()}).Return(nil, nil)
 	
 		_, err := service.CreateSnapshot(context.Background(), ctrUnPublishValReq)
 	assert.Nil(suite.T(), err, "Error should be notnil")
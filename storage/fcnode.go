@@ -150,8 +150,7 @@ func (fc *fcstorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 	var mpathDevice string
 	stagePath := req.GetStagingTargetPath()
 
-	volproto := strings.Split(req.GetVolumeId(), "$$")
-	volName := volproto[0]
+	volName := getVolumeName(req.GetVolumeId())
 
 	dskInfo := diskInfo{}
 	dskInfo.VolName = volName
@@ -253,8 +252,7 @@ func (fc *fcstorage) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReques
 
 func (fc *fcstorage) NodeGetVolumeStats(
 	ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return &csi.NodeGetVolumeStatsResponse{}, status.Error(codes.Unimplemented, time.Now().String())
-
+	return getVolumePathStats(req.GetVolumePath())
 }
 
 func (fc *fcstorage) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -274,10 +272,6 @@ func (fc *fcstorage) MountFCDisk(fm FCMounter, devicePath string) error {
 	}
 	if fm.fcDisk.isBlock {
 		log.Infof("Block volume will be mount at file %s", fm.TargetPath)
-		if fm.ReadOnly {
-			return status.Error(codes.Internal, "Read only is not supported for Block Volume")
-		}
-
 		if err := os.MkdirAll(filepath.Dir(fm.TargetPath), 0750); err != nil {
 			log.Errorf("fc: failed to mkdir %s, error", filepath.Dir(fm.TargetPath))
 			return err
@@ -290,7 +284,11 @@ func (fc *fcstorage) MountFCDisk(fm FCMounter, devicePath string) error {
 		}
 		devicePath = strings.Replace(devicePath, "/host", "", 1)
 		options := []string{"bind"}
-		options = append(options, "rw")
+		if fm.ReadOnly {
+			options = append(options, "ro")
+		} else {
+			options = append(options, "rw")
+		}
 		if err := fm.Mounter.Mount(devicePath, fm.TargetPath, "", options); err != nil {
 			log.Errorf("fc: failed to mount fc volume %s to %s, error %v", devicePath, fm.TargetPath, err)
 			return err
@@ -357,8 +355,7 @@ func (fc *fcstorage) getFCDiskDetails(req *csi.NodePublishVolumeRequest) (*fcDev
 			err = errors.New("Recovered from FC getFCDiskDetails " + fmt.Sprint(res))
 		}
 	}()
-	volproto := strings.Split(req.GetVolumeId(), "$$")
-	volName := volproto[0]
+	volName := getVolumeName(req.GetVolumeId())
 	lun := req.GetPublishContext()["lun"]
 	wwids := req.GetVolumeContext()["WWIDs"]
 	wwidList := strings.Split(wwids, ",")
@@ -396,7 +393,7 @@ func (fc *fcstorage) getFCDiskMounter(req *csi.NodePublishVolumeRequest, fcDetai
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 	return FCMounter{
 		fcDisk:       fcDetails,
-		ReadOnly:     false,
+		ReadOnly:     req.GetReadonly(),
 		FsType:       fstype,
 		MountOptions: mountOptions,
 		Mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()},
@@ -11,10 +11,13 @@ limitations under the License.*/
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
 	"infinibox-csi-driver/helper"
+	"os"
 	"path"
 	"strconv"
 	"strings"
@@ -22,6 +25,8 @@ import (
 
 	log "infinibox-csi-driver/helper/logger"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csictx "github.com/rexray/gocsi/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -37,8 +42,22 @@ const (
 
 	//Treeq count
 	TREEQCOUNT = "host.k8s.treeqs"
+
+	//TREEQSNAPSHOTREF metadata key prefix on filesystem snapshot, one key per treeq snapshot referencing it
+	TREEQSNAPSHOTREF = "host.k8s.treeq_snapshot."
+	//TREEQSNAPSHOTREUSE former snapshot class parameter sharing filesystem snapshots between treeq snapshots, ignored with a warning
+	TREEQSNAPSHOTREUSE = "treeq_snapshot_reuse_seconds"
+	//TREEQPOPULATING metadata key prefix on filesystem, set while a cloned or restored treeq is being populated
+	TREEQPOPULATING = "host.k8s.treeq_populating."
+	//TREEQPVC metadata key prefix on filesystem, namespace/name of the PVC of each treeq from the extra create metadata
+	TREEQPVC = "host.k8s.treeq_pvc."
+	//TREEQVOLUMESNAPSHOT metadata key prefix on filesystem snapshot, namespace/name of the VolumeSnapshot of each treeq snapshot
+	TREEQVOLUMESNAPSHOT = "host.k8s.treeq_volumesnapshot."
 )
 
+//treeqLookupWorkers maximum number of concurrent treeq lookups of checkTreeqName
+const treeqLookupWorkers = 8
+
 // service type
 const (
 	NFSTREEQ             = "nfs_treeq"
@@ -46,22 +65,22 @@ const (
 	TreeqUnixPermissions = "750"
 )
 
-//Operation declare for treeq count operation
-type ACTION int
+//TreeqLockEnv : "lease" to lock the treeq placement and counts with Kubernetes Leases of the POD_NAMESPACE namespace,
+//shared by the controller replicas, the locks are held in process otherwise
+const TreeqLockEnv = "TREEQ_LOCK"
 
-const (
-	//Increment operation
-	IncrementTreeqCount ACTION = 1 + iota
-	//decrement operation
-	DecrementTreeqCount
-	NONE
-)
+//treeqLocker Locker of the treeq placement and counts, created on first use
+var treeqLocker struct {
+	sync.Once
+	helper.Locker
+}
 
 //FilesystemService file system services
 type FilesystemService struct {
 	uniqueID  int64
 	configmap map[string]string // values from storage class
 	pVName    string
+	csiName   string // name of the PV, pVName is the one of the treeq on the array
 	capacity  int64
 
 	fileSystemID int64
@@ -70,11 +89,13 @@ type FilesystemService struct {
 	exportBlock  string
 	ipAddress    string
 
-	cs       commonservice
-	poolID   int64
-	treeqCnt int
+	cs     commonservice
+	poolID int64
+	locker helper.Locker
+	quota  treeqQuota
 
 	treeqVolume map[string]string
+	copier      TreeqDataCopier
 }
 
 func getFilesystemService(serviceType string, c commonservice) *FilesystemService {
@@ -82,6 +103,7 @@ func getFilesystemService(serviceType string, c commonservice) *FilesystemServic
 		return &FilesystemService{
 			cs:          c,
 			treeqVolume: make(map[string]string),
+			copier:      newNfsDataCopier(),
 		}
 	}
 	return nil
@@ -89,38 +111,67 @@ func getFilesystemService(serviceType string, c commonservice) *FilesystemServic
 
 //FileSystemInterface interface
 type FileSystemInterface interface {
+	setCSIName(csiName string)
 	validateTreeqParameters(config map[string]string) (bool, map[string]string)
 	CreateTreeqVolume(config map[string]string, capacity int64, pvName string) (map[string]string, error)
 	DeleteTreeqVolume(filesystemID, treeqID int64) error
 	UpdateTreeqVolume(filesystemID, treeqID, capacity int64, maxSize string) error
 	IsTreeqAlreadyExist(pool_name, network_space, pVName string) (treeqVolume map[string]string, err error)
+	CreateTreeqSnapshot(filesystemID, treeqID int64, snapshotName string, owner string) (*TreeqSnapshot, error)
+	DeleteTreeqSnapshot(fileSystemSnapshotID int64, snapshotName string) error
+	RestoreTreeqVolumeFromSnapshot(config map[string]string, capacity int64, pvName string, snapshot *TreeqSnapshot) (map[string]string, error)
+	CloneTreeqVolume(config map[string]string, capacity int64, pvName string, srcFilesystemID, srcTreeqID int64) (map[string]string, error)
+	VerifyTreeqPopulated(filesystemID, treeqID int64, pvName string) error
+	GetTreeqVolumeUsage(filesystemID, treeqID int64) ([]*csi.VolumeUsage, error)
 }
 
-func (filesystem *FilesystemService) checkTreeqName(FileSystemArry []api.FileSystem, pVName string) (treeqData *api.Treeq) {
-	type item struct {
-		treeq *api.Treeq
-		err   error
-	}
-	itmArry := []item{}
+//checkTreeqName return the treeq named pVName of one of the filesystems, looked up by at most treeqLookupWorkers
+//concurrent calls. A lookup failing for another reason than a missing treeq is returned as error, as the treeq
+//may exist on that filesystem and must not be created again
+func (filesystem *FilesystemService) checkTreeqName(fileSystemArry []api.FileSystem, pVName string) (treeqData *api.Treeq, err error) {
+	var mu sync.Mutex
 	var wg sync.WaitGroup
-	wg.Add(len(FileSystemArry))
+	found := make(chan struct{})
+	fileSystems := make(chan api.FileSystem)
 
-	for _, f := range FileSystemArry {
-		go func(f api.FileSystem) {
-			var it item
+	workers := treeqLookupWorkers
+	if len(fileSystemArry) < workers {
+		workers = len(fileSystemArry)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
 			defer wg.Done()
-			it.treeq, it.err = filesystem.cs.api.GetTreeqByName(f.ID, pVName)			
-			itmArry = append(itmArry, it)
-		}(f)
+			for f := range fileSystems {
+				treeq, lookupErr := filesystem.cs.api.GetTreeqByName(f.ID, pVName)
+				mu.Lock()
+				if lookupErr == nil && treeq != nil {
+					if treeqData == nil {
+						treeqData = treeq
+						close(found)
+					}
+				} else if lookupErr != nil && !strings.Contains(lookupErr.Error(), "treeq with given name not found") && err == nil {
+					log.Errorf("fail to get treeq %s of filesystem %d error %v", pVName, f.ID, lookupErr)
+					err = fmt.Errorf("fail to get treeq %s of filesystem %d: %v", pVName, f.ID, lookupErr)
+				}
+				mu.Unlock()
+			}
+		}()
 	}
-	wg.Wait()
-	for _, it := range itmArry {
-		if it.err == nil && it.treeq != nil {	
-			treeqData = it.treeq
-			return
+send:
+	for _, f := range fileSystemArry {
+		select {
+		case fileSystems <- f:
+		case <-found:
+			break send
 		}
-	}	
-	return
+	}
+	close(fileSystems)
+	wg.Wait()
+	if treeqData != nil {
+		return treeqData, nil
+	}
+	return nil, err
 }
 
 //IsTreeqAlreadyExist check the treeq exist or not
@@ -143,7 +194,11 @@ func (filesystem *FilesystemService) IsTreeqAlreadyExist(pool_name, network_spac
 		if fsMetaData != nil && len(fsMetaData.FileSystemArry) == 0 {
 			return
 		}
-		treeqData := filesystem.checkTreeqName(fsMetaData.FileSystemArry, pVName)
+		treeqData, lookupErr := filesystem.checkTreeqName(fsMetaData.FileSystemArry, pVName)
+		if lookupErr != nil {
+			err = lookupErr
+			return
+		}
 		if treeqData != nil {
 			exportErr := filesystem.getExportPath(treeqData.FilesystemID) //fetch export path and set to filesystem exportPath
 			if exportErr != nil {
@@ -160,6 +215,7 @@ func (filesystem *FilesystemService) IsTreeqAlreadyExist(pool_name, network_spac
 			treeqVolume["TREEQID"] = strconv.FormatInt(treeqData.ID, 10)
 			treeqVolume["ipAddress"] = filesystem.ipAddress
 			treeqVolume["volumePath"] = path.Join(filesystem.exportpath, treeqData.Path)
+			treeqVolume[treeqCapacityKey] = strconv.FormatInt(treeqData.HardCapacity, 10)
 			return
 		}		
 		//inner for loop closed
@@ -179,6 +235,8 @@ func (filesystem *FilesystemService) getExpectedFileSystemID(maxFileSystemSize i
 		err = errors.New("Request treeq size is greater than allowed max_filesystem_size")
 		return
 	}	
+	placement := filesystem.getPlacement()
+	candidates := []treeqCandidate{}
 	page := 1	
 	for {
 		fsMetaData, poolErr := filesystem.cs.api.GetFileSystemsByPoolID(filesystem.poolID, page)
@@ -189,37 +247,52 @@ func (filesystem *FilesystemService) getExpectedFileSystemID(maxFileSystemSize i
 		}
 		if fsMetaData != nil && len(fsMetaData.FileSystemArry) == 0 {
 			log.Debugf("NO filesystem found.filesystem array is empty")
-			return
+			break
 		}
 		for _, fs := range fsMetaData.FileSystemArry {
 			if fs.Size+filesystem.capacity < maxFileSystemSize {
-				treeqCnt, treeqCnterr := filesystem.cs.api.GetFilesytemTreeqCount(fs.ID)
+				treeqCnt, usedCapacity, treeqCnterr := filesystem.getTreeqUsage(fs.ID, placement)
 				if treeqCnterr != nil {
-					log.Errorf("fail to get treeq count of filesystemID %d error %v", fs.ID, err)
+					log.Errorf("fail to get treeq count of filesystemID %d error %v", fs.ID, treeqCnterr)
 					err = errors.New("fail to get treeq count of filesystemID " + strconv.FormatInt(fs.ID, 10))
 					return
 				}
 				if treeqCnt < filesystem.getAllowedCount(MAXTREEQSPERFILESYSTEM) {
-					filesystem.treeqCnt = treeqCnt
-					log.Debugf("filesystem found to create treeQ,filesystemID %d", fs.ID)
-					exportErr := filesystem.getExportPath(fs.ID) //fetch export path and set to filesystem exportPath
-					if exportErr != nil {
-						err = exportErr
+					if !filesystem.isExportedWithNfsVersion(fs.ID) {
+						log.Debugf("filesystem %d is not exported with NFS version %s", fs.ID, filesystem.configmap[KeyNfsVersion])
+						continue
+					}
+					candidates = append(candidates, treeqCandidate{fileSystem: fs, treeqs: treeqCnt, usedCapacity: usedCapacity})
+					if placement == PlacementFirstFit {
+						break
 					}
-					filesys = &fs
-					return
 				}
 			}
 		} //inner for loop closed
-		if fsMetaData.Filemetadata.PagesTotal == fsMetaData.Filemetadata.Page {
+		if (placement == PlacementFirstFit && len(candidates) > 0) || fsMetaData.Filemetadata.PagesTotal == fsMetaData.Filemetadata.Page {
 			break
 		}	
 		page++ //check the file system on next page
 	} //outer for loop closed
-	log.Debugf("NO filesystem found to create treeQ")
+	candidate := selectTreeqCandidate(placement, filesystem.poolID, candidates)
+	if candidate == nil {
+		log.Debugf("NO filesystem found to create treeQ")
+		return
+	}
+	log.Debugf("filesystem found to create treeQ,filesystemID %d placement %s", candidate.fileSystem.ID, placement)
+	exportErr := filesystem.getExportPath(candidate.fileSystem.ID) //fetch export path and set to filesystem exportPath
+	if exportErr != nil {
+		err = exportErr
+	}
+	filesys = &candidate.fileSystem
 	return
 }
 
+//setCSIName set the name of the PV the filesystem created for its treeq is tagged with
+func (filesystem *FilesystemService) setCSIName(csiName string) {
+	filesystem.csiName = csiName
+}
+
 func (filesystem *FilesystemService) setParameter(config map[string]string, capacity int64, pvName string) {
 	filesystem.pVName = pvName
 	filesystem.configmap = config
@@ -227,10 +300,57 @@ func (filesystem *FilesystemService) setParameter(config map[string]string, capa
 	filesystem.exportpath = "/" + filesystem.pVName
 }
 
-var createMutex sync.Mutex
+//getLocker return the Locker of the treeq placement and counts
+func (filesystem *FilesystemService) getLocker() helper.Locker {
+	if filesystem.locker != nil {
+		return filesystem.locker
+	}
+	return populateLocker()
+}
+
+//populateLocker return the Locker shared by the driver replicas, of the treeqs and of the volumes being populated
+func populateLocker() helper.Locker {
+	treeqLocker.Do(func() {
+		treeqLocker.Locker = newTreeqLocker()
+	})
+	return treeqLocker.Locker
+}
+
+func newTreeqLocker() helper.Locker {
+	if lockType, _ := csictx.LookupEnv(context.Background(), TreeqLockEnv); lockType != "lease" {
+		return helper.NewProcessLocker()
+	}
+	namespace, _ := csictx.LookupEnv(context.Background(), "POD_NAMESPACE")
+	identity, _ := csictx.LookupEnv(context.Background(), "POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	locker, err := clientgo.NewLeaseLocker(namespace, identity)
+	if err != nil {
+		log.Errorf("fail to lock treeqs with leases, locking them in process error %v", err)
+		return helper.NewProcessLocker()
+	}
+	log.Infof("treeqs locked with leases of namespace %s held by %s", namespace, identity)
+	return locker
+}
+
+//treeqPoolLock name of the lock of the treeq placement in a pool
+func treeqPoolLock(poolID int64) string {
+	return "treeq-pool-" + strconv.FormatInt(poolID, 10)
+}
+
+//treeqFileSystemLock name of the lock of the treeqs of a filesystem
+func treeqFileSystemLock(fileSystemID int64) string {
+	return "treeq-filesystem-" + strconv.FormatInt(fileSystemID, 10)
+}
 
 //CreateTreeqVolume create volumne method
 func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string, capacity int64, pvName string) (treeqVolume map[string]string, err error) {
+	return filesystem.createTreeqVolume(config, capacity, pvName, false)
+}
+
+//createTreeqVolume create the treeq, populating marks it with TREEQPOPULATING before it is created
+func (filesystem *FilesystemService) createTreeqVolume(config map[string]string, capacity int64, pvName string, populating bool) (treeqVolume map[string]string, err error) {
 
 	defer func() {
 		if res := recover(); res != nil {
@@ -241,6 +361,11 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	treeqVolume["storage_protocol"] = config["storage_protocol"]
 	treeqVolume["nfs_mount_options"] = config["nfs_mount_options"]
 	filesystem.setParameter(config, capacity, pvName)
+	filesystem.quota, err = getTreeqQuota(config, capacity)
+	if err != nil {
+		log.Errorf("fail to get treeq quota %v", err)
+		return
+	}
 
 	ipAddress, err := filesystem.cs.getNetworkSpaceIP(strings.Trim(config["network_space"], " "))
 	if err != nil {
@@ -248,6 +373,11 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 		return
 	}
 	filesystem.ipAddress = ipAddress
+	err = filesystem.cs.validateNetworkSpaceNfsVersion(strings.Trim(config["network_space"], " "), config[KeyNfsVersion])
+	if err != nil {
+		log.Errorf("fail to validate nfs version %v", err)
+		return
+	}
 
 	var poolID int64
 	poolID, err = filesystem.cs.api.GetStoragePoolIDByName(filesystem.configmap["pool_name"])
@@ -264,8 +394,12 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	}
 
 	var filesys *api.FileSystem
-	helper.GetMutex().Mutex.Lock()
-	defer helper.GetMutex().Mutex.Unlock()
+	unlockPool, err := filesystem.getLocker().Lock(treeqPoolLock(poolID))
+	if err != nil {
+		log.Errorf("fail to lock treeq placement of pool %d error %v", poolID, err)
+		return
+	}
+	defer unlockPool()
 
 	filesys, err=filesystem.getExpectedFileSystemID(maxFileSystemSize)	
 	if err != nil {
@@ -288,11 +422,36 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	} else {
 		filesystemID = filesys.ID
 	}
-	
+	unlockFileSystem, err := filesystem.getLocker().Lock(treeqFileSystemLock(filesystemID))
+	if err != nil {
+		log.Errorf("fail to lock treeqs of filesystem %d error %v", filesystemID, err)
+		return
+	}
+	defer unlockFileSystem()
+
+	// a treeq to populate is never seen without its marker, even when the driver stops right after creating it
+	if populating {
+		metadata := make(map[string]interface{})
+		metadata[TREEQPOPULATING+filesystem.pVName] = "true"
+		_, err = filesystem.cs.api.AttachMetadataToObject(filesystemID, metadata)
+		if err != nil {
+			log.Errorf("fail to mark treeq %s as populating error %v", filesystem.pVName, err)
+			if filesys == nil {
+				if deleteFilesystemErr := filesystem.cs.api.DeleteFileSystemComplete(filesystemID); deleteFilesystemErr != nil {
+					log.Errorf("fail to delete filesystem ,filesystemID = %d", filesystemID)
+				}
+			}
+			return
+		}
+	}
+
 	//create treeq
 	treeqResponse, createTreeqerr := filesystem.cs.api.CreateTreeq(filesystemID, filesystem.getTreeParameters())
 	if createTreeqerr != nil {
 		log.Errorf("fail to create treeq  %s error %v", filesystem.pVName, err)
+		if populating && filesys != nil {
+			filesystem.cs.api.DeleteMetadataKey(filesystemID, TREEQPOPULATING+filesystem.pVName)
+		}
 		if filesys == nil { //if the file system created at the time of creating first treeq ,then delete the complete filesystem with export and metata
 			deleteFilesystemErr := filesystem.cs.api.DeleteFileSystemComplete(filesystemID)
 			if deleteFilesystemErr != nil {
@@ -306,35 +465,39 @@ func (filesystem *FilesystemService) CreateTreeqVolume(config map[string]string,
 	treeqVolume["TREEQID"] = strconv.FormatInt(treeqResponse.ID, 10)
 	treeqVolume["ipAddress"] = filesystem.ipAddress
 	treeqVolume["volumePath"] = path.Join(filesystem.exportpath, treeqResponse.Path)
+	treeqVolume[treeqCapacityKey] = strconv.FormatInt(treeqResponse.HardCapacity, 10)
 
-	//if AttachMetadataToObject - fail to add metadata then delete the created treeq
+	//if a later step fails then delete the created treeq and count the treeqs again
 	defer func() {
 		if res := recover(); res != nil {
 			err = errors.New("error while update metadata" + fmt.Sprint(res))
 		}
-		if err != nil && filesystem.fileSystemID != 0 {
+		if err != nil {
 			log.Infof("Seemes to be some problem reverting treeq: %s", filesystem.pVName)
-			filesystem.cs.api.DeleteTreeq(filesystem.fileSystemID, treeqResponse.ID)
+			filesystem.cs.api.DeleteTreeq(filesystemID, treeqResponse.ID)
+			if populating {
+				filesystem.cs.api.DeleteMetadataKey(filesystemID, TREEQPOPULATING+filesystem.pVName)
+			}
+			if _, countErr := filesystem.updateTreeqCount(filesystemID); countErr != nil {
+				log.Errorf("fail to update treeq count of filesystem %d error %v", filesystemID, countErr)
+			}
 		}
 	}()
 
-	treeqCount := filesystem.treeqCnt + 1
-	_, updateTreeqErr := filesystem.UpdateTreeqCnt(filesystemID, NONE, treeqCount)
-	if updateTreeqErr != nil {
-		err = errors.New("fail to increment treeq count as metadata")
+	if _, err = filesystem.updateTreeqCount(filesystemID); err != nil {
+		err = errors.New("fail to update treeq count as metadata")
 		return
 	}
 
-	//if UpdateFilesystem - is fail then descrement the tree count from metadata
-	defer func() {
-		if res := recover(); res != nil {
-			err = errors.New("error while update file size" + fmt.Sprint(res))
-		}
-		if err != nil && filesystemID != 0 {
-			log.Infof("Seemes to be some problem reverting treeqcount")
-			filesystem.UpdateTreeqCnt(filesystemID, DecrementTreeqCount, 0)
+	if owner := getCreateMetadataOwner(config); owner != "" {
+		metadata := make(map[string]interface{})
+		metadata[TREEQPVC+filesystem.pVName] = owner
+		_, err = filesystem.cs.api.AttachMetadataToObject(filesystemID, metadata)
+		if err != nil {
+			log.Errorf("fail to attach pvc %s of treeq %s error %v", owner, filesystem.pVName, err)
+			return
 		}
-	}()
+	}
 
 	// if new file system is created ,while creating the treeq, then not need to update size
 	if filesys != nil {
@@ -378,7 +541,7 @@ func (filesystem *FilesystemService) createExportPathAndAddMetadata() (err error
 		}
 	}()
 	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = filesystem.pVName
+	metadata["host.k8s.pvname"] = filesystem.csiName
 	metadata["host.created_by"] = filesystem.cs.GetCreatedBy()
 
 	_, err = filesystem.cs.api.AttachMetadataToObject(filesystem.fileSystemID, metadata)
@@ -412,13 +575,9 @@ func (filesystem *FilesystemService) createFileSystem() (err error) {
 	mapRequest := make(map[string]interface{})
 	mapRequest["pool_id"] = filesystem.poolID
 
-	var treeqFileSystemName string
-
-	pvSplit := strings.Split(filesystem.pVName, "-")
-	treeqFileSystemName = "csit_" + pvSplit[1]
-
+	treeqFileSystemName := "csit_" + nameUUID(filesystem.pVName)
 	if prefix, ok := filesystem.configmap[FSPREFIX]; ok {
-		treeqFileSystemName = prefix + pvSplit[1]
+		treeqFileSystemName = prefix + nameUUID(filesystem.pVName)
 	}
 	filesystem.exportpath = "/" + treeqFileSystemName
 	mapRequest["name"] = treeqFileSystemName
@@ -435,19 +594,19 @@ func (filesystem *FilesystemService) createFileSystem() (err error) {
 	return
 }
 
-func (filesystem *FilesystemService) createExportPath() (err error) {
-	permissionsMapArray, err := getPermission(filesystem.configmap["nfs_export_permissions"])
+func buildExportPermissions(permission string) (permissionsput []map[string]interface{}, err error) {
+	permissionsMapArray, err := getPermission(permission)
 	if err != nil {
 		return
 	}
-	var permissionsput []map[string]interface{}
 	for _, pass := range permissionsMapArray {
 		access := pass["access"].(string)
 		var rootsq bool
 		_, ok := pass["no_root_squash"].(string)
 		if ok {
-			rootsq, err = strconv.ParseBool(pass["no_root_squash"].(string))
-			if err != nil {
+			var parseErr error
+			rootsq, parseErr = strconv.ParseBool(pass["no_root_squash"].(string))
+			if parseErr != nil {
 				log.Debug("fail to cast no_root_squash value in export permission . setting default value 'true' ")
 				rootsq = true
 			}
@@ -457,9 +616,24 @@ func (filesystem *FilesystemService) createExportPath() (err error) {
 		client := pass["client"].(string)
 		permissionsput = append(permissionsput, map[string]interface{}{"access": access, "no_root_squash": rootsq, "client": client})
 	}
+	return
+}
+
+func (filesystem *FilesystemService) createExportPath() (err error) {
+	permissionsput, err := buildExportPermissions(filesystem.configmap["nfs_export_permissions"])
+	if err != nil {
+		return
+	}
+	//the filesystem is shared by the treeqs, only the root squash of the storage class applies
+	squashExportPermissions(permissionsput, filesystem.configmap, "")
 	var exportFileSystem api.ExportFileSys
 	exportFileSystem.FilesystemID = filesystem.fileSystemID
 	exportFileSystem.Transport_protocols = "TCP"
+	if nfsVersion := filesystem.configmap[KeyNfsVersion]; nfsVersion != "" {
+		exportFileSystem.Nfs_versions = []string{nfsExportVersions[nfsVersion]}
+	}
+	exportFileSystem.Anonymous_uid, _ = strconv.Atoi(filesystem.configmap[KeyNfsAnonymousUID])
+	exportFileSystem.Anonymous_gid, _ = strconv.Atoi(filesystem.configmap[KeyNfsAnonymousGID])
 	exportFileSystem.Privileged_port = true
 	exportFileSystem.Export_path = filesystem.exportpath
 	exportFileSystem.Permissionsput = append(exportFileSystem.Permissionsput, permissionsput...)
@@ -550,6 +724,7 @@ func (filesystem *FilesystemService) getTreeParameters() map[string]interface{}
 	treeqParameter["path"] = path.Join("/", filesystem.pVName)
 	treeqParameter["name"] = filesystem.pVName
 	treeqParameter["hard_capacity"] = filesystem.capacity
+	filesystem.quota.addParameters(treeqParameter)
 	return treeqParameter
 }
 
@@ -576,6 +751,20 @@ func (filesystem *FilesystemService) getExportPath(filesystemID int64) error {
 	return nil
 }
 
+//isExportedWithNfsVersion check the filesystem export serves the nfs_version of the storage class
+func (filesystem *FilesystemService) isExportedWithNfsVersion(filesystemID int64) bool {
+	nfsVersion := filesystem.configmap[KeyNfsVersion]
+	if nfsVersion == "" {
+		return true
+	}
+	exportResponse, err := filesystem.cs.api.GetExportByFileSystem(filesystemID)
+	if err != nil || exportResponse == nil || len(*exportResponse) == 0 {
+		log.Errorf("fail to get export of filesystem %d error %v", filesystemID, err)
+		return false
+	}
+	return exportHasNfsVersion((*exportResponse)[0].NfsVersions, nfsVersion)
+}
+
 func isTreeQEmpty(treeq api.Treeq) bool {
 	if treeq.UsedCapacity > 0 {
 		return false
@@ -583,8 +772,6 @@ func isTreeQEmpty(treeq api.Treeq) bool {
 	return true
 }
 
-var deleteMutex sync.Mutex
-
 //DeleteNFSVolume delete volume method
 func (filesystem *FilesystemService) DeleteTreeqVolume(filesystemID, treeqID int64) (err error) {
 
@@ -613,51 +800,53 @@ func (filesystem *FilesystemService) DeleteTreeqVolume(filesystemID, treeqID int
 		return
 	}
 
-	//3 first decremnt the treeq count to recover
-	// In case of 1 - we are deleting the file system,
-	deleteMutex.Lock()
-	defer deleteMutex.Unlock()
-
-	treeqCnt, err := filesystem.UpdateTreeqCnt(filesystemID, DecrementTreeqCount, 0)
+	//3.lock the treeqs of the filesystem, a treeq may be created on it meanwhile
+	unlock, err := filesystem.getLocker().Lock(treeqFileSystemLock(filesystemID))
 	if err != nil {
-		log.Error("fail to update treeq count")
+		log.Errorf("fail to lock treeqs of filesystem %d error %v", filesystemID, err)
 		return
 	}
+	defer unlock()
+
 	//4.delete the treeq
 	_, err = filesystem.cs.api.DeleteTreeq(filesystemID, treeqID)
 	if err != nil {
 		log.Error("fail to delete treeq")
-		filesystem.UpdateTreeqCnt(filesystemID, IncrementTreeqCount, 0)
 		return
 	}
 
 	//5.Delete file system if all treeq are delete
+	treeqCnt, err := filesystem.cs.api.GetFilesytemTreeqCount(filesystemID)
+	if err != nil {
+		log.Errorf("fail to get treeq count of filesystem %d error %v", filesystemID, err)
+		return
+	}
 	if treeqCnt == 0 { // measn all tree are delete. then delete the complete filesystem with exportPath ,metadata..etc
 		err = filesystem.cs.api.DeleteFileSystemComplete(filesystemID)
 		if err != nil {
 			log.Errorf("fail to delete filesystem filesystemID %d error %v", filesystemID, err)
 			return
 		}
+		log.Debug("Treeq deleted successfully")
+		return
+	}
+	if _, metadataErr := filesystem.cs.api.AttachMetadataToObject(filesystemID, map[string]interface{}{TREEQCOUNT: treeqCnt}); metadataErr != nil {
+		log.Warnf("fail to update treeq count of filesystem %d error %v", filesystemID, metadataErr)
+	}
+	if metadataErr := filesystem.cs.api.DeleteMetadataKey(filesystemID, TREEQPVC+treeq.Name); metadataErr != nil && !strings.Contains(metadataErr.Error(), "NOT_FOUND") {
+		log.Warnf("fail to remove pvc of treeq %s from filesystem %d error %v", treeq.Name, filesystemID, metadataErr)
 	}
 	log.Debug("Treeq deleted successfully")
 	return
 }
 
-//UpdateTreeqCnt method
-func (filesystem *FilesystemService) UpdateTreeqCnt(fileSystemID int64, action ACTION, treeqCnt int) (treeqCount int, err error) {
-	if treeqCnt == 0 {
-		treeqCnt, err = filesystem.cs.api.GetFilesytemTreeqCount(fileSystemID)
-		if err != nil {
-			return
-		}
-		log.Debugf("treeq count of fileSystemID: %d", fileSystemID)
-	}
-
-	switch action {
-	case IncrementTreeqCount:
-		treeqCnt++
-	case DecrementTreeqCount:
-		treeqCnt--
+//updateTreeqCount count the treeqs of the filesystem from its treeq list and record the count as its TREEQCOUNT
+//metadata, which also tells the orphan reconcile the filesystem holds treeqs
+func (filesystem *FilesystemService) updateTreeqCount(fileSystemID int64) (treeqCnt int, err error) {
+	treeqCnt, err = filesystem.cs.api.GetFilesytemTreeqCount(fileSystemID)
+	if err != nil {
+		log.Errorf("fail to get treeq count of fileSystemID: %d error %v", fileSystemID, err)
+		return
 	}
 	metadataParamter := make(map[string]interface{})
 	metadataParamter[TREEQCOUNT] = treeqCnt
@@ -666,9 +855,7 @@ func (filesystem *FilesystemService) UpdateTreeqCnt(fileSystemID int64, action A
 		log.Errorf("Error occured updating treeq count to filesystemID : %d error %v", fileSystemID, err)
 		return
 	}
-
-	treeqCount = treeqCnt
-	log.Debugf("treeq count updated successfully of fileSystemID: %d", fileSystemID)
+	log.Debugf("treeq count %d updated successfully of fileSystemID: %d", treeqCnt, fileSystemID)
 	return
 }
 
@@ -734,8 +921,11 @@ func (filesystem *FilesystemService) UpdateTreeqVolume(filesystemID, treeqID, ca
 		}
 	}
 
-	// Expand Treeq size
+	// Expand Treeq size, the soft capacity keeps its ratio to the hard capacity
 	body := map[string]interface{}{"hard_capacity": capacity}
+	if softCapacity := scaledSoftCapacity(treeq, capacity); softCapacity > 0 {
+		body["soft_capacity"] = softCapacity
+	}
 	_, err = filesystem.cs.api.UpdateTreeq(filesystemID, treeqID, body)
 	if err != nil {
 		log.Errorf("Failed to update treeq size %v", err)
@@ -745,3 +935,21 @@ func (filesystem *FilesystemService) UpdateTreeqVolume(filesystemID, treeqID, ca
 	log.Infoln("Treeq size updated successfully")
 	return
 }
+
+//GetTreeqVolumeUsage return the usage of the quota of the treeq
+func (filesystem *FilesystemService) GetTreeqVolumeUsage(filesystemID, treeqID int64) (usage []*csi.VolumeUsage, err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while getting treeq usage " + fmt.Sprint(res))
+		}
+	}()
+	treeq, err := filesystem.cs.api.GetTreeq(filesystemID, treeqID)
+	if err != nil {
+		log.Errorf("fail to get treeq %d of filesystem %d error %v", treeqID, filesystemID, err)
+		if strings.Contains(err.Error(), "TREEQ_ID_DOES_NOT_EXIST") {
+			return nil, status.Errorf(codes.NotFound, "treeq %d of filesystem %d not found", treeqID, filesystemID)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return getTreeqVolumeUsage(treeq), nil
+}
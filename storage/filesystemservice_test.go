@@ -14,12 +14,17 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (suite *FileSystemServiceSuite) SetupTest() {
@@ -134,7 +139,8 @@ func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_Success() {
 	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(*metadataResp, nil)
 
 	suite.api.On("UpdateFilesystem", fsID, mock.Anything).Return(nil, nil)
-	service := FilesystemService{cs: *suite.cs}
+	locker := &recordingLocker{}
+	service := FilesystemService{cs: *suite.cs, locker: locker}
 	// paramter values to filesystemService
 	var capacity int64 = 1000
 	pVName := "csi-TestTreeq"
@@ -143,7 +149,73 @@ func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_Success() {
 
 	_, err := service.CreateTreeqVolume(configMap, capacity, pVName)
 	assert.Nil(suite.T(), err, "empty object")
+	assert.Equal(suite.T(), []string{"treeq-pool-10", "treeq-filesystem-11"}, locker.locked, "pool and filesystem should be locked")
+	assert.Equal(suite.T(), 0, locker.held, "locks should be released")
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", fsID, map[string]interface{}{TREEQCOUNT: 1})
+}
+
+func (suite *FileSystemServiceSuite) Test_createTreeqVolume_Populating() {
+	fsMetada := getfsMetadata2()
+	var poolID int64 = 10
+	var fsID int64 = 11
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getnetworkspace(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(*fsMetada, nil)
+	suite.api.On("GetFilesytemTreeqCount", fsID).Return(1, nil)
+	suite.api.On("GetExportByFileSystem", fsID).Return(getExportResponse(), nil)
+	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(*getMetadaResponse(), nil)
+	suite.api.On("CreateTreeq", fsID, mock.Anything).Return(*getTreeQResponse(fsID), nil).Run(func(args mock.Arguments) {
+		suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", fsID, map[string]interface{}{TREEQPOPULATING + "csi-TestTreeq": "true"})
+	})
+	suite.api.On("UpdateFilesystem", fsID, mock.Anything).Return(nil, nil)
+	service := FilesystemService{cs: *suite.cs, locker: &recordingLocker{}}
+
+	_, err := service.createTreeqVolume(map[string]string{"network_space": "networkspace"}, 1000, "csi-TestTreeq", true)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "CreateTreeq", fsID, mock.Anything)
+}
 
+func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_Quota() {
+	var poolID int64 = 10
+	var fsID int64 = 11
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getnetworkspace(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(*getfsMetadata2(), nil)
+	suite.api.On("GetFilesytemTreeqCount", fsID).Return(1, nil)
+	suite.api.On("GetExportByFileSystem", fsID).Return(getExportResponse(), nil)
+	treeqResp := getTreeQResponse(fsID)
+	treeqResp.HardCapacity = 2000
+	suite.api.On("CreateTreeq", fsID, mock.Anything).Return(*treeqResp, nil)
+	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(*getMetadaResponse(), nil)
+	suite.api.On("UpdateFilesystem", fsID, mock.Anything).Return(nil, nil)
+	service := FilesystemService{cs: *suite.cs, locker: &recordingLocker{}}
+	configMap := map[string]string{
+		"network_space":          "networkspace",
+		TREEQSOFTCAPACITY:        "90%",
+		TREEQHARDINODES:          "1000",
+		TREEQSOFTINODES:          "800",
+		TREEQCAPACITYGRACEPERIOD: "24h",
+	}
+
+	treeqVolume, err := service.CreateTreeqVolume(configMap, 2000, "csi-TestTreeq")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "2000", treeqVolume[treeqCapacityKey], "applied capacity expected")
+	suite.api.AssertCalled(suite.T(), "CreateTreeq", fsID, map[string]interface{}{
+		"path":                  "/csi-TestTreeq",
+		"name":                  "csi-TestTreeq",
+		"hard_capacity":         int64(2000),
+		"soft_capacity":         int64(1800),
+		"hard_inodes":           int64(1000),
+		"soft_inodes":           int64(800),
+		"capacity_grace_period": int64(86400),
+	})
+}
+
+func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_Quota_Invalid() {
+	service := FilesystemService{cs: *suite.cs}
+	_, err := service.CreateTreeqVolume(map[string]string{TREEQSOFTCAPACITY: "3000"}, 2000, "csi-TestTreeq")
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+	suite.api.AssertNotCalled(suite.T(), "GetNetworkSpaceByName", mock.Anything)
 }
 
 func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_FileSystemCount_Error() {
@@ -209,6 +281,26 @@ func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_CreateFilesystem_Err
 	assert.NotNil(suite.T(), err, "fail to get filecount")
 }
 
+func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_NameWithoutDash() {
+	var fsMetada api.FSMetadata
+	var poolID int64 = 10
+	expectedErr := errors.New("some error")
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getnetworkspace(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(fsMetada, nil)
+	suite.api.On("GetFileSystemCountByPoolID", mock.Anything).Return(200, nil)
+	suite.api.On("CreateFilesystem", mock.Anything).Return(nil, expectedErr)
+
+	service := FilesystemService{cs: *suite.cs}
+	configMap := map[string]string{"network_space": "networkspace"}
+	_, err := service.CreateTreeqVolume(configMap, 1000, "TestTreeq")
+	assert.NotNil(suite.T(), err, "create filesystem error expected")
+	suite.api.AssertCalled(suite.T(), "CreateFilesystem", mock.MatchedBy(func(request map[string]interface{}) bool {
+		return request["name"] == "csit_TestTreeq"
+	}))
+}
+
 func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_ExportFileSystem_Error() {
 	var fsMetada api.FSMetadata
 	var poolID int64 = 10
@@ -288,50 +380,33 @@ func (suite *FileSystemServiceSuite) Test_CreateTreeqVolume_CreateTreeq_Error()
 	assert.NotNil(suite.T(), err, "fail to get filecount")
 }
 
-func (suite *FileSystemServiceSuite) Test_UpdateTreeqCnt_Success1() {
+func (suite *FileSystemServiceSuite) Test_updateTreeqCount_Success() {
 	var fsID int64 = 11
-	expectedCnt := 10
-	currentTreeqCnt := 9
 	metadataResp := getMetadaResponse()
-	suite.api.On("GetFilesytemTreeqCount", fsID).Return(currentTreeqCnt, nil)
-	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(*metadataResp, nil)
-	service := FilesystemService{cs: *suite.cs}
-	cnt, err := service.UpdateTreeqCnt(fsID, IncrementTreeqCount, 0)
-	assert.Nil(suite.T(), err, "empty object")
-	assert.Equal(suite.T(), expectedCnt, cnt, "treeq count shoude be same")
-}
-
-func (suite *FileSystemServiceSuite) Test_UpdateTreeqCnt_Success2() {
-	var fsID int64 = 11
-	expectedCnt := 10
-	currentTreeqCnt := 9
-	metadataResp := getMetadaResponse()
-	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(*metadataResp, nil)
+	suite.api.On("GetFilesytemTreeqCount", fsID).Return(10, nil)
+	suite.api.On("AttachMetadataToObject", fsID, map[string]interface{}{TREEQCOUNT: 10}).Return(*metadataResp, nil)
 	service := FilesystemService{cs: *suite.cs}
-	cnt, err := service.UpdateTreeqCnt(fsID, IncrementTreeqCount, currentTreeqCnt)
+	cnt, err := service.updateTreeqCount(fsID)
 	assert.Nil(suite.T(), err, "empty object")
-	assert.Equal(suite.T(), expectedCnt, cnt, "treeq count shoude be same")
+	assert.Equal(suite.T(), 10, cnt, "treeq count should come from the treeq list")
 }
 
-func (suite *FileSystemServiceSuite) Test_UpdateTreeqCnt_Error1() {
+func (suite *FileSystemServiceSuite) Test_updateTreeqCount_Error1() {
 	var fsID int64 = 11
-	//expectedCnt := 10
-	currentTreeqCnt := 9
 	expectedErr := errors.New("some error")
+	suite.api.On("GetFilesytemTreeqCount", fsID).Return(9, nil)
 	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, expectedErr)
 	service := FilesystemService{cs: *suite.cs}
-	_, err := service.UpdateTreeqCnt(fsID, IncrementTreeqCount, currentTreeqCnt)
+	_, err := service.updateTreeqCount(fsID)
 	assert.NotNil(suite.T(), err, "err should not be nil")
 
 }
-func (suite *FileSystemServiceSuite) Test_UpdateTreeqCnt_Error2() {
+func (suite *FileSystemServiceSuite) Test_updateTreeqCount_Error2() {
 	var fsID int64 = 11
-	//expectedCnt := 10
-	//currentTreeqCnt := 9
 	expectedErr := errors.New("some error")
 	suite.api.On("GetFilesytemTreeqCount", fsID).Return(nil, expectedErr)
 	service := FilesystemService{cs: *suite.cs}
-	_, err := service.UpdateTreeqCnt(fsID, IncrementTreeqCount, 0)
+	_, err := service.updateTreeqCount(fsID)
 	assert.NotNil(suite.T(), err, "err should not be nil")
 
 }
@@ -375,24 +450,28 @@ func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_TreeqCount_fail() {
 	expectedResponse := getTreeQResponse(fsID)
 	expectedResponse.UsedCapacity = 0
 	suite.api.On("GetTreeq", fsID, treeqID).Return(*expectedResponse, nil)
+	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, nil)
 	suite.api.On("GetFilesytemTreeqCount", fsID).Return(0, expectedErr)
 	service := FilesystemService{cs: *suite.cs}
 	err := service.DeleteTreeqVolume(fsID, treeqID)
 	assert.NotNil(suite.T(), err, "empty object")
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystemComplete", fsID)
 }
 
-func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_TreeqCount_fail2() {
+func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_TreeqCount_metadata_fail() {
 	var fsID int64 = 11
 	var treeqID int64 = 10
 	expectedErr := errors.New("some other error")
 	expectedResponse := getTreeQResponse(fsID)
 	expectedResponse.UsedCapacity = 0
 	suite.api.On("GetTreeq", fsID, treeqID).Return(*expectedResponse, nil)
+	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, nil)
 	suite.api.On("GetFilesytemTreeqCount", fsID).Return(10, nil)
 	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, expectedErr)
+	suite.api.On("DeleteMetadataKey", fsID, TREEQPVC+expectedResponse.Name).Return(nil)
 	service := FilesystemService{cs: *suite.cs}
 	err := service.DeleteTreeqVolume(fsID, treeqID)
-	assert.NotNil(suite.T(), err, "empty object")
+	assert.Nil(suite.T(), err, "treeq count metadata is informative once the treeq is deleted")
 }
 
 func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_success() {
@@ -404,9 +483,11 @@ func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_success(
 	suite.api.On("GetFilesytemTreeqCount", fsID).Return(10, nil)
 	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, nil)
 	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, nil)
+	suite.api.On("DeleteMetadataKey", fsID, TREEQPVC+expectedResponse.Name).Return(nil)
 	service := FilesystemService{cs: *suite.cs}
 	err := service.DeleteTreeqVolume(fsID, treeqID)
 	assert.Nil(suite.T(), err, "empty object")
+	suite.api.AssertCalled(suite.T(), "DeleteMetadataKey", fsID, TREEQPVC+expectedResponse.Name)
 }
 
 func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_Error() {
@@ -416,28 +497,42 @@ func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_Error()
 	expectedErr := errors.New("some other error")
 	expectedResponse.UsedCapacity = 0
 	suite.api.On("GetTreeq", fsID, treeqID).Return(*expectedResponse, nil)
-	suite.api.On("GetFilesytemTreeqCount", fsID).Return(10, nil)
-	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, nil)
 	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, expectedErr)
-	suite.api.On("GetFilesytemTreeqCount", mock.Anything).Return(nil, expectedErr)
 
 	service := FilesystemService{cs: *suite.cs}
 	err := service.DeleteTreeqVolume(fsID, treeqID)
 	assert.NotNil(suite.T(), err, "empty object")
+	suite.api.AssertNotCalled(suite.T(), "GetFilesytemTreeqCount", fsID)
+}
+
+func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_LastTreeq() {
+	var fsID int64 = 11
+	var treeqID int64 = 10
+	expectedResponse := getTreeQResponse(fsID)
+	expectedResponse.UsedCapacity = 0
+	suite.api.On("GetTreeq", fsID, treeqID).Return(*expectedResponse, nil)
+	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, nil)
+	suite.api.On("GetFilesytemTreeqCount", fsID).Return(0, nil)
+	suite.api.On("DeleteFileSystemComplete", fsID).Return(nil)
+	locker := &recordingLocker{}
+	service := FilesystemService{cs: *suite.cs, locker: locker}
+	err := service.DeleteTreeqVolume(fsID, treeqID)
+	assert.Nil(suite.T(), err, "empty object")
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", fsID)
+	assert.Equal(suite.T(), []string{"treeq-filesystem-11"}, locker.locked, "filesystem should be locked")
+	assert.Equal(suite.T(), 0, locker.held, "locks should be released")
 }
 
 func (suite *FileSystemServiceSuite) Test_DeleteTreeqVolume_DeleteTreeq_errorToDeletefile() {
 	var fsID int64 = 11
 	var treeqID int64 = 10
-	cnt := 1
 	expectedErr := errors.New("some other error")
 	expectedResponse := getTreeQResponse(fsID)
 	expectedResponse.UsedCapacity = 0
 	suite.api.On("GetTreeq", fsID, treeqID).Return(*expectedResponse, nil)
-	suite.api.On("GetFilesytemTreeqCount", fsID).Return(cnt, nil)
-	suite.api.On("AttachMetadataToObject", fsID, mock.Anything).Return(nil, nil)
 	suite.api.On("DeleteTreeq", fsID, treeqID).Return(nil, nil)
-	suite.api.On("DeleteFileSystemComplete", fsID, treeqID).Return(nil, expectedErr)
+	suite.api.On("GetFilesytemTreeqCount", fsID).Return(0, nil)
+	suite.api.On("DeleteFileSystemComplete", fsID).Return(expectedErr)
 	service := FilesystemService{cs: *suite.cs}
 	err := service.DeleteTreeqVolume(fsID, treeqID)
 	assert.NotNil(suite.T(), err, "empty object")
@@ -534,6 +629,37 @@ func (suite *FileSystemServiceSuite) Test_UpdateTreeqVolume_Success() {
 	assert.Nil(suite.T(), err, "empty object")
 }
 
+func (suite *FileSystemServiceSuite) Test_UpdateTreeqVolume_SoftCapacity() {
+	var filesytemID, treeqID, capacity, treeqSize int64 = 100, 200, 2000, 200
+	expectedResponse := getTreeQResponse(filesytemID)
+	expectedResponse.SoftCapacity = 900
+	body := map[string]interface{}{"hard_capacity": capacity, "soft_capacity": int64(1800)}
+	suite.api.On("GetFileSystemByID", filesytemID).Return(api.FileSystem{Size: 1073741824}, nil)
+	suite.api.On("GetTreeq", filesytemID, treeqID).Return(*expectedResponse, nil)
+	suite.api.On("GetTreeqSizeByFileSystemID", filesytemID).Return(treeqSize, nil)
+	suite.api.On("UpdateTreeq", filesytemID, treeqID, body).Return(expectedResponse, nil)
+	service := FilesystemService{cs: *suite.cs}
+	err := service.UpdateTreeqVolume(filesytemID, treeqID, capacity, "3gib")
+	assert.Nil(suite.T(), err, "soft capacity should keep its ratio to the hard capacity")
+	suite.api.AssertCalled(suite.T(), "UpdateTreeq", filesytemID, treeqID, body)
+}
+
+func (suite *FileSystemServiceSuite) Test_GetTreeqVolumeUsage() {
+	treeq := getTreeQResponse(100)
+	treeq.HardInodes = 1000
+	treeq.UsedInodes = 10
+	suite.api.On("GetTreeq", int64(100), int64(1)).Return(*treeq, nil)
+	suite.api.On("GetTreeq", int64(100), int64(2)).Return(nil, errors.New("TREEQ_ID_DOES_NOT_EXIST"))
+	service := FilesystemService{cs: *suite.cs}
+
+	usage, err := service.GetTreeqVolumeUsage(100, 1)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Len(suite.T(), usage, 2, "bytes and inodes usage expected")
+	assert.Equal(suite.T(), int64(1000), usage[1].GetTotal())
+	_, err = service.GetTreeqVolumeUsage(100, 2)
+	assert.Equal(suite.T(), codes.NotFound, status.Code(err))
+}
+
 func (suite *FileSystemServiceSuite) Test_validateTreeqParameters() {
 	expectedErr := errors.New("some error")
 	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(0, expectedErr)
@@ -612,6 +738,51 @@ func (suite *FileSystemServiceSuite) Test_IsTreeqAlreadyExist_GetExportByFileSys
 
 }
 
+func (suite *FileSystemServiceSuite) Test_checkTreeqName_Found() {
+	fileSystems := getFileSystems(50)
+	treeqNotFound := errors.New("treeq with given name not found")
+	var inFlight, maxInFlight int32
+	countCall := func(args mock.Arguments) {
+		current := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}
+	suite.api.On("GetTreeqByName", int64(40), "pVName").Run(countCall).Return(api.Treeq{ID: 400, FilesystemID: 40, Name: "pVName"}, nil)
+	suite.api.On("GetTreeqByName", mock.Anything, "pVName").Run(countCall).Return(nil, treeqNotFound)
+
+	service := FilesystemService{cs: *suite.cs}
+	treeq, err := service.checkTreeqName(fileSystems, "pVName")
+	assert.Nil(suite.T(), err, "err should be nil")
+	assert.Equal(suite.T(), int64(400), treeq.ID, "treeq of filesystem 40 should be found")
+	assert.True(suite.T(), maxInFlight <= treeqLookupWorkers, "lookups should be bounded, got %d", maxInFlight)
+}
+
+func (suite *FileSystemServiceSuite) Test_checkTreeqName_NotFound() {
+	suite.api.On("GetTreeqByName", mock.Anything, "pVName").Return(nil, errors.New("treeq with given name not found"))
+
+	service := FilesystemService{cs: *suite.cs}
+	treeq, err := service.checkTreeqName(getFileSystems(20), "pVName")
+	assert.Nil(suite.T(), err, "err should be nil")
+	assert.Nil(suite.T(), treeq, "treeq should not be found")
+	suite.api.AssertNumberOfCalls(suite.T(), "GetTreeqByName", 20)
+}
+
+func (suite *FileSystemServiceSuite) Test_checkTreeqName_LookupError() {
+	suite.api.On("GetTreeqByName", int64(7), "pVName").Return(nil, errors.New("some error"))
+	suite.api.On("GetTreeqByName", mock.Anything, "pVName").Return(nil, errors.New("treeq with given name not found"))
+
+	service := FilesystemService{cs: *suite.cs}
+	treeq, err := service.checkTreeqName(getFileSystems(20), "pVName")
+	assert.NotNil(suite.T(), err, "lookup error should be returned, the treeq may exist")
+	assert.Nil(suite.T(), treeq, "treeq should not be found")
+}
+
 //*****Test case Data Generation
 
 func getExportResponse() *[]api.ExportResponse {
@@ -677,3 +848,49 @@ func getfsMetadata2() *api.FSMetadata {
 	fsMetadata.FileSystemArry = fsArry
 	return &fsMetadata
 }
+
+func (suite *FileSystemServiceSuite) Test_isExportedWithNfsVersion() {
+	service := FilesystemService{cs: *suite.cs, configmap: map[string]string{}}
+	assert.True(suite.T(), service.isExportedWithNfsVersion(1), "no version requested")
+
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 10}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(2)).Return([]api.ExportResponse{{ID: 20, NfsVersions: []string{"NFSv4.1"}}}, nil)
+	service.configmap[KeyNfsVersion] = NfsVersion3
+	assert.True(suite.T(), service.isExportedWithNfsVersion(1), "exports default to NFSv3")
+	assert.False(suite.T(), service.isExportedWithNfsVersion(2), "export serves NFSv4.1 only")
+	service.configmap[KeyNfsVersion] = NfsVersion41
+	assert.False(suite.T(), service.isExportedWithNfsVersion(1), "export serves NFSv3 only")
+	assert.True(suite.T(), service.isExportedWithNfsVersion(2), "export serves NFSv4.1")
+}
+
+func getFileSystems(count int) []api.FileSystem {
+	fileSystems := []api.FileSystem{}
+	for i := 1; i <= count; i++ {
+		fileSystems = append(fileSystems, api.FileSystem{ID: int64(i), Size: 10000})
+	}
+	return fileSystems
+}
+
+//recordingLocker Locker recording the locked names
+type recordingLocker struct {
+	sync.Mutex
+	locked []string
+	held   int
+}
+
+func (l *recordingLocker) Lock(name string) (func(), error) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	l.locked = append(l.locked, name)
+	l.held++
+	return func() {
+		l.Mutex.Lock()
+		defer l.Mutex.Unlock()
+		l.held--
+	}, nil
+}
+
+func (l *recordingLocker) TryLock(name string) (func(), bool, error) {
+	unlock, err := l.Lock(name)
+	return unlock, err == nil, err
+}
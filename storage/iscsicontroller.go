@@ -15,6 +15,8 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper"
+	"infinibox-csi-driver/helper/volumeid"
 	"strconv"
 	"strings"
 	"time"
@@ -22,12 +24,16 @@ import (
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/protobuf/ptypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	return iscsi.createVolume(req, validateParametersiSCSI)
+}
+
+//createVolume create a volume exposed through the network space portals, validateParameters checks the storage class parameters of the protocol
+func (iscsi *iscsistorage) createVolume(req *csi.CreateVolumeRequest, validateParameters func(map[string]string) error) (*csi.CreateVolumeResponse, error) {
 	var err error
 	defer func() {
 		if res := recover(); res != nil && err == nil {
@@ -42,7 +48,7 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	log.Infof("requested size in bytes is %d ", sizeBytes)
 	params := req.GetParameters()
 	log.Infof(" csi request parameters %v", params)
-	err = validateParametersiSCSI(params)
+	err = validateParameters(params)
 	if err != nil {
 		return &csi.CreateVolumeResponse{}, status.Error(codes.InvalidArgument, err.Error())
 	}
@@ -57,11 +63,9 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	if volCaps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
 	}
-	for _, volCap := range volCaps {
-		if volCap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			log.Errorf("volume cpability %s for ISCSI is not supported", volCap.GetAccessMode().GetMode().String())
-			return &csi.CreateVolumeResponse{}, fmt.Errorf("volume cpability %s for ISCSI is not supported", volCap.GetAccessMode().GetMode().String())
-		}
+	if err = validateBlockAccessModes(volCaps); err != nil {
+		log.Errorf("%v for ISCSI", err)
+		return &csi.CreateVolumeResponse{}, fmt.Errorf("%v for ISCSI", err)
 	}
 
 	// Volume name to be created
@@ -70,6 +74,11 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	if name == "" {
 		return &csi.CreateVolumeResponse{}, errors.New("Name cannot be empty")
 	}
+	name, err = getObjectName(name, req.GetParameters())
+	if err != nil {
+		log.Errorf("%v for ISCSI", err)
+		return &csi.CreateVolumeResponse{}, err
+	}
 
 	targetVol, err := iscsi.cs.api.GetVolumeByName(name)
 	if err != nil {
@@ -77,9 +86,6 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 			return &csi.CreateVolumeResponse{}, status.Error(codes.Internal, err.Error())
 		}
 	}
-	if targetVol != nil {
-		return &csi.CreateVolumeResponse{}, nil
-	}
 
 	networkSpace := req.GetParameters()["network_space"]
 	nspace, err := iscsi.cs.api.GetNetworkSpaceByName(networkSpace)
@@ -94,6 +100,10 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	req.GetParameters()["iqn"] = nspace.Properties.IscsiIqn
 	req.GetParameters()["portals"] = portals
 
+	if targetVol != nil {
+		return iscsi.cs.getExistingVolumeResponse(targetVol, req, sizeBytes)
+	}
+
 	// We require the storagePool name for creation
 	poolName, ok := req.GetParameters()["pool_name"]
 	if !ok {
@@ -103,9 +113,14 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	// Volume content source support volume and snapshots
 	contentSource := req.GetVolumeContentSource()
 	if contentSource != nil {
-		return iscsi.createVolumeFromVolumeContent(req, name, sizeBytes, poolName)
+		return iscsi.createVolumeFromVolumeContent(req, name, sizeBytes)
 
 	}
+	if err = iscsi.cs.selectStoragePool(req.GetParameters(), sizeBytes); err != nil {
+		log.Errorf("fail to select storage pool of volume %s error %v", name, err)
+		return &csi.CreateVolumeResponse{}, err
+	}
+	poolName = req.GetParameters()[StoragePoolKey]
 	ssd := req.GetParameters()["ssd_enabled"]
 	if ssd == "" {
 		ssd = fmt.Sprint(false)
@@ -130,10 +145,7 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	csiResp := &csi.CreateVolumeResponse{
 		Volume: vi,
 	}
-	volID, err := strconv.Atoi(vi.VolumeId)
-	if err != nil {
-		return &csi.CreateVolumeResponse{}, errors.New("error getting volume id")
-	}
+	volID := volumeResp.ID
 
 	// confirm volume creation
 	vol, err := iscsi.cs.api.GetVolume(volID)
@@ -146,8 +158,10 @@ func (iscsi *iscsistorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		}
 	}
 	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = vol.Name
+	metadata["host.k8s.pvname"] = req.GetName()
 	metadata["host.filesystem_type"] = fstype
+	metadata["host.created_by"] = iscsi.cs.GetCreatedBy()
+	addCreateMetadata(req.GetParameters(), metadata)
 	_, err = iscsi.cs.api.AttachMetadataToObject(int64(vol.ID), metadata)
 	if err != nil {
 		log.Errorf("fail to attach metadata for volume : %s", vol.Name)
@@ -168,12 +182,21 @@ func (iscsi *iscsistorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error parsing volume id : %s", errors.New("Volume id not found"))
 	}
-	id, err := strconv.Atoi(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error parsing volume id : %s", err.Error())
 	}
-	err = iscsi.ValidateDeleteVolume(id)
+	deleteVolume, err := iscsi.cs.releaseObject(volproto.ObjectID, helper.VolumeKey(volproto.ObjectID), volproto)
+	if err != nil {
+		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
+			"error releasing volume : %s", err.Error())
+	}
+	if !deleteVolume {
+		log.Infof("volume %d is still referenced, not deleted", volproto.ObjectID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	err = iscsi.ValidateDeleteVolume(int(volproto.ObjectID))
 	if err != nil {
 		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Internal,
 			"error deleting volume : %s", err.Error())
@@ -181,7 +204,7 @@ func (iscsi *iscsistorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func (iscsi *iscsistorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest, name string, sizeInKbytes int64, storagePool string) (*csi.CreateVolumeResponse, error) {
+func (iscsi *iscsistorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRequest, name string, sizeInKbytes int64) (*csi.CreateVolumeResponse, error) {
 	var err error
 	defer func() {
 		if res := recover(); res != nil && err == nil {
@@ -201,37 +224,44 @@ func (iscsi *iscsistorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRe
 	}
 
 	// Lookup the snapshot source volume.
-	volproto, err := validateStorageType(volumeContentID)
-	if err != nil {
-		log.Errorf("Failed to validate storage type %v", err)
-		return nil, errors.New("error getting volume id")
+	parse := volumeid.Parse
+	if restoreType == "Snapshot" {
+		parse = volumeid.ParseSnapshot
 	}
-
-	ID, err := strconv.Atoi(volproto.VolumeID)
+	volproto, err := parse(volumeContentID)
 	if err != nil {
+		log.Errorf("Failed to validate storage type %v", err)
 		return nil, errors.New("error getting volume id")
 	}
+	ID := int(volproto.ObjectID)
 	srcVol, err := iscsi.cs.api.GetVolume(ID)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, restoreType+" not found: %s", volumeContentID)
 	}
 
-	// Validate the size is the same.
-	if int64(srcVol.Size) != sizeInKbytes {
+	// Validate the size is not smaller, larger clones are resized once the snapshot is taken.
+	if sizeInKbytes < srcVol.Size {
 		return nil, status.Errorf(codes.InvalidArgument,
-			restoreType+" %s has incompatible size %d kbytes with requested %d kbytes",
+			restoreType+" %s has size %d bytes larger than requested %d bytes",
 			volumeContentID, srcVol.Size, sizeInKbytes)
 	}
 
-	// Validate the storagePool is the same.
-	storagePoolID, err := iscsi.cs.api.GetStoragePoolIDByName(storagePool)
+	// The clone stays in the storagePool of the source, block data is only copied into another pool by the hosts.
+	poolID, err := iscsi.cs.selectCloneStoragePool(req.GetParameters(), srcVol.PoolId, sizeInKbytes)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"error while getting storagepoolid with name %s ", storagePool)
+		return nil, err
 	}
-	if storagePoolID != srcVol.PoolId {
+	if poolID != srcVol.PoolId {
 		return nil, status.Errorf(codes.InvalidArgument,
-			"volume storage pool is different than the requested storage pool %s", storagePool)
+			restoreType+" %s is in storage pool %d, clones of block volumes can not be created in storage pool %s",
+			volumeContentID, srcVol.PoolId, req.GetParameters()[StoragePoolKey])
+	}
+	if restoreType == "Snapshot" && isRestoreInPlace(req.GetParameters()) {
+		if sizeInKbytes != srcVol.Size {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"restore in place from snapshot %s needs the size of the snapshot", volumeContentID)
+		}
+		return iscsi.cs.restoreVolumeInPlace(srcVol, req)
 	}
 	ssd := req.GetParameters()["ssd_enabled"]
 	if ssd == "" {
@@ -246,8 +276,13 @@ func (iscsi *iscsistorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRe
 		return nil, status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
 	}
 
-	// Retrieve created destination volume
+	// Resize the created destination volume when needed
 	volID := snapResponse.SnapShotID
+	if err = iscsi.cs.resizeClone(volID, srcVol, sizeInKbytes); err != nil {
+		return nil, err
+	}
+
+	// Retrieve created destination volume
 	dstVol, err := iscsi.cs.api.GetVolume(volID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not retrieve created volume: %d", volID)
@@ -258,8 +293,10 @@ func (iscsi *iscsistorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRe
 	copyRequestParameters(req.GetParameters(), csiVolume.VolumeContext)
 
 	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = dstVol.Name
+	metadata["host.k8s.pvname"] = req.GetName()
 	metadata["host.filesystem_type"] = req.GetParameters()["fstype"]
+	metadata["host.created_by"] = iscsi.cs.GetCreatedBy()
+	addCreateMetadata(req.GetParameters(), metadata)
 	_, err = iscsi.cs.api.AttachMetadataToObject(int64(dstVol.ID), metadata)
 	if err != nil {
 		log.Errorf("fail to attach metadata for volume : %s", dstVol.Name)
@@ -272,13 +309,18 @@ func (iscsi *iscsistorage) createVolumeFromVolumeContent(req *csi.CreateVolumeRe
 }
 
 func (iscsi *iscsistorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (resp *csi.ControllerPublishVolumeResponse, err error) {
+	return iscsi.publishVolume(req, "ISCSI")
+}
+
+//publishVolume map the volume to the host, hostPorts of the publish context lists the host ports of portType
+func (iscsi *iscsistorage) publishVolume(req *csi.ControllerPublishVolumeRequest, portType string) (resp *csi.ControllerPublishVolumeResponse, err error) {
 	log.Infof("ControllerPublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
-	volproto, err := validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("Failed to validate storage type %v", err)
 		return &csi.ControllerPublishVolumeResponse{}, errors.New("error getting volume id")
 	}
-	volID, _ := strconv.Atoi(volproto.VolumeID)
+	volID := int(volproto.ObjectID)
 
 	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
 	if len(nodeNameIP) != 2 {
@@ -286,6 +328,11 @@ func (iscsi *iscsistorage) ControllerPublishVolume(ctx context.Context, req *csi
 	}
 	hostName := nodeNameIP[0]
 
+	unlock, err := lockPublish(helper.VolumeKey(volproto.ObjectID), helper.HostKey(hostName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	host, err := iscsi.cs.validateHost(hostName)
 	if err != nil {
 		return &csi.ControllerPublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
@@ -294,7 +341,7 @@ func (iscsi *iscsistorage) ControllerPublishVolume(ctx context.Context, req *csi
 	ports := ""
 	if len(host.Ports) > 0 {
 		for _, port := range host.Ports {
-			if port.PortType == "ISCSI" {
+			if port.PortType == portType {
 				ports = ports + "," + port.PortAddress
 			}
 		}
@@ -303,6 +350,30 @@ func (iscsi *iscsistorage) ControllerPublishVolume(ctx context.Context, req *csi
 		ports = ports[1:]
 	}
 
+	maxAllowedVol, err := strconv.Atoi(req.GetVolumeContext()["max_vols_per_host"])
+	if err != nil {
+		log.Errorf("Invalid parameter max_vols_per_host error:  %v", err)
+		return &csi.ControllerPublishVolumeResponse{}, err
+	}
+	log.Debugf("host can have maximum %d volume mapped", maxAllowedVol)
+	if clusterName := getHostCluster(req.GetVolumeCapability(), req.GetVolumeContext()); clusterName != "" {
+		log.Debugf("mapping volume %d to host cluster %s", volID, clusterName)
+		luninfo, err := iscsi.cs.mapVolumeToHostCluster(volID, host, clusterName, maxAllowedVol)
+		if err != nil {
+			log.Errorf("Failed to map volume to host cluster with error %v", err)
+			return &csi.ControllerPublishVolumeResponse{}, status.Error(status.Code(err), err.Error())
+		}
+		volCtx := make(map[string]string)
+		volCtx["lun"] = strconv.Itoa(luninfo.Lun)
+		volCtx["hostID"] = strconv.Itoa(host.ID)
+		volCtx["hostClusterID"] = strconv.Itoa(luninfo.HostClusterID)
+		volCtx["hostPorts"] = ports
+		volCtx["securityMethod"] = host.SecurityMethod
+		return &csi.ControllerPublishVolumeResponse{
+			PublishContext: volCtx,
+		}, nil
+	}
+
 	lunList, err := iscsi.cs.api.GetAllLunByHost(host.ID)
 	if err != nil {
 		return &csi.ControllerPublishVolumeResponse{}, err
@@ -318,12 +389,6 @@ func (iscsi *iscsistorage) ControllerPublishVolume(ctx context.Context, req *csi
 			}, nil
 		}
 	}
-	maxAllowedVol, err := strconv.Atoi(req.GetVolumeContext()["max_vols_per_host"])
-	if err != nil {
-		log.Errorf("Invalid parameter max_vols_per_host error:  %v", err)
-		return &csi.ControllerPublishVolumeResponse{}, err
-	}
-	log.Debugf("host can have maximum %d volume mapped", maxAllowedVol)
 	log.Debugf("host %s has %d volume mapped", host.Name, len(lunList))
 	if len(lunList) >= maxAllowedVol {
 		log.Errorf("unable to publish volume on host %s, as maximum allowed volume per host is (%d), limit reached", host.Name, maxAllowedVol)
@@ -349,7 +414,7 @@ func (iscsi *iscsistorage) ControllerPublishVolume(ctx context.Context, req *csi
 
 func (iscsi *iscsistorage) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (resp *csi.ControllerUnpublishVolumeResponse, err error) {
 	log.Infof("ControllerUnpublishVolume called with nodeID %s and volumeId %s", req.GetNodeId(), req.GetVolumeId())
-	volproto, err := validateStorageType(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("failed to validate storage type %v", err)
 		return nil, errors.New("error getting volume id")
@@ -359,6 +424,12 @@ func (iscsi *iscsistorage) ControllerUnpublishVolume(ctx context.Context, req *c
 		return &csi.ControllerUnpublishVolumeResponse{}, errors.New("Node ID not found")
 	}
 	hostName := nodeNameIP[0]
+
+	unlock, err := lockPublish(helper.VolumeKey(volproto.ObjectID), helper.HostKey(hostName))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	host, err := iscsi.cs.api.GetHostByName(hostName)
 	if err != nil {
 		if strings.Contains(err.Error(), "HOST_NOT_FOUND") {
@@ -367,8 +438,25 @@ func (iscsi *iscsistorage) ControllerUnpublishVolume(ctx context.Context, req *c
 		log.Errorf("failed to get host details with error %v", err)
 		return nil, err
 	}
-	if len(host.Luns) > 0 {
-		volID, _ := strconv.Atoi(volproto.VolumeID)
+	clustered := false
+	for _, lun := range host.Luns {
+		if lun.CLustered && int64(lun.VolumeID) == volproto.ObjectID {
+			log.Debugf("release volume %d of host cluster %d for host %s", lun.VolumeID, lun.HostClusterID, host.Name)
+			left, err := iscsi.cs.unmapVolumeFromHostCluster(lun.HostClusterID, lun.VolumeID, &host)
+			if err != nil {
+				log.Errorf("failed to unmap volume %d from host cluster %d with error %v", lun.VolumeID, lun.HostClusterID, err)
+				return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+			}
+			if !left {
+				return &csi.ControllerUnpublishVolumeResponse{}, nil
+			}
+			host.HostClusterID = 0
+			clustered = true
+			break
+		}
+	}
+	if !clustered && len(host.Luns) > 0 {
+		volID := int(volproto.ObjectID)
 		log.Debugf("unmap volume %d from host %d", volID, host.ID)
 		err = iscsi.cs.unmapVolumeFromHost(host.ID, volID)
 		if err != nil {
@@ -376,10 +464,12 @@ func (iscsi *iscsistorage) ControllerUnpublishVolume(ctx context.Context, req *c
 			return &csi.ControllerUnpublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
 		}
 	}
-	if len(host.Luns) < 2 {
+	// the host is deleted with its last mapping, other volumes may still be mapped to it by now
+	if host.HostClusterID == 0 {
 		luns, err := iscsi.cs.api.GetAllLunByHost(host.ID)
 		if err != nil {
 			log.Errorf("failed to retrive luns for host %d with error %v", host.ID, err)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
 		}
 		if len(luns) == 0 {
 			err = iscsi.cs.api.DeleteHost(host.ID)
@@ -419,26 +509,24 @@ func (iscsi *iscsistorage) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 	snapshotName := req.GetName()
 	log.Debugf("Create Snapshot of name %s", snapshotName)
 	log.Debugf("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := validateStorageType(req.GetSourceVolumeId())
+	volproto, err := volumeid.Parse(req.GetSourceVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate storage type %v", err)
 		return
 	}
 
-	sourceVolumeID, _ := strconv.Atoi(volproto.VolumeID)
+	sourceVolumeID := int(volproto.ObjectID)
 	volumeSnapshot, err := iscsi.cs.api.GetVolumeByName(snapshotName)
 	if err != nil {
 		log.Debug("Snapshot with given name not found : ", snapshotName)
-	} else if volumeSnapshot.ParentId == sourceVolumeID {
-		snapshotID = strconv.Itoa(volumeSnapshot.ID) + "$$" + volproto.StorageType
+	} else if volumeSnapshot != nil {
+		if volumeSnapshot.ParentId != sourceVolumeID {
+			log.Errorf("snapshot %s already exists with parent %d", snapshotName, volumeSnapshot.ParentId)
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for another source than volume %d", snapshotName, sourceVolumeID)
+		}
+		snapshotID = getSnapshotID(volproto, int64(volumeSnapshot.ID))
 		return &csi.CreateSnapshotResponse{
-			Snapshot: &csi.Snapshot{
-				SizeBytes:      volumeSnapshot.Size,
-				SnapshotId:     snapshotID,
-				SourceVolumeId: req.GetSourceVolumeId(),
-				CreationTime:   ptypes.TimestampNow(),
-				ReadyToUse:     true,
-			},
+			Snapshot: getCSISnapshot(snapshotID, req.GetSourceVolumeId(), volumeSnapshot.Size, volumeSnapshot.CreatedAt),
 		}, nil
 	}
 
@@ -454,14 +542,10 @@ func (iscsi *iscsistorage) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 		return
 	}
 
-	snapshotID = strconv.Itoa(snapshot.SnapShotID) + "$$" + volproto.StorageType
-	csiSnapshot := &csi.Snapshot{
-		SnapshotId:     snapshotID,
-		SourceVolumeId: req.GetSourceVolumeId(),
-		ReadyToUse:     true,
-		CreationTime:   ptypes.TimestampNow(),
-		SizeBytes:      snapshot.Size,
-	}
+	iscsi.cs.attachSnapshotMetadata(int64(snapshot.SnapShotID), req.GetParameters())
+
+	snapshotID = getSnapshotID(volproto, int64(snapshot.SnapShotID))
+	csiSnapshot := getCSISnapshot(snapshotID, req.GetSourceVolumeId(), snapshot.Size, snapshot.CreatedAt)
 	log.Debug("CreateFileSystemSnapshot resp() ", csiSnapshot)
 	snapshotResp := &csi.CreateSnapshotResponse{Snapshot: csiSnapshot}
 	return snapshotResp, nil
@@ -474,8 +558,12 @@ func (iscsi *iscsistorage) DeleteSnapshot(ctx context.Context, req *csi.DeleteSn
 		}
 	}()
 
-	snapshotID, _ := strconv.Atoi(req.GetSnapshotId())
-	err = iscsi.ValidateDeleteVolume(snapshotID)
+	snapproto, err := volumeid.ParseSnapshot(req.GetSnapshotId())
+	if err != nil {
+		log.Errorf("Invalid snapshot ID %v", err)
+		return &csi.DeleteSnapshotResponse{}, status.Error(codes.InvalidArgument, "Invalid snapshot ID")
+	}
+	err = iscsi.ValidateDeleteVolume(int(snapproto.ObjectID))
 	if err != nil {
 		log.Errorf("fail to delete snapshot %v", err)
 		return &csi.DeleteSnapshotResponse{}, err
@@ -536,11 +624,12 @@ func (iscsi *iscsistorage) ControllerExpandVolume(ctx context.Context, req *csi.
 		}
 	}()
 
-	volumeID, err := strconv.Atoi(req.GetVolumeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("Invalid Volume ID %v", err)
 		return
 	}
+	volumeID := int(volproto.ObjectID)
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
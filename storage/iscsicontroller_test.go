@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (suite *ISCSIControllerSuite) SetupTest() {
@@ -107,6 +111,53 @@ func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_fail() {
 
 
 
+func (suite *ISCSIControllerSuite) Test_CreateVolume_VolumeExists() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap["provision_type"] = "THIN"
+	parameterMap["ssd_enabled"] = "false"
+	crtValReq := getISCSICreateValumeRequest("PVName", parameterMap)
+	crtValReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 1073741824}
+	vol := getVolume()
+	vol.ParentId = 0
+	vol.PoolName = "pool_name1"
+	vol.Provtype = "THIN"
+	suite.api.On("GetVolumeByName", mock.Anything).Return(vol, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "existing volume should be returned")
+	assert.Equal(suite.T(), "v1$$storage_protocol1$$id=100", resp.GetVolume().GetVolumeId())
+	assert.Equal(suite.T(), "iqn.1991-05.com.infinidate:example", resp.GetVolume().GetVolumeContext()["iqn"])
+	assert.Equal(suite.T(), "10.20.30.40", resp.GetVolume().GetVolumeContext()["portals"])
+	assert.Equal(suite.T(), "pool_name1", resp.GetVolume().GetVolumeContext()["pool_name"])
+	suite.api.AssertNotCalled(suite.T(), "CreateVolume", mock.Anything, mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_VolumeExists_Mismatch() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap["provision_type"] = "THIN"
+	crtValReq := getISCSICreateValumeRequest("PVName", parameterMap)
+	crtValReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 2147483648}
+	vol := getVolume()
+	vol.ParentId = 0
+	vol.PoolName = "pool_name1"
+	suite.api.On("GetVolumeByName", mock.Anything).Return(vol, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err), "existing volume is smaller")
+
+	parameterMap = getISCSICreateVolumeParamter()
+	parameterMap["provision_type"] = "THIN"
+	parameterMap["pool_name"] = "pool_name2"
+	crtValReq = getISCSICreateValumeRequest("PVName", parameterMap)
+	crtValReq.CapacityRange = &csi.CapacityRange{RequiredBytes: 1073741824}
+	_, err = service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err), "existing volume is in another pool")
+}
+
 func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_success() {
 	service := iscsistorage{cs: *suite.cs}
 	parameterMap := getISCSICreateVolumeParamter()
@@ -198,6 +249,7 @@ func (suite *ISCSIControllerSuite) Test_DeleteVolume_DeleteVolume_Error() {
 func (suite *ISCSIControllerSuite) Test_DeleteVolume_DeleteVolume_success() {
 	service := iscsistorage{cs: *suite.cs}
 	crtValReq := getISCSIDeleteRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	//expectedErr := errors.New("some Error")
 	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
 	suite.api.On("GetVolumeSnapshotByParentID", mock.Anything).Return([]api.Volume{}, nil)	
@@ -210,6 +262,7 @@ func (suite *ISCSIControllerSuite) Test_DeleteVolume_DeleteVolume_success() {
 func (suite *ISCSIControllerSuite) Test_DeleteVolume_DeleteVolume_AlreadyDelete() {
 	service := iscsistorage{cs: *suite.cs}
 	crtValReq := getISCSIDeleteRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return(nil, errors.New("VOLUME_NOT_FOUND"))
 	expectedErr := errors.New("VOLUME_NOT_FOUND")
 	suite.api.On("GetVolume", mock.Anything).Return(nil, expectedErr)
 	
@@ -255,6 +308,154 @@ func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_content_Attach
 
 
 
+func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_content_Resize() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	crtValReq := getISCSICreateVolumeCloneRequest(parameterMap)
+	crtValReq.CapacityRange.RequiredBytes = 2 * gib
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(getVolume().PoolId, nil)
+	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("UpdateVolume", 1000, api.Volume{Size: 2 * gib}).Return(getVolume(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "larger clone created successfully")
+	suite.api.AssertCalled(suite.T(), "UpdateVolume", 1000, api.Volume{Size: 2 * gib})
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_content_OtherPool() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	crtValReq := getISCSICreateVolumeCloneRequest(parameterMap)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(getVolume(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(getVolume().PoolId+10, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "clone can not leave the pool of its source")
+	suite.api.AssertNotCalled(suite.T(), "CreateSnapshotVolume", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_Existing_ResumeCloneResize() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap[StoragePoolKey] = getVolume().PoolName
+	crtValReq := getISCSICreateVolumeCloneRequest(parameterMap)
+	crtValReq.CapacityRange.RequiredBytes = 2 * gib
+	clone := getVolume()
+	clone.ID = 1000
+	clone.ParentId = 1
+	suite.api.On("GetVolumeByName", mock.Anything).Return(clone, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("UpdateVolume", 1000, api.Volume{Size: 2 * gib}).Return(clone, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "interrupted clone resize resumed")
+	assert.Equal(suite.T(), 2*gib, resp.GetVolume().GetCapacityBytes())
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_CreateVolume_content_SmallerSize() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	crtValReq := getISCSICreateVolumeCloneRequest(parameterMap)
+	srcVol := getVolume()
+	srcVol.Size = 2 * gib
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(srcVol, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "clone smaller than its source")
+	suite.api.AssertNotCalled(suite.T(), "CreateSnapshotVolume", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_RestoreInPlace_OtherPool_Error() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getISCSICreateVolumeSnapshotRequest(parameterMap)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", 1).Return(getVolume(), nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(int64(20), nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "restore in place keeps the pool of the snapshot")
+	suite.api.AssertNotCalled(suite.T(), "RestoreVolumeFromSnapShot", mock.Anything, mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_RestoreInPlace_Mapped_Error() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getISCSICreateVolumeSnapshotRequest(parameterMap)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", 1).Return(getVolume(), nil)
+	parentVol := getVolume()
+	parentVol.ID = 1001
+	parentVol.Mapped = true
+	suite.api.On("GetVolume", 1001).Return(parentVol, nil)
+	suite.api.On("GetMetadata", int64(1001)).Return([]api.Metadata{}, nil)
+	var poolID int64 = 10
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.NotNil(suite.T(), err, "mapped volume should not be restored")
+	suite.api.AssertNotCalled(suite.T(), "RestoreVolumeFromSnapShot", mock.Anything, mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_RestoreInPlace_Success() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getISCSICreateVolumeSnapshotRequest(parameterMap)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", 1).Return(getVolume(), nil)
+	parentVol := getVolume()
+	parentVol.ID = 1001
+	parentVol.ParentId = 0
+	suite.api.On("GetVolume", 1001).Return(parentVol, nil)
+	suite.api.On("GetMetadata", int64(1001)).Return([]api.Metadata{}, nil)
+	var poolID int64 = 10
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+	suite.api.On("RestoreVolumeFromSnapShot", 1001, 100).Return(true, nil)
+	suite.api.On("AttachMetadataToObject", int64(1001), map[string]interface{}{RESTOREREF + crtValReq.GetName(): "100"}).Return(nil, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "restore in place success")
+	assert.Equal(suite.T(), "v1$$storage_protocol1$$id=1001;ref="+crtValReq.GetName(), resp.GetVolume().GetVolumeId(), "reference to the parent volume should be returned")
+	suite.api.AssertNotCalled(suite.T(), "CreateSnapshotVolume", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateVolume_RestoreInPlace_Retried() {
+	service := iscsistorage{cs: *suite.cs}
+	parameterMap := getISCSICreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getISCSICreateVolumeSnapshotRequest(parameterMap)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, nil)
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkspace(), nil)
+	suite.api.On("GetVolume", 1).Return(getVolume(), nil)
+	parentVol := getVolume()
+	parentVol.ID = 1001
+	parentVol.ParentId = 0
+	suite.api.On("GetVolume", 1001).Return(parentVol, nil)
+	suite.api.On("GetMetadata", int64(1001)).Return([]api.Metadata{{Key: RESTOREREF + crtValReq.GetName(), Value: "100"}}, nil)
+	var poolID int64 = 10
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(poolID, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "retried restore in place success")
+	assert.Equal(suite.T(), "v1$$storage_protocol1$$id=1001;ref="+crtValReq.GetName(), resp.GetVolume().GetVolumeId(), "reference to the parent volume should be returned")
+	suite.api.AssertNotCalled(suite.T(), "RestoreVolumeFromSnapShot", mock.Anything, mock.Anything)
+	suite.api.AssertNotCalled(suite.T(), "AttachMetadataToObject", mock.Anything, mock.Anything)
+}
+
 func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume() {
 	service := iscsistorage{cs: *suite.cs}
 //	var parameterMap map[string]string
@@ -296,6 +497,130 @@ func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume_MaxAllowedError(
 }
 
 
+func (suite *ISCSIControllerSuite) Test_validateBlockAccessModes() {
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	readerCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+	singleCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	assert.Nil(suite.T(), validateBlockAccessModes([]*csi.VolumeCapability{blockCap}), "raw block multi writer")
+	assert.Nil(suite.T(), validateBlockAccessModes([]*csi.VolumeCapability{readerCap}), "raw block multi reader")
+	assert.Nil(suite.T(), validateBlockAccessModes([]*csi.VolumeCapability{singleCap}), "single node writer")
+	assert.NotNil(suite.T(), validateBlockAccessModes([]*csi.VolumeCapability{mountCap}), "multi writer needs raw block")
+}
+
+func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume_HostCluster() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrPublishValReq := getISCSIControllerPublishVolumeRequest()
+	ctrPublishValReq.VolumeContext[KeyHostCluster] = "k8s-cluster"
+	ctrPublishValReq.VolumeCapability = getSharedBlockCapability()
+	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
+	suite.api.On("GetHostClusterByName", "k8s-cluster").Return(nil, errors.New("HOST_CLUSTER_NOT_FOUND"))
+	suite.api.On("CreateHostCluster", "k8s-cluster").Return(api.HostCluster{ID: 5, Name: "k8s-cluster"}, nil)
+	suite.api.On("GetAllLunByHost", 10).Return(getLunInfoArry(), nil)
+	suite.api.On("AddHostToHostCluster", 5, 10).Return(nil)
+	suite.api.On("MapVolumeToHostCluster", 5, 1).Return(api.LunInfo{Lun: 11, VolumeID: 1, CLustered: true}, nil)
+	suite.api.On("AttachMetadataToObject", int64(1), mock.Anything).Return(nil, nil)
+	resp, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
+	assert.Nil(suite.T(), err, "fail to control publish on host cluster")
+	assert.Equal(suite.T(), "11", resp.GetPublishContext()["lun"], "lun of the host cluster mapping")
+	assert.Equal(suite.T(), "5", resp.GetPublishContext()["hostClusterID"], "host cluster ID")
+	suite.api.AssertNotCalled(suite.T(), "MapVolumeToHost", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume_HostCluster_MaxVolsPerHost() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrPublishValReq := getISCSIControllerPublishVolumeRequest()
+	ctrPublishValReq.VolumeContext[KeyHostCluster] = "k8s-cluster"
+	ctrPublishValReq.VolumeContext["max_vols_per_host"] = "2"
+	ctrPublishValReq.VolumeCapability = getSharedBlockCapability()
+	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
+	suite.api.On("GetHostClusterByName", "k8s-cluster").Return(api.HostCluster{ID: 5, Name: "k8s-cluster"}, nil)
+	suite.api.On("GetAllLunByHost", 10).Return([]api.LunInfo{{VolumeID: 2, Lun: 12}, {VolumeID: 3, Lun: 13}}, nil)
+	_, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
+	assert.NotNil(suite.T(), err, "max volumes per host reached")
+	suite.api.AssertNotCalled(suite.T(), "AddHostToHostCluster", mock.Anything, mock.Anything)
+	suite.api.AssertNotCalled(suite.T(), "MapVolumeToHostCluster", mock.Anything, mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume_HostInOtherCluster() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrPublishValReq := getISCSIControllerPublishVolumeRequest()
+	ctrPublishValReq.VolumeContext[KeyHostCluster] = "k8s-cluster"
+	ctrPublishValReq.VolumeCapability = getSharedBlockCapability()
+	host := getHostByName()
+	host.HostClusterID = 6
+	suite.api.On("GetHostByName", mock.Anything).Return(host, nil)
+	suite.api.On("GetHostClusterByName", "k8s-cluster").Return(api.HostCluster{ID: 5, Name: "k8s-cluster"}, nil)
+	_, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "host belongs to another cluster")
+}
+
+func (suite *ISCSIControllerSuite) Test_ControllerPublishVolume_HostCluster_SingleNode() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrPublishValReq := getISCSIControllerPublishVolumeRequest()
+	ctrPublishValReq.VolumeContext[KeyHostCluster] = "k8s-cluster"
+	ctrPublishValReq.VolumeCapability = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
+	suite.api.On("GetAllLunByHost", mock.Anything).Return(getLunInfoArry(), nil)
+	suite.api.On("MapVolumeToHost", mock.Anything).Return(getLunInf(), nil)
+	_, err := service.ControllerPublishVolume(context.Background(), ctrPublishValReq)
+	assert.Nil(suite.T(), err, "fail to control publish for iscsi protocol")
+	suite.api.AssertNotCalled(suite.T(), "GetHostClusterByName", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume_HostCluster_StillPublished() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrUnPublishValReq := getISCSIControllerUnpublishVolume()
+	host := getHostByName()
+	host.HostClusterID = 5
+	host.Luns = []api.LunInfo{{VolumeID: 1, Lun: 11, CLustered: true, HostClusterID: 5}, {VolumeID: 2, Lun: 12, CLustered: true, HostClusterID: 5}}
+	suite.api.On("GetHostByName", mock.Anything).Return(host, nil)
+	suite.api.On("DeleteMetadataKey", int64(1), HostClusterNodeRef+"hostName").Return(nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{{Key: HostClusterNodeRef + "otherHost", Value: "k8s-cluster"}}, nil)
+	suite.api.On("GetMetadata", int64(2)).Return([]api.Metadata{{Key: HostClusterNodeRef + "hostName", Value: "k8s-cluster"}}, nil)
+	_, err := service.ControllerUnpublishVolume(context.Background(), ctrUnPublishValReq)
+	assert.Nil(suite.T(), err, "controller unpublish on host cluster")
+	suite.api.AssertNotCalled(suite.T(), "UnMapVolumeFromHostCluster", mock.Anything, mock.Anything)
+	suite.api.AssertNotCalled(suite.T(), "RemoveHostFromHostCluster", mock.Anything, mock.Anything)
+	suite.api.AssertNotCalled(suite.T(), "DeleteHost", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume_HostCluster_LastHost() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrUnPublishValReq := getISCSIControllerUnpublishVolume()
+	host := getHostByName()
+	host.HostClusterID = 5
+	host.Luns = []api.LunInfo{{VolumeID: 1, Lun: 11, CLustered: true, HostClusterID: 5}}
+	suite.api.On("GetHostByName", mock.Anything).Return(host, nil)
+	suite.api.On("DeleteMetadataKey", int64(1), HostClusterNodeRef+"hostName").Return(nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{}, nil)
+	suite.api.On("UnMapVolumeFromHostCluster", 5, 1).Return(nil)
+	suite.api.On("RemoveHostFromHostCluster", 5, 10).Return(nil)
+	suite.api.On("GetAllLunByHost", 10).Return([]api.LunInfo{}, nil)
+	suite.api.On("DeleteHost", 10).Return(nil)
+	_, err := service.ControllerUnpublishVolume(context.Background(), ctrUnPublishValReq)
+	assert.Nil(suite.T(), err, "controller unpublish on host cluster")
+	suite.api.AssertCalled(suite.T(), "UnMapVolumeFromHostCluster", 5, 1)
+	suite.api.AssertCalled(suite.T(), "RemoveHostFromHostCluster", 5, 10)
+	suite.api.AssertCalled(suite.T(), "DeleteHost", 10)
+	suite.api.AssertNotCalled(suite.T(), "UnMapVolumeFromHost", mock.Anything, mock.Anything)
+}
+
 func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume() {
 	service := iscsistorage{cs: *suite.cs}
 //	var parameterMap map[string]string
@@ -309,6 +634,32 @@ func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume() {
 }
 
 
+func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume_HostLocked() {
+	service := iscsistorage{cs: *suite.cs}
+	locks := publishLocks
+	publishLocks = helper.NewLockManager("publish", time.Millisecond)
+	defer func() { publishLocks = locks }()
+	unlock, _ := publishLocks.Lock(helper.HostKey("10.20.20.50"))
+	defer unlock()
+
+	_, err := service.ControllerUnpublishVolume(context.Background(), getISCSIControllerUnpublishVolume())
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "unpublish should wait for the host lock")
+	suite.api.AssertNotCalled(suite.T(), "GetHostByName", mock.Anything)
+	assert.Equal(suite.T(), int64(1), publishLocks.Metrics().Timeouts)
+}
+
+
+func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume_OtherMappingRemains() {
+	service := iscsistorage{cs: *suite.cs}
+	ctrUnPublishValReq := getISCSIControllerUnpublishVolume()
+	suite.api.On("GetHostByName", mock.Anything).Return(getHostByName(), nil)
+	suite.api.On("UnMapVolumeFromHost", mock.Anything, mock.Anything).Return(nil)
+	suite.api.On("GetAllLunByHost", mock.Anything).Return([]api.LunInfo{{HostID: 10, VolumeID: 2, Lun: 2}}, nil)
+	_, err := service.ControllerUnpublishVolume(context.Background(), ctrUnPublishValReq)
+	assert.Nil(suite.T(), err, "controller unpublish for iscsi protocol")
+	suite.api.AssertNotCalled(suite.T(), "DeleteHost", mock.Anything)
+}
+
 func (suite *ISCSIControllerSuite) Test_UnControllerPublishVolume_hostNameErr() {
 	service := iscsistorage{cs: *suite.cs}
 	expectedErr := errors.New("some Error")
@@ -356,11 +707,23 @@ func (suite *ISCSIControllerSuite) Test_CreateSnapshot() {
 	service := iscsistorage{cs: *suite.cs}
 //	var parameterMap map[string]string
 	ctrUnPublishValReq := getISCSICreateSnapshotRequest()	
-	suite.api.On("GetVolumeByName", mock.Anything).Return(getVolume(), nil)
+	suite.api.On("GetVolumeByName", mock.Anything).Return(nil, errors.New("volume with given name not found"))
 	suite.api.On("CreateSnapshotVolume", mock.Anything).Return(getSnapshotResp(), nil)
+	suite.api.On("AttachMetadataToObject", int64(1000), map[string]interface{}{"host.created_by": suite.cs.GetCreatedBy()}).Return(nil, nil)
 	
-		_, err := service.CreateSnapshot(context.Background(), ctrUnPublishValReq)
+		resp, err := service.CreateSnapshot(context.Background(), ctrUnPublishValReq)
 	assert.Nil(suite.T(), err, "Error should be notnil")
+	assert.Equal(suite.T(), int64(1500000000), resp.GetSnapshot().GetCreationTime().GetSeconds(), "creation time should come from the array")
+	assert.True(suite.T(), resp.GetSnapshot().GetReadyToUse(), "snapshot should be ready")
+}
+
+func (suite *ISCSIControllerSuite) Test_CreateSnapshot_NameOfAnotherSource() {
+	service := iscsistorage{cs: *suite.cs}
+	req := getISCSICreateSnapshotRequest()
+	suite.api.On("GetVolumeByName", mock.Anything).Return(getVolume(), nil)
+	_, err := service.CreateSnapshot(context.Background(), req)
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err), "snapshot name is used by a snapshot of another volume")
+	suite.api.AssertNotCalled(suite.T(), "CreateSnapshotVolume", mock.Anything)
 }
 
 func (suite *ISCSIControllerSuite) Test_CreateSnapshot_already_Created() {
@@ -435,7 +798,7 @@ func (suite *ISCSIControllerSuite) Test_GetCapacity(){
 
 func getISCSIExpandVolumeRequest() *csi.ControllerExpandVolumeRequest {
 	return &csi.ControllerExpandVolumeRequest{
-		VolumeId: "1",
+		VolumeId: "1$$iscsi",
 	}
 }
 
@@ -488,6 +851,13 @@ func getHostByName()api.Host{
 }
 
 
+func getSharedBlockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+}
+
 func getISCSIControllerPublishVolumeRequest()*csi.ControllerPublishVolumeRequest{
 	return &csi.ControllerPublishVolumeRequest{
 		VolumeId:      "1$$iscsi",		
@@ -501,6 +871,7 @@ func getSnapshotResp()api.SnapshotVolumesResp{
 	snap.Name="snaName"
 	snap.SnapShotID=1000
 	snap.PoolID=10
+	snap.CreatedAt=1500000000000
 	return snap
 }
 
@@ -515,7 +886,7 @@ func getVolumeArray()[]api.Volume{
 
 func getISCSIDeleteRequest()*csi.DeleteVolumeRequest{
 	return &csi.DeleteVolumeRequest{
-		VolumeId:"103",
+		VolumeId:"103$$iscsi",
 	}
 }
 
@@ -601,6 +972,57 @@ func getISCSICreateVolumeCloneRequest(parameterMap map[string]string) *csi.Creat
 }
 
 
+func getISCSICreateVolumeSnapshotRequest(parameterMap map[string]string) *csi.CreateVolumeRequest {
+	createValume := getISCSICreateVolumeCloneRequest(parameterMap)
+	createValume.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{
+				SnapshotId: "1$$iscsi",
+			},
+		},
+	}
+	return createValume
+}
+
 func getISCSICreateVolumeParamter() map[string]string {
 	return map[string]string{"useCHAP": "useCHAP1", "fstype": "fstype1", "pool_name": "pool_name1", "network_space": "network_space1", "provision_type": "provision_type1", "storage_protocol": "storage_protocol1", "ssd_enabled": "ssd_enabled1", "max_vols_per_host": "max_vols_per_host"}
 }
+
+func (suite *ISCSIControllerSuite) Test_DeleteVolume_RestoreRef_KeepsVolume() {
+	service := iscsistorage{cs: *suite.cs}
+	crtValReq := &csi.DeleteVolumeRequest{VolumeId: "v1$$iscsi$$id=1001;ref=pvc-restored"}
+	suite.api.On("DeleteMetadataKey", int64(1001), RESTOREREF+"pvc-restored").Return(nil)
+	suite.api.On("GetMetadata", int64(1001)).Return([]api.Metadata{{Key: "host.k8s.pvname", Value: "pvc-owner"}}, nil)
+
+	_, err := service.DeleteVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "reference deleted")
+	suite.api.AssertNotCalled(suite.T(), "DeleteVolume", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_DeleteVolume_Owner_Referenced() {
+	service := iscsistorage{cs: *suite.cs}
+	crtValReq := &csi.DeleteVolumeRequest{VolumeId: "v1$$iscsi$$id=1001"}
+	suite.api.On("GetMetadata", int64(1001)).Return([]api.Metadata{{Key: RESTOREREF + "pvc-restored", Value: "100"}}, nil)
+	suite.api.On("AttachMetadataToObject", int64(1001), map[string]interface{}{OWNERDELETED: true}).Return(nil, nil)
+
+	_, err := service.DeleteVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "owner marked deleted")
+	suite.api.AssertNotCalled(suite.T(), "DeleteVolume", mock.Anything)
+}
+
+func (suite *ISCSIControllerSuite) Test_DeleteVolume_LastRef_DeletesVolume() {
+	service := iscsistorage{cs: *suite.cs}
+	crtValReq := &csi.DeleteVolumeRequest{VolumeId: "v1$$iscsi$$id=1001;ref=pvc-restored"}
+	suite.api.On("DeleteMetadataKey", int64(1001), RESTOREREF+"pvc-restored").Return(nil)
+	suite.api.On("GetMetadata", int64(1001)).Return([]api.Metadata{{Key: OWNERDELETED, Value: "true"}}, nil)
+	vol := getVolume()
+	vol.ID = 1001
+	vol.ParentId = 0
+	suite.api.On("GetVolume", 1001).Return(vol, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 1001).Return([]api.Volume{}, nil)
+	suite.api.On("DeleteVolume", 1001).Return(nil)
+
+	_, err := service.DeleteVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "volume deleted with its last reference")
+	suite.api.AssertCalled(suite.T(), "DeleteVolume", 1001)
+}
@@ -359,8 +359,7 @@ func (iscsi *iscsistorage) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfo
 
 func (iscsi *iscsistorage) NodeGetVolumeStats(
 	ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return &csi.NodeGetVolumeStatsResponse{}, status.Error(codes.Unimplemented, time.Now().String())
-
+	return getVolumePathStats(req.GetVolumePath())
 }
 
 func (iscsi *iscsistorage) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
@@ -525,12 +524,14 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 		}
 	}
 
+	return iscsi.mountDisk(b, devicePath)
+}
+
+//mountDisk bind mount a block device or format and mount it at the target path, the disk config is persisted in the stage path
+func (iscsi *iscsistorage) mountDisk(b iscsiDiskMounter, devicePath string) (mntPath string, err error) {
+	mntPath = b.targetPath
 	if b.isBlock {
 		log.Debugf("Block volume will be mount at file %s", b.targetPath)
-		if b.readOnly {
-			return "", status.Error(codes.Internal, "Read only is not supported for Block Volume")
-		}
-
 		if err := os.MkdirAll(filepath.Dir(b.targetPath), 0750); err != nil {
 			log.Errorf("iscsi: failed to mkdir %s, error", filepath.Dir(b.targetPath))
 			return "", err
@@ -543,7 +544,11 @@ func (iscsi *iscsistorage) AttachDisk(b iscsiDiskMounter) (mntPath string, err e
 		}
 		devicePath = strings.Replace(devicePath, "/host", "", 1)
 		options := []string{"bind"}
-		options = append(options, "rw")
+		if b.readOnly {
+			options = append(options, "ro")
+		} else {
+			options = append(options, "rw")
+		}
 		if err := b.mounter.Mount(devicePath, b.targetPath, "", options); err != nil {
 			log.Errorf("iscsi: failed to mount iscsi volume %s [%s] to %s, error %v", devicePath, b.fsType, b.targetPath, err)
 			return "", err
@@ -682,8 +687,7 @@ func (iscsi *iscsistorage) getISCSIInfo(req *csi.NodePublishVolumeRequest) (*isc
 		}
 	}
 
-	volproto := strings.Split(req.GetVolumeId(), "$$")
-	volName := volproto[0]
+	volName := getVolumeName(req.GetVolumeId())
 	iqn := req.GetVolumeContext()["iqn"]
 	lun := req.GetPublishContext()["lun"]
 	portals := req.GetVolumeContext()["portals"]
@@ -714,7 +718,7 @@ func (iscsi *iscsistorage) getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.No
 	return &iscsiDiskMounter{
 		iscsiDisk:    iscsiInfo,
 		fsType:       fstype,
-		readOnly:     false,
+		readOnly:     req.GetReadonly(),
 		mountOptions: mountOptions,
 		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()},
 		exec:         mount.NewOsExec(),
@@ -725,8 +729,7 @@ func (iscsi *iscsistorage) getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.No
 }
 
 func (iscsi *iscsistorage) getISCSIDiskUnmounter(volumeID string) *iscsiDiskUnmounter {
-	volproto := strings.Split(volumeID, "$$")
-	volName := volproto[0]
+	volName := getVolumeName(volumeID)
 	return &iscsiDiskUnmounter{
 		iscsiDisk: &iscsiDisk{
 			VolName: volName,
@@ -0,0 +1,66 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+//LockMetricsIntervalEnv : period of the log of the publish lock metrics, disabled when not set or "0"
+const LockMetricsIntervalEnv = "PUBLISH_LOCK_METRICS_INTERVAL"
+
+//lockMetricsLogger start the log of the publish lock metrics once
+var lockMetricsLogger sync.Once
+
+//registerLockMetrics start the periodic log of the publish lock metrics when it is enabled
+func registerLockMetrics() {
+	lockMetricsLogger.Do(func() {
+		value, ok := csictx.LookupEnv(context.Background(), LockMetricsIntervalEnv)
+		if !ok || value == "" || value == "0" {
+			return
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Warnf("invalid %s value %s, publish lock metrics disabled", LockMetricsIntervalEnv, value)
+			return
+		}
+		go runLockMetrics(interval)
+	})
+}
+
+//runLockMetrics log the publish lock metrics every interval
+func runLockMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		logLockMetrics()
+	}
+}
+
+//logLockMetrics log the counters of the publish locks
+func logLockMetrics() {
+	metrics := publishLocks.Metrics()
+	log.WithFields(log.Fields{
+		"acquired":      metrics.Acquired,
+		"contended":     metrics.Contended,
+		"timeouts":      metrics.Timeouts,
+		"held":          metrics.Held,
+		"waiting":       metrics.Waiting,
+		"wait_time":     metrics.WaitTime.String(),
+		"max_wait_time": metrics.MaxWaitTime.String(),
+	}).Info("publish lock metrics")
+}
@@ -0,0 +1,82 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//KeyNameTemplate : storage class parameter, template of the name of the volumes, filesystems and treeqs on the array,
+	//e.g. "{namespace}-{pvc_name}-{uuid}"
+	KeyNameTemplate = "name_template"
+
+	//maxObjectNameLength : longest name of an InfiniBox object
+	maxObjectNameLength = 64
+)
+
+//namePlaceholder : placeholder of the name template
+var namePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+//invalidNameChars : characters not allowed in the name of an InfiniBox object
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_.\-]`)
+
+//getObjectName return the name of the array object of a volume, the CSI name when the storage class has no name_template.
+//The name only depends on the request so a retried CreateVolume finds the object created by the first call
+func getObjectName(csiName string, parameters map[string]string) (string, error) {
+	template := strings.TrimSpace(parameters[KeyNameTemplate])
+	if template == "" {
+		return csiName, nil
+	}
+	if !strings.Contains(template, "{uuid}") && !strings.Contains(template, "{pv_name}") {
+		return "", status.Errorf(codes.InvalidArgument, "%s %s must contain {uuid} or {pv_name}", KeyNameTemplate, template)
+	}
+	var renderErr error
+	name := namePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		var value string
+		switch placeholder {
+		case "{namespace}":
+			value = parameters[PVCNamespaceParameter]
+		case "{pvc_name}":
+			value = parameters[PVCNameParameter]
+		case "{pv_name}":
+			value = csiName
+		case "{uuid}":
+			value = nameUUID(csiName)
+		default:
+			renderErr = status.Errorf(codes.InvalidArgument, "unknown placeholder %s in %s", placeholder, KeyNameTemplate)
+			return ""
+		}
+		if value == "" && renderErr == nil {
+			renderErr = status.Errorf(codes.InvalidArgument, "placeholder %s of %s needs the provisioner extra create metadata", placeholder, KeyNameTemplate)
+		}
+		return invalidNameChars.ReplaceAllString(value, "_")
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	if invalidNameChars.MatchString(name) {
+		return "", status.Errorf(codes.InvalidArgument, "%s %s has characters other than letters, digits, '_', '.' and '-'", KeyNameTemplate, template)
+	}
+	if len(name) > maxObjectNameLength {
+		return "", status.Errorf(codes.InvalidArgument, "name %s of %s is longer than %d characters", name, KeyNameTemplate, maxObjectNameLength)
+	}
+	return name, nil
+}
+
+//nameUUID return the short UUID of a CSI name, the part after its last dash
+func nameUUID(csiName string) string {
+	return csiName[strings.LastIndex(csiName, "-")+1:]
+}
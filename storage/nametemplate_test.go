@@ -0,0 +1,61 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_getObjectName(t *testing.T) {
+	parameters := map[string]string{
+		PVCNameParameter:      "data",
+		PVCNamespaceParameter: "apps",
+	}
+	name, err := getObjectName("pvc-1b2c3d4e-aaaa-bbbb-cccc-0123456789ab", parameters)
+	assert.Nil(t, err, "error not expected")
+	assert.Equal(t, "pvc-1b2c3d4e-aaaa-bbbb-cccc-0123456789ab", name, "CSI name without template")
+
+	parameters[KeyNameTemplate] = "k8s_{namespace}-{pvc_name}-{uuid}"
+	name, err = getObjectName("pvc-1b2c3d4e-aaaa-bbbb-cccc-0123456789ab", parameters)
+	assert.Nil(t, err, "error not expected")
+	assert.Equal(t, "k8s_apps-data-0123456789ab", name)
+
+	parameters[KeyNameTemplate] = "{pvc_name}.{pv_name}"
+	name, err = getObjectName("csi-abcdef1234", parameters)
+	assert.Nil(t, err, "error not expected")
+	assert.Equal(t, "data.csi-abcdef1234", name)
+}
+
+func Test_getObjectName_Invalid(t *testing.T) {
+	long := strings.Repeat("x", maxObjectNameLength)
+	for _, template := range []string{
+		"{namespace}-{pvc_name}",
+		"{pvc}-{uuid}",
+		"vol {uuid}",
+		long + "{uuid}",
+	} {
+		_, err := getObjectName("pvc-1234", map[string]string{KeyNameTemplate: template, PVCNameParameter: "data", PVCNamespaceParameter: "apps"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), template)
+	}
+	_, err := getObjectName("pvc-1234", map[string]string{KeyNameTemplate: "{pvc_name}-{uuid}"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "missing extra create metadata")
+}
+
+func Test_getObjectName_Sanitized(t *testing.T) {
+	name, err := getObjectName("pvc-1234", map[string]string{KeyNameTemplate: "{pvc_name}-{uuid}", PVCNameParameter: "data:0"})
+	assert.Nil(t, err, "error not expected")
+	assert.Equal(t, "data_0-1234", name)
+}
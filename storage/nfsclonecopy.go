@@ -0,0 +1,163 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"fmt"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper"
+	"strconv"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//NFSCLONECOPYING metadata key on a filesystem cloned into another pool than its source, holds the ID of the source
+//until the data is copied
+const NFSCLONECOPYING = "host.k8s.clone_copying"
+
+//nfsClonePopulateLock name of the lock held while a clone is copied into another pool, by the driver replica copying the data
+func nfsClonePopulateLock(pvName string) string {
+	return "nfs-clone-populate-" + pvName
+}
+
+//cloneCopySourceName name of the snapshot of the source the filesystem is copied from
+func cloneCopySourceName(fileSystemID int64) string {
+	return "csi-copy-" + strconv.FormatInt(fileSystemID, 10)
+}
+
+func (nfs *nfsstorage) getLocker() helper.Locker {
+	if nfs.locker != nil {
+		return nfs.locker
+	}
+	return populateLocker()
+}
+
+func (nfs *nfsstorage) getCopier() TreeqDataCopier {
+	if nfs.copier != nil {
+		return nfs.copier
+	}
+	return newNfsDataCopier()
+}
+
+//copyCloneToPool create the filesystem in the pool of the pool_name parameter and copy into it a snapshot of the source,
+//taken in the pool of the source. The copy runs in the background, CreateVolume is retried with Aborted until it completes
+func (nfs *nfsstorage) copyCloneToPool(srcfsys *api.FileSystem) (err error) {
+	unlockPopulate, ok, err := nfs.getLocker().TryLock(nfsClonePopulateLock(nfs.pVName))
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "fail to lock population of volume %s: %v", nfs.pVName, err)
+	}
+	if !ok {
+		return status.Errorf(codes.Aborted, "volume %s is still being populated", nfs.pVName)
+	}
+	started := false
+	defer func() {
+		if !started {
+			unlockPopulate()
+		}
+	}()
+
+	// the filesystem is marked as being copied along with its other metadata
+	nfs.copySourceID = srcfsys.ID
+	if err = nfs.createFileSystem(); err != nil {
+		log.Errorf("fail to create fileSystem %v", err)
+		return
+	}
+	if err = nfs.createExportPathAndAddMetadata(); err != nil {
+		log.Errorf("fail to create export and metadata %v", err)
+		return
+	}
+
+	snapName := cloneCopySourceName(nfs.fileSystemID)
+	snapParam := &api.FileSystemSnapshot{ParentID: srcfsys.ID, SnapshotName: snapName, WriteProtected: true}
+	snapResponse, err := nfs.cs.api.CreateFileSystemSnapshot(snapParam)
+	if err != nil {
+		log.Errorf("Failed to create snapshot: %s error: %v", snapName, err)
+		nfs.removeCopy(nfs.fileSystemID)
+		return status.Errorf(codes.Internal, "Failed to create snapshot: %s", err.Error())
+	}
+	srcExport, err := nfs.exportFileSystem(snapResponse.SnapshotID, "/"+snapName)
+	if err != nil {
+		log.Errorf("fail to export snapshot %s error %v", snapName, err)
+		nfs.removeCopy(snapResponse.SnapshotID)
+		nfs.removeCopy(nfs.fileSystemID)
+		return status.Errorf(codes.Internal, "fail to export snapshot %s: %s", snapName, err.Error())
+	}
+
+	fileSystemID, snapshotID := nfs.fileSystemID, snapResponse.SnapshotID
+	srcSource := fmt.Sprintf("%s:%s", nfs.ipAddress, srcExport.ExportPath)
+	dstSource := fmt.Sprintf("%s:%s", nfs.ipAddress, nfs.exportBlock)
+	mountOptions := getNfsMountOptions(nfs.configmap["nfs_mount_options"], nfs.configmap[KeyNfsVersion])
+	log.Infof("copying filesystem %d into filesystem %d of storage pool %s", srcfsys.ID, fileSystemID, nfs.configmap[StoragePoolKey])
+	started = true
+	startPopulation(func() {
+		defer unlockPopulate()
+		nfs.copyCloneData(fileSystemID, snapshotID, srcSource, dstSource, mountOptions)
+	})
+	return status.Errorf(codes.Aborted, "volume %s is being copied from filesystem %d", nfs.pVName, srcfsys.ID)
+}
+
+//copyCloneData copy the snapshot of the source into the filesystem and delete the snapshot,
+//the filesystem is removed when the copy fails so the next attempt starts over
+func (nfs *nfsstorage) copyCloneData(fileSystemID, snapshotID int64, srcSource, dstSource string, mountOptions []string) {
+	err := nfs.getCopier().CopyData(srcSource, dstSource, mountOptions)
+	nfs.removeCopy(snapshotID)
+	if err != nil {
+		log.Errorf("fail to copy volume %s error %v", nfs.pVName, err)
+		nfs.removeCopy(fileSystemID)
+		return
+	}
+	// while the marker stays the next CreateVolume call replaces the volume
+	err = nfs.cs.api.DeleteMetadataKey(fileSystemID, NFSCLONECOPYING)
+	if err != nil {
+		log.Errorf("fail to remove copying marker of volume %s error %v", nfs.pVName, err)
+		return
+	}
+	log.Infof("volume %s copied from %s", nfs.pVName, srcSource)
+}
+
+//verifyCloneCopied check an existing filesystem is not being or left partially copied from its source,
+//a stale partial copy, whose population lock no driver replica holds, is removed so that the next attempt starts over
+func (nfs *nfsstorage) verifyCloneCopied(volume *api.FileSystem) error {
+	unlockPopulate, ok, err := nfs.getLocker().TryLock(nfsClonePopulateLock(nfs.pVName))
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "fail to lock population of volume %s: %v", nfs.pVName, err)
+	}
+	if !ok {
+		return status.Errorf(codes.Aborted, "volume %s is still being populated", nfs.pVName)
+	}
+	defer unlockPopulate()
+	metadataArray, err := nfs.cs.api.GetMetadata(volume.ID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error while getting metadata of filesystem %d: %s", volume.ID, err.Error())
+	}
+	for _, metadata := range *metadataArray {
+		if metadata.Key != NFSCLONECOPYING {
+			continue
+		}
+		log.Warnf("volume %s was left partially copied, removing it", nfs.pVName)
+		if snapshot, err := nfs.cs.api.GetFileSystemByName(cloneCopySourceName(volume.ID)); err == nil && snapshot != nil {
+			nfs.removeCopy(snapshot.ID)
+		}
+		nfs.removeCopy(volume.ID)
+		return status.Errorf(codes.Unavailable, "volume %s was partially copied and has been removed, retry", nfs.pVName)
+	}
+	return nil
+}
+
+//removeCopy delete a filesystem of a copy along with its exports and metadata
+func (nfs *nfsstorage) removeCopy(fileSystemID int64) {
+	if err := nfs.cs.api.DeleteFileSystemComplete(fileSystemID); err != nil {
+		log.Errorf("fail to delete filesystem %d error %v", fileSystemID, err)
+	}
+}
@@ -16,13 +16,14 @@ import (
 	"errors"
 	"fmt"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper"
+	"infinibox-csi-driver/helper/volumeid"
 	"strconv"
 	"strings"
 
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/protobuf/ptypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -59,14 +60,6 @@ type infinidatVolume struct {
 	FileSystemID  int64      `json:"fileSystemID"`
 	ExportBlock   string     `json:"exportBlock"`
 }
-type MetaData struct {
-	pVName    string
-	k8sVer    string
-	namespace string
-	pvcId     string
-	pvcName   string
-	pvname    string
-}
 
 type accessType int
 
@@ -77,7 +70,7 @@ const (
 	//Infinibox default values
 	//Ibox max allowed filesystem
 	MaxFileSystemAllowed = 4000
-	MountOptions         = "hard,rsize=1024,wsize=1024"
+	MountOptions         = "hard,rsize=1048576,wsize=1048576"
 	NfsExportPermissions = "RW"
 	NoRootSquash         = true
 	NfsUnixPermissions   = "777"
@@ -117,6 +110,23 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 		log.Errorf("Fail to validate parameter for nfs protocol %v ", validationStatusMap)
 		return nil, status.Error(codes.InvalidArgument, "Fail to validate parameter for nfs protocol")
 	}
+	if err := validateNfsVersion(config[KeyNfsVersion]); err != nil {
+		log.Errorf("Fail to validate parameter for nfs protocol %v ", err)
+		return nil, err
+	}
+	if err := validateExportCIDRs(config[KeyNfsExportCIDRs]); err != nil {
+		log.Errorf("Fail to validate parameter for nfs protocol %v ", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateSquashParameters(config); err != nil {
+		log.Errorf("Fail to validate parameter for nfs protocol %v ", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pvName, err = getObjectName(pvName, config)
+	if err != nil {
+		log.Errorf("Fail to validate parameter for nfs protocol %v ", err)
+		return nil, err
+	}
 	log.Debugf("fileystem %s ,parameter validation success", pvName)
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
@@ -126,9 +136,11 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 	}
 
 	nfs.pVName = pvName
+	nfs.csiName = req.GetName()
 	nfs.configmap = config
 	nfs.capacity = capacity
 	nfs.exportpath = "/" + pvName
+	nfs.exportAccess = volumeAccess(req.GetVolumeCapabilities())
 	ipAddress, err := nfs.cs.getNetworkSpaceIP(strings.Trim(config["network_space"], " "))
 	if err != nil {
 		log.Errorf("fail to get networkspace ipaddress %v", err)
@@ -146,6 +158,27 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 	if volume != nil {
 		// return exiting volume
 		nfs.fileSystemID = volume.ID
+		if volume.PoolName != "" {
+			// pool_name may list several pools, the volume context holds the one of the filesystem
+			nfs.configmap[StoragePoolKey] = volume.PoolName
+		}
+		// a clone left at the size of its source by an interrupted CreateVolume is resized now
+		sourceID, err := getContentSourceID(req)
+		if err != nil {
+			return &csi.CreateVolumeResponse{}, err
+		}
+		// a clone in another pool than its source is a copy, complete once its data is copied
+		if sourceID != 0 && volume.ParentID != sourceID {
+			if err = nfs.verifyCloneCopied(volume); err != nil {
+				return &csi.CreateVolumeResponse{}, err
+			}
+		}
+		if sourceID != 0 && volume.ParentID == sourceID && volume.Size < capacity {
+			log.Infof("resuming resize of clone %s from %d to %d bytes", volume.Name, volume.Size, capacity)
+			if _, err = nfs.cs.api.UpdateFilesystem(volume.ID, api.FileSystem{Size: capacity}); err != nil {
+				return &csi.CreateVolumeResponse{}, status.Errorf(codes.Internal, "failed to resize clone %s to %d bytes: %s", volume.Name, capacity, err.Error())
+			}
+		}
 		exportArray, err := nfs.cs.api.GetExportByFileSystem(nfs.fileSystemID)
 		if err != nil {
 			return &csi.CreateVolumeResponse{}, err
@@ -167,20 +200,28 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 	if contentSource != nil {
 		if contentSource.GetSnapshot() != nil {
 			snapshot := req.GetVolumeContentSource().GetSnapshot()
-			csiResp, err = nfs.createVolumeFrmPVCSource(req, capacity, config["pool_name"], snapshot.GetSnapshotId())
+			if isRestoreInPlace(config) {
+				csiResp, err = nfs.restoreFileSystemInPlace(req, snapshot.GetSnapshotId())
+			} else {
+				csiResp, err = nfs.createVolumeFrmPVCSource(req, capacity, snapshot.GetSnapshotId())
+			}
 			if err != nil {
 				log.Errorf("failed to create volume from snapshot with error %v", err)
 				return &csi.CreateVolumeResponse{}, err
 			}
 		} else if contentSource.GetVolume() != nil {
 			volume := req.GetVolumeContentSource().GetVolume()
-			csiResp, err = nfs.createVolumeFrmPVCSource(req, capacity, config["pool_name"], volume.GetVolumeId())
+			csiResp, err = nfs.createVolumeFrmPVCSource(req, capacity, volume.GetVolumeId())
 			if err != nil {
 				log.Errorf("failed to create volume from pvc with error %v", err)
 				return &csi.CreateVolumeResponse{}, err
 			}
 		}
 	} else {
+		if err = nfs.cs.selectStoragePool(config, capacity); err != nil {
+			log.Errorf("fail to select storage pool of filesystem %s error %v", pvName, err)
+			return &csi.CreateVolumeResponse{}, err
+		}
 		csiResp, err = nfs.CreateNFSVolume(req)
 		if err != nil {
 			log.Errorf("fail to create volume %v", err)
@@ -190,7 +231,7 @@ func (nfs *nfsstorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRe
 	return csiResp, nil
 }
 
-func (nfs *nfsstorage) createVolumeFrmPVCSource(req *csi.CreateVolumeRequest, size int64, storagePool string, volumeID string) (csiResp *csi.CreateVolumeResponse, err error) {
+func (nfs *nfsstorage) createVolumeFrmPVCSource(req *csi.CreateVolumeRequest, size int64, volumeID string) (csiResp *csi.CreateVolumeResponse, err error) {
 	log.Info("Called createVolumeFrmPVCSource")
 	defer func() {
 		if res := recover(); res != nil {
@@ -198,37 +239,33 @@ func (nfs *nfsstorage) createVolumeFrmPVCSource(req *csi.CreateVolumeRequest, si
 		}
 	}()
 	//volume := req.GetVolumeContentSource().GetVolume()
-	name := req.GetName()
+	name := nfs.pVName
 
-	volproto, err := validateStorageType(volumeID)
-	if err != nil || volproto.VolumeID == "" {
-		return nil, errors.New("error getting volume id")
-	}
-	sourceVolumeID, err := strconv.ParseInt(volproto.VolumeID, 10, 64)
+	volproto, err := volumeid.Parse(volumeID)
 	if err != nil {
-		return nil, errors.New("invalid volume id " + volproto.VolumeID)
+		log.Errorf("invalid source id %v", err)
+		return nil, errors.New("error getting volume id")
 	}
+	sourceVolumeID := volproto.ObjectID
 	// Lookup the VolumeSource source.
 	srcfsys, err := nfs.cs.api.GetFileSystemByID(sourceVolumeID)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "volume not found: %d", sourceVolumeID)
 	}
 
-	// Validate the size is the same.
-	if srcfsys.Size != size {
+	// Validate the size is not smaller, larger clones are resized once the snapshot is taken.
+	if size < srcfsys.Size {
 		return nil, status.Errorf(codes.InvalidArgument,
-			"volume %d has not valid size %d with requested %d ",
+			"volume %d has size %d larger than requested %d ",
 			sourceVolumeID, srcfsys.Size, size)
 	}
-	// Validate the storagePool is the same.
-	storagePoolID, err := nfs.cs.api.GetStoragePoolIDByName(storagePool)
+	// The clone stays in the storagePool of the source when requested or selected, otherwise it is copied.
+	poolID, err := nfs.cs.selectCloneStoragePool(req.GetParameters(), srcfsys.PoolID, size)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"error while getting storagepoolid with name %s ", storagePool)
+		return nil, err
 	}
-	if storagePoolID != srcfsys.PoolID {
-		return nil, status.Errorf(codes.InvalidArgument,
-			"volume storage pool is different than the requested storage pool %s", storagePool)
+	if poolID != srcfsys.PoolID {
+		return nil, nfs.copyCloneToPool(srcfsys)
 	}
 
 	snapParam := &api.FileSystemSnapshot{ParentID: sourceVolumeID, SnapshotName: name, WriteProtected: false}
@@ -242,6 +279,10 @@ func (nfs *nfsstorage) createVolumeFrmPVCSource(req *csi.CreateVolumeRequest, si
 	log.Info("createVolumeFrmPVCSource successfully created volume from clone with name: ", snapParam.SnapshotName)
 	nfs.fileSystemID = snapResponse.SnapshotID
 
+	if err = nfs.resizeClone(srcfsys, size); err != nil {
+		return nil, err
+	}
+
 	err = nfs.createExportPathAndAddMetadata()
 	if err != nil {
 		log.Errorf("fail to create export and metadata %v", err)
@@ -250,6 +291,116 @@ func (nfs *nfsstorage) createVolumeFrmPVCSource(req *csi.CreateVolumeRequest, si
 	return nfs.getNfsCsiResponse(req), nil
 }
 
+//resizeClone grow the cloned filesystem to size, the clone is deleted when it fails
+func (nfs *nfsstorage) resizeClone(srcfsys *api.FileSystem, size int64) (err error) {
+	if size <= srcfsys.Size {
+		return nil
+	}
+	log.Infof("resizing clone %d of filesystem %d from %d to %d bytes", nfs.fileSystemID, srcfsys.ID, srcfsys.Size, size)
+	if _, err = nfs.cs.api.UpdateFilesystem(nfs.fileSystemID, api.FileSystem{Size: size}); err != nil {
+		if _, delErr := nfs.cs.api.DeleteFileSystem(nfs.fileSystemID); delErr != nil {
+			log.Errorf("fail to delete clone %d error %v", nfs.fileSystemID, delErr)
+		}
+		return status.Errorf(codes.Internal, "failed to resize clone %d to %d bytes: %s", nfs.fileSystemID, size, err.Error())
+	}
+	return nil
+}
+
+// restoreFileSystemInPlace restore the parent filesystem of the snapshot instead of cloning it.
+// The volume ID returned references the parent, deleting it does not delete the parent of the other PV
+func (nfs *nfsstorage) restoreFileSystemInPlace(req *csi.CreateVolumeRequest, snapshotID string) (csiResp *csi.CreateVolumeResponse, err error) {
+	log.Info("Called restoreFileSystemInPlace")
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while restoring filesystem from snapshot " + fmt.Sprint(res))
+		}
+	}()
+	snapproto, err := volumeid.ParseSnapshot(snapshotID)
+	if err != nil {
+		log.Errorf("invalid snapshot id %v", err)
+		return nil, errors.New("error getting snapshot id")
+	}
+	srcSnapshotID := snapproto.ObjectID
+	snapshot, err := nfs.cs.api.GetFileSystemByID(srcSnapshotID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot not found: %d", srcSnapshotID)
+	}
+	if snapshot.ParentID == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "filesystem %d is not a snapshot, can not restore in place", srcSnapshotID)
+	}
+
+	// make sure the parent filesystem is not published to any node, nor published while it is restored
+	unlock, err := lockPublish(helper.FileSystemKey(snapshot.ParentID))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	// a retried request finds its reference, the parent is not rolled back again
+	restored, err := nfs.cs.hasRestoreRef(snapshot.ParentID, req.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get restore references of filesystem %d: %s", snapshot.ParentID, err.Error())
+	}
+	if !restored {
+		if err = nfs.checkFileSystemUnpublished(snapshot.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	exportArray, err := nfs.cs.api.GetExportByFileSystem(snapshot.ParentID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error while getting exports of filesystem %d", snapshot.ParentID)
+	}
+	if exportArray == nil || len(*exportArray) == 0 {
+		return nil, status.Errorf(codes.NotFound, "exports not found for filesystem %d", snapshot.ParentID)
+	}
+	export := (*exportArray)[0]
+
+	if restored {
+		log.Infof("filesystem %d already restored in place for %s", snapshot.ParentID, req.GetName())
+	} else {
+		log.Infof("restoring filesystem %d in place from snapshot %d", snapshot.ParentID, srcSnapshotID)
+		_, err = nfs.cs.api.RestoreFileSystemFromSnapShot(snapshot.ParentID, srcSnapshotID)
+		if err != nil {
+			log.Errorf("Failed to restore filesystem %d from snapshot %d error: %v", snapshot.ParentID, srcSnapshotID, err)
+			return nil, status.Errorf(codes.Internal, "Failed to restore filesystem from snapshot: %s", err.Error())
+		}
+		// the restored PV references the parent owned by another PV, the parent is deleted with the last of them
+		if err = nfs.cs.addRestoreRef(snapshot.ParentID, req.GetName(), srcSnapshotID); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to add restore reference to filesystem %d: %s", snapshot.ParentID, err.Error())
+		}
+	}
+	nfs.restoreRef = req.GetName()
+	nfs.fileSystemID = snapshot.ParentID
+	nfs.exportID = export.ID
+	nfs.exportBlock = export.ExportPath
+	nfs.exportpath = export.ExportPath
+	return nfs.getNfsCsiResponse(req), nil
+}
+
+//checkFileSystemUnpublished fail with FailedPrecondition when a node references the filesystem or a PV of it is attached to a node
+func (nfs *nfsstorage) checkFileSystemUnpublished(fileSystemID int64) error {
+	metadataArray, err := nfs.cs.api.GetMetadata(fileSystemID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "error while getting metadata of filesystem %d: %s", fileSystemID, err.Error())
+	}
+	for _, metadata := range *metadataArray {
+		if strings.HasPrefix(metadata.Key, NFSNODEREF) {
+			log.Errorf("filesystem %d is still published to %s, can not restore it in place", fileSystemID, metadata.Value)
+			return status.Errorf(codes.FailedPrecondition,
+				"filesystem %d is published to node %s, unpublish it before restoring in place", fileSystemID, metadata.Value)
+		}
+	}
+	nodes, err := nfs.cs.getAttachedNodes(fileSystemID)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "fail to check volume attachments of filesystem %d: %s", fileSystemID, err.Error())
+	}
+	for nodeName := range nodes {
+		log.Errorf("filesystem %d is still attached to %s, can not restore it in place", fileSystemID, nodeName)
+		return status.Errorf(codes.FailedPrecondition,
+			"filesystem %d is attached to node %s, unpublish it before restoring in place", fileSystemID, nodeName)
+	}
+	return nil
+}
+
 //CreateNFSVolume create volumne method
 func (nfs *nfsstorage) CreateNFSVolume(req *csi.CreateVolumeRequest) (csiResp *csi.CreateVolumeResponse, err error) {
 	defer func() {
@@ -264,6 +415,11 @@ func (nfs *nfsstorage) CreateNFSVolume(req *csi.CreateVolumeRequest) (csiResp *c
 	}
 	nfs.configmap["network_space"] = validnwlist
 	log.Debug("networkspace validation success")
+	err = nfs.cs.validateNetworkSpaceNfsVersion(validnwlist, nfs.configmap[KeyNfsVersion])
+	if err != nil {
+		log.Errorf("fail to validate nfs version %v", err)
+		return nil, err
+	}
 
 	err = nfs.createFileSystem()
 	if err != nil {
@@ -306,8 +462,12 @@ func (nfs *nfsstorage) createExportPathAndAddMetadata() (err error) {
 		}
 	}()
 	metadata := make(map[string]interface{})
-	metadata["host.k8s.pvname"] = nfs.pVName
+	metadata["host.k8s.pvname"] = nfs.csiName
 	metadata["host.created_by"] = nfs.cs.GetCreatedBy()
+	if nfs.copySourceID != 0 {
+		metadata[NFSCLONECOPYING] = nfs.copySourceID
+	}
+	addCreateMetadata(nfs.configmap, metadata)
 
 	_, err = nfs.cs.api.AttachMetadataToObject(nfs.fileSystemID, metadata)
 	if err != nil {
@@ -330,41 +490,35 @@ func getPermission(permission string) ([]map[string]interface{}, error) {
 }
 
 func (nfs *nfsstorage) createExportPath() (err error) {
-	permissionsMapArray, err := getPermission(nfs.configmap["nfs_export_permissions"])
+	exportResp, err := nfs.exportFileSystem(nfs.fileSystemID, nfs.exportpath)
 	if err != nil {
+		log.Errorf("fail to create export path of filesystem %s", nfs.pVName)
 		return
 	}
-	var permissionsput []map[string]interface{}
-	for _, pass := range permissionsMapArray {
-		access := pass["access"].(string)
-		var rootsq bool
-		_, ok := pass["no_root_squash"].(string)
-		if ok {
-			rootsq, err = strconv.ParseBool(pass["no_root_squash"].(string))
-			if err != nil {
-				log.Debug("fail to cast no_root_squash value in export permission . setting default value 'true' ")
-				rootsq = true
-			}
-		} else {
-			rootsq = pass["no_root_squash"].(bool)
-		}
-		client := pass["client"].(string)
-		permissionsput = append(permissionsput, map[string]interface{}{"access": access, "no_root_squash": rootsq, "client": client})
+	nfs.exportID = exportResp.ID
+	nfs.exportBlock = exportResp.ExportPath
+	return
+}
+
+//exportFileSystem export the filesystem on exportPath with the export settings of the storage class
+func (nfs *nfsstorage) exportFileSystem(fileSystemID int64, exportPath string) (*api.ExportResponse, error) {
+	permissionsput, err := buildExportPermissions(nfs.configmap["nfs_export_permissions"])
+	if err != nil {
+		return nil, err
 	}
+	squashExportPermissions(permissionsput, nfs.configmap, nfs.exportAccess)
 	var exportFileSystem api.ExportFileSys
-	exportFileSystem.FilesystemID = nfs.fileSystemID
+	exportFileSystem.FilesystemID = fileSystemID
 	exportFileSystem.Transport_protocols = "TCP"
+	if nfsVersion := nfs.configmap[KeyNfsVersion]; nfsVersion != "" {
+		exportFileSystem.Nfs_versions = []string{nfsExportVersions[nfsVersion]}
+	}
+	exportFileSystem.Anonymous_uid, _ = strconv.Atoi(nfs.configmap[KeyNfsAnonymousUID])
+	exportFileSystem.Anonymous_gid, _ = strconv.Atoi(nfs.configmap[KeyNfsAnonymousGID])
 	exportFileSystem.Privileged_port = true
-	exportFileSystem.Export_path = nfs.exportpath
+	exportFileSystem.Export_path = exportPath
 	exportFileSystem.Permissionsput = append(exportFileSystem.Permissionsput, permissionsput...)
-	exportResp, err := nfs.cs.api.ExportFileSystem(exportFileSystem)
-	if err != nil {
-		log.Errorf("fail to create export path of filesystem %s", nfs.pVName)
-		return
-	}
-	nfs.exportID = exportResp.ID
-	nfs.exportBlock = exportResp.ExportPath
-	return
+	return nfs.cs.api.ExportFileSystem(exportFileSystem)
 }
 
 func (nfs *nfsstorage) createFileSystem() (err error) {
@@ -422,9 +576,16 @@ func (nfs *nfsstorage) getNfsCsiResponse(req *csi.CreateVolumeRequest) *csi.Crea
 	nfs.configmap["exportID"] = strconv.Itoa(int((*infinidatVol).ExportID))
 	nfs.configmap["volPathd"] = (*infinidatVol).VolPath
 
+	volumeID := volumeid.ID{
+		Protocol:   NFS,
+		Array:      nfs.configmap[KeyArray],
+		ObjectID:   nfs.fileSystemID,
+		ExportID:   nfs.exportID,
+		RestoreRef: nfs.restoreRef,
+	}
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      (*infinidatVol).VolID,
+			VolumeId:      volumeID.String(),
 			CapacityBytes: nfs.capacity,
 			VolumeContext: nfs.configmap,
 			ContentSource: req.GetVolumeContentSource(),
@@ -438,14 +599,22 @@ func (nfs *nfsstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
-	volumeID := req.GetVolumeId()
-	volID, err := strconv.ParseInt(volumeID, 10, 64)
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("Invalid Volume ID %v", err)
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
 	}
 
-	nfs.uniqueID = volID
+	nfs.uniqueID = volproto.ObjectID
+	deleteFileSystem, err := nfs.cs.releaseObject(volproto.ObjectID, helper.FileSystemKey(volproto.ObjectID), volproto)
+	if err != nil {
+		log.Errorf("fail to release filesystem %d error %v", volproto.ObjectID, err)
+		return &csi.DeleteVolumeResponse{}, err
+	}
+	if !deleteFileSystem {
+		log.Infof("filesystem %d is still referenced, not deleted", volproto.ObjectID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 	nfsDeleteErr := nfs.DeleteNFSVolume()
 	if nfsDeleteErr != nil {
 		if strings.Contains(nfsDeleteErr.Error(), "FILESYSTEM_NOT_FOUND") {
@@ -455,7 +624,7 @@ func (nfs *nfsstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRe
 		log.Errorf("fail to delete NFS Volume %v", nfsDeleteErr)
 		return &csi.DeleteVolumeResponse{}, nfsDeleteErr
 	}
-	log.Infof("volume %s successfully deleted", volumeID)
+	log.Infof("volume %s successfully deleted", req.GetVolumeId())
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -503,23 +672,24 @@ func (nfs *nfsstorage) DeleteNFSVolume() (err error) {
 	return
 }
 
-//ControllerPublishVolume
+//ControllerPublishVolume give the node access to the filesystem export
 func (nfs *nfsstorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	exportID := req.GetVolumeContext()["exportID"]
-	access := NfsExportPermissions
-	/*noRootSquash, castErr := strconv.ParseBool(req.GetVolumeContext()["no_root_squash"])
-	if castErr != nil {
-		log.Debug("fail to cast no_root_squash .set default =true")
-		noRootSquash = true
-	}*/
-	noRootSquash := true //defautl value
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil {
+		return &csi.ControllerPublishVolumeResponse{}, status.Errorf(codes.InvalidArgument, "invalid volume ID %s", req.GetVolumeId())
+	}
+	fileSystemID := volproto.ObjectID
 	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
 	if len(nodeNameIP) != 2 {
 		return &csi.ControllerPublishVolumeResponse{}, errors.New("Node ID not found")
 	}
-	nodeIP := nodeNameIP[1]
-	eportid, _ := strconv.Atoi(exportID)
-	_, err := nfs.cs.api.AddNodeInExport(eportid, access, noRootSquash, nodeIP)
+	rootSquash, _ := strconv.ParseBool(req.GetVolumeContext()[KeyNfsRootSquash])
+	options := exportRuleOptions{
+		access:     exportAccess(req),
+		rootSquash: rootSquash,
+		cidrs:      req.GetVolumeContext()[KeyNfsExportCIDRs],
+	}
+	err = nfs.cs.publishExportRule(fileSystemID, nodeNameIP[0], nodeNameIP[1], options)
 	if err != nil {
 		log.Errorf("fail to add export rule %v", err)
 		return &csi.ControllerPublishVolumeResponse{}, status.Errorf(codes.Internal, "fail to add export rule  %s", err)
@@ -527,13 +697,20 @@ func (nfs *nfsstorage) ControllerPublishVolume(ctx context.Context, req *csi.Con
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
+//ControllerUnpublishVolume remove the node access to the filesystem export
 func (nfs *nfsstorage) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	voltype := req.GetVolumeId()
-	volproto := strings.Split(voltype, "$$")
-	fileID, _ := strconv.ParseInt(volproto[0], 10, 64)
-	err := nfs.cs.api.DeleteExportRule(fileID, req.GetNodeId())
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil {
+		return &csi.ControllerUnpublishVolumeResponse{}, status.Errorf(codes.InvalidArgument, "invalid volume ID %s", req.GetVolumeId())
+	}
+	fileSystemID := volproto.ObjectID
+	nodeNameIP := strings.Split(req.GetNodeId(), "$$")
+	if len(nodeNameIP) != 2 {
+		return &csi.ControllerUnpublishVolumeResponse{}, errors.New("Node ID not found")
+	}
+	err = nfs.cs.unpublishExportRule(fileSystemID, nodeNameIP[1])
 	if err != nil {
-		log.Errorf("fail to delete Export Rule fileystemID %d error %v", fileID, err)
+		log.Errorf("fail to delete Export Rule fileystemID %d error %v", fileSystemID, err)
 		return &csi.ControllerUnpublishVolumeResponse{}, status.Errorf(codes.Internal, "fail to delete Export Rule  %v", err)
 	}
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
@@ -568,26 +745,28 @@ func (nfs *nfsstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapsh
 	snapshotName := req.GetName()
 	log.Debugf("Create Snapshot of name %s", snapshotName)
 	log.Infof("Create Snapshot called with volume Id %s", req.GetSourceVolumeId())
-	volproto, err := validateStorageType(req.GetSourceVolumeId())
+	volproto, err := volumeid.Parse(req.GetSourceVolumeId())
 	if err != nil {
 		log.Errorf("fail to validate storage type %v", err)
 		return
 	}
 
-	sourceFilesystemID, _ := strconv.ParseInt(volproto.VolumeID, 10, 64)
+	sourceFilesystemID := volproto.ObjectID
 	snapshotArray, err := nfs.cs.api.GetSnapshotByName(snapshotName)
-	for _, snap := range *snapshotArray {
-		if snap.ParentId == sourceFilesystemID {
-			snapshotID = strconv.FormatInt(snap.SnapshotID, 10) + "$$" + volproto.StorageType
+	if err != nil {
+		log.Errorf("fail to get snapshot %s error %v", snapshotName, err)
+		return nil, status.Errorf(codes.Internal, "fail to get snapshot %s: %v", snapshotName, err)
+	}
+	if snapshotArray != nil {
+		for _, snap := range *snapshotArray {
+			if snap.ParentId != sourceFilesystemID {
+				log.Errorf("snapshot %s already exists with parent %d", snapshotName, snap.ParentId)
+				return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for another source than filesystem %d", snapshotName, sourceFilesystemID)
+			}
+			snapshotID = getSnapshotID(volproto, snap.SnapshotID)
 			log.Debug("Got snapshot so returning nil")
 			return &csi.CreateSnapshotResponse{
-				Snapshot: &csi.Snapshot{
-					SizeBytes:      snap.Size,
-					SnapshotId:     snapshotID,
-					SourceVolumeId: req.GetSourceVolumeId(),
-					CreationTime:   ptypes.TimestampNow(),
-					ReadyToUse:     true,
-				},
+				Snapshot: getCSISnapshot(snapshotID, req.GetSourceVolumeId(), snap.Size, snap.CreatedAt),
 			}, nil
 		}
 	}
@@ -604,14 +783,10 @@ func (nfs *nfsstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapsh
 		return
 	}
 
-	snapshotID = strconv.FormatInt(resp.SnapshotID, 10) + "$$" + volproto.StorageType
-	snapshot := &csi.Snapshot{
-		SnapshotId:     snapshotID,
-		SourceVolumeId: req.GetSourceVolumeId(),
-		ReadyToUse:     true,
-		CreationTime:   ptypes.TimestampNow(),
-		SizeBytes:      resp.Size,
-	}
+	nfs.cs.attachSnapshotMetadata(resp.SnapshotID, req.GetParameters())
+
+	snapshotID = getSnapshotID(volproto, resp.SnapshotID)
+	snapshot := getCSISnapshot(snapshotID, req.GetSourceVolumeId(), resp.Size, resp.CreatedAt)
 	log.Debug("CreateFileSystemSnapshot resp() ", snapshot)
 	snapshotResp := &csi.CreateSnapshotResponse{Snapshot: snapshot}
 	return snapshotResp, nil
@@ -624,8 +799,12 @@ func (nfs *nfsstorage) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapsh
 		}
 	}()
 
-	snapshotID, _ := strconv.ParseInt(req.GetSnapshotId(), 10, 64)
-	nfs.uniqueID = snapshotID
+	snapproto, err := volumeid.ParseSnapshot(req.GetSnapshotId())
+	if err != nil {
+		log.Errorf("Invalid snapshot ID %v", err)
+		return &csi.DeleteSnapshotResponse{}, status.Error(codes.InvalidArgument, "Invalid snapshot ID")
+	}
+	nfs.uniqueID = snapproto.ObjectID
 	nfsSnapDeleteErr := nfs.DeleteNFSVolume()
 	if nfsSnapDeleteErr != nil {
 		if strings.Contains(nfsSnapDeleteErr.Error(), "FILESYSTEM_NOT_FOUND") {
@@ -648,11 +827,12 @@ func (nfs *nfsstorage) ControllerExpandVolume(ctx context.Context, req *csi.Cont
 		}
 	}()
 
-	ID, err := strconv.ParseInt(req.GetVolumeId(), 10, 64)
+	volproto, err := volumeid.Parse(req.GetVolumeId())
 	if err != nil {
 		log.Errorf("Invalid Volume ID %v", err)
 		return
 	}
+	ID := volproto.ObjectID
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
@@ -4,23 +4,36 @@ import (
 	"context"
 	"errors"
 	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
+	"infinibox-csi-driver/helper"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 )
 
 func (suite *NFSControllerSuite) SetupTest() {
 	suite.api = new(api.MockApiService)
 	suite.cs = &commonservice{api: suite.api}
+	suite.kc = new(clientgo.MockKubeClient)
+	buildKubeClient = func() (clientgo.KubeClient, error) { return suite.kc, nil }
+}
+
+func (suite *NFSControllerSuite) TearDownTest() {
+	buildKubeClient = func() (clientgo.KubeClient, error) { return clientgo.BuildClient() }
 }
 
 type NFSControllerSuite struct {
 	suite.Suite
 	api *api.MockApiService
 	cs  *commonservice
+	kc  *clientgo.MockKubeClient
 }
 
 func TestNfsControllerSuite(t *testing.T) {
@@ -105,6 +118,21 @@ func (suite *NFSControllerSuite) Test_CreateVolume_FileNameExist_sucess() {
 	assert.NotNil(suite.T(), resp, "use existing created filesystem volume")
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_FileNameExist_PoolName() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[StoragePoolKey] = "pool_name2,pool_name1"
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(getFileSystem(), nil)
+	suite.api.On("GetExportByFileSystem", mock.Anything).Return(getExportPath(), nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "file system exist success")
+	assert.Equal(suite.T(), "pool_name1", resp.GetVolume().GetVolumeContext()[StoragePoolKey], "pool of the existing filesystem")
+}
+
 func (suite *NFSControllerSuite) Test_CreateVolume_OneTimeValidation_fail() {
 	service := nfsstorage{cs: *suite.cs}
 	parameterMap := getCreateVolumeParamter()
@@ -220,10 +248,111 @@ func (suite *NFSControllerSuite) Test_CreateVolume_success() {
 
 	resp, err := service.CreateVolume(context.Background(), crtValReq)
 	assert.Nil(suite.T(), err, "fail to create the file system")
-	assert.Equal(suite.T(), resp.GetVolume().GetVolumeId(), "1", "successfully created volumne ID")
+	assert.Equal(suite.T(), "v1$$nfs$$id=1;export=1", resp.GetVolume().GetVolumeId(), "successfully created volumne ID")
 
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_NameTemplate() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyNameTemplate] = "{pvc_name}-{uuid}"
+	parameterMap[PVCNameParameter] = "data"
+	crtValReq := getNFSCreateVolumeRequest("pvc-1234", parameterMap)
+	crtValReq.Name = "pvc-1234"
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", "data-1234").Return(nil, nil)
+	suite.api.On("OneTimeValidation", mock.Anything, mock.Anything).Return("networkspace", nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("GetStoragePoolIDByName", parameterMap["pool_name"]).Return(100, nil)
+	suite.api.On("CreateFilesystem", mock.Anything).Return(getFileSystem(), nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.MatchedBy(func(metadata map[string]interface{}) bool {
+		return metadata["host.k8s.pvname"] == "pvc-1234"
+	})).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "fail to create the file system")
+	suite.api.AssertCalled(suite.T(), "GetFileSystemByName", "data-1234")
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_RootSquashReadOnly() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap["nfs_export_permissions"] = "[{'access':'RW','client':'*','no_root_squash':true}]"
+	parameterMap[KeyNfsRootSquash] = "true"
+	parameterMap[KeyNfsAnonymousUID] = "1000"
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+	crtValReq.VolumeCapabilities = []*csi.VolumeCapability{{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}}
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	suite.api.On("OneTimeValidation", mock.Anything, mock.Anything).Return("networkspace", nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("GetStoragePoolIDByName", parameterMap["pool_name"]).Return(100, nil)
+	suite.api.On("CreateFilesystem", mock.Anything).Return(getFileSystem(), nil)
+	suite.api.On("ExportFileSystem", mock.MatchedBy(func(export api.ExportFileSys) bool {
+		permission := export.Permissionsput[0]
+		return export.Anonymous_uid == 1000 && permission["access"] == NfsExportReadOnly && permission["no_root_squash"] == false
+	})).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "storage class rules squashed and made read only")
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_InvalidNfsVersion() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyNfsVersion] = "4.0"
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "only NFSv3 and NFSv4.1 are supported")
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_NetworkSpaceWithoutNfsVersion() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyNfsVersion] = NfsVersion41
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	suite.api.On("OneTimeValidation", mock.Anything, mock.Anything).Return("networkspace", nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "network space serves NFSv3 only")
+	suite.api.AssertNotCalled(suite.T(), "CreateFilesystem", mock.Anything)
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_NfsVersion41_success() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyNfsVersion] = NfsVersion41
+	crtValReq := getNFSCreateVolumeRequest("PVName", parameterMap)
+	nspace := getNetworkSpace()
+	nspace.Properties.NfsVersions = []string{"NFSv3", "NFSv4.1"}
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(nspace, nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	suite.api.On("OneTimeValidation", mock.Anything, mock.Anything).Return("networkspace", nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("GetStoragePoolIDByName", parameterMap["pool_name"]).Return(100, nil)
+	suite.api.On("CreateFilesystem", mock.Anything).Return(getFileSystem(), nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "fail to create the file system")
+	assert.Equal(suite.T(), NfsVersion41, resp.GetVolume().GetVolumeContext()[KeyNfsVersion])
+	suite.api.AssertCalled(suite.T(), "ExportFileSystem", mock.MatchedBy(func(export api.ExportFileSys) bool {
+		return len(export.Nfs_versions) == 1 && export.Nfs_versions[0] == "NFSv4.1"
+	}))
+}
+
 //=================================================Create Volume END=================================//
 
 func (suite *NFSControllerSuite) Test_CreateVolume_Snapshot_Invalid_volumeID() {
@@ -406,6 +535,91 @@ func (suite *NFSControllerSuite) Test_CreateVolume_Snapshot_Success() {
 	assert.Nil(suite.T(), err, "snapshot sucsess")
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_RestoreInPlace_Published_Error() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getCreateVolumeSnapshotRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.ParentID = 10
+	suite.api.On("GetFileSystemByID", int64(1)).Return(fileSystem, nil)
+	suite.api.On("GetMetadata", int64(10)).Return([]api.Metadata{{Key: NFSNODEREF + "10.20.20.30", Value: "node1"}}, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "filesystem published to node should not be restored")
+	suite.api.AssertNotCalled(suite.T(), "RestoreFileSystemFromSnapShot", mock.Anything, mock.Anything)
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_RestoreInPlace_Attached_Error() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getCreateVolumeSnapshotRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.ParentID = 10
+	suite.api.On("GetFileSystemByID", int64(1)).Return(fileSystem, nil)
+	suite.api.On("GetMetadata", int64(10)).Return([]api.Metadata{}, nil)
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{getOrphanPV("pv1", "v1$$nfs$$id=10")}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{getOrphanAttachment("pv1", "node1")}, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "filesystem attached to node should not be restored")
+	suite.api.AssertNotCalled(suite.T(), "RestoreFileSystemFromSnapShot", mock.Anything, mock.Anything)
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_RestoreInPlace_Success() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getCreateVolumeSnapshotRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.ParentID = 10
+	suite.api.On("GetFileSystemByID", int64(1)).Return(fileSystem, nil)
+	suite.api.On("GetMetadata", int64(10)).Return([]api.Metadata{}, nil)
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{getOrphanPV("pv1", "v1$$nfs$$id=10")}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{}, nil)
+	exportResp := []api.ExportResponse{{ID: 1, ExportPath: "/parentPath", Permissions: []api.Permissions{{Access: "RW", Client: "*"}}}}
+	suite.api.On("GetExportByFileSystem", int64(10)).Return(exportResp, nil)
+	suite.api.On("RestoreFileSystemFromSnapShot", int64(10), int64(1)).Return(true, nil)
+	suite.api.On("AttachMetadataToObject", int64(10), map[string]interface{}{RESTOREREF + "volumeName": "1"}).Return(nil, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "restore in place success")
+	assert.Equal(suite.T(), "v1$$nfs$$id=10;export=1;ref=volumeName", resp.GetVolume().GetVolumeId(), "reference to the parent filesystem should be returned")
+	assert.Equal(suite.T(), "/parentPath", resp.GetVolume().GetVolumeContext()["volPathd"], "parent export path should be returned")
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_RestoreInPlace_Retried() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	parameterMap[KeyRestoreInPlace] = "true"
+	crtValReq := getCreateVolumeSnapshotRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.ParentID = 10
+	suite.api.On("GetFileSystemByID", int64(1)).Return(fileSystem, nil)
+	suite.api.On("GetMetadata", int64(10)).Return([]api.Metadata{{Key: RESTOREREF + "volumeName", Value: "1"}}, nil)
+	exportResp := []api.ExportResponse{{ID: 1, ExportPath: "/parentPath", Permissions: []api.Permissions{{Access: "RW", Client: "*"}}}}
+	suite.api.On("GetExportByFileSystem", int64(10)).Return(exportResp, nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "retried restore in place success")
+	assert.Equal(suite.T(), "v1$$nfs$$id=10;export=1;ref=volumeName", resp.GetVolume().GetVolumeId(), "reference to the parent filesystem should be returned")
+	suite.api.AssertNotCalled(suite.T(), "RestoreFileSystemFromSnapShot", mock.Anything, mock.Anything)
+	suite.kc.AssertNotCalled(suite.T(), "ListVolumeAttachments", mock.Anything)
+}
+
 func (suite *NFSControllerSuite) Test_CreateVolume_Clone_Success() {
 	service := nfsstorage{cs: *suite.cs}
 	parameterMap := getCreateVolumeParamter()
@@ -428,6 +642,111 @@ func (suite *NFSControllerSuite) Test_CreateVolume_Clone_Success() {
 	assert.Nil(suite.T(), err, "volumne clone created successfully")
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_OtherPool() {
+	copier := &treeqDataCopierStub{}
+	service := nfsstorage{cs: *suite.cs, locker: helper.NewProcessLocker(), copier: copier}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	startPopulation = func(populate func()) { populate() }
+	defer func() { startPopulation = func(populate func()) { go populate() } }()
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", "volumeName").Return(nil, nil)
+	suite.api.On("GetFileSystemByID", int64(1)).Return(getFileSystem(), nil)
+	suite.api.On("GetStoragePoolIDByName", "pool_name1").Return(int64(200), nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("CreateFilesystem", mock.MatchedBy(func(request map[string]interface{}) bool {
+		return request["pool_id"] == int64(200)
+	})).Return(api.FileSystem{ID: 50, PoolID: 200}, nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", int64(50), mock.MatchedBy(func(metadata map[string]interface{}) bool {
+		return metadata[NFSCLONECOPYING] == int64(1)
+	})).Return(nil, nil)
+	suite.api.On("CreateFileSystemSnapshot", &api.FileSystemSnapshot{ParentID: 1, SnapshotName: "csi-copy-50", WriteProtected: true}).Return(GetFileSystemSnapshotResponce(60), nil)
+	suite.api.On("DeleteFileSystemComplete", int64(60)).Return(nil)
+	suite.api.On("DeleteMetadataKey", int64(50), NFSCLONECOPYING).Return(nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "CreateVolume is retried until the copy completes")
+	assert.Equal(suite.T(), []string{"10.20.20.50:/exportPath/ 10.20.20.50:/exportPath/"}, copier.copied)
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", int64(60))
+	suite.api.AssertCalled(suite.T(), "DeleteMetadataKey", int64(50), NFSCLONECOPYING)
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystemComplete", int64(50))
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_OtherPool_CopyFailed() {
+	copier := &treeqDataCopierStub{err: errors.New("copy failed")}
+	service := nfsstorage{cs: *suite.cs, locker: helper.NewProcessLocker(), copier: copier}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	startPopulation = func(populate func()) { populate() }
+	defer func() { startPopulation = func(populate func()) { go populate() } }()
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", "volumeName").Return(nil, nil)
+	suite.api.On("GetFileSystemByID", int64(1)).Return(getFileSystem(), nil)
+	suite.api.On("GetStoragePoolIDByName", "pool_name1").Return(int64(200), nil)
+	suite.api.On("GetFileSystemCount").Return(40, nil)
+	suite.api.On("CreateFilesystem", mock.Anything).Return(api.FileSystem{ID: 50, PoolID: 200}, nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", int64(50), mock.Anything).Return(nil, nil)
+	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(GetFileSystemSnapshotResponce(60), nil)
+	suite.api.On("DeleteFileSystemComplete", mock.Anything).Return(nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "CreateVolume is retried until the copy completes")
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", int64(60))
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", int64(50))
+	suite.api.AssertNotCalled(suite.T(), "DeleteMetadataKey", int64(50), NFSCLONECOPYING)
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_OtherPool_Copied() {
+	service := nfsstorage{cs: *suite.cs, locker: helper.NewProcessLocker()}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", "volumeName").Return(api.FileSystem{ID: 50, PoolID: 200, Size: gib}, nil)
+	suite.api.On("GetMetadata", int64(50)).Return([]api.Metadata{{Key: "host.k8s.pvname", Value: "volumeName"}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(50)).Return(getExportPath(), nil)
+
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "copied clone returned")
+	assert.Equal(suite.T(), "v1$$nfs$$id=50", resp.GetVolume().GetVolumeId())
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_OtherPool_StaleCopy() {
+	service := nfsstorage{cs: *suite.cs, locker: helper.NewProcessLocker()}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", "volumeName").Return(api.FileSystem{ID: 50, PoolID: 200, Size: gib}, nil)
+	suite.api.On("GetMetadata", int64(50)).Return([]api.Metadata{{Key: NFSCLONECOPYING, Value: "1"}}, nil)
+	suite.api.On("GetFileSystemByName", "csi-copy-50").Return(api.FileSystem{ID: 60, ParentID: 1}, nil)
+	suite.api.On("DeleteFileSystemComplete", mock.Anything).Return(nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.Unavailable, status.Code(err), "partial copy should be removed")
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", int64(60))
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", int64(50))
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_OtherPool_InProgress() {
+	service := nfsstorage{cs: *suite.cs, locker: helper.NewProcessLocker()}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	unlock, _ := service.locker.Lock(nfsClonePopulateLock("volumeName"))
+	defer unlock()
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", "volumeName").Return(api.FileSystem{ID: 50, PoolID: 200, Size: gib}, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "copy still running")
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystemComplete", mock.Anything)
+}
+
 func (suite *NFSControllerSuite) Test_CreateVolume_Clone_failed() {
 	service := nfsstorage{cs: *suite.cs}
 	parameterMap := getCreateVolumeParamter()
@@ -450,6 +769,85 @@ func (suite *NFSControllerSuite) Test_CreateVolume_Clone_failed() {
 	assert.NotNil(suite.T(), err.Error(), "fail to clone the volumne")
 }
 
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_Resize() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	crtValReq.GetVolumeContentSource().GetVolume().VolumeId = "1$$nfs"
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.Size = gib / 2
+	suite.api.On("GetFileSystemByID", mock.Anything).Return(fileSystem, nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(int64(100), nil)
+	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(GetFileSystemSnapshotResponce(1), nil)
+	suite.api.On("UpdateFilesystem", int64(1), api.FileSystem{Size: gib}).Return(fileSystem, nil)
+	suite.api.On("ExportFileSystem", mock.Anything).Return(getExportResponseValue(), nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, mock.Anything).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "larger clone created successfully")
+	suite.api.AssertCalled(suite.T(), "UpdateFilesystem", int64(1), api.FileSystem{Size: gib})
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Existing_ResumeCloneResize() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	crtValReq.GetVolumeContentSource().GetVolume().VolumeId = "10$$nfs"
+	clone := getFileSystem()
+	clone.ParentID = 10
+	clone.Size = gib / 2
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(clone, nil)
+	suite.api.On("UpdateFilesystem", int64(1), api.FileSystem{Size: gib}).Return(clone, nil)
+	suite.api.On("GetExportByFileSystem", mock.Anything).Return(getExportPath(), nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "interrupted clone resize resumed")
+	suite.api.AssertCalled(suite.T(), "UpdateFilesystem", int64(1), api.FileSystem{Size: gib})
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_ResizeFailed() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	crtValReq.GetVolumeContentSource().GetVolume().VolumeId = "1$$nfs"
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.Size = gib / 2
+	suite.api.On("GetFileSystemByID", mock.Anything).Return(fileSystem, nil)
+	suite.api.On("GetStoragePoolIDByName", mock.Anything).Return(int64(100), nil)
+	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(GetFileSystemSnapshotResponce(1), nil)
+	suite.api.On("UpdateFilesystem", int64(1), mock.Anything).Return(nil, errors.New("resize error"))
+	suite.api.On("DeleteFileSystem", int64(1)).Return(nil, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.NotNil(suite.T(), err, "clone resize failed")
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystem", int64(1))
+}
+
+func (suite *NFSControllerSuite) Test_CreateVolume_Clone_SmallerSize() {
+	service := nfsstorage{cs: *suite.cs}
+	parameterMap := getCreateVolumeParamter()
+	crtValReq := getCreateVolumeCloneRequest("PVName", parameterMap)
+	crtValReq.GetVolumeContentSource().GetVolume().VolumeId = "1$$nfs"
+
+	suite.api.On("GetNetworkSpaceByName", mock.Anything).Return(getNetworkSpace(), nil)
+	suite.api.On("GetFileSystemByName", mock.Anything).Return(nil, nil)
+	fileSystem := getFileSystem()
+	fileSystem.Size = 2 * gib
+	suite.api.On("GetFileSystemByID", mock.Anything).Return(fileSystem, nil)
+
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "clone smaller than its source")
+	suite.api.AssertNotCalled(suite.T(), "CreateFileSystemSnapshot", mock.Anything)
+}
+
 //===========================================================================
 func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_VolumeID_empty() {
 	service := nfsstorage{cs: *suite.cs}
@@ -496,7 +894,7 @@ func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_success() {
 func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_UpdateVolume_Error() {
 	service := nfsstorage{cs: *suite.cs}
 	expectedErr := errors.New("some error")
-	fileSystemID := "100"
+	fileSystemID := "100$$nfs"
 	suite.api.On("UpdateFilesystem", mock.Anything, mock.Anything).Return(nil, expectedErr)
 	_, err := service.ControllerExpandVolume(context.Background(), getNfsExpandVolumeRequest(fileSystemID))
 	assert.NotNil(suite.T(), err, "error expected")
@@ -504,7 +902,7 @@ func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_UpdateVolume_Err
 
 func (suite *NFSControllerSuite) Test_NfsControllerExpandVolume_success_expand() {
 	service := nfsstorage{cs: *suite.cs}
-	fileSystemID := "100"
+	fileSystemID := "100$$nfs"
 	suite.api.On("UpdateFilesystem", mock.Anything, mock.Anything).Return(nil, nil)
 	_, err := service.ControllerExpandVolume(context.Background(), getNfsExpandVolumeRequest(fileSystemID))
 	assert.Nil(suite.T(), err, "error expected")
@@ -545,6 +943,21 @@ func (suite *NFSControllerSuite) Test_NfsCreateSnapshot_Success() {
 	assert.Nil(suite.T(), err, "empty error")
 }
 
+func (suite *NFSControllerSuite) Test_NfsCreateSnapshot_AlreadyExists() {
+	fileSysSnapshotResp := api.FileSystemSnapshotResponce{SnapshotID: 5, Name: "snapshot", ParentId: 1, Size: 1000, CreatedAt: 1500000000000}
+	suite.api.On("GetSnapshotByName", mock.Anything).Return([]api.FileSystemSnapshotResponce{fileSysSnapshotResp}, nil)
+	service := nfsstorage{cs: *suite.cs}
+	resp, err := service.CreateSnapshot(context.Background(), getNfsCreateSnapshotRequest("1$$nfs"))
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "v1$$nfs$$id=5", resp.GetSnapshot().GetSnapshotId())
+	assert.Equal(suite.T(), int64(1500000000), resp.GetSnapshot().GetCreationTime().GetSeconds(), "creation time should come from the array")
+	assert.True(suite.T(), resp.GetSnapshot().GetReadyToUse(), "snapshot should be ready")
+
+	_, err = service.CreateSnapshot(context.Background(), getNfsCreateSnapshotRequest("2$$nfs"))
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err), "snapshot name is used by a snapshot of another filesystem")
+	suite.api.AssertNotCalled(suite.T(), "CreateFileSystemSnapshot", mock.Anything)
+}
+
 func (suite *NFSControllerSuite) Test_NfsCreateSnapshot_CreateFileSystemS_Error() {
 	var fileSysSnapshotRespArry []api.FileSystemSnapshotResponce
 	expectedErr := errors.New("some error")
@@ -565,6 +978,7 @@ func (suite *NFSControllerSuite) Test_NfsCreateSnapshot_CreateFileSystemS_succes
 
 	suite.api.On("GetSnapshotByName", mock.Anything).Return(fileSysSnapshotRespArry, nil)
 	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(filesystem, nil)
+	suite.api.On("AttachMetadataToObject", mock.Anything, map[string]interface{}{"host.created_by": suite.cs.GetCreatedBy()}).Return(nil, nil)
 	service := nfsstorage{cs: *suite.cs}
 	_, err := service.CreateSnapshot(context.Background(), getNfsCreateSnapshotRequest("1$$nfs"))
 	assert.Nil(suite.T(), err, "empty error")
@@ -593,7 +1007,7 @@ func (suite *NFSControllerSuite) Test_NfsDeleteSnapshot_Error() {
 	var snapshotID int64 = 100
 	expectedErr := errors.New("some error")
 	suite.api.On("GetFileSystemByID", snapshotID).Return(nil, expectedErr)
-	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100"))
+	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100$$nfs"))
 	assert.NotNil(suite.T(), err, "error expected")
 }
 
@@ -602,7 +1016,7 @@ func (suite *NFSControllerSuite) Test_NfsDeleteSnapshot_file_not_found() {
 	var snapshotID int64 = 100
 	expectedErr := errors.New("FILESYSTEM_NOT_FOUND")
 	suite.api.On("GetFileSystemByID", snapshotID).Return(nil, expectedErr)
-	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100"))
+	_, err := service.DeleteSnapshot(context.Background(), getNfsDeleteSnapshotRequest("100$$nfs"))
 	assert.Nil(suite.T(), err, "error expected")
 }
 
@@ -657,6 +1071,7 @@ func (suite *NFSControllerSuite) Test_DeleteVolume_InvalidaID() {
 func (suite *NFSControllerSuite) Test_DeleteVolume_fileNotFound() {
 	service := nfsstorage{cs: *suite.cs}
 	delValReq := getNFSDeletRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	expectedErr := errors.New("FILESYSTEM_NOT_FOUND")
 	suite.api.On("GetFileSystemByID", mock.Anything).Return(nil, expectedErr)
 	_, err := service.DeleteVolume(context.Background(), delValReq)
@@ -666,6 +1081,7 @@ func (suite *NFSControllerSuite) Test_DeleteVolume_fileNotFound() {
 func (suite *NFSControllerSuite) Test_DeleteVolume_Error() {
 	service := nfsstorage{cs: *suite.cs}
 	delValReq := getNFSDeletRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	expectedErr := errors.New("some Error")
 	suite.api.On("GetFileSystemByID", mock.Anything).Return(nil, expectedErr)
 	_, err := service.DeleteVolume(context.Background(), delValReq)
@@ -675,6 +1091,7 @@ func (suite *NFSControllerSuite) Test_DeleteVolume_Error() {
 func (suite *NFSControllerSuite) Test_DeleteVolume_Metadata_failed() {
 	service := nfsstorage{cs: *suite.cs}
 	delValReq := getNFSDeletRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	expectedErr := errors.New("some Error")
 
 	//var filsystemID int64 = 1
@@ -689,6 +1106,7 @@ func (suite *NFSControllerSuite) Test_DeleteVolume_Metadata_failed() {
 func (suite *NFSControllerSuite) Test_DeleteVolume_delete_Error() {
 	service := nfsstorage{cs: *suite.cs}
 	delValReq := getNFSDeletRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	expectedErr := errors.New("some Error")
 
 	var parentID int64 = 0
@@ -705,6 +1123,7 @@ func (suite *NFSControllerSuite) Test_DeleteVolume_delete_Error() {
 func (suite *NFSControllerSuite) Test_DeleteVolume_Err2() {
 	service := nfsstorage{cs: *suite.cs}
 	delValReq := getNFSDeletRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	expectedErr := errors.New("some Error")
 
 	var parentID int64 = 11
@@ -722,6 +1141,7 @@ func (suite *NFSControllerSuite) Test_DeleteVolume_Err2() {
 func (suite *NFSControllerSuite) Test_DeleteVolume_success() {
 	service := nfsstorage{cs: *suite.cs}
 	delValReq := getNFSDeletRequest()
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{}, nil)
 	//expectedErr := errors.New("some Error")
 
 	var parentID int64 = 11
@@ -749,35 +1169,139 @@ func (suite *NFSControllerSuite) Test_ControllerPublishVolume_AddNodeInExport_Er
 	service := nfsstorage{cs: *suite.cs}
 	publishValReq := getNFSControllerPublishVolume()
 	expectedErr := errors.New("some Error")
+	suite.api.On("AttachMetadataToObject", int64(1), mock.Anything).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{{Key: NFSNODEREF + "10.20.20.50", Value: "node1"}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11}}, nil)
 	suite.api.On("AddNodeInExport", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, expectedErr)
 	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
-	assert.NotNil(suite.T(), err, "invalid nodeID ID")
+	assert.NotNil(suite.T(), err, "fail to add export rule")
 }
 
 func (suite *NFSControllerSuite) Test_ControllerPublishVolume_success() {
 	service := nfsstorage{cs: *suite.cs}
 	publishValReq := getNFSControllerPublishVolume()
-	//expectedErr := errors.New("some Error")
-	suite.api.On("AddNodeInExport", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil, nil)
+	suite.api.On("AttachMetadataToObject", int64(1), mock.Anything).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{{Key: NFSNODEREF + "10.20.20.50", Value: "node1"}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11}}, nil)
+	suite.api.On("AddNodeInExport", 11, NfsExportPermissions, NoRootSquash, "10.20.20.50").Return(nil, nil)
+	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", int64(1), map[string]interface{}{NFSRULEREF + "10.20.20.50": "true"})
+}
+
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_CIDR() {
+	service := nfsstorage{cs: *suite.cs}
+	publishValReq := getNFSControllerPublishVolume()
+	publishValReq.VolumeContext[KeyNfsExportCIDRs] = "10.20.20.0/24"
+	suite.api.On("AttachMetadataToObject", int64(1), mock.Anything).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{
+		{Key: NFSNODEREF + "10.20.20.50", Value: "node1"},
+		{Key: NFSNODEREF + "10.20.20.51", Value: "node2"},
+		{Key: NFSEXPORTCIDRS, Value: "10.20.20.0/24"},
+		{Key: NFSRULEREF + "10.20.20.0-10.20.20.255", Value: "true"},
+	}, nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11, Permissions: []api.Permissions{{Access: "RW", NoRootSquash: true, Client: "10.20.20.0-10.20.20.255"}}}}, nil)
+	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertNotCalled(suite.T(), "AddNodeInExport", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_ReadOnlyRootSquash() {
+	service := nfsstorage{cs: *suite.cs}
+	publishValReq := getNFSControllerPublishVolume()
+	publishValReq.VolumeContext[KeyNfsRootSquash] = "true"
+	publishValReq.VolumeCapability = &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+	suite.api.On("AttachMetadataToObject", int64(1), mock.Anything).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{
+		{Key: NFSNODEREF + "10.20.20.50", Value: "node1"},
+		{Key: NFSNODEACCESS + "10.20.20.50", Value: "RO"},
+		{Key: NFSROOTSQUASH, Value: "true"},
+	}, nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11}}, nil)
+	suite.api.On("AddNodeInExport", 11, "RO", false, "10.20.20.50").Return(nil, nil)
+	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "AttachMetadataToObject", int64(1), map[string]interface{}{
+		NFSNODEREF + "10.20.20.50":    "node1",
+		NFSNODEACCESS + "10.20.20.50": "RO",
+		NFSROOTSQUASH:                 "true",
+	})
+}
+
+func (suite *NFSControllerSuite) Test_ControllerPublishVolume_UpdateManagedRule() {
+	service := nfsstorage{cs: *suite.cs}
+	publishValReq := getNFSControllerPublishVolume()
+	suite.api.On("AttachMetadataToObject", int64(1), mock.Anything).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{
+		{Key: NFSNODEREF + "10.20.20.50", Value: "node1"},
+		{Key: NFSNODEACCESS + "10.20.20.50", Value: "RW"},
+		{Key: NFSRULEREF + "10.20.20.50", Value: "true"},
+	}, nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11, Permissions: []api.Permissions{{Access: "RO", NoRootSquash: true, Client: "10.20.20.50"}}}}, nil)
+	suite.api.On("DeleteExportRule", int64(1), "10.20.20.50").Return(nil)
+	suite.api.On("AddNodeInExport", 11, "RW", true, "10.20.20.50").Return(nil, nil)
 	_, err := service.ControllerPublishVolume(context.Background(), publishValReq)
-	assert.Nil(suite.T(), err, "invalid nodeID ID")
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "DeleteExportRule", int64(1), "10.20.20.50")
+	suite.api.AssertCalled(suite.T(), "AddNodeInExport", 11, "RW", true, "10.20.20.50")
+}
+
+func (suite *NFSControllerSuite) Test_validateSquashParameters() {
+	assert.Nil(suite.T(), validateSquashParameters(map[string]string{KeyNfsRootSquash: "true", KeyNfsAnonymousUID: "1000", KeyNfsAnonymousGID: "1000"}))
+	assert.NotNil(suite.T(), validateSquashParameters(map[string]string{KeyNfsRootSquash: "yes"}))
+	assert.NotNil(suite.T(), validateSquashParameters(map[string]string{KeyNfsAnonymousUID: "-2"}))
+	assert.NotNil(suite.T(), validateSquashParameters(map[string]string{KeyNfsAnonymousGID: "nobody"}))
 }
+
 func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_DeleteExportRule_error() {
 	service := nfsstorage{cs: *suite.cs}
 	unPublishValReq := getNFSControllerUnpublishVolume()
 	expectedErr := errors.New("some Error")
+	suite.api.On("DeleteMetadataKey", int64(1), mock.Anything).Return(nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{{Key: NFSRULEREF + "10.20.20.50", Value: "true"}}, nil)
 	suite.api.On("DeleteExportRule", mock.Anything, mock.Anything).Return(expectedErr)
 	_, err := service.ControllerUnpublishVolume(context.Background(), unPublishValReq)
-	assert.NotNil(suite.T(), err, "invalid nodeID ID")
+	assert.NotNil(suite.T(), err, "fail to delete export rule")
 }
 
 func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_DeleteExportRule_success() {
 	service := nfsstorage{cs: *suite.cs}
 	unPublishValReq := getNFSControllerUnpublishVolume()
-	//expectedErr := errors.New("some Error")
-	suite.api.On("DeleteExportRule", mock.Anything, mock.Anything).Return(nil)
+	suite.api.On("DeleteMetadataKey", int64(1), mock.Anything).Return(nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{{Key: NFSRULEREF + "10.20.20.50", Value: "true"}}, nil)
+	suite.api.On("DeleteExportRule", int64(1), "10.20.20.50").Return(nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11}}, nil)
+	_, err := service.ControllerUnpublishVolume(context.Background(), unPublishValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "DeleteExportRule", int64(1), "10.20.20.50")
+	suite.api.AssertCalled(suite.T(), "DeleteMetadataKey", int64(1), NFSRULEREF+"10.20.20.50")
+}
+
+func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_RangeStillUsed() {
+	service := nfsstorage{cs: *suite.cs}
+	unPublishValReq := getNFSControllerUnpublishVolume()
+	suite.api.On("DeleteMetadataKey", int64(1), mock.Anything).Return(nil)
+	suite.api.On("GetMetadata", int64(1)).Return([]api.Metadata{
+		{Key: NFSNODEREF + "10.20.20.51", Value: "node2"},
+		{Key: NFSEXPORTCIDRS, Value: "10.20.20.40-10.20.20.60"},
+		{Key: NFSRULEREF + "10.20.20.40-10.20.20.60", Value: "true"},
+	}, nil)
+	suite.api.On("GetExportByFileSystem", int64(1)).Return([]api.ExportResponse{{ID: 11, Permissions: []api.Permissions{{Access: "RW", NoRootSquash: true, Client: "10.20.20.40-10.20.20.60"}}}}, nil)
 	_, err := service.ControllerUnpublishVolume(context.Background(), unPublishValReq)
-	assert.Nil(suite.T(), err, "invalid nodeID ID")
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertNotCalled(suite.T(), "DeleteExportRule", mock.Anything, mock.Anything)
+}
+
+func (suite *NFSControllerSuite) Test_exportClient() {
+	assert.Equal(suite.T(), "10.0.1.5", exportClient("10.0.1.5", ""))
+	assert.Equal(suite.T(), "10.0.1.0-10.0.1.255", exportClient("10.0.1.5", "192.168.0.0/16, 10.0.1.0/24"))
+	assert.Equal(suite.T(), "10.0.1.1-10.0.1.9", exportClient("10.0.1.5", "10.0.1.1-10.0.1.9"))
+	assert.Equal(suite.T(), "10.0.2.5", exportClient("10.0.2.5", "10.0.1.0/24,10.0.1.1-10.0.1.9"))
+	assert.Nil(suite.T(), validateExportCIDRs("10.0.1.0/24,10.0.1.1-10.0.1.9"))
+	assert.NotNil(suite.T(), validateExportCIDRs("10.0.1.0/33"))
+	assert.NotNil(suite.T(), validateExportCIDRs("10.0.1.9-10.0.1.1"))
 }
 
 //============================================================
@@ -785,19 +1309,20 @@ func (suite *NFSControllerSuite) Test_ControllerUnpublishVolume_DeleteExportRule
 func getNFSControllerUnpublishVolume() *csi.ControllerUnpublishVolumeRequest {
 	return &csi.ControllerUnpublishVolumeRequest{
 		VolumeId: "1$$nfs",
+		NodeId:   "node1$$10.20.20.50",
 	}
 }
 
 func getNFSControllerPublishVolume() *csi.ControllerPublishVolumeRequest {
 	return &csi.ControllerPublishVolumeRequest{
-		VolumeId:      "1",
+		VolumeId:      "1$$nfs",
 		VolumeContext: map[string]string{"exportID": "1"},
-		NodeId:        "10.20.20.50$$nfs",
+		NodeId:        "node1$$10.20.20.50",
 	}
 }
 func getNFSDeletRequest() *csi.DeleteVolumeRequest {
 	return &csi.DeleteVolumeRequest{
-		VolumeId: "1",
+		VolumeId: "1$$nfs",
 	}
 }
 
@@ -891,6 +1416,56 @@ func getCreateVolumeCloneRequest(name string, parameterMap map[string]string) *c
 	return createValume
 }
 
+func (suite *NFSControllerSuite) Test_reconcileArrayExportRules_Attachments() {
+	var fileSystemID int64 = 200
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{getOrphanPV("pv-fs", "200$$nfs")}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{getOrphanAttachment("pv-fs", "node1")}, nil)
+	suite.kc.On("GetCSINodeIDs", Name).Return(map[string]string{"node1": "node1$$10.0.0.1", "node2": "node2$$10.0.0.2", "node3": "node3$$10.0.0.3"}, nil)
+	suite.api.On("GetMetadataByKey", "host.k8s.pvname", 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 200, ObjectType: "FILESYSTEM", Key: "host.k8s.pvname", Value: "pv-fs"},
+		api.Metadata{ObjectId: 201, ObjectType: "FILESYSTEM", Key: "host.k8s.pvname", Value: "pv-other-cluster"},
+	), nil)
+	suite.api.On("GetMetadata", fileSystemID).Return([]api.Metadata{
+		{Key: NFSNODEREF + "10.0.0.1", Value: "node1"}, {Key: NFSRULEREF + "10.0.0.1", Value: "true"},
+		{Key: NFSNODEREF + "10.0.0.3", Value: "node3"}, {Key: NFSRULEREF + "10.0.0.3", Value: "true"},
+	}, nil)
+	suite.api.On("DeleteMetadataKey", fileSystemID, mock.Anything).Return(nil)
+	suite.api.On("GetExportByFileSystem", fileSystemID).Return([]api.ExportResponse{{ID: 300, Permissions: []api.Permissions{
+		{Client: "10.0.0.1", Access: "RW", NoRootSquash: true},
+		{Client: "10.0.0.2", Access: "RW", NoRootSquash: true},
+		{Client: "10.0.0.3", Access: "RW", NoRootSquash: true},
+	}}}, nil)
+	suite.api.On("DeleteExportRule", fileSystemID, mock.Anything).Return(nil)
+
+	err := suite.cs.reconcileArrayExportRules(suite.kc)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "DeleteMetadataKey", fileSystemID, NFSNODEREF+"10.0.0.3")
+	suite.api.AssertNotCalled(suite.T(), "DeleteMetadataKey", fileSystemID, NFSNODEREF+"10.0.0.1")
+	suite.api.AssertNotCalled(suite.T(), "DeleteExportRule", fileSystemID, "10.0.0.2")
+	suite.api.AssertNotCalled(suite.T(), "GetMetadata", int64(201))
+	suite.kc.AssertNumberOfCalls(suite.T(), "ListVolumeAttachments", 2)
+}
+
+func (suite *NFSControllerSuite) Test_reconcileArrayExportRules_PublishedSinceList() {
+	var fileSystemID int64 = 200
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{getOrphanPV("pv-fs", "200$$nfs")}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{}, nil).Once()
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{getOrphanAttachment("pv-fs", "node1")}, nil)
+	suite.kc.On("GetCSINodeIDs", Name).Return(map[string]string{"node1": "node1$$10.0.0.1"}, nil)
+	suite.api.On("GetMetadataByKey", "host.k8s.pvname", 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 200, ObjectType: "FILESYSTEM", Key: "host.k8s.pvname", Value: "pv-fs"},
+	), nil)
+	suite.api.On("GetMetadata", fileSystemID).Return([]api.Metadata{{Key: NFSNODEREF + "10.0.0.1", Value: "node1"}, {Key: NFSRULEREF + "10.0.0.1", Value: "true"}}, nil)
+	suite.api.On("GetExportByFileSystem", fileSystemID).Return([]api.ExportResponse{{ID: 300, Permissions: []api.Permissions{
+		{Client: "10.0.0.1", Access: "RW", NoRootSquash: true},
+	}}}, nil)
+
+	err := suite.cs.reconcileArrayExportRules(suite.kc)
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertNotCalled(suite.T(), "DeleteMetadataKey", mock.Anything, mock.Anything)
+	suite.api.AssertNotCalled(suite.T(), "DeleteExportRule", mock.Anything, mock.Anything)
+}
+
 func getCreateVolumeParamter() map[string]string {
 	return map[string]string{"pool_name": "pool_name1", "network_space": "network_space1", "nfs_export_permissions": "[{'access':'RW','client':'192.168.147.190-192.168.147.199','no_root_squash':false},{'access':'RW','client':'192.168.147.10-192.168.147.20','no_root_squash':'false'}]"}
 }
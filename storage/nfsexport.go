@@ -0,0 +1,530 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
+	"infinibox-csi-driver/helper"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	//KeyNfsExportCIDRs : comma separated CIDRs or ip ranges, node rules inside one of them are collapsed into a single rule of the range
+	KeyNfsExportCIDRs = "nfs_export_cidrs"
+
+	//KeyNfsRootSquash : "true" squash root of the published nodes, default false keeps root access
+	KeyNfsRootSquash = "nfs_root_squash"
+
+	//KeyNfsAnonymousUID : uid squashed users are mapped to
+	KeyNfsAnonymousUID = "nfs_anonymous_uid"
+
+	//KeyNfsAnonymousGID : gid squashed users are mapped to
+	KeyNfsAnonymousGID = "nfs_anonymous_gid"
+
+	//NfsExportReadOnly export rule access of nodes publishing the volume readonly
+	NfsExportReadOnly = "RO"
+
+	//NFSNODEREF : filesystem metadata key prefix, one key per node ip the volume is published to
+	NFSNODEREF = "host.k8s.nfs_node."
+
+	//NFSNODEACCESS : filesystem metadata key prefix, export rule access requested by the node
+	NFSNODEACCESS = "host.k8s.nfs_node_access."
+
+	//NFSROOTSQUASH : filesystem metadata key holding the nfs_root_squash of the volume
+	NFSROOTSQUASH = "host.k8s.nfs_root_squash"
+
+	//NFSRULEREF : filesystem metadata key prefix, one key per export rule client added by the driver
+	NFSRULEREF = "host.k8s.nfs_rule."
+
+	//NFSEXPORTCIDRS : filesystem metadata key holding the nfs_export_cidrs of the volume
+	NFSEXPORTCIDRS = "host.k8s.nfs_export_cidrs"
+)
+
+//ExportReconcileInterval : period of the export rules reconciliation of published filesystems
+var ExportReconcileInterval = 10 * time.Minute
+
+//exportReconciler arrays whose driver filesystems are reconciled, by hostname with the last client seen for them
+var exportReconciler = struct {
+	sync.Mutex
+	arrays  map[string]api.Client
+	started bool
+}{arrays: make(map[string]api.Client)}
+
+//exportRuleOptions export rule settings of a node publish
+type exportRuleOptions struct {
+	access     string
+	rootSquash bool
+	cidrs      string
+}
+
+//publishExportRule record the node as published and give it access to the filesystem export
+func (cs *commonservice) publishExportRule(fileSystemID int64, nodeName, nodeIP string, options exportRuleOptions) error {
+	unlock, err := lockPublish(helper.FileSystemKey(fileSystemID))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	metadata := make(map[string]interface{})
+	metadata[NFSNODEREF+nodeIP] = nodeName
+	metadata[NFSNODEACCESS+nodeIP] = options.access
+	metadata[NFSROOTSQUASH] = strconv.FormatBool(options.rootSquash)
+	if options.cidrs != "" {
+		metadata[NFSEXPORTCIDRS] = options.cidrs
+	}
+	_, err = cs.api.AttachMetadataToObject(fileSystemID, metadata)
+	if err != nil {
+		log.Errorf("fail to add node %s reference to filesystem %d error %v", nodeIP, fileSystemID, err)
+		return err
+	}
+	if _, err = cs.reconcileExportRules(fileSystemID); err != nil {
+		return err
+	}
+	cs.registerExportReconcile()
+	return nil
+}
+
+//unpublishExportRule forget the node and remove the rules no published node needs anymore
+func (cs *commonservice) unpublishExportRule(fileSystemID int64, nodeIP string) error {
+	unlock, err := lockPublish(helper.FileSystemKey(fileSystemID))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return cs.removeExportNode(fileSystemID, nodeIP)
+}
+
+//removeExportNode forget the node and remove the rules no published node needs anymore, the publish lock is held
+func (cs *commonservice) removeExportNode(fileSystemID int64, nodeIP string) error {
+	for _, key := range []string{NFSNODEREF + nodeIP, NFSNODEACCESS + nodeIP} {
+		err := cs.api.DeleteMetadataKey(fileSystemID, key)
+		if err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+			log.Errorf("fail to remove node %s reference from filesystem %d error %v", nodeIP, fileSystemID, err)
+			return err
+		}
+	}
+	_, err := cs.reconcileExportRules(fileSystemID)
+	if err != nil && strings.Contains(err.Error(), "NOT_FOUND") {
+		log.Warnf("filesystem %d not found, no export rule to remove", fileSystemID)
+		return nil
+	}
+	return err
+}
+
+//reconcileExportRules make the export rules added by the driver match the nodes the filesystem is published to,
+//rules of the storage class nfs_export_permissions are left untouched.
+//A rule shared by nodes of the same range is RW as soon as one of them publishes RW
+func (cs *commonservice) reconcileExportRules(fileSystemID int64) (published int, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("error while reconciling export rules " + fmt.Sprint(res))
+		}
+	}()
+	metadataArray, err := cs.api.GetMetadata(fileSystemID)
+	if err != nil {
+		log.Errorf("fail to get metadata of filesystem %d error %v", fileSystemID, err)
+		return
+	}
+	nodeIPs := []string{}
+	nodeAccess := make(map[string]string)
+	managed := make(map[string]bool)
+	cidrs := ""
+	noRootSquash := NoRootSquash
+	for _, metadata := range *metadataArray {
+		if strings.HasPrefix(metadata.Key, NFSNODEREF) {
+			nodeIPs = append(nodeIPs, strings.TrimPrefix(metadata.Key, NFSNODEREF))
+		} else if strings.HasPrefix(metadata.Key, NFSNODEACCESS) {
+			nodeAccess[strings.TrimPrefix(metadata.Key, NFSNODEACCESS)] = metadata.Value
+		} else if strings.HasPrefix(metadata.Key, NFSRULEREF) {
+			managed[strings.TrimPrefix(metadata.Key, NFSRULEREF)] = true
+		} else if metadata.Key == NFSEXPORTCIDRS {
+			cidrs = metadata.Value
+		} else if metadata.Key == NFSROOTSQUASH {
+			noRootSquash = metadata.Value != "true"
+		}
+	}
+	desired := make(map[string]string)
+	for _, nodeIP := range nodeIPs {
+		client := exportClient(nodeIP, cidrs)
+		access := nodeAccess[nodeIP]
+		if access == "" {
+			access = NfsExportPermissions
+		}
+		if desired[client] != NfsExportPermissions {
+			desired[client] = access
+		}
+	}
+
+	for client := range managed {
+		if _, ok := desired[client]; ok {
+			continue
+		}
+		log.Debugf("remove export rule %s of filesystem %d", client, fileSystemID)
+		if err = cs.api.DeleteExportRule(fileSystemID, client); err != nil {
+			log.Errorf("fail to delete export rule %s of filesystem %d error %v", client, fileSystemID, err)
+			return
+		}
+		if err = cs.api.DeleteMetadataKey(fileSystemID, NFSRULEREF+client); err != nil {
+			log.Errorf("fail to remove export rule %s reference of filesystem %d error %v", client, fileSystemID, err)
+			return
+		}
+	}
+
+	exportArray, err := cs.api.GetExportByFileSystem(fileSystemID)
+	if err != nil {
+		log.Errorf("fail to get export of filesystem %d error %v", fileSystemID, err)
+		return
+	}
+	if exportArray == nil || len(*exportArray) == 0 {
+		if len(desired) > 0 {
+			err = fmt.Errorf("filesystem %d is not exported", fileSystemID)
+		}
+		return
+	}
+	export := (*exportArray)[0]
+	existing := make(map[string]api.Permissions)
+	for _, permission := range export.Permissions {
+		existing[permission.Client] = permission
+	}
+	for client, access := range desired {
+		if permission, ok := existing[client]; ok {
+			if !managed[client] || (strings.EqualFold(permission.Access, access) && permission.NoRootSquash == noRootSquash) {
+				continue
+			}
+			log.Debugf("update export rule %s of filesystem %d to access %s no_root_squash %t", client, fileSystemID, access, noRootSquash)
+			if err = cs.api.DeleteExportRule(fileSystemID, client); err != nil {
+				log.Errorf("fail to delete export rule %s of filesystem %d error %v", client, fileSystemID, err)
+				return
+			}
+		}
+		log.Debugf("add export rule %s to filesystem %d", client, fileSystemID)
+		if _, err = cs.api.AddNodeInExport(int(export.ID), access, noRootSquash, client); err != nil {
+			log.Errorf("fail to add export rule %s to filesystem %d error %v", client, fileSystemID, err)
+			return
+		}
+		if !managed[client] {
+			metadata := make(map[string]interface{})
+			metadata[NFSRULEREF+client] = "true"
+			if _, err = cs.api.AttachMetadataToObject(fileSystemID, metadata); err != nil {
+				log.Errorf("fail to add export rule %s reference to filesystem %d error %v", client, fileSystemID, err)
+				return
+			}
+		}
+	}
+	return len(nodeIPs), nil
+}
+
+//registerExportReconcile add the array of the client to the periodic reconciliation, started with the first registered array
+func (cs *commonservice) registerExportReconcile() {
+	client, ok := cs.api.(*api.ClientService)
+	if !ok || client.SecretsMap["hostname"] == "" {
+		return
+	}
+	exportReconciler.Lock()
+	defer exportReconciler.Unlock()
+	exportReconciler.arrays[client.SecretsMap["hostname"]] = client
+	if !exportReconciler.started {
+		exportReconciler.started = true
+		go runExportReconciler()
+	}
+}
+
+func runExportReconciler() {
+	ticker := time.NewTicker(ExportReconcileInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reconcileAllExportRules()
+	}
+}
+
+//reconcileAllExportRules reconcile the export rules of the driver filesystems of every registered array
+func reconcileAllExportRules() {
+	kc, err := buildKubeClient()
+	if err != nil {
+		log.Errorf("fail to build kubernetes client for export rules reconciliation error %v", err)
+		return
+	}
+	exportReconciler.Lock()
+	arrays := make(map[string]api.Client, len(exportReconciler.arrays))
+	for hostname, client := range exportReconciler.arrays {
+		arrays[hostname] = client
+	}
+	exportReconciler.Unlock()
+	for hostname, client := range arrays {
+		cs := commonservice{api: client}
+		if err := cs.reconcileArrayExportRules(kc); err != nil {
+			log.Errorf("fail to reconcile export rules of %s error %v", hostname, err)
+		}
+	}
+}
+
+//reconcileArrayExportRules reconcile the export rules of the driver filesystems of the array with the VolumeAttachments,
+//filesystems without a PV of the cluster are left untouched. Errors of one filesystem are logged and the others reconciled
+func (cs *commonservice) reconcileArrayExportRules(kc clientgo.KubeClient) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("error while reconciling export rules " + fmt.Sprint(res))
+		}
+	}()
+	cluster, err := cs.getClusterIndex(kc)
+	if err != nil {
+		return err
+	}
+	nodeIDs, err := kc.GetCSINodeIDs(csiDriverName())
+	if err != nil {
+		return err
+	}
+	nodeIPs := make(map[string]string)
+	for nodeName, nodeID := range nodeIDs {
+		if nodeNameIP := strings.Split(nodeID, "$$"); len(nodeNameIP) == 2 {
+			nodeIPs[nodeName] = nodeNameIP[1]
+		}
+	}
+	fileSystemIDs, err := cs.getDriverFileSystems()
+	if err != nil {
+		return err
+	}
+	for _, fileSystemID := range fileSystemIDs {
+		if _, ok := cluster.filesystems[fileSystemID]; !ok {
+			log.Debugf("filesystem %d has no PV in the cluster, export rules not reconciled", fileSystemID)
+			continue
+		}
+		attachedIPs, err := attachedNodeIPs(cluster, fileSystemID, nodeIPs)
+		if err != nil {
+			log.Warnf("%v, export rules not reconciled", err)
+			continue
+		}
+		unlock, err := lockPublish(helper.FileSystemKey(fileSystemID))
+		if err != nil {
+			log.Warnf("skip export rules reconciliation of filesystem %d error %v", fileSystemID, err)
+			continue
+		}
+		// the attachments were listed before the lock, they are listed again before a node loses its access
+		relist := func() (map[string]bool, error) {
+			current, err := cs.getClusterIndex(kc)
+			if err != nil {
+				return nil, err
+			}
+			return attachedNodeIPs(current, fileSystemID, nodeIPs)
+		}
+		err = cs.syncExportNodes(fileSystemID, attachedIPs, relist)
+		if err == nil {
+			_, err = cs.reconcileExportRules(fileSystemID)
+		}
+		unlock()
+		if err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+			log.Errorf("fail to reconcile export rules of filesystem %d error %v", fileSystemID, err)
+		}
+	}
+	return nil
+}
+
+//attachedNodeIPs return the ips of the nodes the filesystem is attached to, it fails when the ip of one is not known
+func attachedNodeIPs(cluster clusterIndex, fileSystemID int64, nodeIPs map[string]string) (map[string]bool, error) {
+	attachedIPs := make(map[string]bool)
+	for nodeName := range cluster.attachedNodes(fileSystemID) {
+		nodeIP, ok := nodeIPs[nodeName]
+		if !ok {
+			return nil, fmt.Errorf("node ID of node %s attached to filesystem %d not found", nodeName, fileSystemID)
+		}
+		attachedIPs[nodeIP] = true
+	}
+	return attachedIPs, nil
+}
+
+//getDriverFileSystems list the filesystems of the array carrying the PV name metadata of the driver
+func (cs *commonservice) getDriverFileSystems() ([]int64, error) {
+	fileSystemIDs := []int64{}
+	for page := 1; ; page++ {
+		metadataPage, err := cs.api.GetMetadataByKey("host.k8s.pvname", page)
+		if err != nil {
+			log.Errorf("fail to get objects of the driver error %v", err)
+			return nil, err
+		}
+		for _, metadata := range metadataPage.MetadataArry {
+			if strings.EqualFold(metadata.ObjectType, "FILESYSTEM") {
+				fileSystemIDs = append(fileSystemIDs, int64(metadata.ObjectId))
+			}
+		}
+		if page >= metadataPage.Pagemetadata.PagesTotal {
+			return fileSystemIDs, nil
+		}
+	}
+}
+
+//syncExportNodes make the published nodes of the filesystem the attached ones, the export rules follow them.
+//Nodes published but not attached are checked against relist, the current attachments, before they are forgotten
+func (cs *commonservice) syncExportNodes(fileSystemID int64, attachedIPs map[string]bool, relist func() (map[string]bool, error)) error {
+	metadataArray, err := cs.api.GetMetadata(fileSystemID)
+	if err != nil {
+		log.Errorf("fail to get metadata of filesystem %d error %v", fileSystemID, err)
+		return err
+	}
+	detached := []string{}
+	for _, metadata := range *metadataArray {
+		if strings.HasPrefix(metadata.Key, NFSNODEREF) && !attachedIPs[strings.TrimPrefix(metadata.Key, NFSNODEREF)] {
+			detached = append(detached, strings.TrimPrefix(metadata.Key, NFSNODEREF))
+		}
+	}
+	if len(detached) == 0 {
+		return nil
+	}
+	attachedIPs, err = relist()
+	if err != nil {
+		log.Errorf("fail to list the attachments of filesystem %d error %v", fileSystemID, err)
+		return err
+	}
+	for _, nodeIP := range detached {
+		if attachedIPs[nodeIP] {
+			continue
+		}
+		log.Infof("node %s is not attached to filesystem %d anymore, removing its export access", nodeIP, fileSystemID)
+		for _, key := range []string{NFSNODEREF + nodeIP, NFSNODEACCESS + nodeIP} {
+			if err = cs.api.DeleteMetadataKey(fileSystemID, key); err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+				log.Errorf("fail to remove node %s reference from filesystem %d error %v", nodeIP, fileSystemID, err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//exportClient return the export rule client of the node ip, the first configured CIDR or range holding the ip when any
+func exportClient(nodeIP, cidrs string) string {
+	ip := net.ParseIP(nodeIP)
+	if ip == nil {
+		return nodeIP
+	}
+	for _, entry := range strings.Split(cidrs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		first, last, err := parseExportRange(entry)
+		if err != nil {
+			log.Warnf("ignore invalid %s entry %s", KeyNfsExportCIDRs, entry)
+			continue
+		}
+		if bytes.Compare(ip.To16(), first.To16()) >= 0 && bytes.Compare(ip.To16(), last.To16()) <= 0 {
+			return first.String() + "-" + last.String()
+		}
+	}
+	return nodeIP
+}
+
+//parseExportRange return the first and last ip of an IPv4 CIDR or of an ip range first-last
+func parseExportRange(entry string) (first, last net.IP, err error) {
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil || ipNet.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("invalid IPv4 CIDR %s", entry)
+		}
+		start := binary.BigEndian.Uint32(ipNet.IP.To4())
+		end := start | ^binary.BigEndian.Uint32(net.IP(ipNet.Mask).To4())
+		first, last = make(net.IP, 4), make(net.IP, 4)
+		binary.BigEndian.PutUint32(first, start)
+		binary.BigEndian.PutUint32(last, end)
+		return first, last, nil
+	}
+	iprange := strings.Split(entry, "-")
+	if len(iprange) != 2 {
+		return nil, nil, fmt.Errorf("invalid ip range %s", entry)
+	}
+	first, last = net.ParseIP(strings.TrimSpace(iprange[0])), net.ParseIP(strings.TrimSpace(iprange[1]))
+	if first == nil || last == nil || bytes.Compare(first.To16(), last.To16()) > 0 {
+		return nil, nil, fmt.Errorf("invalid ip range %s", entry)
+	}
+	return first, last, nil
+}
+
+//exportAccess return the export rule access of the publish, RO for readonly publish and reader only access modes
+func exportAccess(req *csi.ControllerPublishVolumeRequest) string {
+	if req.GetReadonly() {
+		return NfsExportReadOnly
+	}
+	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		return NfsExportReadOnly
+	}
+	return NfsExportPermissions
+}
+
+//volumeAccess return the export access of the created volume, RO when every requested access mode is reader only
+func volumeAccess(capabilities []*csi.VolumeCapability) string {
+	if len(capabilities) == 0 {
+		return NfsExportPermissions
+	}
+	for _, capability := range capabilities {
+		switch capability.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		default:
+			return NfsExportPermissions
+		}
+	}
+	return NfsExportReadOnly
+}
+
+//squashExportPermissions apply nfs_root_squash to the storage class export rules,
+//squashed rules keep no root access and are made RO when the volume is requested RO
+func squashExportPermissions(permissions []map[string]interface{}, config map[string]string, access string) {
+	if rootSquash, _ := strconv.ParseBool(config[KeyNfsRootSquash]); !rootSquash {
+		return
+	}
+	for _, permission := range permissions {
+		permission["no_root_squash"] = false
+		if access == NfsExportReadOnly {
+			permission["access"] = NfsExportReadOnly
+		}
+	}
+}
+
+//validateSquashParameters check nfs_root_squash is a boolean and the anonymous uid and gid are ids
+func validateSquashParameters(config map[string]string) error {
+	if rootSquash := config[KeyNfsRootSquash]; rootSquash != "" {
+		if _, err := strconv.ParseBool(rootSquash); err != nil {
+			return fmt.Errorf("invalid %s value %s", KeyNfsRootSquash, rootSquash)
+		}
+	}
+	for _, key := range []string{KeyNfsAnonymousUID, KeyNfsAnonymousGID} {
+		if id := config[key]; id != "" {
+			if n, err := strconv.Atoi(id); err != nil || n < 1 {
+				return fmt.Errorf("invalid %s value %s, positive integer expected", key, id)
+			}
+		}
+	}
+	return nil
+}
+
+//validateExportCIDRs check every nfs_export_cidrs entry is a CIDR or an ip range
+func validateExportCIDRs(cidrs string) error {
+	for _, entry := range strings.Split(cidrs, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := parseExportRange(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -13,10 +13,12 @@ package storage
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -49,23 +51,16 @@ func (nfs *nfsstorage) NodePublishVolume(ctx context.Context, req *csi.NodePubli
 	if !notMnt {
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
-	mountOptions := []string{}
-	configMountOptions := req.GetVolumeContext()["nfs_mount_options"]
-	if configMountOptions == "" {
-		configMountOptions = MountOptions
-	}
-	for _, option := range strings.Split(configMountOptions, ",") {
-		if option != "" {
-			mountOptions = append(mountOptions, option)
-		}
-	}
+	mountOptions := getNfsMountOptions(req.GetVolumeContext()["nfs_mount_options"], req.GetVolumeContext()[KeyNfsVersion])
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
 
-	sourceIP := req.GetVolumeContext()["ipAddress"]
-	ep := req.GetVolumeContext()["volPathd"]
-	source := fmt.Sprintf("%s:%s", sourceIP, ep)
+	source, err := nfs.getMountSource(req.GetVolumeId(), req.GetVolumeContext())
+	if err != nil {
+		log.Errorf("fail to get mount source of volume %s error %v", req.GetVolumeId(), err)
+		return nil, err
+	}
 	log.Debugf("Mount sourcePath %v, tagetPath %v", source, targetPath)
 	err = nfs.mounter.Mount(source, targetPath, "nfs", mountOptions)
 	if err != nil {
@@ -75,6 +70,51 @@ func (nfs *nfsstorage) NodePublishVolume(ctx context.Context, req *csi.NodePubli
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+//getMountSource return the ip:path of the filesystem export. A volume context missing the export path
+//is completed from the export of the volume ID, and one missing the ip address from its network_space
+func (nfs *nfsstorage) getMountSource(volumeID string, volumeContext map[string]string) (string, error) {
+	ipAddress := volumeContext["ipAddress"]
+	exportPath := volumeContext["volPathd"]
+	if exportPath == "" {
+		volproto, err := volumeid.Parse(volumeID)
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid volume ID %s", volumeID)
+		}
+		exportID := volproto.ExportID
+		if value := volumeContext["exportID"]; value != "" {
+			if exportID, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", status.Errorf(codes.InvalidArgument, "invalid exportID %s of volume %s", value, volumeID)
+			}
+		}
+		exportArray, err := nfs.cs.api.GetExportByFileSystem(volproto.ObjectID)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "fail to get export of filesystem %d: %v", volproto.ObjectID, err)
+		}
+		if exportArray != nil {
+			for _, export := range *exportArray {
+				if exportID == 0 || export.ID == exportID {
+					exportPath = export.ExportPath
+					break
+				}
+			}
+		}
+		if exportPath == "" {
+			return "", status.Errorf(codes.NotFound, "export %d of filesystem %d not found", exportID, volproto.ObjectID)
+		}
+	}
+	if ipAddress == "" {
+		networkSpace := strings.TrimSpace(volumeContext["network_space"])
+		if networkSpace == "" {
+			return "", status.Errorf(codes.FailedPrecondition, "volume %s has neither ipAddress nor network_space", volumeID)
+		}
+		var err error
+		if ipAddress, err = nfs.cs.getNetworkSpaceIP(networkSpace); err != nil {
+			return "", status.Errorf(codes.Internal, "fail to get ip address of network space %s: %v", networkSpace, err)
+		}
+	}
+	return fmt.Sprintf("%s:%s", ipAddress, exportPath), nil
+}
+
 func (nfs *nfsstorage) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	log.Debug("NodeUnpublishVolume")
 	targetPath := req.GetTargetPath()
@@ -107,8 +147,7 @@ func (nfs *nfsstorage) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequ
 }
 
 func (nfs *nfsstorage) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, time.Now().String()+"---  NodePublishVolume not implemented")
-
+	return getVolumePathStats(req.GetVolumePath())
 }
 
 func (nfs *nfsstorage) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
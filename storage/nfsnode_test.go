@@ -13,6 +13,7 @@ package storage
 import (
 	"context"
 	"errors"
+	"infinibox-csi-driver/api"
 	"infinibox-csi-driver/helper"
 	"os"
 	"testing"
@@ -21,6 +22,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
@@ -80,6 +83,43 @@ func (suite *NodeSuite) Test_NodePublishVolume_success() {
 
 	assert.Nil(suite.T(), err, " error should be nil")
 }
+func (suite *NodeSuite) Test_NodePublishVolume_NfsVersion() {
+	service := nfsstorage{mounter: suite.nfsMountMock}
+	suite.nfsMountMock.On("IsNotMountPoint", mock.Anything).Return(true, nil)
+	suite.nfsMountMock.On("Mount", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	targetPath := "/var/lib/kublet/"
+	req := getNodePublishVolumeRequest(targetPath, getPublishContexMap())
+	req.VolumeContext = map[string]string{"ipAddress": "10.2.2.112", "volPathd": "/fs", KeyNfsVersion: NfsVersion41}
+	_, err := service.NodePublishVolume(context.Background(), req)
+
+	assert.Nil(suite.T(), err, " error should be nil")
+	suite.nfsMountMock.AssertCalled(suite.T(), "Mount", "10.2.2.112:/fs", targetPath, "nfs", []string{"hard", "rsize=1048576", "wsize=1048576", "vers=4.1"})
+}
+
+func (suite *NodeSuite) Test_getNfsMountOptions() {
+	assert.Equal(suite.T(), []string{"hard", "rsize=1048576", "wsize=1048576"}, getNfsMountOptions("", ""))
+	assert.Equal(suite.T(), []string{"soft", "vers=3"}, getNfsMountOptions("soft", NfsVersion3))
+	assert.Equal(suite.T(), []string{"hard", "nfsvers=4.1"}, getNfsMountOptions("hard,nfsvers=4.1", NfsVersion3), "configured version is kept")
+}
+
+func (suite *NodeSuite) Test_NodePublishVolume_ExportFromVolumeID() {
+	apiMock := new(api.MockApiService)
+	service := nfsstorage{cs: commonservice{api: apiMock}, mounter: suite.nfsMountMock}
+	suite.nfsMountMock.On("IsNotMountPoint", mock.Anything).Return(true, nil)
+	suite.nfsMountMock.On("Mount", "10.20.20.50:/fs2", mock.Anything, "nfs", mock.Anything).Return(nil)
+	apiMock.On("GetExportByFileSystem", int64(100)).Return([]api.ExportResponse{{ID: 3000, ExportPath: "/fs1"}, {ID: 3001, ExportPath: "/fs2"}}, nil)
+	apiMock.On("GetNetworkSpaceByName", "nas").Return(getNetworkSpace(), nil)
+	req := getNodePublishVolumeRequest("/var/lib/kublet/", map[string]string{"network_space": "nas"})
+	req.VolumeId = "v1$$nfs$$id=100;export=3001"
+	_, err := service.NodePublishVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "export path and ip address resolved from the volume ID and network space")
+
+	req = getNodePublishVolumeRequest("/var/lib/kublet/", map[string]string{"volPathd": "/fs2"})
+	req.VolumeId = "v1$$nfs$$id=100;export=3001"
+	_, err = service.NodePublishVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err))
+}
+
 func (suite *NodeSuite) Test_NodePublishVolume_mount_fail() {
 	mountErr := errors.New("mount error")
 	service := nfsstorage{mounter: suite.nfsMountMock}
@@ -156,6 +196,7 @@ func getNodePublishVolumeRequest(tagetPath string, publishContexMap map[string]s
 	return &csi.NodePublishVolumeRequest{
 		TargetPath:     tagetPath,
 		PublishContext: publishContexMap,
+		VolumeContext:  publishContexMap,
 	}
 }
 
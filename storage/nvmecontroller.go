@@ -0,0 +1,30 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+//NVMEPortType host port type of the NVMe host NQN
+const NVMEPortType = "NVMEOF"
+
+//CreateVolume create the volume as for iSCSI, the portals of the network space are the NVMe/TCP targets
+func (nvme *nvmestorage) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	return nvme.createVolume(req, validateParametersNVMe)
+}
+
+//ControllerPublishVolume map the volume to the host, hostPorts lists the NQNs already registered for the host
+func (nvme *nvmestorage) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return nvme.publishVolume(req, NVMEPortType)
+}
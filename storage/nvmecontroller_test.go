@@ -0,0 +1,76 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *NVMeControllerSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type NVMeControllerSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestNVMeControllerSuite(t *testing.T) {
+	suite.Run(t, new(NVMeControllerSuite))
+}
+
+func (suite *NVMeControllerSuite) Test_CreateVolume_ISCSIParameter_Fail() {
+	service := nvmestorage{iscsistorage: iscsistorage{cs: *suite.cs}}
+	crtValReq := getISCSICreateValumeRequest("pvname", getISCSICreateVolumeParamter())
+	_, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "useCHAP is not a nvme parameter")
+}
+
+func (suite *NVMeControllerSuite) Test_CreateVolume_VolumeExists() {
+	service := nvmestorage{iscsistorage: iscsistorage{cs: *suite.cs}}
+	crtValReq := getISCSICreateValumeRequest("pvname", getNVMeCreateVolumeParamter())
+	vol := getVolume()
+	vol.ParentId = 0
+	vol.PoolName = "pool_name1"
+	suite.api.On("GetVolumeByName", "pvname").Return(vol, nil)
+	suite.api.On("GetNetworkSpaceByName", "nvme_space").Return(getNetworkspace(), nil)
+	resp, err := service.CreateVolume(context.Background(), crtValReq)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "v1$$nvme$$id=100", resp.GetVolume().GetVolumeId())
+	assert.Equal(suite.T(), "10.20.30.40", resp.GetVolume().GetVolumeContext()["portals"])
+	suite.api.AssertNotCalled(suite.T(), "CreateVolume", mock.Anything, mock.Anything)
+}
+
+func (suite *NVMeControllerSuite) Test_ControllerPublishVolume_NQNPorts() {
+	service := nvmestorage{iscsistorage: iscsistorage{cs: *suite.cs}}
+	host := getHostByName()
+	host.Ports = append(host.Ports, api.HostPort{HostID: host.ID, PortType: NVMEPortType, PortAddress: "nqn.2014-08.org.nvmexpress:uuid:1234"})
+	suite.api.On("GetHostByName", mock.Anything).Return(host, nil)
+	suite.api.On("GetAllLunByHost", mock.Anything).Return(getLunInfoArry(), nil)
+	suite.api.On("MapVolumeToHost", mock.Anything).Return(getLunInf(), nil)
+	resp, err := service.ControllerPublishVolume(context.Background(), getISCSIControllerPublishVolumeRequest())
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "nqn.2014-08.org.nvmexpress:uuid:1234", resp.PublishContext["hostPorts"])
+}
+
+func getNVMeCreateVolumeParamter() map[string]string {
+	return map[string]string{"fstype": "ext4", "pool_name": "pool_name1", "network_space": "nvme_space", "provision_type": "THIN", "storage_protocol": "nvme", "ssd_enabled": "false", "max_vols_per_host": "10"}
+}
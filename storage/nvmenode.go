@@ -0,0 +1,389 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	nvmeDefaultPort    = "4420"
+	nvmeHostNQNFile    = "/host/etc/nvme/hostnqn"
+	nvmeSysBlockPath   = "/host/sys/block"
+	nvmeMultipathParam = "/host/sys/module/nvme_core/parameters/multipath"
+)
+
+var nvmeNamespaceRe = regexp.MustCompile(`^nvme\d+n\d+$`)
+
+//nvmeStateDir directory of the records of the NVMe volumes staged on the node, one file per volume
+var nvmeStateDir = "/host/var/lib/infinibox-csi/nvme"
+
+//nvmeSubsystems serialize the connections and disconnections of the NVMe subsystems of the node
+var nvmeSubsystems sync.Mutex
+
+//nvmeStage record of a staged NVMe volume, the subsystem is disconnected once no staged volume uses it
+type nvmeStage struct {
+	VolumeID     string `json:"volume_id"`
+	SubsystemNQN string `json:"subsystem_nqn"`
+	Device       string `json:"device"`
+}
+
+//nvmeCli the nvme-cli operations used by the node
+type nvmeCli interface {
+	HostNQN() (string, error)
+	Discover(address, port string) error
+	ConnectAll(address, port string) error
+	Disconnect(subsystemNQN string) error
+}
+
+//nvmeCommand run nvme-cli on the host
+type nvmeCommand struct{}
+
+//HostNQN return the NQN the host uses to connect to NVMe subsystems
+func (nvmeCommand) HostNQN() (string, error) {
+	out, err := ioutil.ReadFile(nvmeHostNQNFile)
+	if err != nil {
+		log.Errorf("fail to read host NQN from %s error %v", nvmeHostNQNFile, err)
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+//Discover query the discovery controller at the given address
+func (nvmeCommand) Discover(address, port string) error {
+	out, err := exec.Command("nvme", "discover", "-t", "tcp", "-a", address, "-s", port).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nvme discover on %s:%s failed: %s", address, port, string(out))
+	}
+	return nil
+}
+
+//ConnectAll connect all subsystems reported by the discovery controller at the given address
+func (nvmeCommand) ConnectAll(address, port string) error {
+	out, err := exec.Command("nvme", "connect-all", "-t", "tcp", "-a", address, "-s", port).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "already") {
+		return fmt.Errorf("nvme connect-all on %s:%s failed: %s", address, port, string(out))
+	}
+	return nil
+}
+
+//Disconnect disconnect every controller of the subsystem
+func (nvmeCommand) Disconnect(subsystemNQN string) error {
+	out, err := exec.Command("nvme", "disconnect", "-n", subsystemNQN).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nvme disconnect of %s failed: %s", subsystemNQN, string(out))
+	}
+	return nil
+}
+
+func (nvme *nvmestorage) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (resp *csi.NodeStageVolumeResponse, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from NVMe NodeStageVolume  " + fmt.Sprint(res))
+		}
+	}()
+	log.Info("NodeStageVolume called with ", req.GetPublishContext())
+	hostID := req.GetPublishContext()["hostID"]
+	ports := req.GetPublishContext()["hostPorts"]
+	hstID, _ := strconv.Atoi(hostID)
+	if hstID < 1 {
+		log.Errorf("hostID %d is not valid host ID", hstID)
+		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "not a valid host")
+	}
+	hostNQN, err := nvme.cli.HostNQN()
+	if err != nil || hostNQN == "" {
+		log.Error("host NQN not found")
+		return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, "host NQN not found")
+	}
+	if !strings.Contains(ports, hostNQN) {
+		log.Debug("host port is not created, creating one")
+		err = nvme.cs.AddPortForHost(hstID, NVMEPortType, hostNQN)
+		if err != nil {
+			log.Errorf("error creating host port %v", err)
+			return &csi.NodeStageVolumeResponse{}, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if multipath, err := ioutil.ReadFile(nvmeMultipathParam); err == nil && strings.TrimSpace(string(multipath)) != "Y" {
+		log.Warn("native NVMe multipath is disabled on the host, namespaces are used through a single path")
+	}
+	serial := req.GetVolumeContext()["serial"]
+	if serial == "" {
+		return nil, status.Error(codes.FailedPrecondition, "volume serial not found in volume context")
+	}
+
+	nvmeSubsystems.Lock()
+	defer nvmeSubsystems.Unlock()
+	if stage, err := loadNvmeStage(req.GetVolumeId()); err == nil && findNvmeNamespace(nvmeSysBlockPath, serial) == stage.Device {
+		log.Debugf("volume %s already staged as %s", req.GetVolumeId(), stage.Device)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+	portals := nvme.removeDuplicate(strings.Split(req.GetVolumeContext()["portals"], ","))
+	if err := nvme.connectPortals(portals); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	devicePath := ""
+	for i := 0; i < 10 && devicePath == ""; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		devicePath = findNvmeNamespace(nvmeSysBlockPath, serial)
+	}
+	if devicePath == "" {
+		return nil, status.Errorf(codes.Internal, "namespace of volume %s not found", req.GetVolumeId())
+	}
+	subsystemNQN, err := getNvmeSubsystemNQN(nvmeSysBlockPath, path.Base(devicePath))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "subsystem of namespace %s not found: %v", devicePath, err)
+	}
+	err = saveNvmeStage(nvmeStage{VolumeID: req.GetVolumeId(), SubsystemNQN: subsystemNQN, Device: devicePath})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Debugf("volume %s is namespace %s of subsystem %s", req.GetVolumeId(), devicePath, subsystemNQN)
+	log.Debug("NodeStageVolume completed")
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (nvme *nvmestorage) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	log.Debugf("NodePublishVolume called")
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability not provided")
+	}
+	// the subsystem is connected by NodeStageVolume, volumes staged by earlier versions are looked up by serial
+	devicePath := ""
+	if stage, err := loadNvmeStage(req.GetVolumeId()); err == nil {
+		devicePath = stage.Device
+	} else if serial := req.GetVolumeContext()["serial"]; serial != "" {
+		devicePath = findNvmeNamespace(nvmeSysBlockPath, serial)
+	}
+	if devicePath == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "namespace of volume %s not found, the volume is not staged", req.GetVolumeId())
+	}
+	log.Debugf("volume %s is namespace %s", req.GetVolumeId(), devicePath)
+	portals := nvme.removeDuplicate(strings.Split(req.GetVolumeContext()["portals"], ","))
+
+	diskMounter := nvme.getISCSIDiskMounter(&iscsiDisk{
+		Portals: portals,
+		VolName: getVolumeName(req.GetVolumeId()),
+	}, req)
+	switch volCap.GetAccessType().(type) {
+	case *csi.VolumeCapability_Block:
+		diskMounter.isBlock = true
+	}
+	notMnt, err := diskMounter.mounter.IsLikelyNotMountPoint(diskMounter.targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "Heuristic determination of mount point failed:%v", err)
+	}
+	if !notMnt {
+		log.Infof("nvme: %s already mounted", diskMounter.targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	_, err = nvme.mountDisk(*diskMounter, devicePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+//NodeUnstageVolume the subsystem is shared by the volumes of the host, it is disconnected with the last staged volume
+func (nvme *nvmestorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	log.Info("Called NVMe NodeUnstageVolume")
+	nvmeSubsystems.Lock()
+	defer nvmeSubsystems.Unlock()
+	stage, err := loadNvmeStage(req.GetVolumeId())
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("nvme: failed to read stage record of volume %s Error: %v", req.GetVolumeId(), err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err == nil {
+		stages, err := listNvmeStages()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		inUse := false
+		for _, other := range stages {
+			if other.VolumeID != stage.VolumeID && other.SubsystemNQN == stage.SubsystemNQN {
+				inUse = true
+				break
+			}
+		}
+		if inUse {
+			log.Debugf("subsystem %s is still used by other staged volumes", stage.SubsystemNQN)
+		} else if err := nvme.cli.Disconnect(stage.SubsystemNQN); err != nil {
+			log.Errorf("nvme: %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := os.Remove(nvmeStagePath(stage.VolumeID)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("nvme: failed to remove stage record of volume %s Error: %v", stage.VolumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := os.RemoveAll(path.Join("/host", req.GetStagingTargetPath())); err != nil {
+		log.Errorf("nvme: failed to remove stage path Error: %v", err)
+		return nil, err
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+//nvmeStagePath return the file of the stage record of the volume
+func nvmeStagePath(volumeID string) string {
+	return path.Join(nvmeStateDir, strings.NewReplacer("/", "_", "$", "_").Replace(volumeID)+".json")
+}
+
+func saveNvmeStage(stage nvmeStage) error {
+	if err := os.MkdirAll(nvmeStateDir, 0750); err != nil {
+		return fmt.Errorf("nvme: create %s err %v", nvmeStateDir, err)
+	}
+	data, err := json.Marshal(stage)
+	if err != nil {
+		return fmt.Errorf("nvme: encode err: %v", err)
+	}
+	if err = ioutil.WriteFile(nvmeStagePath(stage.VolumeID), data, 0640); err != nil {
+		return fmt.Errorf("nvme: write stage record of volume %s err %v", stage.VolumeID, err)
+	}
+	return nil
+}
+
+func loadNvmeStage(volumeID string) (stage nvmeStage, err error) {
+	data, err := ioutil.ReadFile(nvmeStagePath(volumeID))
+	if err != nil {
+		return stage, err
+	}
+	err = json.Unmarshal(data, &stage)
+	return stage, err
+}
+
+//listNvmeStages return the records of the volumes staged on the node
+func listNvmeStages() ([]nvmeStage, error) {
+	files, err := ioutil.ReadDir(nvmeStateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("nvme: list %s err %v", nvmeStateDir, err)
+	}
+	stages := []nvmeStage{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(path.Join(nvmeStateDir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("nvme: read %s err %v", f.Name(), err)
+		}
+		var stage nvmeStage
+		if err = json.Unmarshal(data, &stage); err != nil {
+			log.Warnf("nvme: invalid stage record %s skipped, error %v", f.Name(), err)
+			continue
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+//getNvmeSubsystemNQN return the NQN of the subsystem of the namespace, its device is the subsystem or a controller of it
+func getNvmeSubsystemNQN(sysBlockPath, namespace string) (string, error) {
+	nqn, err := ioutil.ReadFile(path.Join(sysBlockPath, namespace, "device", "subsysnqn"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(nqn)), nil
+}
+
+//connectPortals connect the subsystems of every portal, it fails only when no portal can be connected
+func (nvme *nvmestorage) connectPortals(portals []string) error {
+	connected := 0
+	var lastErr error
+	for _, portal := range portals {
+		if portal == "" {
+			continue
+		}
+		address, port := nvmePortal(portal)
+		if err := nvme.cli.Discover(address, port); err != nil {
+			log.Errorf("nvme: %v", err)
+			lastErr = err
+			continue
+		}
+		if err := nvme.cli.ConnectAll(address, port); err != nil {
+			log.Errorf("nvme: %v", err)
+			lastErr = err
+			continue
+		}
+		connected++
+	}
+	if connected == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no portal found in volume context")
+		}
+		return fmt.Errorf("nvme: failed to connect any portal: %v", lastErr)
+	}
+	return nil
+}
+
+//nvmePortal split the portal into address and port, the default NVMe/TCP port is used when not given
+func nvmePortal(portal string) (string, string) {
+	if address, port, err := net.SplitHostPort(portal); err == nil {
+		return address, port
+	}
+	return portal, nvmeDefaultPort
+}
+
+//findNvmeNamespace return the device of the namespace whose NGUID or WWID carries the volume serial,
+//with native multipath there is one device per namespace whatever the number of paths
+func findNvmeNamespace(sysBlockPath, serial string) string {
+	serial = normalizeNvmeID(serial)
+	dirs, err := ioutil.ReadDir(sysBlockPath)
+	if err != nil {
+		log.Errorf("failed to list block devices with error %v", err)
+		return ""
+	}
+	for _, f := range dirs {
+		name := f.Name()
+		if !nvmeNamespaceRe.MatchString(name) {
+			continue
+		}
+		for _, attr := range []string{"nguid", "wwid"} {
+			id, err := ioutil.ReadFile(path.Join(sysBlockPath, name, attr))
+			if err != nil {
+				continue
+			}
+			if nguid := normalizeNvmeID(string(id)); nguid != "" && strings.Contains(nguid, serial) {
+				return path.Join("/host/dev", name)
+			}
+		}
+	}
+	return ""
+}
+
+func normalizeNvmeID(id string) string {
+	id = strings.ToLower(strings.TrimSpace(id))
+	for _, prefix := range []string{"eui.", "nvme.", "uuid."} {
+		id = strings.TrimPrefix(id, prefix)
+	}
+	return strings.NewReplacer("-", "", ":", "", " ", "").Replace(id)
+}
@@ -0,0 +1,189 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"infinibox-csi-driver/api"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *NVMeNodeSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cli = new(NvmeCliMock)
+	suite.service = &nvmestorage{iscsistorage: iscsistorage{cs: commonservice{api: suite.api}}, cli: suite.cli}
+	suite.stateDir = nvmeStateDir
+	dir, err := ioutil.TempDir("", "nvme-state-")
+	assert.Nil(suite.T(), err, "error not expected")
+	nvmeStateDir = dir
+}
+
+func (suite *NVMeNodeSuite) TearDownTest() {
+	os.RemoveAll(nvmeStateDir)
+	nvmeStateDir = suite.stateDir
+}
+
+type NVMeNodeSuite struct {
+	suite.Suite
+	api      *api.MockApiService
+	cli      *NvmeCliMock
+	service  *nvmestorage
+	stateDir string
+}
+
+func TestNVMeNodeSuite(t *testing.T) {
+	suite.Run(t, new(NVMeNodeSuite))
+}
+
+func (suite *NVMeNodeSuite) Test_NodeStageVolume_RegisterNQN() {
+	suite.cli.On("HostNQN").Return("nqn.2014-08.org.nvmexpress:uuid:1234", nil)
+	suite.api.On("AddHostPort", NVMEPortType, "nqn.2014-08.org.nvmexpress:uuid:1234", 10).Return(api.HostPort{}, nil)
+	req := &csi.NodeStageVolumeRequest{PublishContext: map[string]string{"hostID": "10", "hostPorts": ""}}
+	_, err := suite.service.NodeStageVolume(context.Background(), req)
+	assert.NotNil(suite.T(), err, "serial is required to connect the namespace")
+	suite.api.AssertCalled(suite.T(), "AddHostPort", NVMEPortType, "nqn.2014-08.org.nvmexpress:uuid:1234", 10)
+}
+
+func (suite *NVMeNodeSuite) Test_NodeStageVolume_NQNRegistered() {
+	suite.cli.On("HostNQN").Return("nqn.2014-08.org.nvmexpress:uuid:1234", nil)
+	req := &csi.NodeStageVolumeRequest{PublishContext: map[string]string{"hostID": "10", "hostPorts": "nqn.2014-08.org.nvmexpress:uuid:1234"}}
+	suite.service.NodeStageVolume(context.Background(), req)
+	suite.api.AssertNotCalled(suite.T(), "AddHostPort", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *NVMeNodeSuite) Test_NodeStageVolume_NoNQN() {
+	suite.cli.On("HostNQN").Return("", errors.New("no such file"))
+	req := &csi.NodeStageVolumeRequest{PublishContext: map[string]string{"hostID": "10"}}
+	_, err := suite.service.NodeStageVolume(context.Background(), req)
+	assert.NotNil(suite.T(), err, "host NQN is required")
+}
+
+func (suite *NVMeNodeSuite) Test_connectPortals_OnePortalDown() {
+	suite.cli.On("Discover", "10.0.0.1", nvmeDefaultPort).Return(errors.New("no route to host"))
+	suite.cli.On("Discover", "10.0.0.2", "4421").Return(nil)
+	suite.cli.On("ConnectAll", "10.0.0.2", "4421").Return(nil)
+	err := suite.service.connectPortals([]string{"10.0.0.1", "10.0.0.2:4421"})
+	assert.Nil(suite.T(), err, "one connected portal is enough")
+}
+
+func (suite *NVMeNodeSuite) Test_connectPortals_AllDown() {
+	suite.cli.On("Discover", mock.Anything, mock.Anything).Return(nil)
+	suite.cli.On("ConnectAll", mock.Anything, mock.Anything).Return(errors.New("connection refused"))
+	err := suite.service.connectPortals([]string{"10.0.0.1", "10.0.0.2"})
+	assert.NotNil(suite.T(), err, "no portal connected")
+}
+
+func (suite *NVMeNodeSuite) Test_NodePublishVolume_NoSerial() {
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "100$$nvme",
+		VolumeCapability: &csi.VolumeCapability{},
+		VolumeContext:    map[string]string{"portals": "10.0.0.1"},
+	}
+	_, err := suite.service.NodePublishVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err), "volume is not staged")
+	suite.cli.AssertNotCalled(suite.T(), "Discover", mock.Anything, mock.Anything)
+	suite.cli.AssertNotCalled(suite.T(), "ConnectAll", mock.Anything, mock.Anything)
+}
+
+func (suite *NVMeNodeSuite) Test_NodeUnstageVolume_LastVolume() {
+	assert.Nil(suite.T(), saveNvmeStage(nvmeStage{VolumeID: "100$$nvme", SubsystemNQN: "nqn.ibox", Device: "/host/dev/nvme0n1"}))
+	suite.cli.On("Disconnect", "nqn.ibox").Return(nil)
+	_, err := suite.service.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "100$$nvme", StagingTargetPath: "/tmp/nvme-stage-missing"})
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.cli.AssertCalled(suite.T(), "Disconnect", "nqn.ibox")
+	_, err = loadNvmeStage("100$$nvme")
+	assert.True(suite.T(), os.IsNotExist(err), "stage record should be removed")
+}
+
+func (suite *NVMeNodeSuite) Test_NodeUnstageVolume_SubsystemInUse() {
+	assert.Nil(suite.T(), saveNvmeStage(nvmeStage{VolumeID: "100$$nvme", SubsystemNQN: "nqn.ibox", Device: "/host/dev/nvme0n1"}))
+	assert.Nil(suite.T(), saveNvmeStage(nvmeStage{VolumeID: "101$$nvme", SubsystemNQN: "nqn.ibox", Device: "/host/dev/nvme0n2"}))
+	_, err := suite.service.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "100$$nvme", StagingTargetPath: "/tmp/nvme-stage-missing"})
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.cli.AssertNotCalled(suite.T(), "Disconnect", mock.Anything)
+	stages, _ := listNvmeStages()
+	assert.Equal(suite.T(), []nvmeStage{{VolumeID: "101$$nvme", SubsystemNQN: "nqn.ibox", Device: "/host/dev/nvme0n2"}}, stages)
+}
+
+func (suite *NVMeNodeSuite) Test_NodeUnstageVolume_NotRecorded() {
+	_, err := suite.service.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: "100$$nvme", StagingTargetPath: "/tmp/nvme-stage-missing"})
+	assert.Nil(suite.T(), err, "volumes staged by earlier versions are unstaged")
+	suite.cli.AssertNotCalled(suite.T(), "Disconnect", mock.Anything)
+}
+
+func (suite *NVMeNodeSuite) Test_getNvmeSubsystemNQN() {
+	sysBlock, err := ioutil.TempDir("", "sys-block-")
+	assert.Nil(suite.T(), err, "error not expected")
+	defer os.RemoveAll(sysBlock)
+	writeSysAttr(suite.T(), sysBlock, "nvme0n1/device", "subsysnqn", "nqn.2009-11.com.infinidat:storage:infinibox-sn-1234")
+	nqn, err := getNvmeSubsystemNQN(sysBlock, "nvme0n1")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "nqn.2009-11.com.infinidat:storage:infinibox-sn-1234", nqn)
+}
+
+func (suite *NVMeNodeSuite) Test_findNvmeNamespace() {
+	sysBlock, err := ioutil.TempDir("", "sys-block-")
+	assert.Nil(suite.T(), err, "error not expected")
+	defer os.RemoveAll(sysBlock)
+	writeSysAttr(suite.T(), sysBlock, "nvme0c0n1", "nguid", "742b0f00-0004-e780-0000-000000001234")
+	writeSysAttr(suite.T(), sysBlock, "nvme0n1", "wwid", "eui.742b0f000004e78000000000000099aa")
+	writeSysAttr(suite.T(), sysBlock, "nvme0n2", "nguid", "742b0f00-0004-e780-0000-000000001234")
+
+	assert.Equal(suite.T(), "/host/dev/nvme0n2", findNvmeNamespace(sysBlock, "742B0F000004E780000000000000 1234"))
+	assert.Equal(suite.T(), "/host/dev/nvme0n1", findNvmeNamespace(sysBlock, "742b0f000004e78000000000000099aa"))
+	assert.Equal(suite.T(), "", findNvmeNamespace(sysBlock, "742b0f000004e78000000000000055bb"))
+}
+
+func writeSysAttr(t *testing.T, sysBlock, device, attr, value string) {
+	assert.Nil(t, os.MkdirAll(path.Join(sysBlock, device), 0750))
+	assert.Nil(t, ioutil.WriteFile(path.Join(sysBlock, device, attr), []byte(value+"\n"), 0640))
+}
+
+//NvmeCliMock - nvme-cli stand-in
+type NvmeCliMock struct {
+	mock.Mock
+}
+
+func (m *NvmeCliMock) HostNQN() (string, error) {
+	args := m.Called()
+	nqn, _ := args.Get(0).(string)
+	err, _ := args.Get(1).(error)
+	return nqn, err
+}
+
+func (m *NvmeCliMock) Discover(address, port string) error {
+	args := m.Called(address, port)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (m *NvmeCliMock) Disconnect(subsystemNQN string) error {
+	args := m.Called(subsystemNQN)
+	err, _ := args.Get(0).(error)
+	return err
+}
+
+func (m *NvmeCliMock) ConnectAll(address, port string) error {
+	args := m.Called(address, port)
+	err, _ := args.Get(0).(error)
+	return err
+}
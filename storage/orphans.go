@@ -0,0 +1,549 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
+	"infinibox-csi-driver/helper"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
+
+	csictx "github.com/rexray/gocsi/context"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+const (
+	//OrphanReconcileIntervalEnv : period of the orphan reconciliation of the controller, disabled when not set or "0"
+	OrphanReconcileIntervalEnv = "ORPHAN_RECONCILE_INTERVAL"
+
+	//OrphanReconcileCleanupEnv : "true" remove the orphan export rules and LUN mappings found by the periodic reconciliation
+	OrphanReconcileCleanupEnv = "ORPHAN_RECONCILE_CLEANUP"
+)
+
+//OrphanReport result of the cross check of the driver objects of an array with the PVs of the cluster.
+//Orphan volumes, filesystems and treeqs are only reported, the cleanup removes orphan access only
+type OrphanReport struct {
+	Time              string          `json:"time"`
+	Array             string          `json:"array,omitempty"`
+	OrphanObjects     []OrphanObject  `json:"orphan_objects"`
+	MissingObjects    []MissingObject `json:"missing_objects"`
+	OrphanExportRules []OrphanAccess  `json:"orphan_export_rules"`
+	OrphanLunMappings []OrphanAccess  `json:"orphan_lun_mappings"`
+	Cleaned           []OrphanAccess  `json:"cleaned,omitempty"`
+	Errors            []string        `json:"errors,omitempty"`
+}
+
+//OrphanObject volume, filesystem or treeq created by the driver without PV
+type OrphanObject struct {
+	Type         string `json:"type"`
+	ID           int64  `json:"id"`
+	FileSystemID int64  `json:"filesystem_id,omitempty"`
+	Name         string `json:"name"`
+}
+
+//MissingObject PV whose volume, filesystem or treeq is gone from the array
+type MissingObject struct {
+	PVName       string `json:"pv_name"`
+	VolumeHandle string `json:"volume_handle"`
+}
+
+//OrphanAccess export rule or LUN mapping of a node the PV is not attached to
+type OrphanAccess struct {
+	Type     string `json:"type"`
+	ObjectID int64  `json:"object_id"`
+	PVName   string `json:"pv_name,omitempty"`
+	Node     string `json:"node,omitempty"`
+	Client   string `json:"client"`
+}
+
+//clusterIndex PVs of the driver by backend object, and the nodes each PV is attached to
+type clusterIndex struct {
+	volumes     map[int64]string
+	filesystems map[int64]string
+	treeqs      map[string]string
+	attached    map[string]map[string]bool
+
+	//objects : every PV of a volume or filesystem, several once restored in place
+	objects map[int64][]string
+}
+
+//attachedNodes return the nodes any PV of the volume or filesystem is attached to
+func (cluster clusterIndex) attachedNodes(objectID int64) map[string]bool {
+	nodes := make(map[string]bool)
+	for _, pvName := range cluster.objects[objectID] {
+		for nodeName := range cluster.attached[pvName] {
+			nodes[nodeName] = true
+		}
+	}
+	return nodes
+}
+
+//orphanReconciler arrays reconciled periodically, by hostname with the last client seen for them
+var orphanReconciler = struct {
+	sync.Mutex
+	arrays  map[string]api.Client
+	started bool
+}{arrays: make(map[string]api.Client)}
+
+//ReconcileOrphans cross check the driver objects of the array of the secrets with the PVs and volume attachments of the cluster
+func ReconcileOrphans(driverName string, cleanup bool, secrets map[string]string) (*OrphanReport, error) {
+	cs, err := buildCommonService(map[string]string{}, secrets)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := clientgo.BuildClient()
+	if err != nil {
+		return nil, err
+	}
+	report, err := cs.reconcileOrphans(kc, driverName, cleanup)
+	if report != nil {
+		report.Array = secrets["hostname"]
+	}
+	return report, err
+}
+
+//registerOrphanReconcile add the array of the client to the periodic orphan reconciliation when it is enabled
+func (cs *commonservice) registerOrphanReconcile() {
+	client, ok := cs.api.(*api.ClientService)
+	if !ok || client.SecretsMap["hostname"] == "" {
+		return
+	}
+	value, ok := csictx.LookupEnv(context.Background(), OrphanReconcileIntervalEnv)
+	if !ok || value == "" || value == "0" {
+		return
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Warnf("invalid %s value %s, orphan reconciliation disabled", OrphanReconcileIntervalEnv, value)
+		return
+	}
+	orphanReconciler.Lock()
+	defer orphanReconciler.Unlock()
+	orphanReconciler.arrays[client.SecretsMap["hostname"]] = client
+	if !orphanReconciler.started {
+		orphanReconciler.started = true
+		go runOrphanReconciler(interval)
+	}
+}
+
+//buildKubeClient kubernetes client of the controller
+var buildKubeClient = func() (clientgo.KubeClient, error) {
+	return clientgo.BuildClient()
+}
+
+//csiDriverName return the name the driver is registered with, the attacher of its volume attachments
+func csiDriverName() string {
+	if name, ok := csictx.LookupEnv(context.Background(), "CSI_DRIVER_NAME"); ok && name != "" {
+		return name
+	}
+	return Name
+}
+
+//getClusterIndex index the PVs of the array and the volume attachments of the driver
+func (cs *commonservice) getClusterIndex(kc clientgo.KubeClient) (clusterIndex, error) {
+	cluster, _, err := cs.listClusterIndex(kc, csiDriverName())
+	return cluster, err
+}
+
+//listClusterIndex index the PVs of the array and the attachments of the driver, the PVs are returned too
+func (cs *commonservice) listClusterIndex(kc clientgo.KubeClient, driverName string) (clusterIndex, []v1.PersistentVolume, error) {
+	pvs, err := kc.ListPersistentVolumes(driverName)
+	if err != nil {
+		return clusterIndex{}, nil, err
+	}
+	if client, ok := cs.api.(*api.ClientService); ok {
+		pvs = arrayPersistentVolumes(pvs, client.SecretsMap["hostname"])
+	}
+	vas, err := kc.ListVolumeAttachments(driverName)
+	if err != nil {
+		return clusterIndex{}, nil, err
+	}
+	return buildClusterIndex(pvs, vas), pvs, nil
+}
+
+//getAttachedNodes return the nodes any PV of the volume or filesystem is attached to
+func (cs *commonservice) getAttachedNodes(objectID int64) (map[string]bool, error) {
+	kc, err := buildKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := cs.getClusterIndex(kc)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.attachedNodes(objectID), nil
+}
+
+func runOrphanReconciler(interval time.Duration) {
+	driverName := csiDriverName()
+	cleanup := false
+	if value, ok := csictx.LookupEnv(context.Background(), OrphanReconcileCleanupEnv); ok {
+		cleanup, _ = strconv.ParseBool(value)
+	}
+	log.Infof("orphan reconciliation every %v, cleanup %t", interval, cleanup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		kc, err := clientgo.BuildClient()
+		if err != nil {
+			log.Errorf("fail to build kubernetes client for orphan reconciliation error %v", err)
+			continue
+		}
+		orphanReconciler.Lock()
+		arrays := make(map[string]api.Client, len(orphanReconciler.arrays))
+		for hostname, client := range orphanReconciler.arrays {
+			arrays[hostname] = client
+		}
+		orphanReconciler.Unlock()
+		for hostname, client := range arrays {
+			cs := commonservice{api: client}
+			report, err := cs.reconcileOrphans(kc, driverName, cleanup)
+			if err != nil {
+				log.Errorf("fail to reconcile orphans of %s error %v", hostname, err)
+				continue
+			}
+			report.Array = hostname
+			out, _ := json.Marshal(report)
+			log.Infof("orphan report %s", string(out))
+		}
+	}
+}
+
+//reconcileOrphans build the orphan report of the array, errors on single objects are kept in the report
+func (cs *commonservice) reconcileOrphans(kc clientgo.KubeClient, driverName string, cleanup bool) (report *OrphanReport, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("error while reconciling orphans " + fmt.Sprint(res))
+		}
+	}()
+	cluster, pvs, err := cs.listClusterIndex(kc, driverName)
+	if err != nil {
+		return nil, err
+	}
+	nodeIDs, err := kc.GetCSINodeIDs(driverName)
+	if err != nil {
+		return nil, err
+	}
+	report = &OrphanReport{
+		Time:              time.Now().UTC().Format(time.RFC3339),
+		OrphanObjects:     []OrphanObject{},
+		MissingObjects:    []MissingObject{},
+		OrphanExportRules: []OrphanAccess{},
+		OrphanLunMappings: []OrphanAccess{},
+	}
+	taggedVolumes, err := cs.findOrphanObjects(cluster, report)
+	if err != nil {
+		return nil, err
+	}
+	cs.findMissingObjects(pvs, report)
+	// the cleanup lists the attachments again under the publish lock, an object attached since the report is kept
+	var relist func() (clusterIndex, error)
+	if cleanup {
+		relist = func() (clusterIndex, error) {
+			current, _, err := cs.listClusterIndex(kc, driverName)
+			return current, err
+		}
+	}
+	cs.findOrphanExportRules(cluster, nodeIDs, relist, report)
+	cs.findOrphanLunMappings(cluster, taggedVolumes, nodeIDs, relist, report)
+	return report, nil
+}
+
+//buildClusterIndex index the PVs by backend object and the attachments by PV
+func buildClusterIndex(pvs []v1.PersistentVolume, vas []storagev1.VolumeAttachment) clusterIndex {
+	cluster := clusterIndex{
+		volumes:     make(map[int64]string),
+		filesystems: make(map[int64]string),
+		treeqs:      make(map[string]string),
+		attached:    make(map[string]map[string]bool),
+		objects:     make(map[int64][]string),
+	}
+	for _, pv := range pvs {
+		volproto, err := volumeid.Parse(pv.Spec.CSI.VolumeHandle)
+		if err != nil {
+			continue
+		}
+		switch volproto.Protocol {
+		case "fc", "iscsi", "nvme":
+			cluster.volumes[volproto.ObjectID] = pv.Name
+			cluster.objects[volproto.ObjectID] = append(cluster.objects[volproto.ObjectID], pv.Name)
+		case "nfs":
+			cluster.filesystems[volproto.ObjectID] = pv.Name
+			cluster.objects[volproto.ObjectID] = append(cluster.objects[volproto.ObjectID], pv.Name)
+		case NFSTREEQ:
+			cluster.treeqs[fmt.Sprintf("%d#%d", volproto.ObjectID, volproto.TreeqID)] = pv.Name
+		}
+	}
+	for _, va := range vas {
+		pvName := va.Spec.Source.PersistentVolumeName
+		if pvName == nil {
+			continue
+		}
+		if cluster.attached[*pvName] == nil {
+			cluster.attached[*pvName] = make(map[string]bool)
+		}
+		cluster.attached[*pvName][va.Spec.NodeName] = true
+	}
+	return cluster
+}
+
+//findOrphanObjects report the objects tagged with a PV name that no PV uses, objects waiting for the sweep are left out.
+//It returns the ids of all tagged volumes
+func (cs *commonservice) findOrphanObjects(cluster clusterIndex, report *OrphanReport) (map[int64]bool, error) {
+	taggedVolumes := make(map[int64]bool)
+	for page := 1; ; page++ {
+		metadataPage, err := cs.api.GetMetadataByKey("host.k8s.pvname", page)
+		if err != nil {
+			log.Errorf("fail to get objects tagged with pv name error %v", err)
+			return nil, err
+		}
+		for _, metadata := range metadataPage.MetadataArry {
+			objectID := int64(metadata.ObjectId)
+			switch strings.ToUpper(metadata.ObjectType) {
+			case "VOLUME":
+				taggedVolumes[objectID] = true
+				if _, ok := cluster.volumes[objectID]; !ok && !cs.markedToBeDeleted(objectID, report) {
+					report.OrphanObjects = append(report.OrphanObjects, OrphanObject{Type: "volume", ID: objectID, Name: metadata.Value})
+				}
+			case "FILESYSTEM":
+				cs.findOrphanFileSystem(objectID, metadata.Value, cluster, report)
+			}
+		}
+		if page >= metadataPage.Pagemetadata.PagesTotal {
+			return taggedVolumes, nil
+		}
+	}
+}
+
+//findOrphanFileSystem report the filesystem without PV, or for a treeq filesystem its treeqs without PV
+func (cs *commonservice) findOrphanFileSystem(fileSystemID int64, pvName string, cluster clusterIndex, report *OrphanReport) {
+	metadataArray, err := cs.api.GetMetadata(fileSystemID)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("fail to get metadata of filesystem %d: %v", fileSystemID, err))
+		return
+	}
+	treeqFileSystem := false
+	for _, metadata := range *metadataArray {
+		if metadata.Key == TOBEDELETED {
+			return
+		}
+		if metadata.Key == TREEQCOUNT {
+			treeqFileSystem = true
+		}
+	}
+	if !treeqFileSystem {
+		if _, ok := cluster.filesystems[fileSystemID]; !ok {
+			report.OrphanObjects = append(report.OrphanObjects, OrphanObject{Type: "filesystem", ID: fileSystemID, Name: pvName})
+		}
+		return
+	}
+	treeqs, err := cs.api.GetTreeqsByFileSystemID(fileSystemID)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("fail to get treeqs of filesystem %d: %v", fileSystemID, err))
+		return
+	}
+	for _, treeq := range treeqs {
+		if _, ok := cluster.treeqs[fmt.Sprintf("%d#%d", fileSystemID, treeq.ID)]; !ok {
+			report.OrphanObjects = append(report.OrphanObjects, OrphanObject{Type: "treeq", ID: treeq.ID, FileSystemID: fileSystemID, Name: treeq.Name})
+		}
+	}
+}
+
+func (cs *commonservice) markedToBeDeleted(objectID int64, report *OrphanReport) bool {
+	metadataArray, err := cs.api.GetMetadata(objectID)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("fail to get metadata of object %d: %v", objectID, err))
+		return true
+	}
+	for _, metadata := range *metadataArray {
+		if metadata.Key == TOBEDELETED {
+			return true
+		}
+	}
+	return false
+}
+
+//findMissingObjects report the PVs whose backend object is not found
+func (cs *commonservice) findMissingObjects(pvs []v1.PersistentVolume, report *OrphanReport) {
+	for _, pv := range pvs {
+		handle := pv.Spec.CSI.VolumeHandle
+		volproto, err := volumeid.Parse(handle)
+		if err != nil {
+			continue
+		}
+		switch volproto.Protocol {
+		case "fc", "iscsi", "nvme":
+			_, err = cs.api.GetVolume(int(volproto.ObjectID))
+		case "nfs":
+			_, err = cs.api.GetFileSystemByID(volproto.ObjectID)
+		case NFSTREEQ:
+			_, err = cs.api.GetTreeq(volproto.ObjectID, volproto.TreeqID)
+		default:
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		if strings.Contains(err.Error(), "NOT_FOUND") {
+			report.MissingObjects = append(report.MissingObjects, MissingObject{PVName: pv.Name, VolumeHandle: handle})
+		} else {
+			report.Errors = append(report.Errors, fmt.Sprintf("fail to check backend of pv %s: %v", pv.Name, err))
+		}
+	}
+}
+
+//findOrphanExportRules report the node references of nfs filesystems whose PV is not attached to the node,
+//they are removed when relist, the current attachments of the cleanup, is set
+func (cs *commonservice) findOrphanExportRules(cluster clusterIndex, nodeIDs map[string]string, relist func() (clusterIndex, error), report *OrphanReport) {
+	nodeIPs := make(map[string]string)
+	for nodeName, nodeID := range nodeIDs {
+		if nodeNameIP := strings.Split(nodeID, "$$"); len(nodeNameIP) == 2 {
+			nodeIPs[nodeName] = nodeNameIP[1]
+		}
+	}
+	for fileSystemID, pvName := range cluster.filesystems {
+		attachedIPs, err := attachedNodeIPs(cluster, fileSystemID, nodeIPs)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("node ID of a node of pv %s not found, export rules not checked", pvName))
+			continue
+		}
+		metadataArray, err := cs.api.GetMetadata(fileSystemID)
+		if err != nil {
+			if !strings.Contains(err.Error(), "NOT_FOUND") {
+				report.Errors = append(report.Errors, fmt.Sprintf("fail to get metadata of filesystem %d: %v", fileSystemID, err))
+			}
+			continue
+		}
+		for _, metadata := range *metadataArray {
+			if !strings.HasPrefix(metadata.Key, NFSNODEREF) {
+				continue
+			}
+			nodeIP := strings.TrimPrefix(metadata.Key, NFSNODEREF)
+			if attachedIPs[nodeIP] {
+				continue
+			}
+			orphan := OrphanAccess{Type: "export_rule", ObjectID: fileSystemID, PVName: pvName, Node: metadata.Value, Client: nodeIP}
+			if relist == nil {
+				report.OrphanExportRules = append(report.OrphanExportRules, orphan)
+				continue
+			}
+			cleaned, err := cs.cleanupOrphanExportRule(fileSystemID, nodeIP, nodeIPs, relist)
+			if err != nil {
+				report.OrphanExportRules = append(report.OrphanExportRules, orphan)
+				report.Errors = append(report.Errors, fmt.Sprintf("fail to remove export rule %s of filesystem %d: %v", nodeIP, fileSystemID, err))
+				continue
+			}
+			if cleaned {
+				report.OrphanExportRules = append(report.OrphanExportRules, orphan)
+				report.Cleaned = append(report.Cleaned, orphan)
+			}
+		}
+	}
+}
+
+//cleanupOrphanExportRule forget the node of the filesystem unless it is attached once the publish lock is held
+func (cs *commonservice) cleanupOrphanExportRule(fileSystemID int64, nodeIP string, nodeIPs map[string]string, relist func() (clusterIndex, error)) (bool, error) {
+	unlock, err := lockPublish(helper.FileSystemKey(fileSystemID))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	current, err := relist()
+	if err != nil {
+		return false, err
+	}
+	attachedIPs, err := attachedNodeIPs(current, fileSystemID, nodeIPs)
+	if err != nil {
+		return false, err
+	}
+	if attachedIPs[nodeIP] {
+		log.Infof("node %s was attached to filesystem %d since the orphan report, export rule kept", nodeIP, fileSystemID)
+		return false, nil
+	}
+	return true, cs.removeExportNode(fileSystemID, nodeIP)
+}
+
+//findOrphanLunMappings report the mappings of driver volumes to cluster node hosts the PV is not attached to,
+//host cluster mappings are left out. They are unmapped when relist, the current attachments of the cleanup, is set
+func (cs *commonservice) findOrphanLunMappings(cluster clusterIndex, taggedVolumes map[int64]bool, nodeIDs map[string]string, relist func() (clusterIndex, error), report *OrphanReport) {
+	for nodeName, nodeID := range nodeIDs {
+		hostName := strings.Split(nodeID, "$$")[0]
+		host, err := cs.api.GetHostByName(hostName)
+		if err != nil {
+			if !strings.Contains(err.Error(), "HOST_NOT_FOUND") {
+				report.Errors = append(report.Errors, fmt.Sprintf("fail to get host %s: %v", hostName, err))
+			}
+			continue
+		}
+		luns, err := cs.api.GetAllLunByHost(host.ID)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("fail to get luns of host %s: %v", hostName, err))
+			continue
+		}
+		for _, lun := range luns {
+			if lun.CLustered {
+				continue
+			}
+			volumeID := int64(lun.VolumeID)
+			pvName, hasPV := cluster.volumes[volumeID]
+			if !hasPV && !taggedVolumes[volumeID] {
+				continue
+			}
+			if hasPV && cluster.attachedNodes(volumeID)[nodeName] {
+				continue
+			}
+			orphan := OrphanAccess{Type: "lun_mapping", ObjectID: volumeID, PVName: pvName, Node: nodeName, Client: hostName}
+			if relist == nil {
+				report.OrphanLunMappings = append(report.OrphanLunMappings, orphan)
+				continue
+			}
+			cleaned, err := cs.cleanupOrphanLunMapping(volumeID, host.ID, hostName, nodeName, relist)
+			if err != nil {
+				report.OrphanLunMappings = append(report.OrphanLunMappings, orphan)
+				report.Errors = append(report.Errors, fmt.Sprintf("fail to unmap volume %d from host %s: %v", volumeID, hostName, err))
+				continue
+			}
+			if cleaned {
+				report.OrphanLunMappings = append(report.OrphanLunMappings, orphan)
+				report.Cleaned = append(report.Cleaned, orphan)
+			}
+		}
+	}
+}
+
+//cleanupOrphanLunMapping unmap the volume from the host of the node unless it is attached once the publish lock is held
+func (cs *commonservice) cleanupOrphanLunMapping(volumeID int64, hostID int, hostName, nodeName string, relist func() (clusterIndex, error)) (bool, error) {
+	unlock, err := lockPublish(helper.VolumeKey(volumeID), helper.HostKey(hostName))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	current, err := relist()
+	if err != nil {
+		return false, err
+	}
+	if current.attachedNodes(volumeID)[nodeName] {
+		log.Infof("volume %d was attached to node %s since the orphan report, mapping kept", volumeID, nodeName)
+		return false, nil
+	}
+	return true, cs.api.UnMapVolumeFromHost(hostID, int(volumeID))
+}
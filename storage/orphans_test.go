@@ -0,0 +1,168 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/api/clientgo"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func (suite *OrphanSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.kc = new(clientgo.MockKubeClient)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type OrphanSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	kc  *clientgo.MockKubeClient
+	cs  *commonservice
+}
+
+func TestOrphanSuite(t *testing.T) {
+	suite.Run(t, new(OrphanSuite))
+}
+
+func getOrphanPV(name, handle string) v1.PersistentVolume {
+	return v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+			CSI: &v1.CSIPersistentVolumeSource{Driver: Name, VolumeHandle: handle},
+		}},
+	}
+}
+
+func getOrphanAttachment(pvName, nodeName string) storagev1.VolumeAttachment {
+	return storagev1.VolumeAttachment{Spec: storagev1.VolumeAttachmentSpec{
+		Attacher: Name,
+		NodeName: nodeName,
+		Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+	}}
+}
+
+func (suite *OrphanSuite) Test_reconcileOrphans_Objects() {
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{
+		getOrphanPV("pv1", "100$$iscsi"),
+		getOrphanPV("pv2", "300#1#$$nfs_treeq"),
+		getOrphanPV("pv3", "400$$nfs"),
+	}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{}, nil)
+	suite.kc.On("GetCSINodeIDs", Name).Return(map[string]string{}, nil)
+	suite.api.On("GetMetadataByKey", "host.k8s.pvname", 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 100, ObjectType: "VOLUME", Key: "host.k8s.pvname", Value: "pv1"},
+		api.Metadata{ObjectId: 101, ObjectType: "VOLUME", Key: "host.k8s.pvname", Value: "pv-gone"},
+		api.Metadata{ObjectId: 102, ObjectType: "VOLUME", Key: "host.k8s.pvname", Value: "pv-deleted"},
+		api.Metadata{ObjectId: 200, ObjectType: "FILESYSTEM", Key: "host.k8s.pvname", Value: "pv-fs"},
+		api.Metadata{ObjectId: 300, ObjectType: "FILESYSTEM", Key: "host.k8s.pvname", Value: "treeqfs"},
+	), nil)
+	suite.api.On("GetMetadata", int64(101)).Return([]api.Metadata{{Key: "host.k8s.pvname", Value: "pv-gone"}}, nil)
+	suite.api.On("GetMetadata", int64(102)).Return([]api.Metadata{{Key: TOBEDELETED, Value: "true"}}, nil)
+	suite.api.On("GetMetadata", int64(200)).Return([]api.Metadata{{Key: "host.k8s.pvname", Value: "pv-fs"}}, nil)
+	suite.api.On("GetMetadata", int64(300)).Return([]api.Metadata{{Key: TREEQCOUNT, Value: "2"}}, nil)
+	suite.api.On("GetMetadata", int64(400)).Return([]api.Metadata{}, nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(300)).Return([]api.Treeq{{ID: 1, Name: "pv2"}, {ID: 2, Name: "pv-old"}}, nil)
+	suite.api.On("GetVolume", 100).Return(api.Volume{ID: 100}, nil)
+	suite.api.On("GetTreeq", int64(300), int64(1)).Return(api.Treeq{ID: 1}, nil)
+	suite.api.On("GetFileSystemByID", int64(400)).Return(nil, errors.New("FILESYSTEM_NOT_FOUND"))
+
+	report, err := suite.cs.reconcileOrphans(suite.kc, Name, false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), []OrphanObject{
+		{Type: "volume", ID: 101, Name: "pv-gone"},
+		{Type: "filesystem", ID: 200, Name: "pv-fs"},
+		{Type: "treeq", ID: 2, FileSystemID: 300, Name: "pv-old"},
+	}, report.OrphanObjects)
+	assert.Equal(suite.T(), []MissingObject{{PVName: "pv3", VolumeHandle: "400$$nfs"}}, report.MissingObjects)
+	assert.Empty(suite.T(), report.Errors)
+}
+
+func (suite *OrphanSuite) Test_reconcileOrphans_ExportRules() {
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{getOrphanPV("pv1", "200$$nfs")}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{getOrphanAttachment("pv1", "node1")}, nil)
+	suite.kc.On("GetCSINodeIDs", Name).Return(map[string]string{"node1": "node1$$10.20.20.50"}, nil)
+	suite.api.On("GetMetadataByKey", "host.k8s.pvname", 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 200, ObjectType: "FILESYSTEM", Key: "host.k8s.pvname", Value: "pv1"},
+	), nil)
+	suite.api.On("GetMetadata", int64(200)).Return([]api.Metadata{
+		{Key: NFSNODEREF + "10.20.20.50", Value: "node1"},
+		{Key: NFSNODEREF + "10.20.20.51", Value: "node2"},
+	}, nil)
+	suite.api.On("GetFileSystemByID", int64(200)).Return(api.FileSystem{ID: 200}, nil)
+	suite.api.On("GetHostByName", "node1").Return(nil, errors.New("HOST_NOT_FOUND"))
+
+	report, err := suite.cs.reconcileOrphans(suite.kc, Name, false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Empty(suite.T(), report.OrphanObjects)
+	assert.Equal(suite.T(), []OrphanAccess{
+		{Type: "export_rule", ObjectID: 200, PVName: "pv1", Node: "node2", Client: "10.20.20.51"},
+	}, report.OrphanExportRules)
+	assert.Empty(suite.T(), report.Cleaned)
+}
+
+func (suite *OrphanSuite) Test_reconcileOrphans_LunMappingsCleanup() {
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{
+		getOrphanPV("pv1", "100$$fc"),
+		getOrphanPV("pv2", "101$$fc"),
+	}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{getOrphanAttachment("pv1", "node1")}, nil)
+	suite.kc.On("GetCSINodeIDs", Name).Return(map[string]string{"node1": "node1$$10.20.20.50"}, nil)
+	suite.api.On("GetMetadataByKey", "host.k8s.pvname", 1).Return(getToBeDeletedPage(), nil)
+	suite.api.On("GetVolume", 100).Return(api.Volume{ID: 100}, nil)
+	suite.api.On("GetVolume", 101).Return(api.Volume{ID: 101}, nil)
+	suite.api.On("GetHostByName", "node1").Return(api.Host{ID: 10}, nil)
+	suite.api.On("GetAllLunByHost", 10).Return([]api.LunInfo{
+		{VolumeID: 100, Lun: 1},
+		{VolumeID: 101, Lun: 2},
+		{VolumeID: 102, Lun: 3},
+		{VolumeID: 103, Lun: 4, CLustered: true},
+	}, nil)
+	suite.api.On("UnMapVolumeFromHost", 10, 101).Return(nil)
+
+	report, err := suite.cs.reconcileOrphans(suite.kc, Name, true)
+	assert.Nil(suite.T(), err, "error not expected")
+	orphan := OrphanAccess{Type: "lun_mapping", ObjectID: 101, PVName: "pv2", Node: "node1", Client: "node1"}
+	assert.Equal(suite.T(), []OrphanAccess{orphan}, report.OrphanLunMappings)
+	assert.Equal(suite.T(), []OrphanAccess{orphan}, report.Cleaned)
+	suite.api.AssertNumberOfCalls(suite.T(), "UnMapVolumeFromHost", 1)
+}
+
+func (suite *OrphanSuite) Test_reconcileOrphans_LunMappingsAttachedSinceReport() {
+	suite.kc.On("ListPersistentVolumes", Name).Return([]v1.PersistentVolume{getOrphanPV("pv2", "101$$fc")}, nil)
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{}, nil).Once()
+	suite.kc.On("ListVolumeAttachments", Name).Return([]storagev1.VolumeAttachment{getOrphanAttachment("pv2", "node1")}, nil)
+	suite.kc.On("GetCSINodeIDs", Name).Return(map[string]string{"node1": "node1$$10.20.20.50"}, nil)
+	suite.api.On("GetMetadataByKey", "host.k8s.pvname", 1).Return(getToBeDeletedPage(), nil)
+	suite.api.On("GetVolume", 101).Return(api.Volume{ID: 101}, nil)
+	suite.api.On("GetHostByName", "node1").Return(api.Host{ID: 10}, nil)
+	suite.api.On("GetAllLunByHost", 10).Return([]api.LunInfo{{VolumeID: 101, Lun: 2}}, nil)
+
+	report, err := suite.cs.reconcileOrphans(suite.kc, Name, true)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Empty(suite.T(), report.OrphanLunMappings, "volume attached since the report is not an orphan")
+	assert.Empty(suite.T(), report.Cleaned)
+	suite.api.AssertNotCalled(suite.T(), "UnMapVolumeFromHost", mock.Anything, mock.Anything)
+}
+
+func (suite *OrphanSuite) Test_reconcileOrphans_KubeError() {
+	suite.kc.On("ListPersistentVolumes", Name).Return(nil, errors.New("forbidden"))
+	_, err := suite.cs.reconcileOrphans(suite.kc, Name, false)
+	assert.NotNil(suite.T(), err, "error expected")
+}
@@ -0,0 +1,220 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"infinibox-csi-driver/api"
+	"sort"
+	"strings"
+	"sync"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	//KeyPoolSelectionPolicy : storage class parameter, how the pool is picked when pool_name selects several pools,
+	//PoolPolicyMostFree (default), PoolPolicyRoundRobin or PoolPolicyFirstFit
+	KeyPoolSelectionPolicy = "pool_selection_policy"
+
+	//PoolPolicyMostFree : pool with the most free physical space
+	PoolPolicyMostFree = "most_free"
+
+	//PoolPolicyRoundRobin : pools in turn
+	PoolPolicyRoundRobin = "round_robin"
+
+	//PoolPolicyFirstFit : first pool of the list with room for the volume
+	PoolPolicyFirstFit = "first_fit"
+)
+
+//poolRoundRobin next pool index by pool_name value
+var poolRoundRobin = struct {
+	sync.Mutex
+	next map[string]int
+}{next: make(map[string]int)}
+
+//isPoolSelection check pool_name selects several pools: a comma separated list of pools,
+//or key=value selecting the pools whose InfiniBox metadata key has the value
+func isPoolSelection(parameters map[string]string) bool {
+	poolName := parameters[StoragePoolKey]
+	return strings.Contains(poolName, ",") || strings.Contains(poolName, "=")
+}
+
+//validatePoolSelectionPolicy check the pool_selection_policy value
+func validatePoolSelectionPolicy(parameters map[string]string) error {
+	switch parameters[KeyPoolSelectionPolicy] {
+	case "", PoolPolicyMostFree, PoolPolicyRoundRobin, PoolPolicyFirstFit:
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "invalid %s value %s", KeyPoolSelectionPolicy, parameters[KeyPoolSelectionPolicy])
+}
+
+//getCandidatePools return the pools selected by pool_name, in list order or by name for a metadata selector
+func (cs *commonservice) getCandidatePools(parameters map[string]string) ([]api.StoragePool, error) {
+	poolName := strings.TrimSpace(parameters[StoragePoolKey])
+	allPools, err := cs.api.GetStoragePool(0, "")
+	if err != nil {
+		log.Errorf("fail to get storage pools error %v", err)
+		return nil, status.Errorf(codes.Internal, "fail to get storage pools: %v", err)
+	}
+	pools := []api.StoragePool{}
+	if keyValue := strings.SplitN(poolName, "=", 2); len(keyValue) == 2 {
+		selected := make(map[int64]bool)
+		for page := 1; ; page++ {
+			metadataPage, err := cs.api.GetMetadataByKey(strings.TrimSpace(keyValue[0]), page)
+			if err != nil {
+				log.Errorf("fail to get pools with metadata %s error %v", poolName, err)
+				return nil, status.Errorf(codes.Internal, "fail to get pools with metadata %s: %v", poolName, err)
+			}
+			for _, metadata := range metadataPage.MetadataArry {
+				if strings.EqualFold(metadata.ObjectType, "POOL") && metadata.Value == strings.TrimSpace(keyValue[1]) {
+					selected[int64(metadata.ObjectId)] = true
+				}
+			}
+			if page >= metadataPage.Pagemetadata.PagesTotal {
+				break
+			}
+		}
+		for _, pool := range allPools {
+			if selected[pool.ID] {
+				pools = append(pools, pool)
+			}
+		}
+		sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	} else {
+		byName := make(map[string]api.StoragePool)
+		for _, pool := range allPools {
+			byName[pool.Name] = pool
+		}
+		for _, name := range strings.Split(poolName, ",") {
+			if pool, ok := byName[strings.TrimSpace(name)]; ok {
+				pools = append(pools, pool)
+			} else if strings.TrimSpace(name) != "" {
+				log.Warnf("storage pool %s of %s not found", name, StoragePoolKey)
+			}
+		}
+	}
+	if len(pools) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "no storage pool matches %s %s", StoragePoolKey, poolName)
+	}
+	return pools, nil
+}
+
+//poolUsedPercent return the used physical capacity of the pool in percent
+func poolUsedPercent(pool api.StoragePool) int {
+	if pool.PhysicalCapacity <= 0 {
+		return 0
+	}
+	return int(int64(pool.PhysicalCapacity-pool.FreePhysicalSpace) * 100 / int64(pool.PhysicalCapacity))
+}
+
+//poolHasRoom check the pool can take the volume, a pool over its critical threshold takes no volume
+func poolHasRoom(pool api.StoragePool, capacity int64, thick bool) bool {
+	if pool.PhysicalCapacityCritical > 0 && poolUsedPercent(pool) >= pool.PhysicalCapacityCritical {
+		return false
+	}
+	if int64(pool.FreeVirtualSpace) < capacity {
+		return false
+	}
+	return !thick || int64(pool.FreePhysicalSpace) >= capacity
+}
+
+//selectStoragePool pick the pool of a new volume when pool_name selects several pools and store it as the pool_name
+//of the parameters, so it is recorded in the volume context. Pools over their warning threshold are only picked
+//when all pools with room are over it
+func (cs *commonservice) selectStoragePool(parameters map[string]string, capacity int64) error {
+	if !isPoolSelection(parameters) {
+		return nil
+	}
+	if err := validatePoolSelectionPolicy(parameters); err != nil {
+		return err
+	}
+	pools, err := cs.getCandidatePools(parameters)
+	if err != nil {
+		return err
+	}
+	thick := strings.EqualFold(parameters["provision_type"], "THICK")
+	preferred, warned := []api.StoragePool{}, []api.StoragePool{}
+	for _, pool := range pools {
+		if !poolHasRoom(pool, capacity, thick) {
+			log.Debugf("storage pool %s has no room for %d bytes", pool.Name, capacity)
+			continue
+		}
+		if pool.PhysicalCapacityWarning > 0 && poolUsedPercent(pool) >= pool.PhysicalCapacityWarning {
+			warned = append(warned, pool)
+		} else {
+			preferred = append(preferred, pool)
+		}
+	}
+	if len(preferred) == 0 {
+		preferred = warned
+	}
+	if len(preferred) == 0 {
+		return status.Errorf(codes.ResourceExhausted, "no storage pool of %s has room for %d bytes", parameters[StoragePoolKey], capacity)
+	}
+
+	chosen := preferred[0]
+	switch parameters[KeyPoolSelectionPolicy] {
+	case PoolPolicyFirstFit:
+	case PoolPolicyRoundRobin:
+		poolRoundRobin.Lock()
+		index := poolRoundRobin.next[parameters[StoragePoolKey]]
+		poolRoundRobin.next[parameters[StoragePoolKey]] = index + 1
+		poolRoundRobin.Unlock()
+		chosen = preferred[index%len(preferred)]
+	default:
+		for _, pool := range preferred[1:] {
+			if pool.FreePhysicalSpace > chosen.FreePhysicalSpace {
+				chosen = pool
+			}
+		}
+	}
+	log.Infof("storage pool %s selected from %s by %s policy", chosen.Name, parameters[StoragePoolKey], parameters[KeyPoolSelectionPolicy])
+	parameters[StoragePoolKey] = chosen.Name
+	return nil
+}
+
+//selectCloneStoragePool return the ID of the pool of a clone and store its name as the pool_name of the parameters.
+//Clones are snapshots of their source, which can not leave its pool, so the source pool is kept when it is the requested
+//pool or one of the pools pool_name selects. Otherwise the pool is selected as for a new volume and the clone has to be
+//copied into it
+func (cs *commonservice) selectCloneStoragePool(parameters map[string]string, sourcePoolID, capacity int64) (int64, error) {
+	if isPoolSelection(parameters) {
+		pools, err := cs.getCandidatePools(parameters)
+		if err != nil {
+			return 0, err
+		}
+		for _, pool := range pools {
+			if pool.ID == sourcePoolID {
+				parameters[StoragePoolKey] = pool.Name
+				return pool.ID, nil
+			}
+		}
+		if err = cs.selectStoragePool(parameters, capacity); err != nil {
+			return 0, err
+		}
+		for _, pool := range pools {
+			if pool.Name == parameters[StoragePoolKey] {
+				return pool.ID, nil
+			}
+		}
+		return 0, status.Errorf(codes.Internal, "storage pool %s selected for the clone not found", parameters[StoragePoolKey])
+	}
+	storagePool := parameters[StoragePoolKey]
+	storagePoolID, err := cs.api.GetStoragePoolIDByName(storagePool)
+	if err != nil {
+		return 0, status.Errorf(codes.Internal,
+			"error while getting storagepoolid with name %s ", storagePool)
+	}
+	return storagePoolID, nil
+}
@@ -0,0 +1,145 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *PoolSelectionSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type PoolSelectionSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestPoolSelectionSuite(t *testing.T) {
+	suite.Run(t, new(PoolSelectionSuite))
+}
+
+func getSelectionPool(id int64, name string, free int) api.StoragePool {
+	return api.StoragePool{
+		ID:                       id,
+		Name:                     name,
+		PhysicalCapacity:         100 * int(gib),
+		FreePhysicalSpace:        free * int(gib),
+		FreeVirtualSpace:         free * int(gib),
+		PhysicalCapacityWarning:  80,
+		PhysicalCapacityCritical: 90,
+	}
+}
+
+func getSelectionPools() []api.StoragePool {
+	return []api.StoragePool{
+		getSelectionPool(1, "pool1", 30),
+		getSelectionPool(2, "pool2", 60),
+		getSelectionPool(3, "pool3", 15), // over warning
+		getSelectionPool(4, "pool4", 5),  // over critical
+	}
+}
+
+func (suite *PoolSelectionSuite) Test_selectStoragePool_SinglePool() {
+	parameters := map[string]string{StoragePoolKey: "pool1"}
+	err := suite.cs.selectStoragePool(parameters, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "pool1", parameters[StoragePoolKey])
+	suite.api.AssertNotCalled(suite.T(), "GetStoragePool", int64(0), "")
+}
+
+func (suite *PoolSelectionSuite) Test_selectStoragePool_Policies() {
+	suite.api.On("GetStoragePool", int64(0), "").Return(getSelectionPools(), nil)
+
+	parameters := map[string]string{StoragePoolKey: "pool1, pool2,pool3"}
+	err := suite.cs.selectStoragePool(parameters, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "pool2", parameters[StoragePoolKey], "most free")
+
+	parameters = map[string]string{StoragePoolKey: "pool3,pool1,pool2", KeyPoolSelectionPolicy: PoolPolicyFirstFit}
+	err = suite.cs.selectStoragePool(parameters, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "pool1", parameters[StoragePoolKey], "first fit under warning")
+
+	chosen := []string{}
+	for i := 0; i < 3; i++ {
+		parameters = map[string]string{StoragePoolKey: "pool1,pool2,pool4", KeyPoolSelectionPolicy: PoolPolicyRoundRobin}
+		err = suite.cs.selectStoragePool(parameters, gib)
+		assert.Nil(suite.T(), err, "error not expected")
+		chosen = append(chosen, parameters[StoragePoolKey])
+	}
+	assert.Equal(suite.T(), []string{"pool1", "pool2", "pool1"}, chosen, "round robin skips critical pool")
+}
+
+func (suite *PoolSelectionSuite) Test_selectStoragePool_WarningOnly() {
+	suite.api.On("GetStoragePool", int64(0), "").Return(getSelectionPools(), nil)
+	parameters := map[string]string{StoragePoolKey: "pool3,pool4"}
+	err := suite.cs.selectStoragePool(parameters, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "pool3", parameters[StoragePoolKey])
+
+	parameters = map[string]string{StoragePoolKey: "pool3,pool4"}
+	err = suite.cs.selectStoragePool(parameters, 20*gib)
+	assert.Equal(suite.T(), codes.ResourceExhausted, status.Code(err))
+}
+
+func (suite *PoolSelectionSuite) Test_selectStoragePool_MetadataSelector() {
+	suite.api.On("GetStoragePool", int64(0), "").Return(getSelectionPools(), nil)
+	page := api.MetadataPage{MetadataArry: []api.Metadata{
+		{ObjectId: 1, ObjectType: "POOL", Key: "k8s.tier", Value: "gold"},
+		{ObjectId: 2, ObjectType: "POOL", Key: "k8s.tier", Value: "silver"},
+		{ObjectId: 3, ObjectType: "POOL", Key: "k8s.tier", Value: "gold"},
+	}}
+	page.Pagemetadata.PagesTotal = 1
+	suite.api.On("GetMetadataByKey", "k8s.tier", 1).Return(page, nil)
+	parameters := map[string]string{StoragePoolKey: "k8s.tier=gold"}
+	err := suite.cs.selectStoragePool(parameters, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "pool1", parameters[StoragePoolKey])
+}
+
+func (suite *PoolSelectionSuite) Test_selectStoragePool_InvalidPolicy() {
+	parameters := map[string]string{StoragePoolKey: "pool1,pool2", KeyPoolSelectionPolicy: "random"}
+	err := suite.cs.selectStoragePool(parameters, gib)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+}
+
+func (suite *PoolSelectionSuite) Test_selectCloneStoragePool() {
+	suite.api.On("GetStoragePool", int64(0), "").Return(getSelectionPools(), nil)
+	parameters := map[string]string{StoragePoolKey: "pool1,pool2"}
+	poolID, err := suite.cs.selectCloneStoragePool(parameters, 2, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(2), poolID, "clone should stay in the pool of its source")
+	assert.Equal(suite.T(), "pool2", parameters[StoragePoolKey])
+
+	parameters = map[string]string{StoragePoolKey: "pool1,pool2"}
+	poolID, err = suite.cs.selectCloneStoragePool(parameters, 3, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(2), poolID, "clone should be copied into the selected pool")
+	assert.Equal(suite.T(), "pool2", parameters[StoragePoolKey])
+
+	suite.api.On("GetStoragePoolIDByName", "pool3").Return(int64(3), nil)
+	parameters = map[string]string{StoragePoolKey: "pool3"}
+	poolID, err = suite.cs.selectCloneStoragePool(parameters, 2, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(3), poolID, "clone should be copied into the requested pool")
+	poolID, err = suite.cs.selectCloneStoragePool(parameters, 3, gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(3), poolID, "clone should stay in the requested pool of its source")
+}
@@ -0,0 +1,107 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"infinibox-csi-driver/helper/volumeid"
+
+	log "infinibox-csi-driver/helper/logger"
+)
+
+const (
+	//RESTOREREF : metadata key prefix of a volume or filesystem restored in place, one key per PV referencing it
+	RESTOREREF = "host.k8s.restore_ref."
+
+	//OWNERDELETED : metadata key set when the PV owning a referenced volume or filesystem is deleted,
+	//the object is deleted with its last reference
+	OWNERDELETED = "host.k8s.owner_deleted"
+)
+
+//addRestoreRef record the PV restored in place as a reference of the object, the PV does not own the object
+func (cs *commonservice) addRestoreRef(objectID int64, pvName string, snapshotID int64) error {
+	metadata := map[string]interface{}{RESTOREREF + pvName: strconv.FormatInt(snapshotID, 10)}
+	if _, err := cs.api.AttachMetadataToObject(objectID, metadata); err != nil {
+		log.Errorf("fail to add restore reference %s to object %d error %v", pvName, objectID, err)
+		return err
+	}
+	return nil
+}
+
+//hasRestoreRef return whether the PV is already a restore reference of the object, the restore in place is done
+func (cs *commonservice) hasRestoreRef(objectID int64, pvName string) (bool, error) {
+	refs, _, err := cs.getRestoreRefs(objectID)
+	if err != nil {
+		log.Errorf("fail to get restore references of object %d error %v", objectID, err)
+		return false, err
+	}
+	for _, ref := range refs {
+		if ref == pvName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//getRestoreRefs return the PVs referencing the object and whether the PV owning it is deleted
+func (cs *commonservice) getRestoreRefs(objectID int64) (refs []string, ownerDeleted bool, err error) {
+	metadataArray, err := cs.api.GetMetadata(objectID)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, metadata := range *metadataArray {
+		if strings.HasPrefix(metadata.Key, RESTOREREF) {
+			refs = append(refs, strings.TrimPrefix(metadata.Key, RESTOREREF))
+		} else if metadata.Key == OWNERDELETED {
+			ownerDeleted, _ = strconv.ParseBool(metadata.Value)
+		}
+	}
+	return refs, ownerDeleted, nil
+}
+
+//releaseObject release the object of the deleted volume ID, it returns true when the object itself is to be deleted.
+//A reference is dropped and the object deleted with the last reference once its owner is deleted.
+//An owner with references left is only marked deleted. lockKey is the publish lock key of the object
+func (cs *commonservice) releaseObject(objectID int64, lockKey string, volID volumeid.ID) (bool, error) {
+	unlock, err := lockPublish(lockKey)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if volID.IsReference() {
+		err := cs.api.DeleteMetadataKey(objectID, RESTOREREF+volID.RestoreRef)
+		if err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+			log.Errorf("fail to remove restore reference %s from object %d error %v", volID.RestoreRef, objectID, err)
+			return false, err
+		}
+	}
+	refs, ownerDeleted, err := cs.getRestoreRefs(objectID)
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT_FOUND") {
+			return false, nil
+		}
+		log.Errorf("fail to get restore references of object %d error %v", objectID, err)
+		return false, err
+	}
+	if len(refs) > 0 {
+		if !volID.IsReference() && !ownerDeleted {
+			log.Infof("object %d is still referenced by %v, deleted with its last reference", objectID, refs)
+			if _, err = cs.api.AttachMetadataToObject(objectID, map[string]interface{}{OWNERDELETED: true}); err != nil {
+				log.Errorf("fail to mark owner of object %d deleted error %v", objectID, err)
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	return !volID.IsReference() || ownerDeleted, nil
+}
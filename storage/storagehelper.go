@@ -13,12 +13,19 @@ package storage
 import (
 	"errors"
 	"fmt"
-	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/volumeid"
+	"os"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	log "infinibox-csi-driver/helper/logger"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -33,8 +40,119 @@ const (
 	kiBytesofGiB = 1024 * 1024
 
 	bytesofGiB = kiBytesofGiB * bytesofKiB
+
+	//KeyRestoreInPlace : when true, a volume requested from a snapshot restores the snapshot parent instead of cloning it
+	KeyRestoreInPlace = "restore_in_place"
+
+	//KeyHostCluster : when set, multi node raw block volumes are mapped to this host cluster instead of to each host
+	KeyHostCluster = "host_cluster"
+
+	//HostClusterNodeRef : volume metadata key prefix, one key per host the volume is published to through its host cluster
+	HostClusterNodeRef = "host.k8s.cluster_node."
+
+	//KeyNfsVersion : NFS protocol version of nfs and nfs_treeq volumes, NfsVersion3 or NfsVersion41
+	KeyNfsVersion = "nfs_version"
+
+	//NfsVersion3 : NFSv3, the version exports get when nfs_version is not set
+	NfsVersion3 = "3"
+
+	//NfsVersion41 : NFSv4.1
+	NfsVersion41 = "4.1"
+
+	//PVCNameParameter : name of the PVC, passed by the provisioner run with --extra-create-metadata
+	PVCNameParameter = "csi.storage.k8s.io/pvc/name"
+
+	//PVCNamespaceParameter : namespace of the PVC, passed by the provisioner run with --extra-create-metadata
+	PVCNamespaceParameter = "csi.storage.k8s.io/pvc/namespace"
+
+	//PVNameParameter : name of the PV, passed by the provisioner run with --extra-create-metadata
+	PVNameParameter = "csi.storage.k8s.io/pv/name"
+
+	//VolumeSnapshotNameParameter : name of the VolumeSnapshot, passed by the snapshotter run with --extra-create-metadata
+	VolumeSnapshotNameParameter = "csi.storage.k8s.io/volumesnapshot/name"
+
+	//VolumeSnapshotNamespaceParameter : namespace of the VolumeSnapshot, passed by the snapshotter run with --extra-create-metadata
+	VolumeSnapshotNamespaceParameter = "csi.storage.k8s.io/volumesnapshot/namespace"
+
+	//VolumeSnapshotContentNameParameter : name of the VolumeSnapshotContent, passed by the snapshotter run with --extra-create-metadata
+	VolumeSnapshotContentNameParameter = "csi.storage.k8s.io/volumesnapshotcontent/name"
 )
 
+//createMetadataKeys : InfiniBox metadata key of each extra create metadata parameter
+var createMetadataKeys = map[string]string{
+	PVNameParameter:                    "host.k8s.pvname",
+	PVCNameParameter:                   "host.k8s.pvc_name",
+	PVCNamespaceParameter:              "host.k8s.pvc_namespace",
+	VolumeSnapshotNameParameter:        "host.k8s.volumesnapshot_name",
+	VolumeSnapshotNamespaceParameter:   "host.k8s.volumesnapshot_namespace",
+	VolumeSnapshotContentNameParameter: "host.k8s.volumesnapshotcontent_name",
+}
+
+//nfsExportVersions : export and network space names of the nfs_version values
+var nfsExportVersions = map[string]string{
+	NfsVersion3:  "NFSv3",
+	NfsVersion41: "NFSv4.1",
+}
+
+//optionalParams : storage class parameters accepted on top of the required ones
+var optionalParams = []string{
+	KeyRestoreInPlace,
+	KeyHostCluster,
+	KeyNameTemplate,
+	KeyPoolSelectionPolicy,
+	KeyArray,
+	PVCNameParameter,
+	PVCNamespaceParameter,
+	PVNameParameter,
+}
+
+func countOptionalParams(storageClassParams map[string]string) int {
+	count := 0
+	for _, param := range optionalParams {
+		if _, ok := storageClassParams[param]; ok {
+			count++
+		}
+	}
+	return count
+}
+
+func isRestoreInPlace(storageClassParams map[string]string) bool {
+	restore, err := strconv.ParseBool(storageClassParams[KeyRestoreInPlace])
+	if err != nil {
+		return false
+	}
+	return restore
+}
+
+//validateBlockAccessModes allow SINGLE_NODE_WRITER, and multi node modes for raw block volumes only
+func validateBlockAccessModes(volCaps []*csi.VolumeCapability) error {
+	for _, volCap := range volCaps {
+		switch mode := volCap.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+			if volCap.GetBlock() == nil {
+				return fmt.Errorf("volume cpability %s is supported for raw block volumes only", mode.String())
+			}
+		default:
+			return fmt.Errorf("volume cpability %s is not supported", mode.String())
+		}
+	}
+	return nil
+}
+
+//getHostCluster return the host cluster the volume is published to, only multi node raw block volumes are shared through it
+func getHostCluster(volCap *csi.VolumeCapability, volumeContext map[string]string) string {
+	clusterName := volumeContext[KeyHostCluster]
+	if clusterName == "" || volCap.GetBlock() == nil {
+		return ""
+	}
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return clusterName
+	}
+	return ""
+}
+
 func verifyVolumeSize(caprange *csi.CapacityRange) (int64, error) {
 	requiredVolSize := int64(caprange.GetRequiredBytes())
 	allowedMaxVolSize := int64(caprange.GetLimitBytes())
@@ -76,7 +194,7 @@ func validateParametersFC(storageClassParams map[string]string) error {
 		"ssd_enabled",
 		"max_vols_per_host",
 	}
-	if len(reqParams) != len(storageClassParams) {
+	if len(reqParams) != len(storageClassParams)-countOptionalParams(storageClassParams) {
 		log.Error("Mismatch in provided parameters and required params")
 		return errors.New("Mismatch in provided parameters and required params")
 	}
@@ -100,7 +218,7 @@ func validateParametersiSCSI(storageClassParams map[string]string) error {
 		"ssd_enabled",
 		"max_vols_per_host",
 	}
-	if len(reqParams) != len(storageClassParams) {
+	if len(reqParams) != len(storageClassParams)-countOptionalParams(storageClassParams) {
 		log.Error("Mismatch in provided parameters and required params")
 		return errors.New("Mismatch in provided parameters and required params")
 	}
@@ -113,6 +231,97 @@ func validateParametersiSCSI(storageClassParams map[string]string) error {
 	return nil
 }
 
+func validateParametersNVMe(storageClassParams map[string]string) error {
+	reqParams := []string{
+		"fstype",
+		"pool_name",
+		"network_space",
+		"provision_type",
+		"storage_protocol",
+		"ssd_enabled",
+		"max_vols_per_host",
+	}
+	if len(reqParams) != len(storageClassParams)-countOptionalParams(storageClassParams) {
+		log.Error("Mismatch in provided parameters and required params")
+		return errors.New("Mismatch in provided parameters and required params")
+	}
+	for _, param := range reqParams {
+		if storageClassParams[param] == "" {
+			log.Errorf("Invalid value %s for required parameter %s", storageClassParams[param], param)
+			return fmt.Errorf("Invalid value %s for required parameter %s", storageClassParams[param], param)
+		}
+	}
+	return nil
+}
+
+//validateNfsVersion check the nfs_version parameter, empty stands for the export default
+func validateNfsVersion(nfsVersion string) error {
+	if nfsVersion == "" {
+		return nil
+	}
+	if _, ok := nfsExportVersions[nfsVersion]; !ok {
+		return status.Errorf(codes.InvalidArgument, "invalid %s %s, supported versions are %s and %s", KeyNfsVersion, nfsVersion, NfsVersion3, NfsVersion41)
+	}
+	return nil
+}
+
+//exportHasNfsVersion check the export serves nfsVersion, exports without versions serve NFSv3 only
+func exportHasNfsVersion(versions []string, nfsVersion string) bool {
+	if nfsVersion == "" {
+		return true
+	}
+	if len(versions) == 0 {
+		versions = []string{nfsExportVersions[NfsVersion3]}
+	}
+	for _, version := range versions {
+		if version == nfsExportVersions[nfsVersion] {
+			return true
+		}
+	}
+	return false
+}
+
+//getNfsMountOptions split the configured mount options, the version option is added unless already given
+func getNfsMountOptions(configMountOptions, nfsVersion string) []string {
+	mountOptions := []string{}
+	if configMountOptions == "" {
+		configMountOptions = MountOptions
+	}
+	hasVersion := false
+	for _, option := range strings.Split(configMountOptions, ",") {
+		if option != "" {
+			mountOptions = append(mountOptions, option)
+		}
+		if strings.HasPrefix(option, "vers=") || strings.HasPrefix(option, "nfsvers=") {
+			hasVersion = true
+		}
+	}
+	if nfsVersion != "" && !hasVersion {
+		mountOptions = append(mountOptions, "vers="+nfsVersion)
+	}
+	return mountOptions
+}
+
+//addCreateMetadata add the extra create metadata parameters of the request to the metadata of the created object
+func addCreateMetadata(parameters map[string]string, metadata map[string]interface{}) {
+	for param, key := range createMetadataKeys {
+		if value := parameters[param]; value != "" {
+			metadata[key] = value
+		}
+	}
+}
+
+//getCreateMetadataOwner return namespace/name of the PVC or VolumeSnapshot of the extra create metadata, empty without it
+func getCreateMetadataOwner(parameters map[string]string) string {
+	if name := parameters[PVCNameParameter]; name != "" {
+		return parameters[PVCNamespaceParameter] + "/" + name
+	}
+	if name := parameters[VolumeSnapshotNameParameter]; name != "" {
+		return parameters[VolumeSnapshotNamespaceParameter] + "/" + name
+	}
+	return ""
+}
+
 func copyRequestParameters(parameters, out map[string]string) {
 	for key, val := range parameters {
 		if val != "" {
@@ -121,12 +330,73 @@ func copyRequestParameters(parameters, out map[string]string) {
 	}
 }
 
-func validateStorageType(str string) (volprotoconf api.VolumeProtocolConfig, err error) {
-	volproto := strings.Split(str, "$$")
-	if len(volproto) != 2 {
-		return volprotoconf, errors.New("volume Id and other details not found")
+//getVolumeName return the object ID of the volume ID, the volume name of its disk on the node
+func getVolumeName(volumeID string) string {
+	volproto, err := volumeid.Parse(volumeID)
+	if err != nil {
+		return strings.Split(volumeID, "$$")[0]
+	}
+	return strconv.FormatInt(volproto.ObjectID, 10)
+}
+
+//getSnapshotID return the ID of the snapshot with the object ID of the source volume
+func getSnapshotID(source volumeid.ID, objectID int64) string {
+	return volumeid.ID{Protocol: source.Protocol, Array: source.Array, ObjectID: objectID}.String()
+}
+
+//getCSISnapshot return the CSI snapshot of an array snapshot created at createdAt, in milliseconds. The snapshot is
+//ready once the array reports its creation time, until then the retried CreateSnapshot reports it again
+func getCSISnapshot(snapshotID, sourceVolumeID string, size, createdAt int64) *csi.Snapshot {
+	creationTime := ptypes.TimestampNow()
+	if createdAt > 0 {
+		if arrayTime, err := ptypes.TimestampProto(time.Unix(0, createdAt*int64(time.Millisecond))); err == nil {
+			creationTime = arrayTime
+		}
+	}
+	return &csi.Snapshot{
+		SnapshotId:     snapshotID,
+		SourceVolumeId: sourceVolumeID,
+		SizeBytes:      size,
+		CreationTime:   creationTime,
+		ReadyToUse:     createdAt > 0,
+	}
+}
+
+//getVolumePathStats return the usage of the filesystem mounted on the volume path, block volumes are not reported
+func getVolumePathStats(volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path not provided")
+	}
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s not found", volumePath)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !info.IsDir() {
+		return nil, status.Errorf(codes.Unimplemented, "stats of block volume %s are not reported", volumePath)
+	}
+	var statfs syscall.Statfs_t
+	if err = syscall.Statfs(volumePath, &statfs); err != nil {
+		log.Errorf("fail to statfs volume path %s error %v", volumePath, err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	volprotoconf.VolumeID = volproto[0]
-	volprotoconf.StorageType = volproto[1]
-	return volprotoconf, nil
+	blockSize := int64(statfs.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * blockSize,
+				Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+				Available: int64(statfs.Bavail) * blockSize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(statfs.Files),
+				Used:      int64(statfs.Files - statfs.Ffree),
+				Available: int64(statfs.Ffree),
+			},
+		},
+	}, nil
 }
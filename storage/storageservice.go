@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"infinibox-csi-driver/api"
 	"infinibox-csi-driver/helper"
+	"infinibox-csi-driver/helper/volumeid"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -32,6 +33,8 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csictx "github.com/rexray/gocsi/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
@@ -44,6 +47,22 @@ const (
 	KeyVolumeProvisionType = "provision_type"
 )
 
+//PublishLockTimeout : time publish and unpublish wait for the locks of their volume, host or filesystem
+const PublishLockTimeout = time.Minute
+
+//publishLocks serialize the publish operations sharing a volume, host or filesystem,
+//e.g. a host is not deleted while another volume is being mapped to it
+var publishLocks = helper.NewLockManager("publish", PublishLockTimeout)
+
+//lockPublish lock the keys of a publish operation, a lock timeout is Aborted so the operation is retried
+func lockPublish(keys ...string) (func(), error) {
+	unlock, err := publishLocks.LockKeys(keys...)
+	if err != nil {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	return unlock, nil
+}
+
 type Storageoperations interface {
 	csi.ControllerServer
 	csi.NodeServer
@@ -55,9 +74,14 @@ type fcstorage struct {
 type iscsistorage struct {
 	cs commonservice
 }
+type nvmestorage struct {
+	iscsistorage
+	cli nvmeCli
+}
 type treeqstorage struct {
 	csi.ControllerServer
 	csi.NodeServer
+	cs             commonservice
 	filesysService FileSystemInterface
 	osHelper       helper.OsHelper
 	mounter        mount.Interface
@@ -66,6 +90,7 @@ type nfsstorage struct {
 	uniqueID  int64
 	configmap map[string]string
 	pVName    string
+	csiName   string
 	capacity  int64
 
 	////
@@ -74,9 +99,14 @@ type nfsstorage struct {
 	exportID     int64
 	exportBlock  string
 	ipAddress    string
+	restoreRef   string
+	exportAccess string
+	copySourceID int64
 	cs           commonservice
 	mounter      mount.Interface
 	osHelper     helper.OsHelper
+	locker       helper.Locker
+	copier       TreeqDataCopier
 }
 
 type commonservice struct {
@@ -89,15 +119,20 @@ type commonservice struct {
 func NewStorageController(storageProtocol string, configparams ...map[string]string) (Storageoperations, error) {
 	comnserv, err := buildCommonService(configparams[0], configparams[1])
 	if err == nil {
+		comnserv.registerSweep()
+		comnserv.registerOrphanReconcile()
+		registerLockMetrics()
 		storageProtocol = strings.TrimSpace(storageProtocol)
 		if storageProtocol == "fc" {
 			return &fcstorage{cs: comnserv}, nil
 		} else if storageProtocol == "iscsi" {
 			return &iscsistorage{cs: comnserv}, nil
+		} else if storageProtocol == "nvme" {
+			return &nvmestorage{iscsistorage: iscsistorage{cs: comnserv}, cli: nvmeCommand{}}, nil
 		} else if storageProtocol == "nfs" {
 			return &nfsstorage{cs: comnserv, mounter: mount.New(""), osHelper: helper.Service{}}, nil
 		} else if storageProtocol == "nfs_treeq" {
-			return &treeqstorage{filesysService: getFilesystemService(storageProtocol, comnserv), osHelper: helper.Service{}}, nil
+			return &treeqstorage{cs: comnserv, filesysService: getFilesystemService(storageProtocol, comnserv), osHelper: helper.Service{}}, nil
 		}
 		return nil, errors.New("Error: Invalid storage protocol -" + storageProtocol)
 	}
@@ -113,6 +148,8 @@ func NewStorageNode(storageProtocol string, configparams ...map[string]string) (
 			return &fcstorage{cs: comnserv}, nil
 		} else if storageProtocol == "iscsi" {
 			return &iscsistorage{cs: comnserv}, nil
+		} else if storageProtocol == "nvme" {
+			return &nvmestorage{iscsistorage: iscsistorage{cs: comnserv}, cli: nvmeCommand{}}, nil
 		} else if storageProtocol == "nfs" {
 			return &nfsstorage{cs: comnserv, mounter: mount.New(""), osHelper: helper.Service{}}, nil
 		} else if storageProtocol == "nfs_treeq" {
@@ -242,6 +279,137 @@ func (cs *commonservice) validateHost(hostName string) (*api.Host, error) {
 	return &host, nil
 }
 
+func (cs *commonservice) validateHostCluster(clusterName string) (*api.HostCluster, error) {
+	log.Info("Check if host cluster available, create if not available")
+	cluster, err := cs.api.GetHostClusterByName(clusterName)
+	if err != nil && !strings.Contains(err.Error(), "HOST_CLUSTER_NOT_FOUND") {
+		log.Errorf("failed to get host cluster with error %v", err)
+		return nil, err
+	}
+	if cluster.ID == 0 {
+		log.Info("Creating host cluster with name ", clusterName)
+		cluster, err = cs.api.CreateHostCluster(clusterName)
+		if err != nil {
+			log.Errorf("failed to create host cluster with error %v", err)
+			return nil, err
+		}
+	}
+	return &cluster, nil
+}
+
+//mapVolumeToHostCluster join the host to the host cluster and map the volume to the cluster,
+//so every host of the cluster sees the volume with the same lun. The host sees at most maxAllowedVol volumes
+func (cs *commonservice) mapVolumeToHostCluster(volumeID int, host *api.Host, clusterName string, maxAllowedVol int) (luninfo api.LunInfo, err error) {
+	cluster, err := cs.validateHostCluster(clusterName)
+	if err != nil {
+		return luninfo, err
+	}
+	if host.HostClusterID != 0 && host.HostClusterID != cluster.ID {
+		return luninfo, status.Errorf(codes.FailedPrecondition, "host %s belongs to another host cluster than %s", host.Name, clusterName)
+	}
+	lunList, err := cs.api.GetAllLunByHost(host.ID)
+	if err != nil {
+		return luninfo, err
+	}
+	mapped := false
+	for _, lun := range lunList {
+		mapped = mapped || lun.VolumeID == volumeID
+	}
+	log.Debugf("host %s has %d volume mapped", host.Name, len(lunList))
+	if !mapped && len(lunList) >= maxAllowedVol {
+		log.Errorf("unable to publish volume on host %s, as maximum allowed volume per host is (%d), limit reached", host.Name, maxAllowedVol)
+		return luninfo, status.Error(codes.Internal, "Unable to publish volume as max allowed volume (per host) limit reached")
+	}
+	if host.HostClusterID == 0 {
+		err = cs.api.AddHostToHostCluster(cluster.ID, host.ID)
+		if err != nil {
+			return luninfo, err
+		}
+	}
+	luninfo, err = cs.api.MapVolumeToHostCluster(cluster.ID, volumeID, -1)
+	if err != nil {
+		if strings.Contains(err.Error(), "MAPPING_ALREADY_EXISTS") {
+			luninfo, err = cs.api.GetLunByHostClusterVolume(cluster.ID, volumeID)
+		}
+		if err != nil {
+			return luninfo, err
+		}
+	}
+	luninfo.HostClusterID = cluster.ID
+
+	// one reference per host, the cluster mapping is removed with the last one
+	metadata := make(map[string]interface{})
+	metadata[HostClusterNodeRef+host.Name] = clusterName
+	_, err = cs.api.AttachMetadataToObject(int64(volumeID), metadata)
+	if err != nil {
+		log.Errorf("failed to add host %s reference to volume %d with error %v", host.Name, volumeID, err)
+		return luninfo, err
+	}
+	return luninfo, nil
+}
+
+//unmapVolumeFromHostCluster remove the host reference, and the cluster mapping once no host references the volume.
+//The host leaves the host cluster once no volume of the cluster references it, left is then true
+func (cs *commonservice) unmapVolumeFromHostCluster(clusterID, volumeID int, host *api.Host) (left bool, err error) {
+	err = cs.api.DeleteMetadataKey(int64(volumeID), HostClusterNodeRef+host.Name)
+	if err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+		log.Errorf("failed to remove host %s reference from volume %d with error %v", host.Name, volumeID, err)
+		return false, err
+	}
+	hostNames, err := cs.getHostClusterNodeRefs(volumeID)
+	if err != nil {
+		return false, err
+	}
+	if len(hostNames) > 0 {
+		log.Debugf("volume %d is still published to hosts %v", volumeID, hostNames)
+	} else {
+		err = cs.api.UnMapVolumeFromHostCluster(clusterID, volumeID)
+		if err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+			return false, err
+		}
+	}
+
+	for _, lun := range host.Luns {
+		if !lun.CLustered || lun.HostClusterID != clusterID || lun.VolumeID == volumeID {
+			continue
+		}
+		hostNames, err = cs.getHostClusterNodeRefs(lun.VolumeID)
+		if err != nil {
+			return false, err
+		}
+		for _, hostName := range hostNames {
+			if hostName == host.Name {
+				log.Debugf("host %s still uses volume %d of host cluster %d", host.Name, lun.VolumeID, clusterID)
+				return false, nil
+			}
+		}
+	}
+	err = cs.api.RemoveHostFromHostCluster(clusterID, host.ID)
+	if err != nil && !strings.Contains(err.Error(), "NOT_FOUND") {
+		return false, err
+	}
+	log.Infof("host %s left host cluster %d", host.Name, clusterID)
+	return true, nil
+}
+
+//getHostClusterNodeRefs return the hosts the volume is published to through its host cluster
+func (cs *commonservice) getHostClusterNodeRefs(volumeID int) (hostNames []string, err error) {
+	metadataArray, err := cs.api.GetMetadata(int64(volumeID))
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT_FOUND") {
+			return nil, nil
+		}
+		log.Errorf("failed to get metadata of volume %d with error %v", volumeID, err)
+		return nil, err
+	}
+	for _, metadata := range *metadataArray {
+		if strings.HasPrefix(metadata.Key, HostClusterNodeRef) {
+			hostNames = append(hostNames, strings.TrimPrefix(metadata.Key, HostClusterNodeRef))
+		}
+	}
+	return hostNames, nil
+}
+
 func (cs *commonservice) deleteVolume(volumeID int) (err error) {
 	err = cs.api.DeleteVolume(volumeID)
 	if err != nil {
@@ -265,9 +433,15 @@ func (cs *commonservice) getCSIResponse(vol *api.Volume, req *csi.CreateVolumeRe
 		"StoragePoolName": storagePoolName,
 		"CreationTime":    time.Unix(int64(vol.CreatedAt), 0).String(),
 		"targetWWNs":      req.GetParameters()["targetWWNs"],
+		"serial":          vol.Serial,
+	}
+	volumeID := volumeid.ID{
+		Protocol: req.GetParameters()["storage_protocol"],
+		Array:    req.GetParameters()[KeyArray],
+		ObjectID: int64(vol.ID),
 	}
 	vi := &csi.Volume{
-		VolumeId:      strconv.Itoa(vol.ID),
+		VolumeId:      volumeID.String(),
 		CapacityBytes: vol.Size,
 		VolumeContext: attributes,
 		ContentSource: req.GetVolumeContentSource(),
@@ -275,6 +449,164 @@ func (cs *commonservice) getCSIResponse(vol *api.Volume, req *csi.CreateVolumeRe
 	return vi
 }
 
+//getContentSourceID return the object ID of the snapshot or volume the volume is created from, 0 without content source
+func getContentSourceID(req *csi.CreateVolumeRequest) (int64, error) {
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		source, err := volumeid.ParseSnapshot(snapshot.GetSnapshotId())
+		if err != nil {
+			return 0, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return source.ObjectID, nil
+	} else if volume := req.GetVolumeContentSource().GetVolume(); volume != nil {
+		source, err := volumeid.Parse(volume.GetVolumeId())
+		if err != nil {
+			return 0, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return source.ObjectID, nil
+	}
+	return 0, nil
+}
+
+//getExistingVolumeResponse return the volume found by name for a retried CreateVolume,
+//AlreadyExists when its size, provisioning, pool or content source does not match the request.
+//A clone of the requested source smaller than requested is resized, as its CreateVolume was interrupted
+func (cs *commonservice) getExistingVolumeResponse(vol *api.Volume, req *csi.CreateVolumeRequest, sizeBytes int64) (*csi.CreateVolumeResponse, error) {
+	params := req.GetParameters()
+	mismatch := func(format string, args ...interface{}) error {
+		log.Errorf("volume %s exists with a different %s", vol.Name, fmt.Sprintf(format, args...))
+		return status.Errorf(codes.AlreadyExists, "volume %s exists with a different %s", vol.Name, fmt.Sprintf(format, args...))
+	}
+	if ssd := params["ssd_enabled"]; ssd != "" {
+		if ssdEnabled, err := strconv.ParseBool(ssd); err == nil && ssdEnabled != vol.SsdEnabled {
+			return nil, mismatch("ssd_enabled %t", vol.SsdEnabled)
+		}
+	}
+
+	sourceID, err := getContentSourceID(req)
+	if err != nil {
+		return nil, err
+	}
+	if int64(vol.ParentId) != sourceID {
+		return nil, mismatch("content source, parent %d", vol.ParentId)
+	}
+	// a clone left at the size of its source by an interrupted CreateVolume is resized now
+	if sourceID != 0 && vol.Size < sizeBytes {
+		log.Infof("resuming resize of clone %s from %d to %d bytes", vol.Name, vol.Size, sizeBytes)
+		if _, err := cs.api.UpdateVolume(vol.ID, api.Volume{Size: sizeBytes}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resize clone %s to %d bytes: %s", vol.Name, sizeBytes, err.Error())
+		}
+		vol.Size = sizeBytes
+	}
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if vol.Size < sizeBytes || (limitBytes > 0 && vol.Size > limitBytes) {
+		return nil, mismatch("size %d bytes", vol.Size)
+	}
+	// clones are snapshots of their source, which keep the provisioning type of the source
+	volType := "THIN"
+	if provisionType, ok := params[KeyVolumeProvisionType]; ok {
+		volType = provisionType
+	}
+	if sourceID == 0 && vol.Provtype != "" && !strings.EqualFold(vol.Provtype, volType) {
+		return nil, mismatch("provision_type %s", vol.Provtype)
+	}
+
+	poolName := vol.PoolName
+	if poolName == "" {
+		poolName = cs.getStoragePoolNameFromID(vol.PoolId)
+	}
+	if isPoolSelection(params) {
+		pools, err := cs.getCandidatePools(params)
+		if err != nil {
+			return nil, err
+		}
+		selected := false
+		for _, pool := range pools {
+			selected = selected || pool.ID == vol.PoolId
+		}
+		if !selected {
+			return nil, mismatch("storage pool %s", poolName)
+		}
+	} else if params[StoragePoolKey] != poolName {
+		return nil, mismatch("storage pool %s", poolName)
+	}
+	params[StoragePoolKey] = poolName
+
+	log.Infof("volume %s already exists, returning volume %d", vol.Name, vol.ID)
+	vi := cs.getCSIResponse(vol, req)
+	copyRequestParameters(params, vi.VolumeContext)
+	return &csi.CreateVolumeResponse{Volume: vi}, nil
+}
+
+// restoreVolumeInPlace: restore the parent volume of the given snapshot instead of creating a clone of it.
+// The volume ID returned references the parent, deleting it does not delete the parent of the other PV
+func (cs *commonservice) restoreVolumeInPlace(snapshot *api.Volume, req *csi.CreateVolumeRequest) (csiResp *csi.CreateVolumeResponse, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from restoreVolumeInPlace " + fmt.Sprint(res))
+		}
+	}()
+	if snapshot.ParentId == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %d is not a snapshot, can not restore in place", snapshot.ID)
+	}
+	// the parent is not mapped while it is restored
+	unlock, err := lockPublish(helper.VolumeKey(int64(snapshot.ParentId)))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	parentVol, err := cs.api.GetVolume(snapshot.ParentId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "parent volume %d of snapshot %d not found", snapshot.ParentId, snapshot.ID)
+	}
+	// a retried request finds its reference, the parent is not rolled back again
+	restored, err := cs.hasRestoreRef(int64(parentVol.ID), req.GetName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get restore references of volume %s: %s", parentVol.Name, err.Error())
+	}
+	if restored {
+		log.Infof("volume %s already restored in place for %s", parentVol.Name, req.GetName())
+	} else {
+		if parentVol.Mapped {
+			log.Errorf("volume %s is still mapped, can not restore it from snapshot %d", parentVol.Name, snapshot.ID)
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume %s is mapped to host, unpublish it before restoring in place", parentVol.Name)
+		}
+		log.Infof("restoring volume %s in place from snapshot %d", parentVol.Name, snapshot.ID)
+		_, err = cs.api.RestoreVolumeFromSnapShot(parentVol.ID, snapshot.ID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to restore volume %s from snapshot %d: %s", parentVol.Name, snapshot.ID, err.Error())
+		}
+		// the restored PV references the parent owned by another PV, the parent is deleted with the last of them
+		if err = cs.addRestoreRef(int64(parentVol.ID), req.GetName(), int64(snapshot.ID)); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to add restore reference to volume %s: %s", parentVol.Name, err.Error())
+		}
+	}
+	csiVolume := cs.getCSIResponse(parentVol, req)
+	volumeID, err := volumeid.Parse(csiVolume.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	volumeID.RestoreRef = req.GetName()
+	csiVolume.VolumeId = volumeID.String()
+	copyRequestParameters(req.GetParameters(), csiVolume.VolumeContext)
+	return &csi.CreateVolumeResponse{Volume: csiVolume}, nil
+}
+
+//resizeClone grow the clone of the source volume to size, the clone is deleted when it fails
+func (cs *commonservice) resizeClone(cloneID int, srcVol *api.Volume, size int64) (err error) {
+	if size <= srcVol.Size {
+		return nil
+	}
+	log.Infof("resizing clone %d of volume %d from %d to %d bytes", cloneID, srcVol.ID, srcVol.Size, size)
+	if _, err = cs.api.UpdateVolume(cloneID, api.Volume{Size: size}); err != nil {
+		if delErr := cs.api.DeleteVolume(cloneID); delErr != nil {
+			log.Errorf("fail to delete clone %d error %v", cloneID, delErr)
+		}
+		return status.Errorf(codes.Internal, "failed to resize clone %d to %d bytes: %s", cloneID, size, err.Error())
+	}
+	return nil
+}
+
 func (cs *commonservice) getStoragePoolNameFromID(id int64) string {
 	log.Infof("getStoragePoolNameFromID called with storagepoolid %d", id)
 	storagePoolName := cs.storagePoolIdName[id]
@@ -302,6 +634,24 @@ func (cs *commonservice) getNetworkSpaceIP(networkSpace string) (string, error)
 	return nspace.Portals[index].IpAdress, nil
 }
 
+//validateNetworkSpaceNfsVersion check every network space serves nfsVersion, as the volume ip is picked from any of them
+func (cs *commonservice) validateNetworkSpaceNfsVersion(networkSpaces, nfsVersion string) error {
+	if nfsVersion == "" {
+		return nil
+	}
+	for _, name := range strings.Split(networkSpaces, ",") {
+		nspace, err := cs.api.GetNetworkSpaceByName(strings.TrimSpace(name))
+		if err != nil {
+			log.Errorf("fail to get network space %s error %v", name, err)
+			return err
+		}
+		if !exportHasNfsVersion(nspace.Properties.NfsVersions, nfsVersion) {
+			return status.Errorf(codes.InvalidArgument, "network space %s does not support NFS version %s", name, nfsVersion)
+		}
+	}
+	return nil
+}
+
 func getRandomIndex(max int) int {
 	rand.Seed(time.Now().UnixNano())
 	min := 0
@@ -309,12 +659,24 @@ func getRandomIndex(max int) int {
 	return index
 }
 
+//attachSnapshotMetadata tag a created snapshot as created by the driver with the extra create metadata of the request.
+//The snapshot exists already, a failure is only logged as a retry would find it by name
+func (cs *commonservice) attachSnapshotMetadata(snapshotID int64, parameters map[string]string) {
+	metadata := make(map[string]interface{})
+	metadata["host.created_by"] = cs.GetCreatedBy()
+	addCreateMetadata(parameters, metadata)
+	_, err := cs.api.AttachMetadataToObject(snapshotID, metadata)
+	if err != nil {
+		log.Errorf("fail to attach metadata to snapshot %d error %v", snapshotID, err)
+	}
+}
+
 func (cs *commonservice) GetCreatedBy() string {
 	var createdBy string
-	createdBy = "CSI/" + cs.driverversion
+	createdBy = CreatedByPrefix + cs.driverversion
 	k8version := getClusterVersion()
 	if k8version != "" {
-		createdBy = "CSI/" + k8version + "/" + cs.driverversion
+		createdBy = CreatedByPrefix + k8version + "/" + cs.driverversion
 	}
 	return createdBy
 }
@@ -0,0 +1,248 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	csictx "github.com/rexray/gocsi/context"
+)
+
+const (
+	//SweepIntervalEnv : period of the sweep of objects marked to be deleted, "0" disables the sweep
+	SweepIntervalEnv = "TOBEDELETED_SWEEP_INTERVAL"
+
+	//SweepDryRunEnv : "false" delete the swept objects, by default the sweep only logs the objects it would delete
+	SweepDryRunEnv = "TOBEDELETED_SWEEP_DRY_RUN"
+
+	defaultSweepInterval = time.Hour
+
+	//maxSweepPasses bound the passes of one sweep, deeper snapshot chains are finished by the next sweep
+	maxSweepPasses = 10
+
+	//CreatedByPrefix : prefix of the created_by metadata of the objects created by the driver
+	CreatedByPrefix = "CSI/"
+)
+
+//sweeper arrays swept for objects marked to be deleted, by hostname with the last client seen for them
+var sweeper = struct {
+	sync.Mutex
+	arrays  map[string]api.Client
+	started bool
+}{arrays: make(map[string]api.Client)}
+
+//sweptObject object marked to be deleted
+type sweptObject struct {
+	id         int64
+	objectType string
+}
+
+//registerSweep add the array of the client to the periodic sweep, started with the first registered array
+func (cs *commonservice) registerSweep() {
+	client, ok := cs.api.(*api.ClientService)
+	if !ok || client.SecretsMap["hostname"] == "" {
+		return
+	}
+	interval, dryRun := sweepConfig()
+	if interval == 0 {
+		return
+	}
+	sweeper.Lock()
+	defer sweeper.Unlock()
+	sweeper.arrays[client.SecretsMap["hostname"]] = client
+	if !sweeper.started {
+		sweeper.started = true
+		log.Infof("sweep of objects marked %s every %v, dry run %t", TOBEDELETED, interval, dryRun)
+		go runSweeper(interval, dryRun)
+	}
+}
+
+//sweepConfig return the sweep interval and dry run setting of the environment
+func sweepConfig() (interval time.Duration, dryRun bool) {
+	interval, dryRun = defaultSweepInterval, true
+	if value, ok := csictx.LookupEnv(context.Background(), SweepIntervalEnv); ok && value != "" {
+		if value == "0" {
+			return 0, false
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Warnf("invalid %s value %s, using %v", SweepIntervalEnv, value, defaultSweepInterval)
+		} else {
+			interval = d
+		}
+	}
+	if value, ok := csictx.LookupEnv(context.Background(), SweepDryRunEnv); ok && value != "" {
+		if parsed, err := strconv.ParseBool(value); err != nil {
+			log.Warnf("invalid %s value %s, dry run", SweepDryRunEnv, value)
+		} else {
+			dryRun = parsed
+		}
+	}
+	return
+}
+
+func runSweeper(interval time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweeper.Lock()
+		arrays := make(map[string]api.Client, len(sweeper.arrays))
+		for hostname, client := range sweeper.arrays {
+			arrays[hostname] = client
+		}
+		sweeper.Unlock()
+		for hostname, client := range arrays {
+			cs := commonservice{api: client}
+			deleted, err := cs.sweepToBeDeleted(dryRun)
+			if err != nil {
+				log.Errorf("fail to sweep objects marked %s of %s error %v", TOBEDELETED, hostname, err)
+				continue
+			}
+			log.Infof("sweep of %s deleted %d objects marked %s", hostname, deleted, TOBEDELETED)
+		}
+	}
+}
+
+//sweepToBeDeleted delete the volumes and filesystems marked to be deleted whose snapshots are all gone.
+//Only objects whose created_by metadata is the one of a driver version are deleted.
+//Deleting a snapshot can free its parent, so the sweep repeats until nothing more is deleted.
+//Errors of one object are logged and the sweep goes on with the others
+func (cs *commonservice) sweepToBeDeleted(dryRun bool) (deleted int, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("error while sweeping objects to be deleted " + fmt.Sprint(res))
+		}
+	}()
+	for i := 0; i < maxSweepPasses; i++ {
+		objects, listErr := cs.getToBeDeletedObjects()
+		if listErr != nil {
+			return deleted, listErr
+		}
+		pass := 0
+		for _, object := range objects {
+			if cs.sweepObject(object, dryRun) {
+				pass++
+			}
+		}
+		deleted += pass
+		if dryRun || pass == 0 {
+			break
+		}
+	}
+	return deleted, nil
+}
+
+//getToBeDeletedObjects list the objects whose TOBEDELETED metadata is true
+func (cs *commonservice) getToBeDeletedObjects() ([]sweptObject, error) {
+	objects := []sweptObject{}
+	for page := 1; ; page++ {
+		metadataPage, err := cs.api.GetMetadataByKey(TOBEDELETED, page)
+		if err != nil {
+			log.Errorf("fail to get objects marked %s error %v", TOBEDELETED, err)
+			return nil, err
+		}
+		for _, metadata := range metadataPage.MetadataArry {
+			if marked, _ := strconv.ParseBool(metadata.Value); marked {
+				objects = append(objects, sweptObject{id: int64(metadata.ObjectId), objectType: strings.ToUpper(metadata.ObjectType)})
+			}
+		}
+		if page >= metadataPage.Pagemetadata.PagesTotal {
+			return objects, nil
+		}
+	}
+}
+
+//sweepObject delete the object when it was created by the driver and has no child anymore, it returns true when deleted
+func (cs *commonservice) sweepObject(object sweptObject, dryRun bool) bool {
+	var hasChild bool
+	switch object.objectType {
+	case "VOLUME":
+		vol, err := cs.api.GetVolume(int(object.id))
+		if err != nil {
+			if !strings.Contains(err.Error(), "VOLUME_NOT_FOUND") {
+				log.Errorf("fail to get volume %d marked %s error %v", object.id, TOBEDELETED, err)
+			}
+			return false
+		}
+		childVolumes, err := cs.api.GetVolumeSnapshotByParentID(vol.ID)
+		if err != nil {
+			log.Errorf("fail to get snapshots of volume %d error %v", object.id, err)
+			return false
+		}
+		hasChild = len(*childVolumes) > 0
+	case "FILESYSTEM":
+		_, err := cs.api.GetFileSystemByID(object.id)
+		if err != nil {
+			if !strings.Contains(err.Error(), "FILESYSTEM_NOT_FOUND") {
+				log.Errorf("fail to get filesystem %d marked %s error %v", object.id, TOBEDELETED, err)
+			}
+			return false
+		}
+		hasChild = cs.api.FileSystemHasChild(object.id)
+	default:
+		log.Warnf("object %d of type %s is marked %s, skipped", object.id, object.objectType, TOBEDELETED)
+		return false
+	}
+	if hasChild {
+		log.Debugf("%s %d marked %s still has snapshots", object.objectType, object.id, TOBEDELETED)
+		return false
+	}
+	if refs, _, err := cs.getRestoreRefs(object.id); err != nil || len(refs) > 0 {
+		log.Debugf("%s %d marked %s is still referenced by %v, error %v", object.objectType, object.id, TOBEDELETED, refs, err)
+		return false
+	}
+	if !cs.createdByDriver(object.id) {
+		log.Warnf("%s %d is marked %s but was not created by the driver, skipped", object.objectType, object.id, TOBEDELETED)
+		return false
+	}
+	if dryRun {
+		log.Infof("dry run: %s %d marked %s would be deleted", object.objectType, object.id, TOBEDELETED)
+		return false
+	}
+
+	var err error
+	if object.objectType == "VOLUME" {
+		err = cs.api.DeleteVolume(int(object.id))
+	} else {
+		err = cs.api.DeleteFileSystemComplete(object.id)
+	}
+	if err != nil {
+		log.Errorf("fail to delete %s %d marked %s error %v", object.objectType, object.id, TOBEDELETED, err)
+		return false
+	}
+	log.Infof("deleted %s %d marked %s", object.objectType, object.id, TOBEDELETED)
+	return true
+}
+
+//createdByDriver check the created_by metadata of the object is the one of the driver, whatever its version
+//and the kubernetes version at creation time
+func (cs *commonservice) createdByDriver(objectID int64) bool {
+	metadataArray, err := cs.api.GetMetadata(objectID)
+	if err != nil {
+		log.Errorf("fail to get metadata of object %d error %v", objectID, err)
+		return false
+	}
+	for _, metadata := range *metadataArray {
+		if metadata.Key == "host.created_by" {
+			return strings.HasPrefix(metadata.Value, CreatedByPrefix)
+		}
+	}
+	return false
+}
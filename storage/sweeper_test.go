@@ -0,0 +1,142 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+func (suite *SweeperSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api, driverversion: "1.1.0"}
+}
+
+type SweeperSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestSweeperSuite(t *testing.T) {
+	suite.Run(t, new(SweeperSuite))
+}
+
+func getToBeDeletedPage(metadata ...api.Metadata) api.MetadataPage {
+	page := api.MetadataPage{MetadataArry: metadata}
+	page.Pagemetadata.PagesTotal = 1
+	return page
+}
+
+func (suite *SweeperSuite) Test_sweepToBeDeleted_DeleteWithoutChild() {
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 100, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+		api.Metadata{ObjectId: 200, ObjectType: "FILESYSTEM", Key: TOBEDELETED, Value: "true"},
+	), nil).Once()
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(), nil)
+	suite.api.On("GetVolume", 100).Return(api.Volume{ID: 100}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 100).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(100)).Return([]api.Metadata{{Key: "host.created_by", Value: suite.cs.GetCreatedBy()}}, nil)
+	suite.api.On("DeleteVolume", 100).Return(nil)
+	suite.api.On("GetFileSystemByID", int64(200)).Return(api.FileSystem{ID: 200, ParentID: 300}, nil)
+	suite.api.On("FileSystemHasChild", int64(200)).Return(false)
+	suite.api.On("GetMetadata", int64(200)).Return([]api.Metadata{{Key: "host.created_by", Value: "CSI/v1.14.0/1.0.0"}}, nil)
+	suite.api.On("DeleteFileSystemComplete", int64(200)).Return(nil)
+	deleted, err := suite.cs.sweepToBeDeleted(false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), 2, deleted)
+}
+
+func (suite *SweeperSuite) Test_sweepToBeDeleted_SkipChildAndForeign() {
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 100, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+		api.Metadata{ObjectId: 101, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+		api.Metadata{ObjectId: 102, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "false"},
+		api.Metadata{ObjectId: 103, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+	), nil)
+	suite.api.On("GetVolume", 100).Return(api.Volume{ID: 100}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 100).Return([]api.Volume{{ID: 110}}, nil)
+	suite.api.On("GetVolume", 101).Return(api.Volume{ID: 101}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 101).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(101)).Return([]api.Metadata{{Key: TOBEDELETED, Value: "true"}, {Key: "host.k8s.pvname", Value: "pv1"}}, nil)
+	suite.api.On("GetVolume", 103).Return(api.Volume{ID: 103, ParentId: 100}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 103).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(103)).Return([]api.Metadata{{Key: "host.created_by", Value: "replication"}}, nil)
+	deleted, err := suite.cs.sweepToBeDeleted(false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), 0, deleted)
+	suite.api.AssertNotCalled(suite.T(), "DeleteVolume", mock.Anything)
+}
+
+func (suite *SweeperSuite) Test_sweepToBeDeleted_ContinueOnError() {
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 100, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+		api.Metadata{ObjectId: 101, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+	), nil).Once()
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 100, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+	), nil)
+	suite.api.On("GetVolume", mock.Anything).Return(api.Volume{ID: 100, ParentId: 1}, nil).Once()
+	suite.api.On("GetVolume", mock.Anything).Return(api.Volume{ID: 101, ParentId: 1}, nil).Once()
+	suite.api.On("GetVolume", mock.Anything).Return(api.Volume{ID: 100, ParentId: 1}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", mock.Anything).Return(nil, nil)
+	suite.api.On("GetMetadata", mock.Anything).Return([]api.Metadata{{Key: "host.created_by", Value: suite.cs.GetCreatedBy()}}, nil)
+	suite.api.On("DeleteVolume", 100).Return(errors.New("VOLUME_IS_MAPPED"))
+	suite.api.On("DeleteVolume", 101).Return(nil)
+	deleted, err := suite.cs.sweepToBeDeleted(false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), 1, deleted)
+}
+
+func (suite *SweeperSuite) Test_sweepToBeDeleted_DryRun() {
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 200, ObjectType: "FILESYSTEM", Key: TOBEDELETED, Value: "true"},
+	), nil)
+	suite.api.On("GetFileSystemByID", int64(200)).Return(api.FileSystem{ID: 200, ParentID: 300}, nil)
+	suite.api.On("FileSystemHasChild", int64(200)).Return(false)
+	suite.api.On("GetMetadata", int64(200)).Return([]api.Metadata{{Key: "host.created_by", Value: suite.cs.GetCreatedBy()}}, nil)
+	deleted, err := suite.cs.sweepToBeDeleted(true)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), 0, deleted)
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystemComplete", mock.Anything)
+}
+
+func (suite *SweeperSuite) Test_sweepToBeDeleted_SkipReferenced() {
+	suite.api.On("GetMetadataByKey", TOBEDELETED, 1).Return(getToBeDeletedPage(
+		api.Metadata{ObjectId: 100, ObjectType: "VOLUME", Key: TOBEDELETED, Value: "true"},
+	), nil)
+	suite.api.On("GetVolume", 100).Return(api.Volume{ID: 100}, nil)
+	suite.api.On("GetVolumeSnapshotByParentID", 100).Return(nil, nil)
+	suite.api.On("GetMetadata", int64(100)).Return([]api.Metadata{{Key: "host.created_by", Value: suite.cs.GetCreatedBy()}, {Key: RESTOREREF + "pv2", Value: "110"}}, nil)
+	deleted, err := suite.cs.sweepToBeDeleted(false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), 0, deleted)
+	suite.api.AssertNotCalled(suite.T(), "DeleteVolume", mock.Anything)
+}
+
+func (suite *SweeperSuite) Test_sweepConfig_DryRunDefault() {
+	os.Unsetenv(SweepIntervalEnv)
+	os.Unsetenv(SweepDryRunEnv)
+	interval, dryRun := sweepConfig()
+	assert.Equal(suite.T(), defaultSweepInterval, interval)
+	assert.True(suite.T(), dryRun, "sweep is a dry run unless disabled explicitly")
+
+	os.Setenv(SweepDryRunEnv, "false")
+	defer os.Unsetenv(SweepDryRunEnv)
+	_, dryRun = sweepConfig()
+	assert.False(suite.T(), dryRun)
+}
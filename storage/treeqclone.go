@@ -0,0 +1,157 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//treeqPopulateLock name of the lock held while a treeq is populated, by the driver replica copying the data
+func treeqPopulateLock(pvName string) string {
+	return "treeq-populate-" + pvName
+}
+
+//CloneTreeqVolume create a new treeq and start populating it with the content of an existing treeq
+func (filesystem *FilesystemService) CloneTreeqVolume(config map[string]string, capacity int64, pvName string, srcFilesystemID, srcTreeqID int64) (treeqVolume map[string]string, err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while cloning treeq " + fmt.Sprint(res))
+		}
+	}()
+	srcTreeq, err := filesystem.cs.api.GetTreeq(srcFilesystemID, srcTreeqID)
+	if err != nil {
+		if strings.Contains(err.Error(), "TREEQ_ID_DOES_NOT_EXIST") || strings.Contains(err.Error(), "FILESYSTEM_NOT_FOUND") {
+			return nil, status.Errorf(codes.NotFound, "source treeq %d does not exist on filesystem %d", srcTreeqID, srcFilesystemID)
+		}
+		log.Errorf("Error occured while getting treeq: %s", err)
+		return
+	}
+	if capacity < srcTreeq.HardCapacity {
+		return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than source treeq capacity %d", capacity, srcTreeq.HardCapacity)
+	}
+	exportArray, err := filesystem.cs.api.GetExportByFileSystem(srcFilesystemID)
+	if err != nil {
+		log.Errorf("fail to get export of filesystem %d error %v", srcFilesystemID, err)
+		return
+	}
+	if exportArray == nil || len(*exportArray) == 0 {
+		return nil, status.Errorf(codes.Internal, "source filesystem %d is not exported", srcFilesystemID)
+	}
+	srcPath := path.Join((*exportArray)[0].ExportPath, srcTreeq.Path)
+	log.Infof("cloning treeq %s from treeq %d of filesystem %d", pvName, srcTreeqID, srcFilesystemID)
+	return filesystem.populateTreeq(config, capacity, pvName, srcPath, func() {})
+}
+
+//startPopulation run the data copy of a new treeq in the background
+var startPopulation = func(populate func()) { go populate() }
+
+//populateTreeq create the treeq and copy the exported srcPath into it in the background, CreateVolume is retried
+//with Aborted until the copy completes. The treeq filesystem carries a populating marker until then.
+//done is called once the copy is over or could not start
+func (filesystem *FilesystemService) populateTreeq(config map[string]string, capacity int64, pvName, srcPath string, done func()) (treeqVolume map[string]string, err error) {
+	unlockPopulate, ok, err := filesystem.getLocker().TryLock(treeqPopulateLock(pvName))
+	if err != nil {
+		done()
+		return nil, status.Errorf(codes.Unavailable, "fail to lock population of volume %s: %v", pvName, err)
+	}
+	if !ok {
+		done()
+		return nil, status.Errorf(codes.Aborted, "volume %s is still being populated", pvName)
+	}
+	started := false
+	defer func() {
+		if !started {
+			unlockPopulate()
+			done()
+		}
+	}()
+
+	treeqVolume, err = filesystem.createTreeqVolume(config, capacity, pvName, true)
+	if err != nil {
+		return
+	}
+	filesystemID, _ := strconv.ParseInt(treeqVolume["ID"], 10, 64)
+	treeqID, _ := strconv.ParseInt(treeqVolume["TREEQID"], 10, 64)
+
+	srcSource := fmt.Sprintf("%s:%s", treeqVolume["ipAddress"], srcPath)
+	dstSource := fmt.Sprintf("%s:%s", treeqVolume["ipAddress"], treeqVolume["volumePath"])
+	mountOptions := getNfsMountOptions(config["nfs_mount_options"], config[KeyNfsVersion])
+	started = true
+	startPopulation(func() {
+		defer done()
+		defer unlockPopulate()
+		filesystem.copyTreeqData(filesystemID, treeqID, pvName, srcSource, dstSource, mountOptions)
+	})
+	return nil, status.Errorf(codes.Aborted, "volume %s is being populated from %s", pvName, srcPath)
+}
+
+//copyTreeqData copy the data into the new treeq, the treeq is removed when the copy fails so the next attempt starts over
+func (filesystem *FilesystemService) copyTreeqData(filesystemID, treeqID int64, pvName, srcSource, dstSource string, mountOptions []string) {
+	err := filesystem.copier.CopyData(srcSource, dstSource, mountOptions)
+	if err != nil {
+		log.Errorf("fail to populate treeq %s error %v", pvName, err)
+		filesystem.removeTreeq(filesystemID, treeqID)
+		filesystem.cs.api.DeleteMetadataKey(filesystemID, TREEQPOPULATING+pvName)
+		return
+	}
+	// while the marker stays the next CreateVolume call replaces the volume
+	err = filesystem.cs.api.DeleteMetadataKey(filesystemID, TREEQPOPULATING+pvName)
+	if err != nil {
+		log.Errorf("fail to remove populating marker of treeq %s error %v", pvName, err)
+		return
+	}
+	log.Infof("treeq %s populated from %s", pvName, srcSource)
+}
+
+//VerifyTreeqPopulated check an existing treeq is not being or left partially populated,
+//a stale partial copy, whose population lock no driver replica holds, is removed so that the next attempt starts over
+func (filesystem *FilesystemService) VerifyTreeqPopulated(filesystemID, treeqID int64, pvName string) (err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while verifying treeq " + fmt.Sprint(res))
+		}
+	}()
+	unlockPopulate, ok, err := filesystem.getLocker().TryLock(treeqPopulateLock(pvName))
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "fail to lock population of volume %s: %v", pvName, err)
+	}
+	if !ok {
+		return status.Errorf(codes.Aborted, "volume %s is still being populated", pvName)
+	}
+	defer unlockPopulate()
+	metadataArray, err := filesystem.cs.api.GetMetadata(filesystemID)
+	if err != nil {
+		log.Errorf("fail to get metadata of filesystem %d error %v", filesystemID, err)
+		return
+	}
+	for _, metadata := range *metadataArray {
+		if metadata.Key != TREEQPOPULATING+pvName {
+			continue
+		}
+		log.Warnf("treeq %s was left partially populated, removing it", pvName)
+		filesystem.removeTreeq(filesystemID, treeqID)
+		err = filesystem.cs.api.DeleteMetadataKey(filesystemID, TREEQPOPULATING+pvName)
+		if err != nil {
+			log.Errorf("fail to remove populating marker of treeq %s error %v", pvName, err)
+		}
+		return status.Errorf(codes.Unavailable, "volume %s was partially populated and has been removed, retry", pvName)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *TreeqCloneSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type TreeqCloneSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestTreeqCloneSuite(t *testing.T) {
+	suite.Run(t, new(TreeqCloneSuite))
+}
+
+func (suite *TreeqCloneSuite) Test_CloneTreeqVolume_SourceNotFound() {
+	var filesystemID, treeqID int64 = 10, 20
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(nil, errors.New("TREEQ_ID_DOES_NOT_EXIST"))
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	_, err := service.CloneTreeqVolume(map[string]string{}, gib, "pvc-2", filesystemID, treeqID)
+	assert.Equal(suite.T(), codes.NotFound, status.Code(err), "source treeq not found")
+}
+
+func (suite *TreeqCloneSuite) Test_CloneTreeqVolume_SmallerCapacity() {
+	var filesystemID, treeqID int64 = 10, 20
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(api.Treeq{ID: treeqID, Path: "/pvc-1", HardCapacity: 2 * gib}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	_, err := service.CloneTreeqVolume(map[string]string{}, gib, "pvc-2", filesystemID, treeqID)
+	assert.Equal(suite.T(), codes.OutOfRange, status.Code(err), "capacity smaller than source")
+	suite.api.AssertNotCalled(suite.T(), "CreateTreeq", mock.Anything, mock.Anything)
+}
+
+func (suite *TreeqCloneSuite) Test_CloneTreeqVolume_SourceNotExported() {
+	var filesystemID, treeqID int64 = 10, 20
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(api.Treeq{ID: treeqID, Path: "/pvc-1", HardCapacity: gib}, nil)
+	suite.api.On("GetExportByFileSystem", filesystemID).Return([]api.ExportResponse{}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	_, err := service.CloneTreeqVolume(map[string]string{}, gib, "pvc-2", filesystemID, treeqID)
+	assert.NotNil(suite.T(), err, "source filesystem is not exported")
+}
+
+func (suite *TreeqCloneSuite) Test_populateTreeq_InProgress() {
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	service.locker = helper.NewProcessLocker()
+	unlock, _ := service.locker.Lock(treeqPopulateLock("pvc-2"))
+	defer unlock()
+	done := false
+	_, err := service.populateTreeq(map[string]string{}, gib, "pvc-2", "/fs/pvc-1", func() { done = true })
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "copy already running")
+	assert.True(suite.T(), done, "done is called when the copy does not start")
+	err = service.VerifyTreeqPopulated(100, 200, "pvc-2")
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "copy already running")
+}
+
+func (suite *TreeqCloneSuite) Test_copyTreeqData_Success() {
+	var filesystemID, treeqID int64 = 100, 200
+	suite.api.On("DeleteMetadataKey", filesystemID, TREEQPOPULATING+"pvc-2").Return(nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	service.copier = &treeqDataCopierStub{}
+	service.copyTreeqData(filesystemID, treeqID, "pvc-2", "1.1.1.1:/fs/pvc-1", "1.1.1.1:/fs/pvc-2", nil)
+	suite.api.AssertCalled(suite.T(), "DeleteMetadataKey", filesystemID, TREEQPOPULATING+"pvc-2")
+	suite.api.AssertNotCalled(suite.T(), "DeleteTreeq", filesystemID, treeqID)
+}
+
+func (suite *TreeqCloneSuite) Test_copyTreeqData_Failure() {
+	var filesystemID, treeqID int64 = 100, 200
+	suite.api.On("GetFilesytemTreeqCount", filesystemID).Return(2, nil)
+	suite.api.On("AttachMetadataToObject", filesystemID, mock.Anything).Return([]api.Metadata{}, nil)
+	suite.api.On("DeleteTreeq", filesystemID, treeqID).Return(api.Treeq{}, nil)
+	suite.api.On("DeleteMetadataKey", filesystemID, TREEQPOPULATING+"pvc-2").Return(nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	service.copier = &treeqDataCopierStub{err: errors.New("copy failed")}
+	service.copyTreeqData(filesystemID, treeqID, "pvc-2", "1.1.1.1:/fs/pvc-1", "1.1.1.1:/fs/pvc-2", nil)
+	suite.api.AssertCalled(suite.T(), "DeleteTreeq", filesystemID, treeqID)
+}
+
+func (suite *TreeqCloneSuite) Test_VerifyTreeqPopulated_Complete() {
+	var filesystemID int64 = 100
+	suite.api.On("GetMetadata", filesystemID).Return([]api.Metadata{{Key: TREEQCOUNT, Value: "1"}}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	err := service.VerifyTreeqPopulated(filesystemID, 200, "pvc-2")
+	assert.Nil(suite.T(), err, "error not expected")
+}
+
+func (suite *TreeqCloneSuite) Test_VerifyTreeqPopulated_StaleCopy() {
+	var filesystemID, treeqID int64 = 100, 200
+	suite.api.On("GetMetadata", filesystemID).Return([]api.Metadata{{Key: TREEQPOPULATING + "pvc-2", Value: "true"}}, nil)
+	suite.api.On("GetFilesytemTreeqCount", filesystemID).Return(2, nil)
+	suite.api.On("AttachMetadataToObject", filesystemID, mock.Anything).Return([]api.Metadata{}, nil)
+	suite.api.On("DeleteTreeq", filesystemID, treeqID).Return(api.Treeq{}, nil)
+	suite.api.On("DeleteMetadataKey", filesystemID, TREEQPOPULATING+"pvc-2").Return(nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	err := service.VerifyTreeqPopulated(filesystemID, treeqID, "pvc-2")
+	assert.Equal(suite.T(), codes.Unavailable, status.Code(err), "partial copy should be reported")
+	suite.api.AssertCalled(suite.T(), "DeleteTreeq", filesystemID, treeqID)
+}
+
+type treeqDataCopierStub struct {
+	err    error
+	copied []string
+}
+
+func (c *treeqDataCopierStub) CopyData(srcSource, dstSource string, mountOptions []string) error {
+	c.copied = append(c.copied, srcSource+" "+dstSource)
+	return c.err
+}
@@ -14,6 +14,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"infinibox-csi-driver/helper/volumeid"
 	"strconv"
 	"strings"
 
@@ -36,40 +37,119 @@ func (treeq *treeqstorage) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", validationStatusMap)
 		return nil, status.Error(codes.InvalidArgument, "Fail to validate parameter for nfs_treeq protocol")
 	}
+	if err = validateNfsVersion(config[KeyNfsVersion]); err != nil {
+		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", err)
+		return nil, err
+	}
+	if err = validateTreeqPlacement(config[TREEQPLACEMENT]); err != nil {
+		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", err)
+		return nil, err
+	}
+	if err = validateSquashParameters(config); err != nil {
+		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	pvName, err = getObjectName(pvName, config)
+	if err != nil {
+		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", err)
+		return nil, err
+	}
+	treeq.filesysService.setCSIName(req.GetName())
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
 		capacity = gib
 		log.Warn("Volume Minimum capacity should be greater 1 GB")
 	}
-	treeqVolumeMap, err = treeq.filesysService.IsTreeqAlreadyExist(config["pool_name"], strings.Trim(config["network_space"], ""), pvName)
+	if _, err = getTreeqQuota(config, capacity); err != nil {
+		log.Errorf("Fail to validate parameter for nfs_treeq protocol %v ", err)
+		return nil, err
+	}
+	poolSelection := isPoolSelection(config)
+	poolNames := []string{config[StoragePoolKey]}
+	if poolSelection {
+		if err = validatePoolSelectionPolicy(config); err != nil {
+			return nil, err
+		}
+		pools, poolErr := treeq.cs.getCandidatePools(config)
+		if poolErr != nil {
+			return nil, poolErr
+		}
+		poolNames = []string{}
+		for _, pool := range pools {
+			poolNames = append(poolNames, pool.Name)
+		}
+	}
+	for _, poolName := range poolNames {
+		treeqVolumeMap, err = treeq.filesysService.IsTreeqAlreadyExist(poolName, strings.Trim(config["network_space"], ""), pvName)
+		if poolSelection && len(treeqVolumeMap) > 0 {
+			config[StoragePoolKey] = poolName
+		}
+		if err != nil || len(treeqVolumeMap) > 0 {
+			break
+		}
+	}
 	if len(treeqVolumeMap) == 0 && err == nil {
-		treeqVolumeMap, err = treeq.filesysService.CreateTreeqVolume(config, capacity, pvName)
-	} 
+		if err = treeq.cs.selectStoragePool(config, capacity); err != nil {
+			log.Errorf("fail to select storage pool of treeq %s error %v", pvName, err)
+			return &csi.CreateVolumeResponse{}, err
+		}
+		if snapshotSource := req.GetVolumeContentSource().GetSnapshot(); snapshotSource != nil {
+			treeqVolumeMap, err = treeq.restoreFromSnapshot(config, capacity, pvName, snapshotSource.GetSnapshotId())
+		} else if volumeSource := req.GetVolumeContentSource().GetVolume(); volumeSource != nil {
+			treeqVolumeMap, err = treeq.cloneFromVolume(config, capacity, pvName, volumeSource.GetVolumeId())
+		} else {
+			treeqVolumeMap, err = treeq.filesysService.CreateTreeqVolume(config, capacity, pvName)
+		}
+	} else if err == nil && req.GetVolumeContentSource() != nil {
+		// the treeq exists, make sure its data copy is complete
+		filesystemID, _ := strconv.ParseInt(treeqVolumeMap["ID"], 10, 64)
+		treeqID, _ := strconv.ParseInt(treeqVolumeMap["TREEQID"], 10, 64)
+		err = treeq.filesysService.VerifyTreeqPopulated(filesystemID, treeqID, pvName)
+	}
 	if err != nil {
 		log.Errorf("fail to create volume %v", err)
 		return &csi.CreateVolumeResponse{}, err
 	}
+	if config[KeyNfsVersion] != "" {
+		treeqVolumeMap[KeyNfsVersion] = config[KeyNfsVersion]
+	}
+	if poolSelection {
+		treeqVolumeMap[StoragePoolKey] = config[StoragePoolKey]
+	}
+	volumeID := volumeid.ID{
+		Protocol:          NFSTREEQ,
+		Array:             config[KeyArray],
+		MaxFileSystemSize: config[MAXFILESYSTEMSIZE],
+	}
+	volumeID.ObjectID, _ = strconv.ParseInt(treeqVolumeMap["ID"], 10, 64)
+	volumeID.TreeqID, _ = strconv.ParseInt(treeqVolumeMap["TREEQID"], 10, 64)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      treeqVolumeMap["ID"] + "#" + treeqVolumeMap["TREEQID"] + "#" + config[MAXFILESYSTEMSIZE],
-			CapacityBytes: capacity,
+			VolumeId:      volumeID.String(),
+			CapacityBytes: appliedTreeqCapacity(treeqVolumeMap, capacity),
 			VolumeContext: treeqVolumeMap,
 			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
 
-func getVolumeIDs(volumeID string) (filesystemID, treeqID int64, size string, err error) {
-	volproto := strings.Split(volumeID, "#")
-	if len(volproto) != 3 {
-		err = errors.New("volume Id and other details not found")
-		return
+func (treeq *treeqstorage) restoreFromSnapshot(config map[string]string, capacity int64, pvName, snapshotID string) (map[string]string, error) {
+	snapproto, err := volumeid.ParseSnapshot(snapshotID)
+	if err != nil || !snapproto.IsTreeq() {
+		log.Errorf("Invalid snapshot ID %s %v", snapshotID, err)
+		return nil, status.Error(codes.InvalidArgument, "Invalid snapshot ID")
 	}
-	filesystemID, err = strconv.ParseInt(volproto[0], 10, 64)
-	treeqID, err = strconv.ParseInt(volproto[1], 10, 64)
-	size = volproto[2]
-	return
+	return treeq.filesysService.RestoreTreeqVolumeFromSnapshot(config, capacity, pvName, getTreeqSnapshot(snapproto))
+}
+
+func (treeq *treeqstorage) cloneFromVolume(config map[string]string, capacity int64, pvName, volumeID string) (map[string]string, error) {
+	volproto, err := volumeid.Parse(volumeID)
+	if err != nil || !volproto.IsTreeq() {
+		log.Errorf("Invalid source volume ID %s", volumeID)
+		return nil, status.Error(codes.InvalidArgument, "Invalid source volume ID, only nfs_treeq volumes can be cloned")
+	}
+	return treeq.filesysService.CloneTreeqVolume(config, capacity, pvName, volproto.ObjectID, volproto.TreeqID)
 }
 
 func (treeq *treeqstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -77,12 +157,12 @@ func (treeq *treeqstorage) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
 
-	filesystemID, treeqID, _, err := getVolumeIDs(req.GetVolumeId())
-	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil || !volproto.IsTreeq() {
+		log.Errorf("Invalid Volume ID %s %v", req.GetVolumeId(), err)
 		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
 	}
-	nfsDeleteErr := treeq.filesysService.DeleteTreeqVolume(filesystemID, treeqID)
+	nfsDeleteErr := treeq.filesysService.DeleteTreeqVolume(volproto.ObjectID, volproto.TreeqID)
 	if nfsDeleteErr != nil {
 		if strings.Contains(nfsDeleteErr.Error(), "FILESYSTEM_NOT_FOUND") {
 			log.Error("treeq already delete from infinibox")
@@ -103,13 +183,47 @@ func (treeq *treeqstorage) ControllerUnpublishVolume(ctx context.Context, req *c
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (treeq *treeqstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return &csi.CreateSnapshotResponse{}, status.Error(codes.Unimplemented, "Unsupported operation for treeq")
+func (treeq *treeqstorage) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (createSnapshot *csi.CreateSnapshotResponse, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from CSI CreateSnapshot  " + fmt.Sprint(res))
+		}
+	}()
+	log.Infof("Create Snapshot %s called with volume Id %s", req.GetName(), req.GetSourceVolumeId())
+	volproto, err := volumeid.Parse(req.GetSourceVolumeId())
+	if err != nil || !volproto.IsTreeq() {
+		log.Errorf("Invalid Volume ID %s %v", req.GetSourceVolumeId(), err)
+		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
+	}
+	filesystemID, treeqID := volproto.ObjectID, volproto.TreeqID
+	if _, ok := req.GetParameters()[TREEQSNAPSHOTREUSE]; ok {
+		log.Warnf("%s is not supported anymore, snapshot %s gets its own filesystem snapshot", TREEQSNAPSHOTREUSE, req.GetName())
+	}
+
+	snapshot, err := treeq.filesysService.CreateTreeqSnapshot(filesystemID, treeqID, req.GetName(), getCreateMetadataOwner(req.GetParameters()))
+	if err != nil {
+		log.Errorf("fail to create snapshot %s error %v", req.GetName(), err)
+		return
+	}
+	return &csi.CreateSnapshotResponse{
+		Snapshot: getCSISnapshot(getTreeqSnapshotID(volproto, snapshot), req.GetSourceVolumeId(), snapshot.Size, snapshot.CreatedAt),
+	}, nil
 }
 
 func (treeq *treeqstorage) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return &csi.DeleteSnapshotResponse{}, status.Error(codes.Unimplemented, "Unsupported operation for treeq")
-
+	snapproto, err := volumeid.ParseSnapshot(req.GetSnapshotId())
+	if err != nil || !snapproto.IsTreeq() {
+		log.Errorf("Invalid snapshot ID %s %v", req.GetSnapshotId(), err)
+		return nil, status.Error(codes.InvalidArgument, "Invalid snapshot ID")
+	}
+	snapshot := getTreeqSnapshot(snapproto)
+	err = treeq.filesysService.DeleteTreeqSnapshot(snapshot.FileSystemSnapshotID, snapshot.Name)
+	if err != nil {
+		log.Errorf("fail to delete snapshot %s error %v", req.GetSnapshotId(), err)
+		return &csi.DeleteSnapshotResponse{}, err
+	}
+	log.Infof("treeq snapshot %s successfully deleted", req.GetSnapshotId())
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (treeq *treeqstorage) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (expandVolume *csi.ControllerExpandVolumeResponse, err error) {
@@ -119,11 +233,12 @@ func (treeq *treeqstorage) ControllerExpandVolume(ctx context.Context, req *csi.
 		}
 	}()
 
-	filesystemID, treeqID, maxSize, err := getVolumeIDs(req.GetVolumeId())
-	if err != nil {
-		log.Errorf("Invalid Volume ID %v", err)
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil || !volproto.IsTreeq() {
+		log.Errorf("Invalid Volume ID %s %v", req.GetVolumeId(), err)
 		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
 	}
+	filesystemID, treeqID, maxSize := volproto.ObjectID, volproto.TreeqID, volproto.MaxFileSystemSize
 
 	capacity := int64(req.GetCapacityRange().GetRequiredBytes())
 	if capacity < gib {
@@ -21,6 +21,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (suite *TreeqControllerSuite) SetupTest() {
@@ -43,6 +45,29 @@ func (suite *TreeqControllerSuite) Test_CreateVolume_validation() {
 	assert.NotNil(suite.T(), err, "empty error")
 }
 
+func (suite *TreeqControllerSuite) Test_CreateVolume_AppliedCapacity() {
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, make(map[string]string))
+	volumeResponse := getCreateVolumeResponse()
+	volumeResponse[treeqCapacityKey] = "2147483648"
+	suite.filesystem.On("IsTreeqAlreadyExist", mock.Anything, mock.Anything, mock.Anything).Return(make(map[string]string), nil)
+	suite.filesystem.On("CreateTreeqVolume", mock.Anything, mock.Anything, mock.Anything).Return(volumeResponse, nil)
+	service := treeqstorage{filesysService: suite.filesystem}
+	result, err := service.CreateVolume(context.Background(), getCreateVolumeRequest())
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(2147483648), result.GetVolume().GetCapacityBytes(), "applied treeq capacity expected")
+	assert.NotContains(suite.T(), result.GetVolume().GetVolumeContext(), treeqCapacityKey)
+}
+
+func (suite *TreeqControllerSuite) Test_CreateVolume_InvalidQuota() {
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, make(map[string]string))
+	service := treeqstorage{filesysService: suite.filesystem}
+	req := getCreateVolumeRequest()
+	req.Parameters = map[string]string{TREEQSOFTINODES: "many"}
+	_, err := service.CreateVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+	suite.filesystem.AssertNotCalled(suite.T(), "CreateTreeqVolume", mock.Anything, mock.Anything, mock.Anything)
+}
+
 func (suite *TreeqControllerSuite) Test_CreateVolume_Error() {
 	mapParameter := make(map[string]string)
 	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, mapParameter)
@@ -68,7 +93,7 @@ func (suite *TreeqControllerSuite) Test_CreateVolume_Success() {
 	assert.Nil(suite.T(), err, "empty error")
 	val := result.GetVolume()
 	fmt.Println("val", val.GetVolumeId())
-	assert.Equal(suite.T(), "100#200#", val.GetVolumeId(), "ID shoulde be equal")
+	assert.Equal(suite.T(), "v1$$nfs_treeq$$id=100;treeq=200", val.GetVolumeId(), "ID shoulde be equal")
 }
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_VolumeID_empty() {
@@ -85,7 +110,7 @@ func (suite *TreeqControllerSuite) Test_DeleteVolume_InvalidVolumeID() {
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_Error() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200"
+	volumeID := "100#200#$$nfs_treeq"
 	expectedErr := errors.New("Some error")
 	var filesytemID, treeqID int64 = 100, 200
 	suite.filesystem.On("DeleteTreeqVolume", filesytemID, treeqID).Return(expectedErr)
@@ -95,7 +120,7 @@ func (suite *TreeqControllerSuite) Test_DeleteVolume_Error() {
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_Error_filenotfound() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	expectedErr := errors.New("FILESYSTEM_NOT_FOUND error")
 	var filesytemID, treeqID int64 = 100, 200
 	suite.filesystem.On("DeleteTreeqVolume", filesytemID, treeqID).Return(expectedErr)
@@ -105,7 +130,7 @@ func (suite *TreeqControllerSuite) Test_DeleteVolume_Error_filenotfound() {
 
 func (suite *TreeqControllerSuite) Test_DeleteVolume_success() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	var filesytemID, treeqID int64 = 100, 200
 	suite.filesystem.On("DeleteTreeqVolume", filesytemID, treeqID).Return(nil)
 	resp, err := service.DeleteVolume(context.Background(), getDeleteVolumeRequest(volumeID))
@@ -127,7 +152,7 @@ func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_InvalidVolumeID()
 
 func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200"
+	volumeID := "100#200#$$nfs_treeq"
 	expectedErr := errors.New("Some error")
 	var filesytemID, treeqID, capacity int64 = 100, 200, 1073741824
 	var maxSize = ""
@@ -138,7 +163,7 @@ func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error() {
 
 func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error_filenotfound() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	var filesytemID, treeqID, capacity int64 = 100, 200, 1073741824
 	var maxSize = ""
 	suite.filesystem.On("UpdateTreeqVolume", filesytemID, treeqID, capacity, maxSize).Return(nil)
@@ -148,7 +173,7 @@ func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_Error_filenotfoun
 
 func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_success() {
 	service := treeqstorage{filesysService: suite.filesystem}
-	volumeID := "100#200#"
+	volumeID := "100#200#$$nfs_treeq"
 	var filesytemID, treeqID, capacity int64 = 100, 200, 1073741824
 	var maxSize = ""
 	suite.filesystem.On("UpdateTreeqVolume", filesytemID, treeqID, capacity, maxSize).Return(nil)
@@ -157,6 +182,130 @@ func (suite *TreeqControllerSuite) Test_ControllerExpandVolume_success() {
 	assert.NotNil(suite.T(), resp, "response should not be nil")
 }
 
+func (suite *TreeqControllerSuite) Test_CreateVolume_FromSnapshot_Success() {
+	mapParameter := make(map[string]string)
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, mapParameter)
+	suite.filesystem.On("IsTreeqAlreadyExist", mock.Anything, mock.Anything, mock.Anything).Return(make(map[string]string), nil)
+	expectedSnapshot := &TreeqSnapshot{FileSystemSnapshotID: 300, TreeqPath: "/pvc-source", Name: "snapshot-1"}
+	suite.filesystem.On("RestoreTreeqVolumeFromSnapshot", mock.Anything, mock.Anything, mock.Anything, expectedSnapshot).Return(getCreateVolumeResponse(), nil)
+	service := treeqstorage{filesysService: suite.filesystem}
+	req := getCreateVolumeRequest()
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "300#/pvc-source#snapshot-1$$nfs_treeq"},
+		},
+	}
+	result, err := service.CreateVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "empty error")
+	assert.Equal(suite.T(), "v1$$nfs_treeq$$id=100;treeq=200", result.GetVolume().GetVolumeId(), "ID shoulde be equal")
+	suite.filesystem.AssertNotCalled(suite.T(), "CreateTreeqVolume", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *TreeqControllerSuite) Test_CreateVolume_FromSnapshot_InvalidSnapshotID() {
+	mapParameter := make(map[string]string)
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, mapParameter)
+	suite.filesystem.On("IsTreeqAlreadyExist", mock.Anything, mock.Anything, mock.Anything).Return(make(map[string]string), nil)
+	service := treeqstorage{filesysService: suite.filesystem}
+	req := getCreateVolumeRequest()
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "300$$nfs_treeq"},
+		},
+	}
+	_, err := service.CreateVolume(context.Background(), req)
+	assert.NotNil(suite.T(), err, "invalid snapshot ID")
+}
+
+func (suite *TreeqControllerSuite) Test_CreateVolume_FromVolume_Success() {
+	mapParameter := make(map[string]string)
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, mapParameter)
+	suite.filesystem.On("IsTreeqAlreadyExist", mock.Anything, mock.Anything, mock.Anything).Return(make(map[string]string), nil)
+	var srcFilesystemID, srcTreeqID int64 = 10, 20
+	suite.filesystem.On("CloneTreeqVolume", mock.Anything, mock.Anything, mock.Anything, srcFilesystemID, srcTreeqID).Return(getCreateVolumeResponse(), nil)
+	service := treeqstorage{filesysService: suite.filesystem}
+	req := getCreateVolumeRequest()
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "10#20#$$nfs_treeq"},
+		},
+	}
+	result, err := service.CreateVolume(context.Background(), req)
+	assert.Nil(suite.T(), err, "empty error")
+	assert.Equal(suite.T(), "v1$$nfs_treeq$$id=100;treeq=200", result.GetVolume().GetVolumeId(), "ID shoulde be equal")
+}
+
+func (suite *TreeqControllerSuite) Test_CreateVolume_FromVolume_NotTreeq() {
+	mapParameter := make(map[string]string)
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, mapParameter)
+	suite.filesystem.On("IsTreeqAlreadyExist", mock.Anything, mock.Anything, mock.Anything).Return(make(map[string]string), nil)
+	service := treeqstorage{filesysService: suite.filesystem}
+	req := getCreateVolumeRequest()
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "10$$nfs"},
+		},
+	}
+	_, err := service.CreateVolume(context.Background(), req)
+	assert.NotNil(suite.T(), err, "only treeq volumes can be cloned")
+}
+
+func (suite *TreeqControllerSuite) Test_CreateVolume_FromVolume_StillPopulating() {
+	mapParameter := make(map[string]string)
+	suite.filesystem.On("validateTreeqParameters", mock.Anything).Return(true, mapParameter)
+	suite.filesystem.On("IsTreeqAlreadyExist", mock.Anything, mock.Anything, mock.Anything).Return(getCreateVolumeResponse(), nil)
+	var filesystemID, treeqID int64 = 100, 200
+	suite.filesystem.On("VerifyTreeqPopulated", filesystemID, treeqID, mock.Anything).Return(status.Error(codes.Aborted, "still being populated"))
+	service := treeqstorage{filesysService: suite.filesystem}
+	req := getCreateVolumeRequest()
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "10#20#$$nfs_treeq"},
+		},
+	}
+	_, err := service.CreateVolume(context.Background(), req)
+	assert.Equal(suite.T(), codes.Aborted, status.Code(err), "volume should not be reported ready")
+	suite.filesystem.AssertNotCalled(suite.T(), "CloneTreeqVolume", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *TreeqControllerSuite) Test_CreateSnapshot_InvalidVolumeID() {
+	service := treeqstorage{filesysService: suite.filesystem}
+	_, err := service.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "100$$nfs_treeq"})
+	assert.NotNil(suite.T(), err, "invalid volume ID")
+}
+
+func (suite *TreeqControllerSuite) Test_CreateSnapshot_Success() {
+	service := treeqstorage{filesysService: suite.filesystem}
+	var filesytemID, treeqID int64 = 100, 200
+	snapshot := &TreeqSnapshot{FileSystemSnapshotID: 300, TreeqPath: "/pvc-source", Name: "snapshot-1", Size: 1000, CreatedAt: 1500000000000}
+	suite.filesystem.On("CreateTreeqSnapshot", filesytemID, treeqID, "snapshot-1", "apps/backup").Return(snapshot, nil)
+	req := &csi.CreateSnapshotRequest{
+		Name:           "snapshot-1",
+		SourceVolumeId: "100#200#$$nfs_treeq",
+		Parameters: map[string]string{
+			VolumeSnapshotNameParameter:      "backup",
+			VolumeSnapshotNamespaceParameter: "apps",
+		},
+	}
+	resp, err := service.CreateSnapshot(context.Background(), req)
+	assert.Nil(suite.T(), err, "error Not expected")
+	assert.Equal(suite.T(), "v1$$nfs_treeq$$id=300;path=/pvc-source;name=snapshot-1", resp.GetSnapshot().GetSnapshotId(), "snapshot ID should be equal")
+	assert.Equal(suite.T(), int64(1500000000), resp.GetSnapshot().GetCreationTime().GetSeconds(), "creation time should come from the array")
+}
+
+func (suite *TreeqControllerSuite) Test_DeleteSnapshot_InvalidSnapshotID() {
+	service := treeqstorage{filesysService: suite.filesystem}
+	_, err := service.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "300"})
+	assert.NotNil(suite.T(), err, "invalid snapshot ID")
+}
+
+func (suite *TreeqControllerSuite) Test_DeleteSnapshot_Success() {
+	service := treeqstorage{filesysService: suite.filesystem}
+	var fsSnapshotID int64 = 300
+	suite.filesystem.On("DeleteTreeqSnapshot", fsSnapshotID, "snapshot-1").Return(nil)
+	_, err := service.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "300#/pvc-source#snapshot-1$$nfs_treeq"})
+	assert.Nil(suite.T(), err, "error Not expected")
+}
+
 func TestTreeqControllerSuite(t *testing.T) {
 	suite.Run(t, new(TreeqControllerSuite))
 }
@@ -192,6 +341,9 @@ func (m *FileSystemInterfaceMock) CreateTreeqVolume(config map[string]string, ca
 	err, _ := status.Get(1).(error)
 	return st, err
 }
+func (m *FileSystemInterfaceMock) setCSIName(csiName string) {
+}
+
 func (m *FileSystemInterfaceMock) validateTreeqParameters(config map[string]string) (bool, map[string]string) {
 	status := m.Called(config)
 	st, _ := status.Get(0).(bool)
@@ -216,3 +368,43 @@ func (m *FileSystemInterfaceMock) IsTreeqAlreadyExist(pool_name, network_space,
 	err, _ := status.Get(1).(error)
 	return st, err
 }
+
+func (m *FileSystemInterfaceMock) CreateTreeqSnapshot(filesystemID, treeqID int64, snapshotName string, owner string) (*TreeqSnapshot, error) {
+	status := m.Called(filesystemID, treeqID, snapshotName, owner)
+	st, _ := status.Get(0).(*TreeqSnapshot)
+	err, _ := status.Get(1).(error)
+	return st, err
+}
+
+func (m *FileSystemInterfaceMock) DeleteTreeqSnapshot(fileSystemSnapshotID int64, snapshotName string) error {
+	status := m.Called(fileSystemSnapshotID, snapshotName)
+	err, _ := status.Get(0).(error)
+	return err
+}
+
+func (m *FileSystemInterfaceMock) RestoreTreeqVolumeFromSnapshot(config map[string]string, capacity int64, pvName string, snapshot *TreeqSnapshot) (map[string]string, error) {
+	status := m.Called(config, capacity, pvName, snapshot)
+	st, _ := status.Get(0).(map[string]string)
+	err, _ := status.Get(1).(error)
+	return st, err
+}
+
+func (m *FileSystemInterfaceMock) CloneTreeqVolume(config map[string]string, capacity int64, pvName string, srcFilesystemID, srcTreeqID int64) (map[string]string, error) {
+	status := m.Called(config, capacity, pvName, srcFilesystemID, srcTreeqID)
+	st, _ := status.Get(0).(map[string]string)
+	err, _ := status.Get(1).(error)
+	return st, err
+}
+
+func (m *FileSystemInterfaceMock) VerifyTreeqPopulated(filesystemID, treeqID int64, pvName string) error {
+	status := m.Called(filesystemID, treeqID, pvName)
+	err, _ := status.Get(0).(error)
+	return err
+}
+
+func (m *FileSystemInterfaceMock) GetTreeqVolumeUsage(filesystemID, treeqID int64) ([]*csi.VolumeUsage, error) {
+	status := m.Called(filesystemID, treeqID)
+	usage, _ := status.Get(0).([]*csi.VolumeUsage)
+	err, _ := status.Get(1).(error)
+	return usage, err
+}
@@ -0,0 +1,91 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/helper"
+	"io/ioutil"
+	"os/exec"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+//TreeqDataCopier copy the content of one nfs source into another
+type TreeqDataCopier interface {
+	CopyData(srcSource, dstSource string, mountOptions []string) error
+}
+
+type nfsDataCopier struct {
+	mounter  mount.Interface
+	osHelper helper.OsHelper
+}
+
+func newNfsDataCopier() TreeqDataCopier {
+	return &nfsDataCopier{mounter: mount.New(""), osHelper: helper.Service{}}
+}
+
+//CopyData mount both nfs sources on temporary directories and copy the source content into destination
+func (c *nfsDataCopier) CopyData(srcSource, dstSource string, mountOptions []string) (err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("error while copying treeq data " + fmt.Sprint(res))
+		}
+	}()
+	srcDir, err := c.mountSource(srcSource, append([]string{"ro"}, mountOptions...))
+	if err != nil {
+		return
+	}
+	defer c.unmountSource(srcDir)
+
+	dstDir, err := c.mountSource(dstSource, mountOptions)
+	if err != nil {
+		return
+	}
+	defer c.unmountSource(dstDir)
+
+	log.Infof("copying data from %s to %s", srcSource, dstSource)
+	out, err := exec.Command("cp", "-a", srcDir+"/.", dstDir).CombinedOutput()
+	if err != nil {
+		log.Errorf("fail to copy data from %s to %s: %s", srcSource, dstSource, string(out))
+		return fmt.Errorf("fail to copy data from %s to %s: %v", srcSource, dstSource, err)
+	}
+	log.Infof("data copied successfully from %s to %s", srcSource, dstSource)
+	return nil
+}
+
+func (c *nfsDataCopier) mountSource(source string, mountOptions []string) (string, error) {
+	dir, err := ioutil.TempDir("", "csi-treeq-")
+	if err != nil {
+		log.Errorf("fail to create temporary mount point %v", err)
+		return "", err
+	}
+	err = c.mounter.Mount(source, dir, "nfs", mountOptions)
+	if err != nil {
+		log.Errorf("fail to mount source path '%s' : %s", source, err)
+		c.osHelper.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+func (c *nfsDataCopier) unmountSource(dir string) {
+	if err := c.mounter.Unmount(dir); err != nil {
+		log.Errorf("fail to unmount temporary mount point '%s' : %s", dir, err)
+		return
+	}
+	if err := c.osHelper.Remove(dir); err != nil && !c.osHelper.IsNotExist(err) {
+		log.Errorf("fail to remove temporary mount point '%s' : %s", dir, err)
+	}
+}
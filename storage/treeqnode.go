@@ -13,9 +13,9 @@ package storage
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -41,16 +41,7 @@ func (treeq *treeqstorage) NodePublishVolume(ctx context.Context, req *csi.NodeP
 	if !notMnt {
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
-	mountOptions := []string{}
-	configMountOptions := req.GetVolumeContext()["nfs_mount_options"]
-	if configMountOptions == "" {
-		configMountOptions = MountOptions
-	}
-	for _, option := range strings.Split(configMountOptions, ",") {
-		if option != "" {
-			mountOptions = append(mountOptions, option)
-		}
-	}
+	mountOptions := getNfsMountOptions(req.GetVolumeContext()["nfs_mount_options"], req.GetVolumeContext()[KeyNfsVersion])
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
@@ -96,3 +87,32 @@ func (treeq *treeqstorage) NodeStageVolume(ctx context.Context, req *csi.NodeSta
 func (treeq *treeqstorage) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
+
+//NodeGetVolumeStats report the usage of the treeq quota, the statfs of the mount is the one of the whole filesystem
+func (treeq *treeqstorage) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volproto, err := volumeid.Parse(req.GetVolumeId())
+	if err != nil || !volproto.IsTreeq() {
+		log.Errorf("Invalid Volume ID %s %v", req.GetVolumeId(), err)
+		return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path not provided")
+	}
+	notMnt, err := treeq.mounter.IsNotMountPoint(volumePath)
+	if err != nil {
+		if treeq.osHelper.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s not found", volumePath)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if notMnt {
+		return nil, status.Errorf(codes.NotFound, "volume path %s is not mounted", volumePath)
+	}
+	usage, err := treeq.filesysService.GetTreeqVolumeUsage(volproto.ObjectID, volproto.TreeqID)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
+}
+
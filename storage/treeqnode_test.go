@@ -21,6 +21,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (suite *TreeqNodeSuite) SetupTest() {
@@ -181,3 +183,30 @@ func (suite *TreeqNodeSuite) Test_NodeUnstageVolume() {
 	_, err := service.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{})
 	assert.Nil(suite.T(), err, "empty err")
 }
+
+func (suite *TreeqNodeSuite) Test_NodeGetVolumeStats() {
+	filesystem := new(FileSystemInterfaceMock)
+	service := treeqstorage{mounter: suite.nfsMountMock, osHelper: suite.osHelperMock, filesysService: filesystem}
+	suite.nfsMountMock.On("IsNotMountPoint", "/var/lib/kubelet/pods/1/volumes/pv").Return(false, nil)
+	usage := []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 1000, Used: 100, Available: 900}}
+	filesystem.On("GetTreeqVolumeUsage", int64(100), int64(200)).Return(usage, nil)
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "v1$$nfs_treeq$$id=100;treeq=200", VolumePath: "/var/lib/kubelet/pods/1/volumes/pv"}
+	resp, err := service.NodeGetVolumeStats(context.Background(), req)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), usage, resp.GetUsage(), "treeq quota usage expected")
+}
+
+func (suite *TreeqNodeSuite) Test_NodeGetVolumeStats_NotMounted() {
+	filesystem := new(FileSystemInterfaceMock)
+	service := treeqstorage{mounter: suite.nfsMountMock, osHelper: suite.osHelperMock, filesysService: filesystem}
+	suite.nfsMountMock.On("IsNotMountPoint", mock.Anything).Return(true, nil)
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "v1$$nfs_treeq$$id=100;treeq=200", VolumePath: "/var/lib/kubelet/pods/1/volumes/pv"}
+	_, err := service.NodeGetVolumeStats(context.Background(), req)
+	assert.Equal(suite.T(), codes.NotFound, status.Code(err))
+	filesystem.AssertNotCalled(suite.T(), "GetTreeqVolumeUsage", mock.Anything, mock.Anything)
+
+	req.VolumeId = "100$$nfs"
+	_, err = service.NodeGetVolumeStats(context.Background(), req)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "treeq volume ID expected")
+}
+
@@ -0,0 +1,285 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"infinibox-csi-driver/api"
+	log "infinibox-csi-driver/helper/logger"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//treeq placement constants
+const (
+	//TREEQPLACEMENT storage class parameter, filesystem of the pool a new treeq is placed on
+	TREEQPLACEMENT = "treeq_placement"
+
+	//PlacementFirstFit first filesystem with room for the treeq, the default
+	PlacementFirstFit = "first_fit"
+	//PlacementLeastUsed filesystem whose treeqs use the least capacity
+	PlacementLeastUsed = "least_used"
+	//PlacementLeastTreeqs filesystem with the fewest treeqs
+	PlacementLeastTreeqs = "least_treeqs"
+	//PlacementSpread filesystems with room for the treeq in turn
+	PlacementSpread = "spread"
+)
+
+var treeqPlacements = map[string]bool{
+	PlacementFirstFit:    true,
+	PlacementLeastUsed:   true,
+	PlacementLeastTreeqs: true,
+	PlacementSpread:      true,
+}
+
+//treeqSpread filesystem of each pool the last treeq was spread to.
+//The placement of a pool is locked, so with several controller replicas each replica spreads its own treeqs
+var treeqSpread = struct {
+	sync.Mutex
+	last map[int64]int64
+}{last: make(map[int64]int64)}
+
+//treeqCandidate filesystem with room for a new treeq
+type treeqCandidate struct {
+	fileSystem   api.FileSystem
+	treeqs       int
+	usedCapacity int64
+}
+
+//validateTreeqPlacement check the treeq_placement parameter, empty is first_fit
+func validateTreeqPlacement(placement string) error {
+	if placement == "" || treeqPlacements[placement] {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "invalid %s %s, supported placements are %s, %s, %s and %s",
+		TREEQPLACEMENT, placement, PlacementFirstFit, PlacementLeastUsed, PlacementLeastTreeqs, PlacementSpread)
+}
+
+//getPlacement return the treeq placement of the storage class
+func (filesystem *FilesystemService) getPlacement() string {
+	if placement := filesystem.configmap[TREEQPLACEMENT]; placement != "" {
+		return placement
+	}
+	return PlacementFirstFit
+}
+
+//getTreeqUsage return the treeq count of the filesystem, and for placements other than first_fit the capacity used by its treeqs
+func (filesystem *FilesystemService) getTreeqUsage(fileSystemID int64, placement string) (treeqs int, usedCapacity int64, err error) {
+	if placement == PlacementFirstFit {
+		treeqs, err = filesystem.cs.api.GetFilesytemTreeqCount(fileSystemID)
+		return
+	}
+	treeqList, err := filesystem.cs.api.GetTreeqsByFileSystemID(fileSystemID)
+	if err != nil {
+		return
+	}
+	for _, treeq := range treeqList {
+		usedCapacity += treeq.UsedCapacity
+	}
+	return len(treeqList), usedCapacity, nil
+}
+
+//selectTreeqCandidate pick the filesystem of the candidates of the pool a new treeq is placed on
+func selectTreeqCandidate(placement string, poolID int64, candidates []treeqCandidate) *treeqCandidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+	selected := 0
+	switch placement {
+	case PlacementLeastUsed:
+		for i, candidate := range candidates {
+			best := candidates[selected]
+			if candidate.usedCapacity < best.usedCapacity || (candidate.usedCapacity == best.usedCapacity && candidate.treeqs < best.treeqs) {
+				selected = i
+			}
+		}
+	case PlacementLeastTreeqs:
+		for i, candidate := range candidates {
+			best := candidates[selected]
+			if candidate.treeqs < best.treeqs || (candidate.treeqs == best.treeqs && candidate.usedCapacity < best.usedCapacity) {
+				selected = i
+			}
+		}
+	case PlacementSpread:
+		treeqSpread.Lock()
+		defer treeqSpread.Unlock()
+		last := treeqSpread.last[poolID]
+		next := -1
+		for i, candidate := range candidates {
+			if candidate.fileSystem.ID > last && (next < 0 || candidate.fileSystem.ID < candidates[next].fileSystem.ID) {
+				next = i
+			}
+			if candidate.fileSystem.ID < candidates[selected].fileSystem.ID {
+				selected = i
+			}
+		}
+		if next >= 0 {
+			selected = next
+		}
+		treeqSpread.last[poolID] = candidates[selected].fileSystem.ID
+	}
+	return &candidates[selected]
+}
+
+//TreeqBalanceReport distribution of the treeqs of a pool among its treeq filesystems
+type TreeqBalanceReport struct {
+	Time              string              `json:"time"`
+	Pool              string              `json:"pool"`
+	FileSystems       []FileSystemBalance `json:"filesystems"`
+	Treeqs            int                 `json:"treeqs"`
+	MinTreeqs         int                 `json:"min_treeqs"`
+	MaxTreeqs         int                 `json:"max_treeqs"`
+	TreeqImbalance    float64             `json:"treeq_imbalance"`
+	UsedCapacity      int64               `json:"used_capacity"`
+	MinUsedCapacity   int64               `json:"min_used_capacity"`
+	MaxUsedCapacity   int64               `json:"max_used_capacity"`
+	CapacityImbalance float64             `json:"capacity_imbalance"`
+	Moves             []TreeqMove         `json:"moves,omitempty"`
+}
+
+//FileSystemBalance treeqs of a filesystem of the pool
+type FileSystemBalance struct {
+	ID            int64  `json:"id"`
+	Name          string `json:"name"`
+	Size          int64  `json:"size"`
+	Treeqs        int    `json:"treeqs"`
+	TreeqCapacity int64  `json:"treeq_capacity"`
+	UsedCapacity  int64  `json:"used_capacity"`
+}
+
+//TreeqMove treeq to copy to another filesystem to even the treeq counts, the report does not move it
+type TreeqMove struct {
+	Treeq          string `json:"treeq"`
+	TreeqID        int64  `json:"treeq_id"`
+	FromFileSystem int64  `json:"from_filesystem"`
+	ToFileSystem   int64  `json:"to_filesystem"`
+	UsedCapacity   int64  `json:"used_capacity"`
+}
+
+//BuildTreeqBalanceReport report the treeq imbalance of the filesystems of the pool named fsPrefix*, all filesystems when fsPrefix is empty
+func BuildTreeqBalanceReport(poolName, fsPrefix string, secrets map[string]string) (*TreeqBalanceReport, error) {
+	cs, err := buildCommonService(map[string]string{}, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return cs.treeqBalanceReport(poolName, fsPrefix)
+}
+
+func (cs *commonservice) treeqBalanceReport(poolName, fsPrefix string) (report *TreeqBalanceReport, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("error while building treeq balance report " + fmt.Sprint(res))
+		}
+	}()
+	poolID, err := cs.api.GetStoragePoolIDByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get pool %s: %v", poolName, err)
+	}
+	report = &TreeqBalanceReport{Time: time.Now().UTC().Format(time.RFC3339), Pool: poolName, FileSystems: []FileSystemBalance{}}
+	treeqsByFileSystem := make(map[int64][]api.Treeq)
+	for page := 1; ; page++ {
+		fsMetaData, err := cs.api.GetFileSystemsByPoolID(poolID, page)
+		if err != nil {
+			return nil, fmt.Errorf("fail to get filesystems of pool %s: %v", poolName, err)
+		}
+		for _, fs := range fsMetaData.FileSystemArry {
+			if !strings.HasPrefix(fs.Name, fsPrefix) {
+				continue
+			}
+			treeqs, err := cs.api.GetTreeqsByFileSystemID(fs.ID)
+			if err != nil {
+				return nil, fmt.Errorf("fail to get treeqs of filesystem %s: %v", fs.Name, err)
+			}
+			balance := FileSystemBalance{ID: fs.ID, Name: fs.Name, Size: fs.Size, Treeqs: len(treeqs)}
+			for _, treeq := range treeqs {
+				balance.TreeqCapacity += treeq.HardCapacity
+				balance.UsedCapacity += treeq.UsedCapacity
+			}
+			report.FileSystems = append(report.FileSystems, balance)
+			treeqsByFileSystem[fs.ID] = treeqs
+		}
+		if len(fsMetaData.FileSystemArry) == 0 || fsMetaData.Filemetadata.PagesTotal <= fsMetaData.Filemetadata.Page {
+			break
+		}
+	}
+	report.summarize()
+	report.Moves = suggestTreeqMoves(report.FileSystems, treeqsByFileSystem)
+	return report, nil
+}
+
+//summarize set the totals, extremes and imbalances of the filesystems, an imbalance is (max - min) / mean
+func (report *TreeqBalanceReport) summarize() {
+	for i, fs := range report.FileSystems {
+		report.Treeqs += fs.Treeqs
+		report.UsedCapacity += fs.UsedCapacity
+		if i == 0 || fs.Treeqs < report.MinTreeqs {
+			report.MinTreeqs = fs.Treeqs
+		}
+		if fs.Treeqs > report.MaxTreeqs {
+			report.MaxTreeqs = fs.Treeqs
+		}
+		if i == 0 || fs.UsedCapacity < report.MinUsedCapacity {
+			report.MinUsedCapacity = fs.UsedCapacity
+		}
+		if fs.UsedCapacity > report.MaxUsedCapacity {
+			report.MaxUsedCapacity = fs.UsedCapacity
+		}
+	}
+	count := float64(len(report.FileSystems))
+	if report.Treeqs > 0 {
+		report.TreeqImbalance = float64(report.MaxTreeqs-report.MinTreeqs) / (float64(report.Treeqs) / count)
+	}
+	if report.UsedCapacity > 0 {
+		report.CapacityImbalance = float64(report.MaxUsedCapacity-report.MinUsedCapacity) / (float64(report.UsedCapacity) / count)
+	}
+}
+
+//suggestTreeqMoves move the least used treeq of the filesystem with the most treeqs to the one with the fewest,
+//until the treeq counts differ by one at most
+func suggestTreeqMoves(fileSystems []FileSystemBalance, treeqsByFileSystem map[int64][]api.Treeq) []TreeqMove {
+	counts := make(map[int64]int)
+	remaining := make(map[int64][]api.Treeq)
+	for _, fs := range fileSystems {
+		counts[fs.ID] = fs.Treeqs
+		treeqs := append([]api.Treeq{}, treeqsByFileSystem[fs.ID]...)
+		sort.Slice(treeqs, func(i, j int) bool { return treeqs[i].UsedCapacity < treeqs[j].UsedCapacity })
+		remaining[fs.ID] = treeqs
+	}
+	moves := []TreeqMove{}
+	for len(fileSystems) > 1 {
+		most, fewest := fileSystems[0].ID, fileSystems[0].ID
+		for _, fs := range fileSystems {
+			if counts[fs.ID] > counts[most] {
+				most = fs.ID
+			}
+			if counts[fs.ID] < counts[fewest] {
+				fewest = fs.ID
+			}
+		}
+		if counts[most]-counts[fewest] <= 1 || len(remaining[most]) == 0 {
+			break
+		}
+		treeq := remaining[most][0]
+		remaining[most] = remaining[most][1:]
+		counts[most]--
+		counts[fewest]++
+		moves = append(moves, TreeqMove{Treeq: treeq.Name, TreeqID: treeq.ID, FromFileSystem: most, ToFileSystem: fewest, UsedCapacity: treeq.UsedCapacity})
+	}
+	log.Debugf("%d treeq moves suggested to balance %d filesystems", len(moves), len(fileSystems))
+	return moves
+}
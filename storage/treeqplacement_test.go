@@ -0,0 +1,153 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *TreeqPlacementSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type TreeqPlacementSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestTreeqPlacementSuite(t *testing.T) {
+	suite.Run(t, new(TreeqPlacementSuite))
+}
+
+//getPlacementPage page of filesystems of pool 10
+func getPlacementPage(page, pagesTotal int, fileSystems ...api.FileSystem) api.FSMetadata {
+	return api.FSMetadata{
+		FileSystemArry: fileSystems,
+		Filemetadata:   api.FileSystemMetaData{Page: page, PagesTotal: pagesTotal, PageSize: 50, NumberOfObjects: len(fileSystems)},
+	}
+}
+
+//getPlacementTreeqs treeqs of the filesystem using usedCapacity each
+func getPlacementTreeqs(fileSystemID int64, count int, usedCapacity int64) []api.Treeq {
+	treeqs := []api.Treeq{}
+	for i := 0; i < count; i++ {
+		treeqs = append(treeqs, api.Treeq{ID: fileSystemID*100 + int64(i), FilesystemID: fileSystemID, Name: "pvc-" + string(rune('a'+i)), HardCapacity: 1000, UsedCapacity: usedCapacity})
+	}
+	return treeqs
+}
+
+func (suite *TreeqPlacementSuite) mockPlacementPool() {
+	var poolID int64 = 10
+	suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(getPlacementPage(1, 2, api.FileSystem{ID: 21, Name: "csit_a", Size: 10000}), nil)
+	suite.api.On("GetFileSystemsByPoolID", poolID, 2).Return(getPlacementPage(2, 2, api.FileSystem{ID: 22, Name: "csit_b", Size: 10000}), nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(21)).Return(getPlacementTreeqs(21, 1, 500), nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(22)).Return(getPlacementTreeqs(22, 3, 10), nil)
+	suite.api.On("GetExportByFileSystem", int64(21)).Return([]api.ExportResponse{{ID: 1, ExportPath: "/csit_a"}}, nil)
+	suite.api.On("GetExportByFileSystem", int64(22)).Return([]api.ExportResponse{{ID: 2, ExportPath: "/csit_b"}}, nil)
+}
+
+func (suite *TreeqPlacementSuite) Test_getExpectedFileSystemID_LeastTreeqs() {
+	suite.mockPlacementPool()
+	service := FilesystemService{cs: *suite.cs, poolID: 10, capacity: 1000, configmap: map[string]string{TREEQPLACEMENT: PlacementLeastTreeqs}}
+	fs, err := service.getExpectedFileSystemID(1000000)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(21), fs.ID, "filesystem with the fewest treeqs expected")
+	assert.Equal(suite.T(), "/csit_a", service.exportpath)
+}
+
+func (suite *TreeqPlacementSuite) Test_getExpectedFileSystemID_LeastUsed() {
+	suite.mockPlacementPool()
+	service := FilesystemService{cs: *suite.cs, poolID: 10, capacity: 1000, configmap: map[string]string{TREEQPLACEMENT: PlacementLeastUsed}}
+	fs, err := service.getExpectedFileSystemID(1000000)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(22), fs.ID, "filesystem whose treeqs use the least capacity expected")
+	assert.Equal(suite.T(), "/csit_b", service.exportpath)
+}
+
+func (suite *TreeqPlacementSuite) Test_getExpectedFileSystemID_MaxTreeqs() {
+	suite.mockPlacementPool()
+	configmap := map[string]string{TREEQPLACEMENT: PlacementLeastUsed, MAXTREEQSPERFILESYSTEM: "3"}
+	service := FilesystemService{cs: *suite.cs, poolID: 10, capacity: 1000, configmap: configmap}
+	fs, err := service.getExpectedFileSystemID(1000000)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), int64(21), fs.ID, "full filesystem should not be selected")
+}
+
+func (suite *TreeqPlacementSuite) Test_getExpectedFileSystemID_TreeqsError() {
+	var poolID int64 = 10
+	suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(getPlacementPage(1, 1, api.FileSystem{ID: 21, Size: 10000}), nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(21)).Return(nil, errors.New("some error"))
+	service := FilesystemService{cs: *suite.cs, poolID: poolID, capacity: 1000, configmap: map[string]string{TREEQPLACEMENT: PlacementSpread}}
+	_, err := service.getExpectedFileSystemID(1000000)
+	assert.NotNil(suite.T(), err, "error expected")
+}
+
+func (suite *TreeqPlacementSuite) Test_selectTreeqCandidate_Spread() {
+	var poolID int64 = 999
+	candidates := []treeqCandidate{{fileSystem: api.FileSystem{ID: 3}}, {fileSystem: api.FileSystem{ID: 1}}, {fileSystem: api.FileSystem{ID: 2}}}
+	selected := []int64{}
+	for i := 0; i < 4; i++ {
+		selected = append(selected, selectTreeqCandidate(PlacementSpread, poolID, candidates).fileSystem.ID)
+	}
+	assert.Equal(suite.T(), []int64{1, 2, 3, 1}, selected, "filesystems should be selected in turn")
+	assert.Equal(suite.T(), int64(1), selectTreeqCandidate(PlacementSpread, poolID+1, candidates).fileSystem.ID, "pools should be spread separately")
+	assert.Nil(suite.T(), selectTreeqCandidate(PlacementSpread, poolID, nil), "no candidate")
+}
+
+func (suite *TreeqPlacementSuite) Test_validateTreeqPlacement() {
+	assert.Nil(suite.T(), validateTreeqPlacement(""), "default placement")
+	assert.Nil(suite.T(), validateTreeqPlacement(PlacementSpread))
+	err := validateTreeqPlacement("random")
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+}
+
+func (suite *TreeqPlacementSuite) Test_treeqBalanceReport() {
+	var poolID int64 = 10
+	suite.api.On("GetStoragePoolIDByName", "pool1").Return(poolID, nil)
+	suite.api.On("GetFileSystemsByPoolID", poolID, 1).Return(getPlacementPage(1, 2,
+		api.FileSystem{ID: 21, Name: "csit_a", Size: 10000}, api.FileSystem{ID: 23, Name: "other", Size: 10000}), nil)
+	suite.api.On("GetFileSystemsByPoolID", poolID, 2).Return(getPlacementPage(2, 2,
+		api.FileSystem{ID: 22, Name: "csit_b", Size: 10000}, api.FileSystem{ID: 24, Name: "csit_c", Size: 10000}), nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(21)).Return(getPlacementTreeqs(21, 4, 100), nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(22)).Return(getPlacementTreeqs(22, 1, 100), nil)
+	suite.api.On("GetTreeqsByFileSystemID", int64(24)).Return(getPlacementTreeqs(24, 1, 400), nil)
+
+	report, err := suite.cs.treeqBalanceReport("pool1", "csit_")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Len(suite.T(), report.FileSystems, 3, "filesystems of other prefixes should be ignored")
+	assert.Equal(suite.T(), 6, report.Treeqs)
+	assert.Equal(suite.T(), 1, report.MinTreeqs)
+	assert.Equal(suite.T(), 4, report.MaxTreeqs)
+	assert.Equal(suite.T(), 1.5, report.TreeqImbalance)
+	assert.Equal(suite.T(), int64(900), report.UsedCapacity)
+	assert.Equal(suite.T(), 1.0, report.CapacityImbalance, "used capacity of 400, 100 and 400")
+	assert.Len(suite.T(), report.Moves, 2, "two treeqs should move from the full filesystem")
+	for _, move := range report.Moves {
+		assert.Equal(suite.T(), int64(21), move.FromFileSystem)
+	}
+	assert.NotEqual(suite.T(), report.Moves[0].ToFileSystem, report.Moves[1].ToFileSystem, "moves should spread the treeqs")
+	suite.api.AssertNotCalled(suite.T(), "GetTreeqsByFileSystemID", int64(23))
+}
+
+func (suite *TreeqPlacementSuite) Test_treeqBalanceReport_PoolError() {
+	suite.api.On("GetStoragePoolIDByName", "pool1").Return(nil, errors.New("some error"))
+	_, err := suite.cs.treeqBalanceReport("pool1", "csit_")
+	assert.NotNil(suite.T(), err, "error expected")
+}
@@ -0,0 +1,152 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"infinibox-csi-driver/api"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//treeq quota storage class parameters
+const (
+	//TREEQSOFTCAPACITY soft capacity of the treeqs, a size as 80gib or a percentage of the volume capacity as 90%
+	TREEQSOFTCAPACITY = "treeq_soft_capacity"
+	//TREEQHARDINODES and TREEQSOFTINODES inode limits of the treeqs
+	TREEQHARDINODES = "treeq_hard_inodes"
+	TREEQSOFTINODES = "treeq_soft_inodes"
+	//TREEQCAPACITYGRACEPERIOD and TREEQINODESGRACEPERIOD time the soft limits may be exceeded, as 24h
+	TREEQCAPACITYGRACEPERIOD = "treeq_capacity_grace_period"
+	TREEQINODESGRACEPERIOD   = "treeq_inodes_grace_period"
+)
+
+//treeqCapacityKey treeq volume map key of the hard capacity applied to the treeq, returned as the capacity of the volume
+const treeqCapacityKey = "treeq_capacity"
+
+//treeqQuota quota settings of a treeq besides its hard capacity, zero values are not set
+type treeqQuota struct {
+	softCapacity        int64
+	hardInodes          int64
+	softInodes          int64
+	capacityGracePeriod time.Duration
+	inodesGracePeriod   time.Duration
+}
+
+//getTreeqQuota return the quota of the storage class for a treeq of capacity bytes
+func getTreeqQuota(config map[string]string, capacity int64) (quota treeqQuota, err error) {
+	if value := strings.TrimSpace(config[TREEQSOFTCAPACITY]); value != "" {
+		if strings.HasSuffix(value, "%") {
+			percent, parseErr := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if parseErr != nil || percent <= 0 || percent > 100 {
+				return quota, status.Errorf(codes.InvalidArgument, "invalid %s %s, expected a percentage between 0%% and 100%%", TREEQSOFTCAPACITY, value)
+			}
+			quota.softCapacity = int64(float64(capacity) * percent / 100)
+		} else if quota.softCapacity, err = strconv.ParseInt(value, 10, 64); err != nil {
+			quota.softCapacity, err = convertToByte(value)
+			if err != nil || quota.softCapacity <= 0 {
+				return quota, status.Errorf(codes.InvalidArgument, "invalid %s %s, expected a size in gib or tib, or a percentage", TREEQSOFTCAPACITY, value)
+			}
+		}
+		if quota.softCapacity <= 0 || quota.softCapacity > capacity {
+			return quota, status.Errorf(codes.InvalidArgument, "%s %s should be positive and at most the volume capacity %d", TREEQSOFTCAPACITY, value, capacity)
+		}
+	}
+	for key, limit := range map[string]*int64{TREEQHARDINODES: &quota.hardInodes, TREEQSOFTINODES: &quota.softInodes} {
+		if value := strings.TrimSpace(config[key]); value != "" {
+			if *limit, err = strconv.ParseInt(value, 10, 64); err != nil || *limit <= 0 {
+				return quota, status.Errorf(codes.InvalidArgument, "invalid %s %s, expected a positive number of inodes", key, value)
+			}
+		}
+	}
+	if quota.hardInodes > 0 && quota.softInodes > quota.hardInodes {
+		return quota, status.Errorf(codes.InvalidArgument, "%s %d should be at most %s %d", TREEQSOFTINODES, quota.softInodes, TREEQHARDINODES, quota.hardInodes)
+	}
+	for key, period := range map[string]*time.Duration{TREEQCAPACITYGRACEPERIOD: &quota.capacityGracePeriod, TREEQINODESGRACEPERIOD: &quota.inodesGracePeriod} {
+		if value := strings.TrimSpace(config[key]); value != "" {
+			if *period, err = time.ParseDuration(value); err != nil || *period < time.Second {
+				return quota, status.Errorf(codes.InvalidArgument, "invalid %s %s, expected a duration of a second at least as 24h", key, value)
+			}
+		}
+	}
+	return quota, nil
+}
+
+//addParameters add the quota settings to the parameters of a treeq creation
+func (quota treeqQuota) addParameters(treeqParameter map[string]interface{}) {
+	if quota.softCapacity > 0 {
+		treeqParameter["soft_capacity"] = quota.softCapacity
+	}
+	if quota.hardInodes > 0 {
+		treeqParameter["hard_inodes"] = quota.hardInodes
+	}
+	if quota.softInodes > 0 {
+		treeqParameter["soft_inodes"] = quota.softInodes
+	}
+	if quota.capacityGracePeriod > 0 {
+		treeqParameter["capacity_grace_period"] = int64(quota.capacityGracePeriod / time.Second)
+	}
+	if quota.inodesGracePeriod > 0 {
+		treeqParameter["inodes_grace_period"] = int64(quota.inodesGracePeriod / time.Second)
+	}
+}
+
+//scaledSoftCapacity return the soft capacity of the treeq expanded to capacity, in the same ratio to the hard capacity
+func scaledSoftCapacity(treeq *api.Treeq, capacity int64) int64 {
+	if treeq.SoftCapacity <= 0 || treeq.HardCapacity <= 0 {
+		return 0
+	}
+	return int64(float64(treeq.SoftCapacity) / float64(treeq.HardCapacity) * float64(capacity))
+}
+
+//appliedTreeqCapacity return the hard capacity applied to the treeq of the volume map, capacity when it is not known.
+//The capacity is removed from the map, which is the volume context
+func appliedTreeqCapacity(treeqVolume map[string]string, capacity int64) int64 {
+	value, ok := treeqVolume[treeqCapacityKey]
+	if !ok {
+		return capacity
+	}
+	delete(treeqVolume, treeqCapacityKey)
+	if applied, err := strconv.ParseInt(value, 10, 64); err == nil && applied > 0 {
+		return applied
+	}
+	return capacity
+}
+
+//getTreeqVolumeUsage return the usage of the treeq quota, the inodes usage when the treeq has an inode limit
+func getTreeqVolumeUsage(treeq *api.Treeq) []*csi.VolumeUsage {
+	available := func(total, used int64) int64 {
+		if used > total {
+			return 0
+		}
+		return total - used
+	}
+	usage := []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     treeq.HardCapacity,
+		Used:      treeq.UsedCapacity,
+		Available: available(treeq.HardCapacity, treeq.UsedCapacity),
+	}}
+	if treeq.HardInodes > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     treeq.HardInodes,
+			Used:      treeq.UsedInodes,
+			Available: available(treeq.HardInodes, treeq.UsedInodes),
+		})
+	}
+	return usage
+}
@@ -0,0 +1,100 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"infinibox-csi-driver/api"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type TreeqQuotaSuite struct {
+	suite.Suite
+}
+
+func TestTreeqQuotaSuite(t *testing.T) {
+	suite.Run(t, new(TreeqQuotaSuite))
+}
+
+func (suite *TreeqQuotaSuite) Test_getTreeqQuota() {
+	quota, err := getTreeqQuota(map[string]string{}, 10*gib)
+	assert.Nil(suite.T(), err, "no quota is valid")
+	assert.Equal(suite.T(), treeqQuota{}, quota)
+
+	config := map[string]string{
+		TREEQSOFTCAPACITY:        "8gib",
+		TREEQHARDINODES:          "1000",
+		TREEQSOFTINODES:          "900",
+		TREEQCAPACITYGRACEPERIOD: "1h",
+		TREEQINODESGRACEPERIOD:   "48h",
+	}
+	quota, err = getTreeqQuota(config, 10*gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), treeqQuota{softCapacity: 8 * gib, hardInodes: 1000, softInodes: 900, capacityGracePeriod: time.Hour, inodesGracePeriod: 48 * time.Hour}, quota)
+
+	quota, err = getTreeqQuota(map[string]string{TREEQSOFTCAPACITY: "75%"}, 4*gib)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), 3*gib, quota.softCapacity, "percentage of the volume capacity")
+}
+
+func (suite *TreeqQuotaSuite) Test_getTreeqQuota_Invalid() {
+	for _, config := range []map[string]string{
+		{TREEQSOFTCAPACITY: "120%"},
+		{TREEQSOFTCAPACITY: "20gib"},
+		{TREEQSOFTCAPACITY: "lots"},
+		{TREEQHARDINODES: "-1"},
+		{TREEQHARDINODES: "100", TREEQSOFTINODES: "200"},
+		{TREEQCAPACITYGRACEPERIOD: "1ms"},
+		{TREEQINODESGRACEPERIOD: "tomorrow"},
+	} {
+		_, err := getTreeqQuota(config, 10*gib)
+		assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err), "invalid quota %v", config)
+	}
+}
+
+func (suite *TreeqQuotaSuite) Test_scaledSoftCapacity() {
+	assert.Equal(suite.T(), int64(1800), scaledSoftCapacity(&api.Treeq{HardCapacity: 1000, SoftCapacity: 900}, 2000))
+	assert.Equal(suite.T(), int64(0), scaledSoftCapacity(&api.Treeq{HardCapacity: 1000}, 2000), "no soft capacity")
+}
+
+func (suite *TreeqQuotaSuite) Test_appliedTreeqCapacity() {
+	treeqVolume := map[string]string{"ID": "1", treeqCapacityKey: "2000"}
+	assert.Equal(suite.T(), int64(2000), appliedTreeqCapacity(treeqVolume, 1000))
+	assert.NotContains(suite.T(), treeqVolume, treeqCapacityKey, "capacity should not be part of the volume context")
+	assert.Equal(suite.T(), int64(1000), appliedTreeqCapacity(treeqVolume, 1000), "requested capacity when not known")
+}
+
+func (suite *TreeqQuotaSuite) Test_getTreeqVolumeUsage() {
+	usage := getTreeqVolumeUsage(&api.Treeq{HardCapacity: 1000, UsedCapacity: 1200})
+	assert.Equal(suite.T(), []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 1000, Used: 1200, Available: 0}}, usage, "no inodes usage without inode limit")
+}
+
+func (suite *TreeqQuotaSuite) Test_getVolumePathStats() {
+	dir, err := ioutil.TempDir("", "stats")
+	assert.Nil(suite.T(), err)
+	defer os.RemoveAll(dir)
+
+	resp, err := getVolumePathStats(dir)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Len(suite.T(), resp.GetUsage(), 2, "bytes and inodes usage expected")
+	assert.True(suite.T(), resp.GetUsage()[0].GetTotal() > 0, "total bytes expected")
+
+	_, err = getVolumePathStats(dir + "/missing")
+	assert.Equal(suite.T(), codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,350 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/volumeid"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "infinibox-csi-driver/helper/logger"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//TreeqSnapshot treeq snapshot, stored as a reference on a snapshot of the treeq's filesystem
+type TreeqSnapshot struct {
+	Name                 string
+	FileSystemSnapshotID int64
+	TreeqPath            string
+	Size                 int64
+	CreatedAt            int64 // in milliseconds
+}
+
+//restore in progress holds a reference on the filesystem snapshot too
+const restoreRefPrefix = "restore-"
+
+//treeqSnapshotsLock name of the lock of the snapshot creation of a filesystem
+func treeqSnapshotsLock(fileSystemID int64) string {
+	return "treeq-snapshots-" + strconv.FormatInt(fileSystemID, 10)
+}
+
+//treeqSnapshotRefsLock name of the lock of the treeq snapshot references of a filesystem snapshot
+func treeqSnapshotRefsLock(fileSystemSnapshotID int64) string {
+	return "treeq-snapshot-refs-" + strconv.FormatInt(fileSystemSnapshotID, 10)
+}
+
+//getTreeqSnapshotID return the ID of the treeq snapshot of the source treeq
+func getTreeqSnapshotID(source volumeid.ID, snapshot *TreeqSnapshot) string {
+	return volumeid.ID{
+		Protocol:     source.Protocol,
+		Array:        source.Array,
+		ObjectID:     snapshot.FileSystemSnapshotID,
+		TreeqPath:    snapshot.TreeqPath,
+		SnapshotName: snapshot.Name,
+	}.String()
+}
+
+//getTreeqSnapshot return the treeq snapshot of a decoded snapshot ID
+func getTreeqSnapshot(snapproto volumeid.ID) *TreeqSnapshot {
+	return &TreeqSnapshot{
+		FileSystemSnapshotID: snapproto.ObjectID,
+		TreeqPath:            snapproto.TreeqPath,
+		Name:                 snapproto.SnapshotName,
+	}
+}
+
+//getTreeqSnapshotRefs return treeq path referenced by snapshot name
+func (filesystem *FilesystemService) getTreeqSnapshotRefs(fileSystemSnapshotID int64) (refs map[string]string, err error) {
+	refs, _, err = filesystem.getTreeqSnapshotMetadata(fileSystemSnapshotID)
+	return
+}
+
+//getTreeqSnapshotMetadata return treeq path and VolumeSnapshot referenced by snapshot name
+func (filesystem *FilesystemService) getTreeqSnapshotMetadata(fileSystemSnapshotID int64) (refs, owners map[string]string, err error) {
+	metadataArray, err := filesystem.cs.api.GetMetadata(fileSystemSnapshotID)
+	if err != nil {
+		return
+	}
+	refs = make(map[string]string)
+	owners = make(map[string]string)
+	for _, metadata := range *metadataArray {
+		if strings.HasPrefix(metadata.Key, TREEQSNAPSHOTREF) {
+			refs[strings.TrimPrefix(metadata.Key, TREEQSNAPSHOTREF)] = metadata.Value
+		} else if strings.HasPrefix(metadata.Key, TREEQVOLUMESNAPSHOT) {
+			owners[strings.TrimPrefix(metadata.Key, TREEQVOLUMESNAPSHOT)] = metadata.Value
+		}
+	}
+	return
+}
+
+//addTreeqSnapshotRef reference the filesystem snapshot from a treeq snapshot, owner is the namespace/name of its VolumeSnapshot when known
+func (filesystem *FilesystemService) addTreeqSnapshotRef(fileSystemSnapshotID int64, name, treeqPath, owner string) error {
+	metadata := make(map[string]interface{})
+	metadata[TREEQSNAPSHOTREF+name] = treeqPath
+	if owner != "" {
+		metadata[TREEQVOLUMESNAPSHOT+name] = owner
+	}
+	_, err := filesystem.cs.api.AttachMetadataToObject(fileSystemSnapshotID, metadata)
+	if err != nil {
+		log.Errorf("fail to add reference %s to filesystem snapshot %d error %v", name, fileSystemSnapshotID, err)
+	}
+	return err
+}
+
+//removeTreeqSnapshotRef remove the reference and delete the filesystem snapshot once it is not referenced anymore
+func (filesystem *FilesystemService) removeTreeqSnapshotRef(fileSystemSnapshotID int64, name string) (err error) {
+	refs, owners, err := filesystem.getTreeqSnapshotMetadata(fileSystemSnapshotID)
+	if err != nil {
+		if strings.Contains(err.Error(), "NOT_FOUND") {
+			log.Debugf("filesystem snapshot %d already deleted", fileSystemSnapshotID)
+			return nil
+		}
+		log.Errorf("fail to get references of filesystem snapshot %d error %v", fileSystemSnapshotID, err)
+		return
+	}
+	if _, ok := refs[name]; ok {
+		err = filesystem.cs.api.DeleteMetadataKey(fileSystemSnapshotID, TREEQSNAPSHOTREF+name)
+		if err != nil {
+			log.Errorf("fail to remove reference %s from filesystem snapshot %d error %v", name, fileSystemSnapshotID, err)
+			return
+		}
+		delete(refs, name)
+	}
+	if _, ok := owners[name]; ok && len(refs) > 0 {
+		err = filesystem.cs.api.DeleteMetadataKey(fileSystemSnapshotID, TREEQVOLUMESNAPSHOT+name)
+		if err != nil {
+			log.Errorf("fail to remove volume snapshot of %s from filesystem snapshot %d error %v", name, fileSystemSnapshotID, err)
+			return
+		}
+	}
+	if len(refs) > 0 {
+		log.Debugf("filesystem snapshot %d still referenced by %d treeq snapshots", fileSystemSnapshotID, len(refs))
+		return
+	}
+	err = filesystem.cs.api.DeleteFileSystemComplete(fileSystemSnapshotID)
+	if err != nil && strings.Contains(err.Error(), "FILESYSTEM_NOT_FOUND") {
+		err = nil
+	}
+	if err != nil {
+		log.Errorf("fail to delete filesystem snapshot %d error %v", fileSystemSnapshotID, err)
+		return
+	}
+	log.Infof("filesystem snapshot %d deleted as it is not referenced anymore", fileSystemSnapshotID)
+	return
+}
+
+//CreateTreeqSnapshot snapshot the filesystem of the treeq and reference the filesystem snapshot from the treeq snapshot.
+//Every treeq snapshot has its own filesystem snapshot taken at request time
+func (filesystem *FilesystemService) CreateTreeqSnapshot(filesystemID, treeqID int64, snapshotName string, owner string) (treeqSnapshot *TreeqSnapshot, err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while creating treeq snapshot " + fmt.Sprint(res))
+		}
+	}()
+	treeq, err := filesystem.cs.api.GetTreeq(filesystemID, treeqID)
+	if err != nil {
+		if strings.Contains(err.Error(), "TREEQ_ID_DOES_NOT_EXIST") {
+			return nil, status.Errorf(codes.NotFound, "treeq %d does not exist on filesystem %d", treeqID, filesystemID)
+		}
+		log.Errorf("Error occured while getting treeq: %s", err)
+		return
+	}
+
+	unlock, err := filesystem.getLocker().Lock(treeqSnapshotsLock(filesystemID))
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "fail to lock snapshots of filesystem %d: %v", filesystemID, err)
+	}
+	defer unlock()
+
+	// the filesystem snapshot of a treeq snapshot is named after it, names are unique on the array
+	snapshots, err := filesystem.cs.api.GetSnapshotByName(snapshotName)
+	if err != nil {
+		log.Errorf("fail to get snapshot %s error %v", snapshotName, err)
+		return
+	}
+	var fsSnapshot *api.FileSystemSnapshotResponce
+	for i := range *snapshots {
+		snap := (*snapshots)[i]
+		if snap.Name != snapshotName {
+			continue
+		}
+		if snap.ParentId != filesystemID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for filesystem %d", snapshotName, snap.ParentId)
+		}
+		refs, refErr := filesystem.getTreeqSnapshotRefs(snap.SnapshotID)
+		if refErr != nil {
+			err = refErr
+			log.Errorf("fail to get references of filesystem snapshot %d error %v", snap.SnapshotID, err)
+			return
+		}
+		if treeqPath, ok := refs[snapshotName]; ok {
+			if treeqPath != treeq.Path {
+				return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for treeq %s", snapshotName, treeqPath)
+			}
+			log.Debugf("treeq snapshot %s already exists", snapshotName)
+			return &TreeqSnapshot{Name: snapshotName, FileSystemSnapshotID: snap.SnapshotID, TreeqPath: treeq.Path, Size: treeq.HardCapacity, CreatedAt: snap.CreatedAt}, nil
+		}
+		fsSnapshot = &snap // left over of a previous attempt
+	}
+
+	created := false
+	if fsSnapshot == nil {
+		fileSystemSnapshot := &api.FileSystemSnapshot{
+			ParentID:       filesystemID,
+			SnapshotName:   snapshotName,
+			WriteProtected: true,
+		}
+		fsSnapshot, err = filesystem.cs.api.CreateFileSystemSnapshot(fileSystemSnapshot)
+		if err != nil {
+			log.Errorf("fail to create snapshot of filesystem %d error %v", filesystemID, err)
+			return
+		}
+		if fsSnapshot.CreatedAt == 0 {
+			fsSnapshot.CreatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		created = true
+	}
+
+	err = filesystem.addTreeqSnapshotRef(fsSnapshot.SnapshotID, snapshotName, treeq.Path, owner)
+	if err != nil {
+		if created {
+			filesystem.cs.api.DeleteFileSystemComplete(fsSnapshot.SnapshotID)
+		}
+		return
+	}
+	treeqSnapshot = &TreeqSnapshot{
+		Name:                 snapshotName,
+		FileSystemSnapshotID: fsSnapshot.SnapshotID,
+		TreeqPath:            treeq.Path,
+		Size:                 treeq.HardCapacity,
+		CreatedAt:            fsSnapshot.CreatedAt,
+	}
+	log.Infof("treeq snapshot %s created on filesystem snapshot %d", snapshotName, fsSnapshot.SnapshotID)
+	return
+}
+
+//DeleteTreeqSnapshot remove the treeq snapshot reference, last reference delete the filesystem snapshot
+func (filesystem *FilesystemService) DeleteTreeqSnapshot(fileSystemSnapshotID int64, snapshotName string) (err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while deleting treeq snapshot " + fmt.Sprint(res))
+		}
+	}()
+	unlock, err := filesystem.getLocker().Lock(treeqSnapshotRefsLock(fileSystemSnapshotID))
+	if err != nil {
+		return status.Errorf(codes.Aborted, "fail to lock references of filesystem snapshot %d: %v", fileSystemSnapshotID, err)
+	}
+	defer unlock()
+	return filesystem.removeTreeqSnapshotRef(fileSystemSnapshotID, snapshotName)
+}
+
+//RestoreTreeqVolumeFromSnapshot create a new treeq and start populating it from the treeq path of the snapshot
+func (filesystem *FilesystemService) RestoreTreeqVolumeFromSnapshot(config map[string]string, capacity int64, pvName string, snapshot *TreeqSnapshot) (treeqVolume map[string]string, err error) {
+	defer func() {
+		if res := recover(); res != nil {
+			err = errors.New("error while restoring treeq from snapshot " + fmt.Sprint(res))
+		}
+	}()
+	fsSnapshot, err := filesystem.cs.api.GetFileSystemByID(snapshot.FileSystemSnapshotID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot not found: %d", snapshot.FileSystemSnapshotID)
+	}
+
+	// hold a reference so the filesystem snapshot is not deleted while copying
+	unlock, err := filesystem.getLocker().Lock(treeqSnapshotRefsLock(fsSnapshot.ID))
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "fail to lock references of filesystem snapshot %d: %v", fsSnapshot.ID, err)
+	}
+	refs, err := filesystem.getTreeqSnapshotRefs(fsSnapshot.ID)
+	if err == nil {
+		if _, ok := refs[snapshot.Name]; !ok {
+			err = status.Errorf(codes.NotFound, "snapshot %s not found", snapshot.Name)
+		} else {
+			err = filesystem.addTreeqSnapshotRef(fsSnapshot.ID, restoreRefPrefix+pvName, snapshot.TreeqPath, "")
+		}
+	}
+	unlock()
+	if err != nil {
+		return
+	}
+	release := func() {
+		unlock, err := filesystem.getLocker().Lock(treeqSnapshotRefsLock(fsSnapshot.ID))
+		if err != nil {
+			log.Errorf("fail to lock references of filesystem snapshot %d error %v", fsSnapshot.ID, err)
+			return
+		}
+		defer unlock()
+		filesystem.removeTreeqSnapshotRef(fsSnapshot.ID, restoreRefPrefix+pvName)
+	}
+
+	export, err := filesystem.exportSnapshot(fsSnapshot, pvName)
+	if err != nil {
+		release()
+		return nil, status.Errorf(codes.Internal, "fail to export snapshot %d: %v", fsSnapshot.ID, err)
+	}
+	log.Infof("restoring treeq %s from snapshot %s", pvName, snapshot.Name)
+	return filesystem.populateTreeq(config, capacity, pvName, path.Join(export.ExportPath, snapshot.TreeqPath), func() {
+		filesystem.cs.api.DeleteExportPath(export.ID)
+		release()
+	})
+}
+
+//exportSnapshot export the filesystem snapshot read only, so its content can be copied
+func (filesystem *FilesystemService) exportSnapshot(fsSnapshot *api.FileSystem, pvName string) (*api.ExportResponse, error) {
+	exportPath := "/csi_restore_" + pvName
+	exportArray, err := filesystem.cs.api.GetExportByFileSystem(fsSnapshot.ID)
+	if err == nil && exportArray != nil {
+		for _, export := range *exportArray {
+			if export.ExportPath == exportPath {
+				return &export, nil
+			}
+		}
+	}
+	permissionsput, err := buildExportPermissions(filesystem.configmap["nfs_export_permissions"])
+	if err != nil {
+		return nil, err
+	}
+	for _, permission := range permissionsput {
+		permission["access"] = "RO"
+	}
+	var exportFileSystem api.ExportFileSys
+	exportFileSystem.FilesystemID = fsSnapshot.ID
+	exportFileSystem.Transport_protocols = "TCP"
+	exportFileSystem.Privileged_port = true
+	exportFileSystem.Export_path = exportPath
+	exportFileSystem.Permissionsput = append(exportFileSystem.Permissionsput, permissionsput...)
+	return filesystem.cs.api.ExportFileSystem(exportFileSystem)
+}
+
+//removeTreeq delete a treeq whatever its content is, used to revert a failed restore
+func (filesystem *FilesystemService) removeTreeq(filesystemID, treeqID int64) {
+	log.Infof("Seemes to be some problem reverting treeq %d of filesystem %d", treeqID, filesystemID)
+	unlock, err := filesystem.getLocker().Lock(treeqFileSystemLock(filesystemID))
+	if err != nil {
+		log.Errorf("fail to lock treeqs of filesystem %d error %v", filesystemID, err)
+		return
+	}
+	defer unlock()
+	_, err = filesystem.cs.api.DeleteTreeq(filesystemID, treeqID)
+	if err != nil {
+		log.Errorf("fail to delete treeq %d of filesystem %d error %v", treeqID, filesystemID, err)
+	}
+	if _, err = filesystem.updateTreeqCount(filesystemID); err != nil {
+		log.Errorf("fail to update treeq count of filesystem %d error %v", filesystemID, err)
+	}
+}
@@ -0,0 +1,147 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"infinibox-csi-driver/helper/volumeid"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *TreeqSnapshotSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type TreeqSnapshotSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestTreeqSnapshotSuite(t *testing.T) {
+	suite.Run(t, new(TreeqSnapshotSuite))
+}
+
+func (suite *TreeqSnapshotSuite) Test_getTreeqSnapshot() {
+	snapproto, err := volumeid.ParseSnapshot("300#/pvc-1#snapshot-1$$nfs_treeq")
+	assert.Nil(suite.T(), err, "error not expected")
+	snapshot := getTreeqSnapshot(snapproto)
+	assert.Equal(suite.T(), int64(300), snapshot.FileSystemSnapshotID)
+	assert.Equal(suite.T(), "/pvc-1", snapshot.TreeqPath)
+	assert.Equal(suite.T(), "snapshot-1", snapshot.Name)
+
+	snapshotID := getTreeqSnapshotID(volumeid.ID{Protocol: NFSTREEQ, Array: "ibox1"}, snapshot)
+	assert.Equal(suite.T(), "v1$$nfs_treeq$$id=300;array=ibox1;path=/pvc-1;name=snapshot-1", snapshotID)
+	snapproto, err = volumeid.ParseSnapshot(snapshotID)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), snapshot, getTreeqSnapshot(snapproto))
+}
+
+func (suite *TreeqSnapshotSuite) Test_CreateTreeqSnapshot_TreeqNotFound() {
+	var filesystemID, treeqID int64 = 100, 200
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(nil, errors.New("TREEQ_ID_DOES_NOT_EXIST"))
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	_, err := service.CreateTreeqSnapshot(filesystemID, treeqID, "snapshot-1", "")
+	assert.NotNil(suite.T(), err, "treeq not found")
+}
+
+func (suite *TreeqSnapshotSuite) Test_CreateTreeqSnapshot_New() {
+	var filesystemID, treeqID, fsSnapshotID int64 = 100, 200, 300
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(getTreeq(), nil)
+	suite.api.On("GetSnapshotByName", "snapshot-1").Return([]api.FileSystemSnapshotResponce{}, nil)
+	suite.api.On("CreateFileSystemSnapshot", mock.Anything).Return(api.FileSystemSnapshotResponce{SnapshotID: fsSnapshotID, CreatedAt: 1000}, nil)
+	suite.api.On("AttachMetadataToObject", fsSnapshotID, mock.Anything).Return([]api.Metadata{}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	snapshot, err := service.CreateTreeqSnapshot(filesystemID, treeqID, "snapshot-1", "")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), fsSnapshotID, snapshot.FileSystemSnapshotID)
+	assert.Equal(suite.T(), "/pvc-1", snapshot.TreeqPath)
+}
+
+func (suite *TreeqSnapshotSuite) Test_CreateTreeqSnapshot_AlreadyExists() {
+	var filesystemID, treeqID, fsSnapshotID int64 = 100, 200, 300
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(getTreeq(), nil)
+	suite.api.On("GetSnapshotByName", "snapshot-1").Return([]api.FileSystemSnapshotResponce{{SnapshotID: fsSnapshotID, Name: "snapshot-1", ParentId: filesystemID}}, nil)
+	suite.api.On("GetMetadata", fsSnapshotID).Return([]api.Metadata{{Key: TREEQSNAPSHOTREF + "snapshot-1", Value: "/pvc-1"}}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	snapshot, err := service.CreateTreeqSnapshot(filesystemID, treeqID, "snapshot-1", "")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), fsSnapshotID, snapshot.FileSystemSnapshotID)
+	suite.api.AssertNotCalled(suite.T(), "CreateFileSystemSnapshot", mock.Anything)
+}
+
+func (suite *TreeqSnapshotSuite) Test_CreateTreeqSnapshot_LeftOver() {
+	var filesystemID, treeqID, fsSnapshotID int64 = 100, 200, 300
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(getTreeq(), nil)
+	suite.api.On("GetSnapshotByName", "snapshot-1").Return([]api.FileSystemSnapshotResponce{{SnapshotID: fsSnapshotID, Name: "snapshot-1", ParentId: filesystemID}}, nil)
+	suite.api.On("GetMetadata", fsSnapshotID).Return([]api.Metadata{}, nil)
+	suite.api.On("AttachMetadataToObject", fsSnapshotID, mock.Anything).Return([]api.Metadata{}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	snapshot, err := service.CreateTreeqSnapshot(filesystemID, treeqID, "snapshot-1", "")
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), fsSnapshotID, snapshot.FileSystemSnapshotID, "filesystem snapshot of a previous attempt reused")
+	suite.api.AssertNotCalled(suite.T(), "CreateFileSystemSnapshot", mock.Anything)
+	suite.api.AssertNotCalled(suite.T(), "GetFileSystemSnapshotsByParentID", mock.Anything)
+}
+
+func (suite *TreeqSnapshotSuite) Test_CreateTreeqSnapshot_OtherFileSystem() {
+	var filesystemID, treeqID, fsSnapshotID int64 = 100, 200, 300
+	suite.api.On("GetTreeq", filesystemID, treeqID).Return(getTreeq(), nil)
+	suite.api.On("GetSnapshotByName", "snapshot-1").Return([]api.FileSystemSnapshotResponce{{SnapshotID: fsSnapshotID, Name: "snapshot-1", ParentId: 101}}, nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	_, err := service.CreateTreeqSnapshot(filesystemID, treeqID, "snapshot-1", "")
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err), "snapshot name used on another filesystem")
+	suite.api.AssertNotCalled(suite.T(), "CreateFileSystemSnapshot", mock.Anything)
+}
+
+func (suite *TreeqSnapshotSuite) Test_DeleteTreeqSnapshot_StillReferenced() {
+	var fsSnapshotID int64 = 300
+	suite.api.On("GetMetadata", fsSnapshotID).Return([]api.Metadata{
+		{Key: TREEQSNAPSHOTREF + "snapshot-0", Value: "/pvc-0"},
+		{Key: TREEQSNAPSHOTREF + "snapshot-1", Value: "/pvc-1"},
+	}, nil)
+	suite.api.On("DeleteMetadataKey", fsSnapshotID, TREEQSNAPSHOTREF+"snapshot-1").Return(nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	err := service.DeleteTreeqSnapshot(fsSnapshotID, "snapshot-1")
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertNotCalled(suite.T(), "DeleteFileSystemComplete", mock.Anything)
+}
+
+func (suite *TreeqSnapshotSuite) Test_DeleteTreeqSnapshot_LastReference() {
+	var fsSnapshotID int64 = 300
+	suite.api.On("GetMetadata", fsSnapshotID).Return([]api.Metadata{{Key: TREEQSNAPSHOTREF + "snapshot-1", Value: "/pvc-1"}}, nil)
+	suite.api.On("DeleteMetadataKey", fsSnapshotID, TREEQSNAPSHOTREF+"snapshot-1").Return(nil)
+	suite.api.On("DeleteFileSystemComplete", fsSnapshotID).Return(nil)
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	err := service.DeleteTreeqSnapshot(fsSnapshotID, "snapshot-1")
+	assert.Nil(suite.T(), err, "error not expected")
+	suite.api.AssertCalled(suite.T(), "DeleteFileSystemComplete", fsSnapshotID)
+}
+
+func (suite *TreeqSnapshotSuite) Test_DeleteTreeqSnapshot_AlreadyDeleted() {
+	var fsSnapshotID int64 = 300
+	suite.api.On("GetMetadata", fsSnapshotID).Return(nil, errors.New("METADATA_OBJECT_NOT_FOUND"))
+	service := getFilesystemService(NFSTREEQ, *suite.cs)
+	err := service.DeleteTreeqSnapshot(fsSnapshotID, "snapshot-1")
+	assert.Nil(suite.T(), err, "error not expected")
+}
+
+func getTreeq() api.Treeq {
+	return api.Treeq{ID: 200, FilesystemID: 100, Name: "pvc-1", Path: "/pvc-1", HardCapacity: 1000}
+}
@@ -0,0 +1,179 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "infinibox-csi-driver/helper/logger"
+	"infinibox-csi-driver/helper/volumeid"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//ImportVolume resolve an existing volume or filesystem by name into the volume handle and volume context of a static PV,
+//parameters are the storage class parameters the PV would have been provisioned with.
+//An object tagged with another PV name is only imported with force
+func ImportVolume(storageProtocol, name, pvName string, parameters, secrets map[string]string, force bool) (*csi.Volume, error) {
+	cs, err := buildCommonService(map[string]string{}, secrets)
+	if err != nil {
+		return nil, err
+	}
+	return cs.importVolume(strings.TrimSpace(storageProtocol), name, pvName, parameters, force)
+}
+
+//importVolume build the static PV volume of the named object and tag the object with the PV name,
+//the object must not be tagged with another PV name unless force is set
+func (cs *commonservice) importVolume(storageProtocol, name, pvName string, parameters map[string]string, force bool) (volume *csi.Volume, err error) {
+	defer func() {
+		if res := recover(); res != nil && err == nil {
+			err = errors.New("Recovered from importVolume " + fmt.Sprint(res))
+		}
+	}()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name of the volume to import is missing")
+	}
+	if pvName == "" {
+		pvName = name
+	}
+	config := make(map[string]string)
+	copyRequestParameters(parameters, config)
+	config["storage_protocol"] = storageProtocol
+
+	var objectID int64
+	switch storageProtocol {
+	case "fc", "iscsi", "nvme":
+		volume, objectID, err = cs.importBlockVolume(storageProtocol, name, config)
+	case "nfs":
+		volume, objectID, err = cs.importFileSystem(name, config)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "import of storage protocol %s is not supported", storageProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadataArray, err := cs.api.GetMetadata(objectID)
+	if err != nil {
+		log.Errorf("fail to get metadata of %s error %v", name, err)
+		return nil, status.Errorf(codes.Internal, "fail to get metadata of %s: %v", name, err)
+	}
+	for _, metadata := range *metadataArray {
+		if metadata.Key != "host.k8s.pvname" || metadata.Value == pvName {
+			continue
+		}
+		if !force {
+			return nil, status.Errorf(codes.AlreadyExists, "%s is already used by PV %s, import it with force to take it over", name, metadata.Value)
+		}
+		log.Warnf("%s is used by PV %s, taken over by PV %s", name, metadata.Value, pvName)
+	}
+
+	metadata := make(map[string]interface{})
+	metadata["host.k8s.pvname"] = pvName
+	if config["fstype"] != "" && storageProtocol != "nfs" {
+		metadata["host.filesystem_type"] = config["fstype"]
+	}
+	if _, err = cs.api.AttachMetadataToObject(objectID, metadata); err != nil {
+		log.Errorf("fail to attach metadata to %s error %v", name, err)
+		return nil, status.Errorf(codes.Internal, "fail to attach metadata to %s: %v", name, err)
+	}
+	log.Infof("imported %s as volume %s", name, volume.VolumeId)
+	return volume, nil
+}
+
+//importBlockVolume resolve a volume, iSCSI and NVMe volumes get the portals of the network_space
+func (cs *commonservice) importBlockVolume(storageProtocol, name string, config map[string]string) (*csi.Volume, int64, error) {
+	vol, err := cs.api.GetVolumeByName(name)
+	if err != nil {
+		if strings.Contains(err.Error(), "volume with given name not found") {
+			return nil, 0, status.Errorf(codes.NotFound, "volume %s not found", name)
+		}
+		return nil, 0, status.Error(codes.Internal, err.Error())
+	}
+	if vol == nil {
+		return nil, 0, status.Errorf(codes.NotFound, "volume %s not found", name)
+	}
+	if storageProtocol != "fc" {
+		networkSpace := strings.TrimSpace(config["network_space"])
+		if networkSpace == "" {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "network_space is required to import %s volume", storageProtocol)
+		}
+		nspace, err := cs.api.GetNetworkSpaceByName(networkSpace)
+		if err != nil {
+			return nil, 0, status.Errorf(codes.Internal, "fail to get network space %s: %v", networkSpace, err)
+		}
+		portals := []string{}
+		for _, p := range nspace.Portals {
+			portals = append(portals, p.IpAdress)
+		}
+		if len(portals) == 0 {
+			return nil, 0, status.Errorf(codes.FailedPrecondition, "network space %s has no portal", networkSpace)
+		}
+		config["iqn"] = nspace.Properties.IscsiIqn
+		config["portals"] = strings.Join(portals, ",")
+	}
+	if cs.storagePoolIdName == nil {
+		cs.storagePoolIdName = make(map[int64]string)
+	}
+	volume := cs.getCSIResponse(vol, &csi.CreateVolumeRequest{Parameters: config})
+	copyRequestParameters(config, volume.VolumeContext)
+	return volume, int64(vol.ID), nil
+}
+
+//importFileSystem resolve a filesystem and its export, the ip address is taken from the network_space
+func (cs *commonservice) importFileSystem(name string, config map[string]string) (*csi.Volume, int64, error) {
+	fileSystem, err := cs.api.GetFileSystemByName(name)
+	if err != nil {
+		if strings.Contains(err.Error(), "filesystem with given name not found") {
+			return nil, 0, status.Errorf(codes.NotFound, "filesystem %s not found", name)
+		}
+		return nil, 0, status.Error(codes.Internal, err.Error())
+	}
+	if fileSystem == nil {
+		return nil, 0, status.Errorf(codes.NotFound, "filesystem %s not found", name)
+	}
+	exportArray, err := cs.api.GetExportByFileSystem(fileSystem.ID)
+	if err != nil {
+		return nil, 0, status.Errorf(codes.Internal, "fail to get export of filesystem %s: %v", name, err)
+	}
+	if exportArray == nil || len(*exportArray) == 0 {
+		return nil, 0, status.Errorf(codes.FailedPrecondition, "filesystem %s is not exported", name)
+	}
+	export := (*exportArray)[0]
+	networkSpace := strings.TrimSpace(config["network_space"])
+	if networkSpace == "" {
+		return nil, 0, status.Error(codes.InvalidArgument, "network_space is required to import nfs volume")
+	}
+	ipAddress, err := cs.getNetworkSpaceIP(networkSpace)
+	if err != nil {
+		return nil, 0, status.Errorf(codes.Internal, "fail to get ip address of network space %s: %v", networkSpace, err)
+	}
+	if config["nfs_mount_options"] == "" {
+		config["nfs_mount_options"] = MountOptions
+	}
+	config["exportID"] = strconv.FormatInt(export.ID, 10)
+	config["volPathd"] = export.ExportPath
+	config["ipAddress"] = ipAddress
+	return &csi.Volume{
+		VolumeId: volumeid.ID{
+			Protocol: NFS,
+			Array:    config[KeyArray],
+			ObjectID: fileSystem.ID,
+			ExportID: export.ID,
+		}.String(),
+		CapacityBytes: fileSystem.Size,
+		VolumeContext: config,
+	}, fileSystem.ID, nil
+}
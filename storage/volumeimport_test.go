@@ -0,0 +1,100 @@
+/*Copyright 2020 Infinidat
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.*/
+package storage
+
+import (
+	"errors"
+	"infinibox-csi-driver/api"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (suite *VolumeImportSuite) SetupTest() {
+	suite.api = new(api.MockApiService)
+	suite.cs = &commonservice{api: suite.api}
+}
+
+type VolumeImportSuite struct {
+	suite.Suite
+	api *api.MockApiService
+	cs  *commonservice
+}
+
+func TestVolumeImportSuite(t *testing.T) {
+	suite.Run(t, new(VolumeImportSuite))
+}
+
+func (suite *VolumeImportSuite) Test_importVolume_iSCSI() {
+	suite.api.On("GetVolumeByName", "volName").Return(getVolume(), nil)
+	suite.api.On("GetNetworkSpaceByName", "iscsi1").Return(getNetworkspace(), nil)
+	suite.api.On("GetMetadata", int64(100)).Return([]api.Metadata{}, nil)
+	suite.api.On("AttachMetadataToObject", int64(100), map[string]interface{}{
+		"host.k8s.pvname":      "pv1",
+		"host.filesystem_type": "xfs",
+	}).Return(nil, nil)
+	volume, err := suite.cs.importVolume("iscsi", "volName", "pv1", map[string]string{"network_space": "iscsi1", "fstype": "xfs"}, false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "v1$$iscsi$$id=100", volume.VolumeId)
+	assert.Equal(suite.T(), "10.20.30.40", volume.VolumeContext["portals"])
+	assert.Equal(suite.T(), "iqn.1991-05.com.infinidate:example", volume.VolumeContext["iqn"])
+	assert.Equal(suite.T(), "iscsi", volume.VolumeContext["storage_protocol"])
+}
+
+func (suite *VolumeImportSuite) Test_importVolume_NFS() {
+	suite.api.On("GetFileSystemByName", "fs1").Return(api.FileSystem{ID: 7394, Size: 2147483648}, nil)
+	suite.api.On("GetExportByFileSystem", int64(7394)).Return([]api.ExportResponse{{ID: 3000, ExportPath: "/fs1"}}, nil)
+	suite.api.On("GetNetworkSpaceByName", "nas").Return(getNetworkSpace(), nil)
+	suite.api.On("GetMetadata", int64(7394)).Return([]api.Metadata{{Key: "host.k8s.pvname", Value: "fs1"}}, nil)
+	suite.api.On("AttachMetadataToObject", int64(7394), map[string]interface{}{"host.k8s.pvname": "fs1"}).Return(nil, nil)
+	volume, err := suite.cs.importVolume("nfs", "fs1", "", map[string]string{"network_space": "nas"}, false)
+	assert.Nil(suite.T(), err, "error not expected")
+	assert.Equal(suite.T(), "v1$$nfs$$id=7394;export=3000", volume.VolumeId)
+	assert.Equal(suite.T(), int64(2147483648), volume.CapacityBytes)
+	assert.Equal(suite.T(), "3000", volume.VolumeContext["exportID"])
+	assert.Equal(suite.T(), "/fs1", volume.VolumeContext["volPathd"])
+	assert.Equal(suite.T(), "10.20.20.50", volume.VolumeContext["ipAddress"])
+	assert.Equal(suite.T(), MountOptions, volume.VolumeContext["nfs_mount_options"])
+}
+
+func (suite *VolumeImportSuite) Test_importVolume_UsedByOtherPV() {
+	suite.api.On("GetVolumeByName", "volName").Return(getVolume(), nil)
+	suite.api.On("GetMetadata", int64(100)).Return([]api.Metadata{{Key: "host.k8s.pvname", Value: "pv2"}}, nil)
+	_, err := suite.cs.importVolume("fc", "volName", "pv1", nil, false)
+	assert.Equal(suite.T(), codes.AlreadyExists, status.Code(err))
+	suite.api.AssertNotCalled(suite.T(), "AttachMetadataToObject", mock.Anything, mock.Anything)
+
+	suite.api.On("AttachMetadataToObject", int64(100), map[string]interface{}{"host.k8s.pvname": "pv1"}).Return(nil, nil)
+	_, err = suite.cs.importVolume("fc", "volName", "pv1", nil, true)
+	assert.Nil(suite.T(), err, "forced import takes the volume over")
+}
+
+func (suite *VolumeImportSuite) Test_importVolume_NFS_NotExported() {
+	suite.api.On("GetFileSystemByName", "fs1").Return(api.FileSystem{ID: 7394}, nil)
+	suite.api.On("GetExportByFileSystem", int64(7394)).Return(nil, nil)
+	_, err := suite.cs.importVolume("nfs", "fs1", "", map[string]string{"network_space": "nas"}, false)
+	assert.Equal(suite.T(), codes.FailedPrecondition, status.Code(err))
+}
+
+func (suite *VolumeImportSuite) Test_importVolume_NotFound() {
+	suite.api.On("GetVolumeByName", "volName").Return(nil, errors.New("volume with given name not found"))
+	_, err := suite.cs.importVolume("fc", "volName", "", nil, false)
+	assert.Equal(suite.T(), codes.NotFound, status.Code(err))
+}
+
+func (suite *VolumeImportSuite) Test_importVolume_UnsupportedProtocol() {
+	_, err := suite.cs.importVolume("nfs_treeq", "treeq1", "", nil, false)
+	assert.Equal(suite.T(), codes.InvalidArgument, status.Code(err))
+}